@@ -8,17 +8,6 @@ with goPackages; let
 
   buildSrc = src;
 
-  go-s3 = buildGoPackage rec {
-    name = "go-s3";
-    goPackagePath = "github.com/oysterbooks/s3";
-    src = fetchFromGitHub {
-      rev = "master";
-      owner = "oysterbooks";
-      repo = "s3";
-      sha256 = "0ql1i7b8qjrvh6bbh43vka9va7q15s98s1x2h7b1c5q3nsgn77sy";
-    };
-  };
-
   go-imagick = buildGoPackage rec {
     name = "go-imagick";
     goPackagePath = "github.com/rafikk/imagick";
@@ -34,7 +23,7 @@ with goPackages; let
   go-halfshell = buildGoPackage rec {
     name = "go-halfshell";
     goPackagePath = "github.com/oysterbooks/halfshell/halfshell";
-    propagatedBuildInputs = [ go-s3 go-imagick ];
+    propagatedBuildInputs = [ go-imagick ];
     src = builtins.toPath "${buildSrc}/halfshell";
   };
 
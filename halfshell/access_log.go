@@ -0,0 +1,146 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is the format of the lines of the access log.
+type AccessLogFormat string
+
+const (
+	// AccessLogFormatCommon is the Common Log Format.
+	AccessLogFormatCommon AccessLogFormat = "common"
+
+	// AccessLogFormatCombined is the Combined Log Format, followed by the
+	// time spent handling the request in microseconds.
+	AccessLogFormatCombined AccessLogFormat = "combined"
+
+	// AccessLogFormatJSON logs a JSON object per request.
+	AccessLogFormatJSON AccessLogFormat = "json"
+)
+
+// AccessLog writes a line per request, apart from the application logs.
+type AccessLog struct {
+	Format AccessLogFormat
+
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewAccessLog returns an access log writing to destination, which is either
+// "stdout" or the path of a file lines are appended to. It returns nil if
+// destination is "off".
+func NewAccessLog(destination string, format AccessLogFormat) (*AccessLog, error) {
+	switch format {
+	case AccessLogFormatCommon, AccessLogFormatCombined, AccessLogFormatJSON:
+	default:
+		return nil, fmt.Errorf("Unknown access log format %q", format)
+	}
+
+	switch destination {
+	case "off":
+		return nil, nil
+	case "", "stdout":
+		return &AccessLog{Format: format, w: os.Stdout}, nil
+	}
+	file, err := os.OpenFile(destination, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLog{Format: format, w: file}, nil
+}
+
+// NewAccessLogWithConfig returns the access log configured for the server,
+// exiting if it can't be opened.
+func NewAccessLogWithConfig(config *ServerConfig) *AccessLog {
+	accessLog, err := NewAccessLog(config.AccessLog, config.AccessLogFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid access log: %v\n", err)
+		os.Exit(1)
+	}
+	return accessLog
+}
+
+type accessLogEntry struct {
+	Time      string  `json:"time"`
+	Host      string  `json:"host"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Protocol  string  `json:"protocol"`
+	Status    int     `json:"status"`
+	Bytes     int     `json:"bytes"`
+	Referer   string  `json:"referer"`
+	UserAgent string  `json:"user_agent"`
+	Route     string  `json:"route,omitempty"`
+	Duration  float64 `json:"duration_ms"`
+}
+
+// Log writes the line of a request once its response has been written.
+func (l *AccessLog) Log(w *ResponseWriter, r *Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	duration := time.Since(r.Timestamp)
+
+	var line []byte
+	switch l.Format {
+	case AccessLogFormatJSON:
+		entry := accessLogEntry{
+			Time:      r.Timestamp.Format(time.RFC3339Nano),
+			Host:      host,
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Protocol:  r.Proto,
+			Status:    w.Status,
+			Bytes:     w.Size,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			Duration:  float64(duration) / float64(time.Millisecond),
+		}
+		if r.Route != nil {
+			entry.Route = r.Route.Name
+		}
+		line, _ = json.Marshal(entry)
+		line = append(line, '\n')
+	case AccessLogFormatCombined:
+		line = []byte(fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d %q %q %d\n",
+			host, r.Timestamp.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method, r.URL.RequestURI(), r.Proto, w.Status, w.Size,
+			r.Referer(), r.UserAgent(), duration/time.Microsecond))
+	default:
+		line = []byte(fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d\n",
+			host, r.Timestamp.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method, r.URL.RequestURI(), r.Proto, w.Status, w.Size))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
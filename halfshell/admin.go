@@ -0,0 +1,205 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminRequestHandler handles the requests to the administration endpoints.
+// The endpoints are disabled unless an admin token is configured, and
+// requests must carry it as a bearer token.
+func (s *Server) AdminRequestHandler(w *ResponseWriter, r *Request) {
+	if s.AdminToken == "" {
+		w.WriteError("Not Found", http.StatusNotFound)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+		w.WriteError("Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/admin/cache":
+		s.CachePurgeHandler(w, r)
+	case "/admin/reload":
+		s.ReloadHandler(w, r)
+	case "/admin/stats":
+		s.StatsHandler(w, r)
+	case "/admin/warm":
+		s.WarmUpHandler(w, r)
+	default:
+		w.WriteError("Not Found", http.StatusNotFound)
+	}
+}
+
+// CachePurgeHandler removes cached derivatives from the caches of all
+// routes. The key parameter is the "<route>:<path>" of a source image, whose
+// derivatives are all removed. A key ending with "*" removes the derivatives
+// of all the source images whose key starts with the rest of it.
+func (s *Server) CachePurgeHandler(w *ResponseWriter, r *Request) {
+	if r.Method != "DELETE" {
+		w.SetHeader("Allow", "DELETE")
+		w.WriteError("Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.FormValue("key")
+	if key == "" {
+		w.WriteError("Missing key parameter", http.StatusBadRequest)
+		return
+	}
+
+	var prefix string
+	if strings.HasSuffix(key, "*") {
+		prefix = strings.TrimSuffix(key, "*")
+	} else {
+		prefix = key + "?"
+	}
+
+	result := struct {
+		Purged int      `json:"purged"`
+		Errors []string `json:"errors,omitempty"`
+	}{}
+
+	purgedCaches := make(map[Cache]bool)
+	for _, route := range s.routes() {
+		if route.Cache == nil || purgedCaches[route.Cache] {
+			continue
+		}
+		purgedCaches[route.Cache] = true
+
+		purged, err := route.Cache.Purge(prefix)
+		result.Purged += purged
+		if err != nil {
+			s.Logger.Warnf("Error purging cache of route %s: %v", route.Name, err)
+			result.Errors = append(result.Errors, route.Name+": "+err.Error())
+		}
+	}
+
+	s.Logger.Infof("Purged %d cached images for key %s", result.Purged, key)
+	w.WriteJSON(result)
+}
+
+// ReloadHandler reloads the configuration of the server.
+func (s *Server) ReloadHandler(w *ResponseWriter, r *Request) {
+	if r.Method != "POST" {
+		w.SetHeader("Allow", "POST")
+		w.WriteError("Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Reload == nil {
+		w.WriteError("Not Found", http.StatusNotFound)
+		return
+	}
+
+	err := s.Reload()
+	if err != nil {
+		s.Logger.Errorf("Unable to reload configuration: %v", err)
+		w.WriteError(err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteText("OK")
+}
+
+// adminStats is the response of the stats endpoint.
+type adminStats struct {
+	UptimeSeconds      int64                       `json:"uptime_seconds"`
+	ImageMagickVersion string                      `json:"imagemagick_version"`
+	ProcessingWorkers  adminPoolStats              `json:"processing_workers"`
+	Requests           adminPoolStats              `json:"requests"`
+	Routes             map[string]*adminRouteStats `json:"routes"`
+}
+
+type adminPoolStats struct {
+	Active int `json:"active"`
+	Queued int `json:"queued"`
+}
+
+type adminRouteStats struct {
+	Requests          uint64            `json:"requests"`
+	Statuses          map[string]uint64 `json:"statuses"`
+	AverageDurationMs float64           `json:"average_duration_ms"`
+	Cache             *adminCacheStats  `json:"cache,omitempty"`
+}
+
+type adminCacheStats struct {
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+
+	// Images and Bytes are only reported by caches that know their size.
+	Images *int    `json:"images,omitempty"`
+	Bytes  *uint64 `json:"bytes,omitempty"`
+}
+
+// StatsHandler reports the uptime of the server, the requests and cache
+// lookups of each route since the server started, the occupancy of the
+// worker pools and the version of ImageMagick.
+func (s *Server) StatsHandler(w *ResponseWriter, r *Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.SetHeader("Allow", "GET, HEAD")
+		w.WriteError("Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := &adminStats{
+		UptimeSeconds:      int64(time.Since(s.Started) / time.Second),
+		ImageMagickVersion: imageMagickVersion(),
+		ProcessingWorkers:  adminPoolStats{s.WorkerPool.Active(), s.WorkerPool.Queued()},
+		Requests:           adminPoolStats{s.RequestPool.Active(), s.RequestPool.Queued()},
+		Routes:             make(map[string]*adminRouteStats),
+	}
+
+	for _, route := range s.routes() {
+		routeStats := &adminRouteStats{Statuses: make(map[string]uint64)}
+		for status, count := range DefaultMetrics.CounterValues("halfshell_requests_total", "status", "route", route.Name) {
+			routeStats.Statuses[status] = uint64(count)
+			routeStats.Requests += uint64(count)
+		}
+		count, sum := DefaultMetrics.HistogramTotals("halfshell_request_duration_seconds", "route", route.Name)
+		if count > 0 {
+			routeStats.AverageDurationMs = sum / float64(count) * 1000
+		}
+
+		if route.Cache != nil {
+			results := DefaultMetrics.CounterValues("halfshell_cache_requests_total", "result", "route", route.Name)
+			cacheStats := &adminCacheStats{Hits: uint64(results["hit"]), Misses: uint64(results["miss"])}
+			if lookups := cacheStats.Hits + cacheStats.Misses; lookups > 0 {
+				cacheStats.HitRate = float64(cacheStats.Hits) / float64(lookups)
+			}
+			if sizer, ok := route.Cache.(CacheSizer); ok {
+				images, bytes := sizer.Size()
+				cacheStats.Images, cacheStats.Bytes = &images, &bytes
+			}
+			routeStats.Cache = cacheStats
+		}
+
+		stats.Routes[route.Name] = routeStats
+	}
+
+	w.WriteJSON(stats)
+}
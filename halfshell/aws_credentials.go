@@ -0,0 +1,373 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AWSCredentials are the credentials used to sign requests to AWS. Temporary
+// credentials have a session token and an expiry time.
+type AWSCredentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Expires      time.Time
+}
+
+// errNoAWSCredentials is returned by providers of the credential chain that
+// aren't configured.
+var errNoAWSCredentials = errors.New("No AWS credentials")
+
+// awsCredentialsRefreshWindow is how long before they expire temporary
+// credentials are refreshed.
+const awsCredentialsRefreshWindow = 5 * time.Minute
+
+type awsCredentialsProvider struct {
+	name     string
+	retrieve func(ctx context.Context) (*AWSCredentials, error)
+}
+
+// AWSCredentialsChain retrieves AWS credentials from the first source that
+// provides them, in the order of the standard AWS credential chain: the keys
+// given in the configuration, the environment, a web identity token (as used
+// by IAM roles for Kubernetes service accounts), the shared credentials file,
+// the ECS container credentials and the EC2 instance profile. Temporary
+// credentials are refreshed before they expire.
+type AWSCredentialsChain struct {
+	Logger *Logger
+
+	providers   []awsCredentialsProvider
+	client      *http.Client
+	mu          sync.Mutex
+	credentials *AWSCredentials
+}
+
+// NewAWSCredentialsChain returns a credential chain starting with the given
+// static keys, if not empty.
+func NewAWSCredentialsChain(accessKey, secretKey string) *AWSCredentialsChain {
+	chain := &AWSCredentialsChain{
+		Logger: NewLogger("aws.credentials"),
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+	chain.providers = []awsCredentialsProvider{
+		{"config", func(ctx context.Context) (*AWSCredentials, error) {
+			if accessKey == "" {
+				return nil, errNoAWSCredentials
+			}
+			return &AWSCredentials{AccessKey: accessKey, SecretKey: secretKey}, nil
+		}},
+		{"environment", chain.environmentCredentials},
+		{"web identity", chain.webIdentityCredentials},
+		{"shared credentials file", chain.sharedFileCredentials},
+		{"container", chain.containerCredentials},
+		{"instance profile", chain.instanceProfileCredentials},
+	}
+	return chain
+}
+
+// Retrieve returns the current credentials.
+func (c *AWSCredentialsChain) Retrieve(ctx context.Context) (*AWSCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.credentials != nil && (c.credentials.Expires.IsZero() ||
+		time.Now().Add(awsCredentialsRefreshWindow).Before(c.credentials.Expires)) {
+		return c.credentials, nil
+	}
+
+	for _, provider := range c.providers {
+		credentials, err := provider.retrieve(ctx)
+		if err == errNoAWSCredentials {
+			continue
+		}
+		if err != nil {
+			c.Logger.Warnf("Unable to retrieve AWS credentials from %s: %v", provider.name, err)
+			continue
+		}
+		c.Logger.Infof("Retrieved AWS credentials from %s", provider.name)
+		c.credentials = credentials
+		return credentials, nil
+	}
+	return nil, errNoAWSCredentials
+}
+
+func (c *AWSCredentialsChain) environmentCredentials(ctx context.Context) (*AWSCredentials, error) {
+	credentials := &AWSCredentials{
+		AccessKey:    firstEnv("AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY"),
+		SecretKey:    firstEnv("AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.AccessKey == "" || credentials.SecretKey == "" {
+		return nil, errNoAWSCredentials
+	}
+	return credentials, nil
+}
+
+func (c *AWSCredentialsChain) webIdentityCredentials(ctx context.Context) (*AWSCredentials, error) {
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	roleARN := os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || roleARN == "" {
+		return nil, errNoAWSCredentials
+	}
+
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("halfshell-%d", time.Now().Unix())
+	}
+
+	endpoint := "https://sts.amazonaws.com/"
+	if region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"); region != "" {
+		endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com/", region)
+	}
+
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	httpRequest, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	body, err := c.do(ctx, httpRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	err = xml.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AWSCredentials{
+		AccessKey:    response.Credentials.AccessKeyID,
+		SecretKey:    response.Credentials.SecretAccessKey,
+		SessionToken: response.Credentials.SessionToken,
+		Expires:      response.Credentials.Expiration,
+	}, nil
+}
+
+func (c *AWSCredentialsChain) sharedFileCredentials(ctx context.Context) (*AWSCredentials, error) {
+	fileName := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if fileName == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errNoAWSCredentials
+		}
+		fileName = filepath.Join(home, ".aws", "credentials")
+	}
+
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil, errNoAWSCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	credentials := &AWSCredentials{}
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "aws_access_key_id":
+			credentials.AccessKey = value
+		case "aws_secret_access_key":
+			credentials.SecretKey = value
+		case "aws_session_token":
+			credentials.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if credentials.AccessKey == "" || credentials.SecretKey == "" {
+		return nil, errNoAWSCredentials
+	}
+	return credentials, nil
+}
+
+func (c *AWSCredentialsChain) containerCredentials(ctx context.Context) (*AWSCredentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relativeURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relativeURI != "" {
+		endpoint = "http://169.254.170.2" + relativeURI
+	}
+	if endpoint == "" {
+		return nil, errNoAWSCredentials
+	}
+
+	httpRequest, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		httpRequest.Header.Set("Authorization", token)
+	}
+
+	body, err := c.do(ctx, httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	return parseAWSJSONCredentials(body)
+}
+
+func (c *AWSCredentialsChain) instanceProfileCredentials(ctx context.Context) (*AWSCredentials, error) {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return nil, errNoAWSCredentials
+	}
+
+	const metadataURL = "http://169.254.169.254/latest"
+
+	// The endpoint doesn't respond outside of EC2, so don't wait for long.
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	// IMDSv2 requires a session token.
+	tokenRequest, _ := http.NewRequest("PUT", metadataURL+"/api/token", nil)
+	tokenRequest.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := c.do(ctx, tokenRequest)
+	if err != nil {
+		return nil, errNoAWSCredentials
+	}
+
+	get := func(path string) ([]byte, error) {
+		httpRequest, _ := http.NewRequest("GET", metadataURL+path, nil)
+		httpRequest.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return c.do(ctx, httpRequest)
+	}
+
+	roles, err := get("/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return nil, errNoAWSCredentials
+	}
+
+	body, err := get("/meta-data/iam/security-credentials/" + role)
+	if err != nil {
+		return nil, err
+	}
+	return parseAWSJSONCredentials(body)
+}
+
+func (c *AWSCredentialsChain) do(ctx context.Context, httpRequest *http.Request) ([]byte, error) {
+	httpResponse, err := c.client.Do(httpRequest.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, err
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %d from %v", httpResponse.StatusCode, httpRequest.URL)
+	}
+	return body, nil
+}
+
+// parseAWSJSONCredentials parses the credentials returned by the ECS and EC2
+// metadata endpoints.
+func parseAWSJSONCredentials(body []byte) (*AWSCredentials, error) {
+	var response struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &AWSCredentials{
+		AccessKey:    response.AccessKeyID,
+		SecretKey:    response.SecretAccessKey,
+		SessionToken: response.Token,
+		Expires:      response.Expiration,
+	}, nil
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
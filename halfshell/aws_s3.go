@@ -0,0 +1,285 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultS3Region is the region of buckets for which no region is configured.
+const defaultS3Region = "us-east-1"
+
+// maxS3PresignExpires is the longest validity, in seconds, of presigned URLs
+// S3 accepts.
+const maxS3PresignExpires = 7 * 24 * 60 * 60
+
+// s3Location holds where the objects of a bucket are requested from.
+// Endpoint overrides the AWS endpoint of the region, for S3-compatible
+// services. With PathStyle, the bucket is part of the request path rather
+// than of the host name.
+type s3Location struct {
+	Bucket    string
+	Region    string
+	Endpoint  string
+	PathStyle bool
+}
+
+// newS3Request returns a request for an object of a bucket, to be signed with
+// signAWSRequest.
+func newS3Request(method string, location s3Location, key string, body []byte) (*http.Request, error) {
+	region := location.Region
+	if region == "" {
+		region = defaultS3Region
+	}
+	endpoint := location.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	endpointURL, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	host, path := endpointURL.Host, endpointURL.EscapedPath()
+	if location.PathStyle {
+		path += "/" + awsURIEncode(location.Bucket, true)
+	} else {
+		host = location.Bucket + "." + host
+	}
+	rawURL := endpointURL.Scheme + "://" + host + path + "/" + awsURIEncode(strings.TrimPrefix(key, "/"), false)
+
+	httpRequest, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("X-Amz-Content-Sha256", hashSHA256(body))
+	return httpRequest, nil
+}
+
+// newS3HTTPClient returns the client for S3 requests using transport.
+// insecureSkipVerify disables the verification of TLS certificates, for
+// self-hosted services with self-signed certificates.
+func newS3HTTPClient(transport *http.Transport, insecureSkipVerify bool) *http.Client {
+	if insecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &http.Client{Transport: transport}
+}
+
+// signAWSRequest signs a request with Signature Version 4. All the X-Amz-*
+// headers of the request must be set beforehand, since they are signed.
+func signAWSRequest(r *http.Request, credentials *AWSCredentials, region, service string, now time.Time) {
+	if region == "" {
+		region = defaultS3Region
+	}
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	r.Header.Set("X-Amz-Date", amzDate)
+	if credentials.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = hashSHA256(nil)
+		r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-type" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		awsCanonicalQuery(r.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashSHA256([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.AccessKey, scope, signedHeaders, signature))
+}
+
+// presignAWSRequest signs a request with Signature Version 4 in its query
+// string rather than its headers, which makes its URL valid for expires. The
+// X-Amz-* headers of the request are signed along with the host header, so
+// they must be sent with the URL.
+func presignAWSRequest(r *http.Request, credentials *AWSCredentials, region, service string, now time.Time, expires time.Duration) {
+	if region == "" {
+		region = defaultS3Region
+	}
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	r.Header.Del("X-Amz-Content-Sha256")
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := r.URL.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", credentials.AccessKey+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int64(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", signedHeaders)
+	if credentials.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		awsCanonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashSHA256([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.URL.RawQuery = awsCanonicalQuery(query) + "&X-Amz-Signature=" + signature
+}
+
+// newS3CustomerKeyHeaders returns the headers of requests for objects
+// encrypted with the customer-provided key (SSE-C) encoded in base64.
+func newS3CustomerKeyHeaders(encodedKey string) (http.Header, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Invalid SSE-C key, it must be a base64 encoded 256-bit key")
+	}
+	keyMD5 := md5.Sum(key)
+
+	headers := http.Header{}
+	headers.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+	headers.Set("X-Amz-Server-Side-Encryption-Customer-Key", encodedKey)
+	headers.Set("X-Amz-Server-Side-Encryption-Customer-Key-Md5", base64.StdEncoding.EncodeToString(keyMD5[:]))
+	return headers, nil
+}
+
+func awsCanonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// awsURIEncode encodes s as specified for Signature Version 4, which escapes
+// every character but the unreserved ones, and slashes unless encodeSlash is
+// set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+func hashSHA256(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A BatchOutput stores the images generated by batch processing.
+type BatchOutput interface {
+	Write(name string, image *ProcessedImage) error
+}
+
+// NewBatchOutput returns the output for a destination, which is either a
+// local directory or an S3 location such as
+// "s3://bucket/prefix?region=eu-west-1". The endpoint and path_style query
+// parameters of S3 locations configure S3-compatible services.
+func NewBatchOutput(destination string) (BatchOutput, error) {
+	if !strings.HasPrefix(destination, "s3://") {
+		return &directoryBatchOutput{Directory: destination}, nil
+	}
+
+	destinationURL, err := url.Parse(destination)
+	if err != nil {
+		return nil, err
+	}
+	query := destinationURL.Query()
+	return &s3BatchOutput{
+		Location: s3Location{
+			Bucket:    destinationURL.Host,
+			Region:    query.Get("region"),
+			Endpoint:  query.Get("endpoint"),
+			PathStyle: query.Get("path_style") == "true",
+		},
+		Prefix:      strings.TrimPrefix(destinationURL.Path, "/"),
+		Credentials: NewAWSCredentialsChain("", ""),
+	}, nil
+}
+
+type directoryBatchOutput struct {
+	Directory string
+}
+
+func (o *directoryBatchOutput) Write(name string, image *ProcessedImage) error {
+	fileName := filepath.Join(o.Directory, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(fileName), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, image.Bytes, 0644)
+}
+
+type s3BatchOutput struct {
+	Location    s3Location
+	Prefix      string
+	Credentials *AWSCredentialsChain
+}
+
+func (o *s3BatchOutput) Write(name string, image *ProcessedImage) error {
+	credentials, err := o.Credentials.Retrieve(context.Background())
+	if err != nil {
+		return err
+	}
+
+	httpRequest, err := newS3Request("PUT", o.Location, path.Join(o.Prefix, name), image.Bytes)
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", image.ContentType)
+	signAWSRequest(httpRequest, credentials, o.Location.Region, "s3", time.Now())
+
+	httpResponse, err := http.DefaultClient.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error uploading image (url=%v, status=%d)", httpRequest.URL, httpResponse.StatusCode)
+	}
+	return nil
+}
+
+// RunBatch processes the jobs read from jobs, one per line, and writes the
+// results to output, without starting the HTTP server. Each job is the path
+// and query string of a request, as it would be sent to the server, and
+// optionally the name of the output, separated by whitespace. Up to workers
+// jobs are processed at once. The number of failed jobs is returned.
+func (h *Halfshell) RunBatch(jobs io.Reader, output BatchOutput, workers int) int {
+	Initialize()
+	defer Terminate()
+
+	h.applyResourceLimits()
+
+	h.Server.WorkerPool = NewWorkerPool(uint64(workers), 0)
+
+	lines := make(chan string)
+	var failures int
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for line := range lines {
+				err := h.processBatchJob(line, output)
+				if err != nil {
+					h.Logger.Errorf("Error processing %s: %v", line, err)
+					mutex.Lock()
+					failures++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	scanner := bufio.NewScanner(jobs)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines <- line
+		}
+	}
+	close(lines)
+	wg.Wait()
+
+	if err := scanner.Err(); err != nil {
+		h.Logger.Errorf("Error reading jobs: %v", err)
+		failures++
+	}
+	return failures
+}
+
+func (h *Halfshell) processBatchJob(line string, output BatchOutput) error {
+	fields := strings.Fields(line)
+	httpRequest, err := http.NewRequest("GET", fields[0], nil)
+	if err != nil {
+		return err
+	}
+
+	r := h.Server.NewRequest(httpRequest)
+	if r.Route == nil {
+		return fmt.Errorf("No route available to handle request")
+	}
+	if r.OptionsError != nil {
+		return r.OptionsError
+	}
+
+	processedImage, err := h.Server.ProcessImage(r)
+	if err != nil {
+		return err
+	}
+	if processedImage.Placeholder {
+		return ErrImageNotFound
+	}
+
+	name := batchOutputName(httpRequest.URL)
+	if len(fields) > 1 {
+		name = fields[1]
+	}
+	err = output.Write(name, processedImage)
+	if err != nil {
+		return err
+	}
+	h.Logger.Infof("Wrote %s", name)
+	return nil
+}
+
+// batchOutputName returns the default output name of a job, its path with the
+// sorted query parameters inserted before the extension, e.g.
+// "blog/header_h-300_w-400.jpg" for "/blog/header.jpg?w=400&h=300".
+func batchOutputName(requestURL *url.URL) string {
+	name := strings.TrimPrefix(requestURL.Path, "/")
+	query := requestURL.Query()
+	if len(query) == 0 {
+		return name
+	}
+
+	params := make([]string, 0, len(query))
+	for key := range query {
+		params = append(params, url.PathEscape(key)+"-"+url.PathEscape(query.Get(key)))
+	}
+	sort.Strings(params)
+
+	extension := path.Ext(name)
+	return strings.TrimSuffix(name, extension) + "_" + strings.Join(params, "_") + extension
+}
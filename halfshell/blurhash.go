@@ -0,0 +1,150 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+const (
+	BlurHashComponentsX = 4
+	BlurHashComponentsY = 3
+
+	// The image is downsampled to fit within this size before computing the
+	// hash. The result is visually identical and orders of magnitude cheaper.
+	blurHashSampleSize = 32
+)
+
+const blurHashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// GetBlurHash returns the BlurHash (https://blurha.sh) string of the image.
+func (i *Image) GetBlurHash() (string, error) {
+	thumbnail, err := i.GetThumbnail(blurHashSampleSize)
+	if err != nil {
+		return "", err
+	}
+	return encodeBlurHash(thumbnail, BlurHashComponentsX, BlurHashComponentsY), nil
+}
+
+func encodeBlurHash(img image.Image, componentsX, componentsY int) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// Convert the image to linear RGB once up front.
+	pixels := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			pixels[y*width+x] = [3]float64{
+				sRGBToLinear(r >> 8), sRGBToLinear(g >> 8), sRGBToLinear(b >> 8),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for cy := 0; cy < componentsY; cy++ {
+		for cx := 0; cx < componentsX; cx++ {
+			normalisation := 2.0
+			if cx == 0 && cy == 0 {
+				normalisation = 1.0
+			}
+
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(cx)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(cy)*float64(y)/float64(height))
+					pixel := pixels[y*width+x]
+					factor[0] += basis * pixel[0]
+					factor[1] += basis * pixel[1]
+					factor[2] += basis * pixel[2]
+				}
+			}
+
+			scale := 1.0 / float64(width*height)
+			factor[0] *= scale
+			factor[1] *= scale
+			factor[2] *= scale
+			factors = append(factors, factor)
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((componentsX-1)+(componentsY-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMaximumValue := 0.0
+		for _, factor := range ac {
+			for _, component := range factor {
+				actualMaximumValue = math.Max(actualMaximumValue, math.Abs(component))
+			}
+		}
+		quantisedMaximumValue := int(math.Max(0, math.Min(82, math.Floor(actualMaximumValue*166-0.5))))
+		maximumValue = float64(quantisedMaximumValue+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximumValue, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	dcValue := linearTosRGB(dc[0])<<16 + linearTosRGB(dc[1])<<8 + linearTosRGB(dc[2])
+	hash.WriteString(encodeBase83(dcValue, 4))
+
+	for _, factor := range ac {
+		quantise := func(value float64) int {
+			signed := math.Copysign(math.Pow(math.Abs(value/maximumValue), 0.5), value)
+			return int(math.Max(0, math.Min(18, math.Floor(signed*9+9.5))))
+		}
+		acValue := quantise(factor[0])*19*19 + quantise(factor[1])*19 + quantise(factor[2])
+		hash.WriteString(encodeBase83(acValue, 2))
+	}
+
+	return hash.String()
+}
+
+func encodeBase83(value, length int) string {
+	result := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		result[i-1] = blurHashCharacters[digit]
+	}
+	return string(result)
+}
+
+func sRGBToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearTosRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
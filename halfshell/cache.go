@@ -0,0 +1,126 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+type CacheType string
+type CacheFactoryFunction func(*CacheConfig) (Cache, error)
+
+var (
+	cacheTypeToFactoryFunctionMap = make(map[CacheType]CacheFactoryFunction)
+)
+
+// ErrCachePurgeUnsupported is returned by caches that can't enumerate their
+// keys, and so can't be purged.
+var ErrCachePurgeUnsupported = errors.New("Cache does not support purging")
+
+// Cache stores processed images so that repeated requests for the same
+// derivative don't have to be fetched and processed again.
+type Cache interface {
+	Get(key string) (*ProcessedImage, bool)
+	Set(key string, image *ProcessedImage)
+
+	// Purge removes the images whose key starts with prefix and returns
+	// the number of images removed.
+	Purge(prefix string) (int, error)
+}
+
+// CacheSizer is implemented by caches that can report the number and total
+// size in bytes of the images they hold, for the admin stats endpoint.
+type CacheSizer interface {
+	Size() (images int, bytes uint64)
+}
+
+func RegisterCache(cacheType CacheType, factory CacheFactoryFunction) {
+	cacheTypeToFactoryFunctionMap[cacheType] = factory
+}
+
+// NewCache returns the cache described by config, or nil if no cache type is
+// configured.
+func NewCache(config *CacheConfig) (Cache, error) {
+	if config.Type == "" {
+		return nil, nil
+	}
+	factory := cacheTypeToFactoryFunctionMap[config.Type]
+	if factory == nil {
+		return nil, fmt.Errorf("Unknown cache type: %s", config.Type)
+	}
+	return factory(config)
+}
+
+// NewCacheWithConfig is like NewCache, but exits if the cache can't be
+// created.
+func NewCacheWithConfig(config *CacheConfig) Cache {
+	cache, err := NewCache(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid cache: %v\n", err)
+		os.Exit(1)
+	}
+	return cache
+}
+
+// Staleness returns the time image has been stale for at now, which is
+// negative or zero while it's fresh. Images cached before their cache time
+// was recorded are fresh.
+func (c *CacheConfig) Staleness(image *ProcessedImage, now time.Time) time.Duration {
+	if c.MaxAge == 0 || image.CachedAt.IsZero() {
+		return 0
+	}
+	return now.Sub(image.CachedAt) - time.Duration(c.MaxAge)*time.Second
+}
+
+// cacheImageID returns an identifier for the content of image. Shared caches
+// store images by content, so derivatives that come out identical, such as
+// an image requested at its own size and unresized, are only stored once.
+// The identifier is computed from the encoded image rather than its
+// signature, which only covers the pixels, so encodings of the same pixels in
+// other formats or qualities aren't stored under the same identifier.
+func cacheImageID(image *ProcessedImage) string {
+	hash := sha1.New()
+	hash.Write([]byte(image.ContentType + "\n"))
+	hash.Write(image.Bytes)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func marshalProcessedImage(image *ProcessedImage) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(image)
+	return buffer.Bytes(), err
+}
+
+func unmarshalProcessedImage(data []byte) (*ProcessedImage, error) {
+	image := &ProcessedImage{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(image)
+	if err != nil {
+		return nil, err
+	}
+	return image, nil
+}
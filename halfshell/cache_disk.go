@@ -0,0 +1,242 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CacheTypeDisk CacheType = "disk"
+)
+
+const diskCacheTempPrefix = ".tmp-"
+
+// DiskCache is a cache persisted to a directory, so that it survives
+// restarts. Files are evicted least recently used first once their total size
+// exceeds the cache's maximum size.
+type DiskCache struct {
+	Config *CacheConfig
+	Logger *Logger
+
+	mu    sync.Mutex
+	index *lruIndex
+}
+
+func NewDiskCacheWithConfig(config *CacheConfig) (Cache, error) {
+	cache := &DiskCache{
+		Config: config,
+		Logger: NewLogger("cache.disk"),
+	}
+	cache.index = newLRUIndex(config.MaxSize<<20, func(fileName string, _ interface{}) {
+		cache.removeFile(fileName)
+	})
+
+	err := os.MkdirAll(config.Path, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cache.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return cache, nil
+}
+
+func (c *DiskCache) Get(key string) (*ProcessedImage, bool) {
+	fileName := c.fileNameForKey(key)
+
+	c.mu.Lock()
+	_, ok := c.index.Get(fileName)
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	file, err := os.Open(filepath.Join(c.Config.Path, fileName))
+	if err != nil {
+		c.Logger.Warnf("Failed to open cached image: %v", err)
+		return nil, false
+	}
+	defer file.Close()
+
+	var cachedKey string
+	image := &ProcessedImage{}
+	decoder := gob.NewDecoder(file)
+	err = decoder.Decode(&cachedKey)
+	if err == nil {
+		err = decoder.Decode(image)
+	}
+	if err != nil {
+		c.Logger.Warnf("Failed to read cached image: %v", err)
+		return nil, false
+	}
+
+	// Keep the modification time current so the recency of use survives
+	// restarts.
+	now := time.Now()
+	os.Chtimes(file.Name(), now, now)
+
+	return image, true
+}
+
+func (c *DiskCache) Set(key string, image *ProcessedImage) {
+	fileName := c.fileNameForKey(key)
+
+	// The image is written to a temporary file that is then renamed, so
+	// readers never see a partially written file.
+	file, err := ioutil.TempFile(c.Config.Path, diskCacheTempPrefix)
+	if err != nil {
+		c.Logger.Warnf("Failed to create cache file: %v", err)
+		return
+	}
+	// The key is written ahead of the image, so the keys of the cached
+	// files can be read without decoding the images.
+	encoder := gob.NewEncoder(file)
+	err = encoder.Encode(key)
+	if err == nil {
+		err = encoder.Encode(image)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		c.Logger.Warnf("Failed to write cache file: %v", err)
+		os.Remove(file.Name())
+		return
+	}
+
+	fileInfo, err := os.Stat(file.Name())
+	if err != nil || uint64(fileInfo.Size()) > c.index.maxSize {
+		os.Remove(file.Name())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err = os.Rename(file.Name(), filepath.Join(c.Config.Path, fileName))
+	if err != nil {
+		c.Logger.Warnf("Failed to write cache file: %v", err)
+		os.Remove(file.Name())
+		return
+	}
+	c.index.Add(fileName, nil, uint64(fileInfo.Size()))
+}
+
+func (c *DiskCache) Purge(prefix string) (int, error) {
+	c.mu.Lock()
+	fileNames := make([]string, 0, len(c.index.entries))
+	for fileName := range c.index.entries {
+		fileNames = append(fileNames, fileName)
+	}
+	c.mu.Unlock()
+
+	purged := 0
+	for _, fileName := range fileNames {
+		key, err := c.keyForFileName(fileName)
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		c.mu.Lock()
+		if c.index.Remove(fileName) {
+			c.removeFile(fileName)
+			purged++
+		}
+		c.mu.Unlock()
+	}
+	return purged, nil
+}
+
+// keyForFileName reads the key of a cached file.
+func (c *DiskCache) keyForFileName(fileName string) (string, error) {
+	file, err := os.Open(filepath.Join(c.Config.Path, fileName))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var key string
+	err = gob.NewDecoder(file).Decode(&key)
+	return key, err
+}
+
+// load indexes the files already in the cache directory, most recently
+// modified first.
+func (c *DiskCache) load() error {
+	fileInfos, err := ioutil.ReadDir(c.Config.Path)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(fileInfos, func(i, j int) bool {
+		return fileInfos[i].ModTime().Before(fileInfos[j].ModTime())
+	})
+
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(fileInfo.Name(), diskCacheTempPrefix) {
+			c.removeFile(fileInfo.Name())
+			continue
+		}
+		c.index.Add(fileInfo.Name(), nil, uint64(fileInfo.Size()))
+	}
+
+	c.Logger.Infof("Loaded %d cached images from %s", len(c.index.entries), c.Config.Path)
+	return nil
+}
+
+func (c *DiskCache) removeFile(fileName string) {
+	err := os.Remove(filepath.Join(c.Config.Path, fileName))
+	if err != nil && !os.IsNotExist(err) {
+		c.Logger.Warnf("Failed to remove cache file: %v", err)
+	}
+}
+
+func (c *DiskCache) fileNameForKey(key string) string {
+	hash := sha1.Sum([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func (c *DiskCache) Size() (int, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.index.entries), c.index.size
+}
+
+func init() {
+	RegisterCache(CacheTypeDisk, NewDiskCacheWithConfig)
+}
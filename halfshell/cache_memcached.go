@@ -0,0 +1,127 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	CacheTypeMemcached CacheType = "memcached"
+)
+
+// MemcachedCache is a cache stored in Memcached, which can be shared by
+// several Halfshell instances. Each key points to the identifier of the
+// image, which is stored separately.
+type MemcachedCache struct {
+	Config *CacheConfig
+	Logger *Logger
+	client *memcache.Client
+}
+
+func NewMemcachedCacheWithConfig(config *CacheConfig) (Cache, error) {
+	address := config.Address
+	if address == "" {
+		address = "localhost:11211"
+	}
+
+	return &MemcachedCache{
+		Config: config,
+		Logger: NewLogger("cache.memcached"),
+		client: memcache.New(strings.Split(address, ",")...),
+	}, nil
+}
+
+func (c *MemcachedCache) Get(key string) (*ProcessedImage, bool) {
+	item, err := c.client.Get(c.keyForKey(key))
+	if err == memcache.ErrCacheMiss {
+		return nil, false
+	}
+	if err != nil {
+		c.Logger.Warnf("Error getting cached image: %v", err)
+		return nil, false
+	}
+
+	item, err = c.client.Get(c.keyForImageID(string(item.Value)))
+	if err == memcache.ErrCacheMiss {
+		return nil, false
+	}
+	if err != nil {
+		c.Logger.Warnf("Error getting cached image: %v", err)
+		return nil, false
+	}
+
+	image, err := unmarshalProcessedImage(item.Value)
+	if err != nil {
+		c.Logger.Warnf("Failed to read cached image: %v", err)
+		return nil, false
+	}
+	return image, true
+}
+
+func (c *MemcachedCache) Set(key string, image *ProcessedImage) {
+	data, err := marshalProcessedImage(image)
+	if err != nil {
+		c.Logger.Warnf("Failed to encode image: %v", err)
+		return
+	}
+
+	id := cacheImageID(image)
+	err = c.client.Set(&memcache.Item{
+		Key:        c.keyForImageID(id),
+		Value:      data,
+		Expiration: int32(c.Config.TTL),
+	})
+	if err == nil {
+		err = c.client.Set(&memcache.Item{
+			Key:        c.keyForKey(key),
+			Value:      []byte(id),
+			Expiration: int32(c.Config.TTL),
+		})
+	}
+	if err != nil {
+		c.Logger.Warnf("Error caching image: %v", err)
+	}
+}
+
+// keyForKey hashes key, since Memcached keys are limited to 250 characters
+// and can't contain whitespace.
+func (c *MemcachedCache) keyForKey(key string) string {
+	hash := sha1.Sum([]byte(key))
+	return "halfshell:key:" + hex.EncodeToString(hash[:])
+}
+
+func (c *MemcachedCache) keyForImageID(id string) string {
+	return "halfshell:image:" + id
+}
+
+// Purge isn't supported, since the cache's keys can't be enumerated.
+func (c *MemcachedCache) Purge(prefix string) (int, error) {
+	return 0, ErrCachePurgeUnsupported
+}
+
+func init() {
+	RegisterCache(CacheTypeMemcached, NewMemcachedCacheWithConfig)
+}
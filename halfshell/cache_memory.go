@@ -0,0 +1,97 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	CacheTypeMemory CacheType = "memory"
+)
+
+// MemoryCache is an in-process cache that evicts the least recently used
+// images once the total size of the cached images exceeds its maximum size.
+type MemoryCache struct {
+	Config *CacheConfig
+	Logger *Logger
+
+	mu    sync.Mutex
+	index *lruIndex
+}
+
+func NewMemoryCacheWithConfig(config *CacheConfig) (Cache, error) {
+	return &MemoryCache{
+		Config: config,
+		Logger: NewLogger("cache.memory"),
+		index:  newLRUIndex(config.MaxSize<<20, nil),
+	}, nil
+}
+
+func (c *MemoryCache) Get(key string) (*ProcessedImage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	value, ok := c.index.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return value.(*ProcessedImage), true
+}
+
+func (c *MemoryCache) Set(key string, image *ProcessedImage) {
+	size := uint64(len(image.Bytes))
+	if size > c.index.maxSize {
+		c.Logger.Infof("Not caching %s: %d bytes exceeds the cache size", key, size)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.index.Add(key, image, size)
+}
+
+func (c *MemoryCache) Purge(prefix string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for key := range c.index.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.index.Remove(key)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (c *MemoryCache) Size() (int, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.index.entries), c.index.size
+}
+
+func init() {
+	RegisterCache(CacheTypeMemory, NewMemoryCacheWithConfig)
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	CacheTypeRedis CacheType = "redis"
+)
+
+// redisTimeout bounds connecting to Redis and each command sent to it, as
+// images are looked up while requests wait for them.
+const redisTimeout = 2 * time.Second
+
+// RedisCache is a cache stored in Redis, which can be shared by several
+// Halfshell instances. Each key points to the identifier of the image, which
+// is stored separately.
+type RedisCache struct {
+	Config *CacheConfig
+	Logger *Logger
+	pool   *redis.Pool
+}
+
+func NewRedisCacheWithConfig(config *CacheConfig) (Cache, error) {
+	address := config.Address
+	if address == "" {
+		address = "localhost:6379"
+	}
+
+	return &RedisCache{
+		Config: config,
+		Logger: NewLogger("cache.redis"),
+		pool: &redis.Pool{
+			MaxIdle:     16,
+			IdleTimeout: 4 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", address,
+					redis.DialConnectTimeout(redisTimeout),
+					redis.DialReadTimeout(redisTimeout),
+					redis.DialWriteTimeout(redisTimeout))
+			},
+		},
+	}, nil
+}
+
+func (c *RedisCache) Get(key string) (*ProcessedImage, bool) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	id, err := redis.String(conn.Do("GET", c.keyForKey(key)))
+	if err == redis.ErrNil {
+		return nil, false
+	}
+	if err != nil {
+		c.Logger.Warnf("Error getting cached image: %v", err)
+		return nil, false
+	}
+
+	data, err := redis.Bytes(conn.Do("GET", c.keyForImageID(id)))
+	if err == redis.ErrNil {
+		return nil, false
+	}
+	if err != nil {
+		c.Logger.Warnf("Error getting cached image: %v", err)
+		return nil, false
+	}
+
+	image, err := unmarshalProcessedImage(data)
+	if err != nil {
+		c.Logger.Warnf("Failed to read cached image: %v", err)
+		return nil, false
+	}
+	return image, true
+}
+
+func (c *RedisCache) Set(key string, image *ProcessedImage) {
+	data, err := marshalProcessedImage(image)
+	if err != nil {
+		c.Logger.Warnf("Failed to encode image: %v", err)
+		return
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	id := cacheImageID(image)
+	err = c.set(conn, c.keyForImageID(id), data)
+	if err == nil {
+		err = c.set(conn, c.keyForKey(key), id)
+	}
+	if err != nil {
+		c.Logger.Warnf("Error caching image: %v", err)
+	}
+}
+
+// Purge removes the keys starting with prefix. The images themselves may be
+// shared by other keys, so they are left to expire.
+func (c *RedisCache) Purge(prefix string) (int, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	pattern := c.keyForKey(redisPatternEscaper.Replace(prefix)) + "*"
+	purged := 0
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return purged, err
+		}
+		cursor, _ = redis.Int(values[0], nil)
+		keys, _ := redis.Strings(values[1], nil)
+
+		if len(keys) > 0 {
+			n, err := redis.Int(conn.Do("DEL", redis.Args{}.AddFlat(keys)...))
+			if err != nil {
+				return purged, err
+			}
+			purged += n
+		}
+
+		if cursor == 0 {
+			return purged, nil
+		}
+	}
+}
+
+// redisPatternEscaper escapes the characters with a special meaning in Redis
+// glob-style patterns.
+var redisPatternEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (c *RedisCache) set(conn redis.Conn, key string, value interface{}) error {
+	var err error
+	if c.Config.TTL > 0 {
+		_, err = conn.Do("SET", key, value, "EX", c.Config.TTL)
+	} else {
+		_, err = conn.Do("SET", key, value)
+	}
+	return err
+}
+
+func (c *RedisCache) keyForKey(key string) string {
+	return "halfshell:key:" + key
+}
+
+func (c *RedisCache) keyForImageID(id string) string {
+	return "halfshell:image:" + id
+}
+
+func init() {
+	RegisterCache(CacheTypeRedis, NewRedisCacheWithConfig)
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	CacheTypeS3 CacheType = "s3"
+)
+
+// s3CacheMaxUploads bounds the number of concurrent uploads. Images cached
+// while that many uploads are in progress aren't uploaded, so a slow bucket
+// doesn't accumulate images waiting to be.
+const s3CacheMaxUploads = 8
+
+// s3CacheTimeout bounds each request to the bucket, as images are looked up
+// while requests wait for them.
+const s3CacheTimeout = 10 * time.Second
+
+// S3Cache writes processed images back to an S3 bucket and serves them from
+// there on subsequent requests. Uploads happen in the background, so they
+// don't delay responses. The objects carry the image's content type, so the
+// bucket can also be served directly by static hosting.
+type S3Cache struct {
+	Config      *CacheConfig
+	Logger      *Logger
+	Credentials *AWSCredentialsChain
+	Client      *http.Client
+	uploads     chan struct{}
+}
+
+func NewS3CacheWithConfig(config *CacheConfig) (Cache, error) {
+	client := newS3HTTPClient(http.DefaultTransport.(*http.Transport).Clone(), config.S3InsecureSkipVerify)
+	client.Timeout = s3CacheTimeout
+	return &S3Cache{
+		Config:      config,
+		Logger:      NewLogger("cache.s3.%s", config.S3Bucket),
+		Credentials: NewAWSCredentialsChain(config.S3AccessKey, config.S3SecretKey),
+		Client:      client,
+		uploads:     make(chan struct{}, s3CacheMaxUploads),
+	}, nil
+}
+
+func (c *S3Cache) Get(key string) (*ProcessedImage, bool) {
+	httpRequest, err := c.signedHTTPRequest("GET", key, nil)
+	if err != nil {
+		c.Logger.Warnf("Error signing request: %v", err)
+		return nil, false
+	}
+	httpResponse, err := c.Client.Do(httpRequest)
+	if err != nil {
+		c.Logger.Warnf("Error getting cached image: %v", err)
+		return nil, false
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		c.Logger.Warnf("Error getting cached image: %v", err)
+		return nil, false
+	}
+
+	lastModified, _ := http.ParseTime(httpResponse.Header.Get("X-Amz-Meta-Last-Modified"))
+	// Objects are written when the image is cached.
+	cachedAt, _ := http.ParseTime(httpResponse.Header.Get("Last-Modified"))
+
+	return &ProcessedImage{
+		Bytes:       data,
+		ContentType: httpResponse.Header.Get("Content-Type"),
+		Signature:   httpResponse.Header.Get("X-Amz-Meta-Signature"),
+		ETag:        httpResponse.Header.Get("X-Amz-Meta-Etag"),
+		BlurHash:    httpResponse.Header.Get("X-Amz-Meta-Blurhash"),
+
+		LastModified: lastModified,
+		CachedAt:     cachedAt,
+	}, true
+}
+
+func (c *S3Cache) Set(key string, image *ProcessedImage) {
+	select {
+	case c.uploads <- struct{}{}:
+	default:
+		c.Logger.Warnf("Too many uploads in progress, not caching image")
+		return
+	}
+
+	go func() {
+		defer func() { <-c.uploads }()
+
+		httpRequest, err := c.signedHTTPRequest("PUT", key, image)
+		if err != nil {
+			c.Logger.Warnf("Error signing request: %v", err)
+			return
+		}
+		httpResponse, err := c.Client.Do(httpRequest)
+		if err != nil {
+			c.Logger.Warnf("Error uploading image: %v", err)
+			return
+		}
+		defer httpResponse.Body.Close()
+		if httpResponse.StatusCode != http.StatusOK {
+			c.Logger.Warnf("Error uploading image (url=%v, status=%d)", httpRequest.URL, httpResponse.StatusCode)
+			return
+		}
+		c.Logger.Infof("Successfully uploaded image to S3: %v", httpRequest.URL)
+	}()
+}
+
+func (c *S3Cache) signedHTTPRequest(method, key string, image *ProcessedImage) (*http.Request, error) {
+	credentials, err := c.Credentials.Retrieve(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	if image != nil {
+		body = image.Bytes
+	}
+
+	location := s3Location{
+		Bucket:    c.Config.S3Bucket,
+		Region:    c.Config.S3Region,
+		Endpoint:  c.Config.S3Endpoint,
+		PathStyle: c.Config.S3PathStyle,
+	}
+	httpRequest, err := newS3Request(method, location, c.objectNameForKey(key), body)
+	if err != nil {
+		return nil, err
+	}
+	if image != nil {
+		httpRequest.Header.Set("Content-Type", image.ContentType)
+		if image.Signature != "" {
+			httpRequest.Header.Set("X-Amz-Meta-Signature", image.Signature)
+		}
+		if image.ETag != "" {
+			httpRequest.Header.Set("X-Amz-Meta-Etag", image.ETag)
+		}
+		if !image.LastModified.IsZero() {
+			httpRequest.Header.Set("X-Amz-Meta-Last-Modified", image.LastModified.UTC().Format(http.TimeFormat))
+		}
+		if image.BlurHash != "" {
+			httpRequest.Header.Set("X-Amz-Meta-Blurhash", image.BlurHash)
+		}
+	}
+	signAWSRequest(httpRequest, credentials, c.Config.S3Region, "s3", time.Now())
+
+	return httpRequest, nil
+}
+
+// objectNameForKey hashes key, since the processing options in it don't map
+// to a valid object name.
+func (c *S3Cache) objectNameForKey(key string) string {
+	hash := sha1.Sum([]byte(key))
+	return strings.TrimLeft(c.Config.Prefix+hex.EncodeToString(hash[:]), "/")
+}
+
+// Purge isn't supported, since the cache's keys can't be enumerated.
+func (c *S3Cache) Purge(prefix string) (int, error) {
+	return 0, ErrCachePurgeUnsupported
+}
+
+func init() {
+	RegisterCache(CacheTypeS3, NewS3CacheWithConfig)
+}
@@ -23,6 +23,7 @@ package halfshell
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"reflect"
 	"regexp"
@@ -34,24 +35,176 @@ import (
 type Config struct {
 	ServerConfig  *ServerConfig
 	StatterConfig *StatterConfig
+	LogConfig     *LogConfig
 	RouteConfigs  []*RouteConfig
 }
 
+// LogConfig holds the log levels, globally and by component name pattern.
+type LogConfig struct {
+	Level           LogLevel
+	ComponentLevels map[string]LogLevel
+}
+
 // ServerConfig holds the configuration settings relevant for the HTTP server.
 type ServerConfig struct {
-	Port         uint64
-	ReadTimeout  uint64
-	WriteTimeout uint64
+	BindAddress         string
+	Port                uint64
+	ReadTimeout         uint64
+	ReadHeaderTimeout   uint64
+	WriteTimeout        uint64
+	IdleTimeout         uint64
+	MaxHeaderBytes      uint64
+	DisableKeepAlives   bool
+	DisableHTTP2        bool
+	ProcessingWorkers   uint64
+	ProcessingQueueSize uint64
+
+	// MaxConcurrentRequests bounds the number of image requests handled at
+	// once, with up to RequestQueueSize requests waiting for up to
+	// RequestQueueTimeout seconds. Requests aren't bounded if it is 0.
+	MaxConcurrentRequests uint64
+	RequestQueueSize      uint64
+	RequestQueueTimeout   uint64
+
+	ProcessingTimeout uint64
+	ShutdownTimeout   uint64
+	AdminToken        string
+	MaxUploadSize     uint64
+
+	// WarmUpWebhookSecret signs the webhook calls of warm-up jobs.
+	WarmUpWebhookSecret string
+
+	MetricsPort   uint64
+	LivenessPath  string
+	ReadinessPath string
+
+	// TLSCertFile and TLSKeyFile are the certificate and key the server
+	// terminates TLS with. The server uses plain HTTP if they are empty.
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSMinVersion string
+	TLSReload     bool
+
+	// DebugAddress is the address the pprof and expvar endpoints are served
+	// on, e.g. "127.0.0.1:6060". They are disabled if it is empty.
+	DebugAddress string
+
+	// Listeners are the addresses the server accepts connections on. The
+	// first is the listener of BindAddress and Port.
+	Listeners []*ListenerConfig
+
+	// TrustedProxies are the IP addresses and CIDR ranges of the proxies
+	// whose X-Forwarded-For headers identify clients.
+	TrustedProxies []string
+
+	// AccessLog is "stdout", "off", or the path of the access log file.
+	AccessLog       string
+	AccessLogFormat AccessLogFormat
+
+	// TracingEndpoint is the OTLP/HTTP endpoint spans are exported to.
+	// Tracing is disabled if it is empty.
+	TracingEndpoint    string
+	TracingServiceName string
+	TracingSampleRate  float64
+
+	// CacheControl, Expires and StaleWhileRevalidate are the defaults of the
+	// routes' settings of the same name.
+	CacheControl         string
+	Expires              uint64
+	StaleWhileRevalidate uint64
+}
+
+// ListenerConfig holds the settings of an address the server accepts
+// connections on.
+type ListenerConfig struct {
+	Name        string
+	BindAddress string
+	Port        uint64
+
+	// Routes are the names of the routes served by the listener. All the
+	// routes are served if it is empty.
+	Routes []string
+
+	// Admin makes the listener serve the administration endpoints.
+	Admin bool
 }
 
 // RouteConfig holds the configuration settings for a particular route.
 type RouteConfig struct {
 	Name            string
 	CacheControl    string
+	Defaults        map[string]string
+	ParameterNames  map[string]string
 	Pattern         *regexp.Regexp
 	ImagePathIndex  int
 	SourceConfig    *SourceConfig
 	ProcessorConfig *ProcessorConfig
+
+	// SourceConfigs is the ordered list of sources tried by the route until
+	// one has the image. SourceConfig is the first of them.
+	SourceConfigs []*SourceConfig
+
+	// Expires and StaleWhileRevalidate are in seconds.
+	Expires              uint64
+	StaleWhileRevalidate uint64
+
+	SurrogateKeys      string
+	SurrogateKeyHeader string
+
+	// SigningKeys are the secrets any of which may sign requests. Requests
+	// aren't required to be signed if there are none.
+	SigningKeys []string
+
+	// RequireExpires makes signed requests without an expiry time invalid.
+	RequireExpires bool
+
+	// AllowUploads makes the route process images uploaded with POST
+	// requests.
+	AllowUploads bool
+
+	// Placeholder is the path of the image returned with PlaceholderStatus
+	// when the requested image isn't found. It is retrieved from
+	// PlaceholderSourceConfig, or from the route's sources if it is nil.
+	Placeholder             string
+	PlaceholderSourceConfig *SourceConfig
+	PlaceholderStatus       uint64
+
+	// ProcessorConfigs is the ordered list of processors applied by the
+	// route. ProcessorConfig is the first of them.
+	ProcessorConfigs []*ProcessorConfig
+
+	// RateLimit is the number of requests per second allowed from each
+	// client IP, in bursts of up to RateLimitBurst. Requests aren't limited
+	// if it is 0.
+	RateLimit      float64
+	RateLimitBurst uint64
+
+	// MaxConcurrentRequests bounds the number of requests handled by the
+	// route at once, with up to RequestQueueSize requests waiting. Requests
+	// aren't bounded if it is 0.
+	MaxConcurrentRequests uint64
+	RequestQueueSize      uint64
+
+	// AutoFormat makes the route convert images to the first of AutoFormats
+	// the client accepts, unless a format is requested.
+	AutoFormat  bool
+	AutoFormats []string
+
+	// Passthrough makes the route serve the original images of requests
+	// without processing parameters as is.
+	Passthrough bool
+
+	// ClientHints makes the route scale images by the client hints of
+	// requests.
+	ClientHints bool
+
+	// ParameterLimits restricts the processing parameters of requests. It is
+	// nil if the route has no limits.
+	ParameterLimits *ParameterLimits
+
+	// Script is the path of a Lua script rewriting the source path and
+	// processing parameters of requests.
+	Script string
 }
 
 // SourceConfig holds the type information and configuration settings for a
@@ -62,26 +215,206 @@ type SourceConfig struct {
 	S3AccessKey string
 	S3Bucket    string
 	S3SecretKey string
+	S3Region    string
+	S3Endpoint  string
 	Directory   string
 	Host        string
+
+	// S3Bucket and S3Key may contain {name} placeholders, which are replaced
+	// with the named groups of the route pattern. S3Key defaults to the
+	// image_path group. S3AllowedBuckets restricts the templated buckets.
+	S3Key            string
+	S3AllowedBuckets []string
+
+	// S3PathStyle puts the bucket in the request path rather than the host
+	// name, and S3InsecureSkipVerify disables the verification of TLS
+	// certificates, for S3-compatible services.
+	S3PathStyle          bool
+	S3InsecureSkipVerify bool
+
+	// S3Presigned makes the S3 source request objects with presigned URLs,
+	// valid for S3PresignExpires seconds, rather than signed headers.
+	S3Presigned      bool
+	S3PresignExpires uint64
+
+	// S3RequesterPays acknowledges that the requests are charged to the
+	// source's account, which Requester Pays buckets require.
+	S3RequesterPays bool
+
+	// S3SSECustomerKey is the base64 encoded key of objects encrypted with a
+	// customer-provided key (SSE-C).
+	S3SSECustomerKey string
+
+	// AllowedHosts restricts the hosts remote sources may connect to. It
+	// holds host names, which match subdomains if they start with a dot, and
+	// CIDRs. AllowPrivateNetworks allows connecting to private, loopback and
+	// link-local addresses.
+	AllowedHosts         []string
+	AllowPrivateNetworks bool
+
+	// Proxy is the URL of the proxy remote sources connect through. The
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables apply if
+	// it's empty.
+	Proxy string
+
+	// Headers are added to the requests of HTTP sources, along with the
+	// headers of the incoming request named in ForwardHeaders.
+	Headers        map[string]string
+	ForwardHeaders []string
+
+	// BasicAuthUsername and BasicAuthPassword, or BearerToken, authenticate
+	// the requests of HTTP sources. TLSClientCertFile and TLSClientKeyFile
+	// are a client certificate presented to the origin, and TLSCAFile the
+	// certificate authorities its certificate is verified with.
+	BasicAuthUsername string
+	BasicAuthPassword string
+	BearerToken       string
+	TLSClientCertFile string
+	TLSClientKeyFile  string
+	TLSCAFile         string
+
+	// BaseURL, EmbeddedURLs, Timeout (in seconds), MaxIdleConnections,
+	// RedirectPolicy, MaxRedirects and AllowInsecureRedirects configure HTTP
+	// sources.
+	BaseURL                string
+	EmbeddedURLs           bool
+	Timeout                uint64
+	MaxIdleConnections     uint64
+	RedirectPolicy         string
+	MaxRedirects           uint64
+	AllowInsecureRedirects bool
+
+	// ConnectTimeout and ReadTimeout, in seconds, bound the time to connect
+	// to remote sources and to wait for data from them. MaxOriginalSize is
+	// the maximum size in bytes of original images.
+	ConnectTimeout  uint64
+	ReadTimeout     uint64
+	MaxOriginalSize uint64
+
+	// MaxIdleConnectionsTotal, MaxConnectionsPerHost and
+	// IdleConnectionTimeout (in seconds) tune the connection pools of
+	// remote sources along with MaxIdleConnections. DNSCacheTTL, in seconds,
+	// caches the addresses of their hosts.
+	MaxIdleConnectionsTotal uint64
+	MaxConnectionsPerHost   uint64
+	IdleConnectionTimeout   uint64
+	DNSCacheTTL             uint64
+
+	// Retries is the number of times failed fetches are retried. The wait
+	// before the first retry is RetryBackoff milliseconds, doubling with each
+	// retry. Network errors and RetryStatuses are retried.
+	Retries       uint64
+	RetryBackoff  uint64
+	RetryStatuses []uint64
+
+	// CacheMaxSize is the size in megabytes of the cache of originals, and
+	// CacheTTL the time in seconds they are cached for. No originals are
+	// cached if CacheMaxSize is 0.
+	CacheMaxSize uint64
+	CacheTTL     uint64
+
+	// NotFoundTTL is the time in seconds images the source doesn't have are
+	// remembered as missing for, and NotFoundCacheSize the number of them
+	// remembered. Missing images aren't remembered if NotFoundTTL is 0.
+	NotFoundTTL       uint64
+	NotFoundCacheSize uint64
+
+	// VideoFrames makes the source return a frame of the videos it holds,
+	// extracted by the ffmpeg executable at FFmpegPath.
+	VideoFrames bool
+	FFmpegPath  string
+
+	// Options holds the settings of source types registered by plugins or
+	// custom builds.
+	Options map[string]interface{}
 }
 
 // ProcessorConfig holds the configuration settings for the image processor.
 type ProcessorConfig struct {
 	Name                    string
+	Backend                 ImageProcessorBackend
 	ImageCompressionQuality uint64
 	DefaultScaleMode        uint
 	DefaultImageHeight      uint64
 	DefaultImageWidth       uint64
 	MaxImageDimensions      ImageDimensions
 	MaxBlurRadiusPercentage float64
+	MaxSourcePixels         uint64
+	MaxSourceFrames         uint64
 	AutoOrient              bool
+	ResourceLimits          ResourceLimitsConfig
+	Sharpen                 SharpenConfig
+	PNGPaletteColors        uint64
+	PNGPaletteDither        bool
+	AutoQualityThreshold    float64
+	ChromaSubsampling       string
+	Metadata                string
+	MaxSheetTiles           uint64
+	BlurHashHeader          bool
+	BackgroundColor         string
+	Cache                   CacheConfig
 	Formats                 map[string]FormatConfig
 
+	// Options holds the settings of processor backends registered by
+	// plugins or custom builds.
+	Options map[string]interface{}
+
 	// DEPRECATED
 	MaintainAspectRatio bool
 }
 
+// ResourceLimitsConfig holds the ImageMagick resource limits. Memory, Map
+// and Disk are in megabytes, Time is in seconds. A value of 0 leaves the
+// ImageMagick default in place.
+type ResourceLimitsConfig struct {
+	Memory  uint64
+	Map     uint64
+	Disk    uint64
+	Threads uint64
+	Time    uint64
+}
+
+// SharpenConfig holds the settings of the unsharp mask applied to downscaled
+// images. Radius and Sigma are in pixels, a Radius of 0 lets ImageMagick pick
+// one from Sigma. Amount is the proportion of the difference added back, and
+// Threshold the fraction of the color range below which differences are left
+// alone.
+type SharpenConfig struct {
+	Enabled   bool
+	Radius    float64
+	Sigma     float64
+	Amount    float64
+	Threshold float64
+}
+
+// CacheConfig holds the configuration settings for the cache of processed
+// images. MaxSize is in megabytes, TTL is in seconds.
+type CacheConfig struct {
+	Type    CacheType
+	MaxSize uint64
+	Path    string
+	Address string
+	TTL     uint64
+
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3Region    string
+	S3Endpoint  string
+	Prefix      string
+
+	S3PathStyle          bool
+	S3InsecureSkipVerify bool
+
+	// MaxAge is the time in seconds images are fresh for once cached. Stale
+	// images are served while they are processed again for up to
+	// StaleWhileRevalidate seconds, and when processing them fails for up to
+	// StaleIfError seconds. Images are always fresh if MaxAge is 0.
+	MaxAge               uint64
+	StaleWhileRevalidate uint64
+	StaleIfError         uint64
+}
+
 type FormatConfig struct {
 	Width  uint64
 	Height uint64
@@ -93,37 +426,84 @@ type StatterConfig struct {
 	Host    string
 	Port    uint64
 	Enabled bool
+
+	// Format is the protocol metrics are sent with. With
+	// StatterFormatDogStatsD, Tags are added to every metric.
+	Format StatterFormat
+	Tags   map[string]string
 }
 
+// StatterFormat is the protocol used to send metrics to StatsD.
+type StatterFormat string
+
+const (
+	StatterFormatStatsD    StatterFormat = "statsd"
+	StatterFormatDogStatsD StatterFormat = "dogstatsd"
+)
+
 // NewConfigFromFile parses a JSON configuration file and returns a pointer to
-// a new Config object.
+// a new Config object. It exits if the configuration is invalid.
 func NewConfigFromFile(filepath string) *Config {
-	parser := newConfigParser(filepath)
-	config := parser.parse()
+	config, err := LoadConfigFromFile(filepath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 	return config
 }
 
+// LoadConfigFromFile is like NewConfigFromFile, but returns an error if the
+// configuration is invalid, e.g. to reload it in a running server.
+func LoadConfigFromFile(filepath string) (config *Config, err error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open file %s", filepath)
+	}
+	defer file.Close()
+
+	parser := configParser{filepath: filepath}
+	err = json.NewDecoder(file).Decode(&parser.data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse file %s: %v", filepath, err)
+	}
+	applyEnvironmentOverrides(parser.data, os.Environ())
+	if _, err = expandEnvironment(parser.data); err != nil {
+		return nil, fmt.Errorf("Invalid configuration in %s: %v", filepath, err)
+	}
+	// Plugins register the source types and processor backends the
+	// configuration may refer to, so they are loaded before it is validated.
+	if err = loadConfigPlugins(filepath, parser.data["plugins"]); err != nil {
+		return nil, fmt.Errorf("Invalid configuration in %s: %v", filepath, err)
+	}
+	if problems := validateConfig(parser.data); len(problems) > 0 {
+		return nil, &ConfigError{Filepath: filepath, Problems: problems}
+	}
+
+	// The parser reports invalid settings by panicking, as do the type
+	// assertions on settings of the wrong type.
+	defer func() {
+		if r := recover(); r != nil {
+			config, err = nil, fmt.Errorf("Invalid configuration in %s: %v", filepath, r)
+		}
+	}()
+	return parser.parse(), nil
+}
+
 type configParser struct {
 	filepath string
 	data     map[string]interface{}
 }
 
-func newConfigParser(filepath string) *configParser {
-	file, err := os.Open(filepath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to open file %s\n", filepath)
-		os.Exit(1)
-	}
-	decoder := json.NewDecoder(file)
-	parser := configParser{filepath: filepath}
-	decoder.Decode(&parser.data)
-	return &parser
+// fail aborts the parsing of an invalid configuration.
+func (c *configParser) fail(format string, v ...interface{}) {
+	panic(fmt.Sprintf(format, v...))
 }
 
 func (c *configParser) parse() *Config {
 	config := Config{
 		ServerConfig:  c.parseServerConfig(),
 		StatterConfig: c.parseStatterConfig(),
+		LogConfig:     c.parseLogConfig(),
 	}
 
 	sourceConfigsByName := make(map[string]*SourceConfig)
@@ -143,8 +523,7 @@ func (c *configParser) parse() *Config {
 		routeData := routesData[routePatternString].(map[string]interface{})
 		pattern, err := regexp.Compile(routePatternString)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid route pattern %s: %v\n", routePatternString, err)
-			os.Exit(1)
+			c.fail("Invalid route pattern %s: %v", routePatternString, err)
 		}
 
 		for i, expName := range pattern.SubexpNames() {
@@ -154,33 +533,297 @@ func (c *configParser) parse() *Config {
 		}
 
 		if routeConfig.ImagePathIndex == -1 {
-			fmt.Fprintf(os.Stderr, "No 'image_path' named group in regex: %s\n", routePatternString)
-			os.Exit(1)
+			c.fail("No 'image_path' named group in regex: %s", routePatternString)
 		}
 
-		processorKey := routeData["processor"].(string)
-		sourceKey := routeData["source"].(string)
+		var processorKeys []string
+		switch processor := routeData["processor"].(type) {
+		case string:
+			processorKeys = []string{processor}
+		case []interface{}:
+			for _, processorKey := range processor {
+				processorKeys = append(processorKeys, processorKey.(string))
+			}
+		}
+		var sourceKeys []string
+		switch source := routeData["source"].(type) {
+		case string:
+			sourceKeys = []string{source}
+		case []interface{}:
+			for _, sourceKey := range source {
+				sourceKeys = append(sourceKeys, sourceKey.(string))
+			}
+		}
 
 		routeConfig.Name = routeData["name"].(string)
 		routeConfig.Pattern = pattern
-		routeConfig.ProcessorConfig = processorConfigsByName[processorKey]
-		routeConfig.SourceConfig = sourceConfigsByName[sourceKey]
+		for _, processorKey := range processorKeys {
+			routeConfig.ProcessorConfigs = append(routeConfig.ProcessorConfigs, processorConfigsByName[processorKey])
+		}
+		routeConfig.ProcessorConfig = routeConfig.ProcessorConfigs[0]
+		for _, sourceKey := range sourceKeys {
+			routeConfig.SourceConfigs = append(routeConfig.SourceConfigs, sourceConfigsByName[sourceKey])
+		}
+		routeConfig.SourceConfig = routeConfig.SourceConfigs[0]
+		routeConfig.CacheControl = config.ServerConfig.CacheControl
 		if _, ok := routeData["cache_control"]; ok {
 			routeConfig.CacheControl = routeData["cache_control"].(string)
 		}
 
+		routeConfig.Expires = config.ServerConfig.Expires
+		if expires, ok := routeData["expires"].(float64); ok {
+			routeConfig.Expires = uint64(expires)
+		}
+
+		routeConfig.StaleWhileRevalidate = config.ServerConfig.StaleWhileRevalidate
+		if staleWhileRevalidate, ok := routeData["stale_while_revalidate"].(float64); ok {
+			routeConfig.StaleWhileRevalidate = uint64(staleWhileRevalidate)
+		}
+
+		if surrogateKeys, ok := routeData["surrogate_keys"].(string); ok {
+			routeConfig.SurrogateKeys = surrogateKeys
+		}
+		routeConfig.SurrogateKeyHeader = "Surrogate-Key"
+		if surrogateKeyHeader, ok := routeData["surrogate_key_header"].(string); ok {
+			routeConfig.SurrogateKeyHeader = surrogateKeyHeader
+		}
+
+		switch signingKeys := routeData["signing_keys"].(type) {
+		case string:
+			routeConfig.SigningKeys = []string{signingKeys}
+		case []interface{}:
+			for _, signingKey := range signingKeys {
+				routeConfig.SigningKeys = append(routeConfig.SigningKeys, signingKey.(string))
+			}
+		}
+
+		routeConfig.RequireExpires, _ = routeData["require_expires"].(bool)
+		routeConfig.AllowUploads, _ = routeData["allow_uploads"].(bool)
+
+		routeConfig.Placeholder, _ = routeData["placeholder"].(string)
+		if placeholderSource, ok := routeData["placeholder_source"].(string); ok {
+			routeConfig.PlaceholderSourceConfig = sourceConfigsByName[placeholderSource]
+		}
+		routeConfig.PlaceholderStatus = http.StatusNotFound
+		if placeholderStatus, ok := routeData["placeholder_status"].(float64); ok {
+			routeConfig.PlaceholderStatus = uint64(placeholderStatus)
+		}
+
+		routeConfig.RateLimit, _ = routeData["rate_limit"].(float64)
+		if rateLimitBurst, ok := routeData["rate_limit_burst"].(float64); ok {
+			routeConfig.RateLimitBurst = uint64(rateLimitBurst)
+		}
+
+		if maxConcurrentRequests, ok := routeData["max_concurrent_requests"].(float64); ok {
+			routeConfig.MaxConcurrentRequests = uint64(maxConcurrentRequests)
+		}
+		if requestQueueSize, ok := routeData["request_queue_size"].(float64); ok {
+			routeConfig.RequestQueueSize = uint64(requestQueueSize)
+		}
+
+		routeConfig.Passthrough, _ = routeData["passthrough"].(bool)
+		routeConfig.Script, _ = routeData["script"].(string)
+		routeConfig.ClientHints, _ = routeData["client_hints"].(bool)
+		routeConfig.AutoFormat, _ = routeData["auto_format"].(bool)
+		routeConfig.AutoFormats = DefaultAutoFormats
+		switch autoFormats := routeData["auto_formats"].(type) {
+		case string:
+			routeConfig.AutoFormats = []string{autoFormats}
+		case []interface{}:
+			routeConfig.AutoFormats = nil
+			for _, autoFormat := range autoFormats {
+				if autoFormat, ok := autoFormat.(string); ok {
+					routeConfig.AutoFormats = append(routeConfig.AutoFormats, strings.ToLower(autoFormat))
+				}
+			}
+		}
+
+		if limits, ok := routeData["limits"].(map[string]interface{}); ok {
+			routeConfig.ParameterLimits = parseParameterLimits(limits)
+		}
+
+		routeConfig.Defaults = make(map[string]string)
+		if defaults, ok := routeData["defaults"].(map[string]interface{}); ok {
+			for name, value := range defaults {
+				routeConfig.Defaults[name] = fmt.Sprint(value)
+			}
+		}
+
+		routeConfig.ParameterNames = make(map[string]string)
+		if parameters, ok := routeData["parameters"].(map[string]interface{}); ok {
+			for name, requestName := range parameters {
+				routeConfig.ParameterNames[name] = fmt.Sprint(requestName)
+			}
+		}
+
 		config.RouteConfigs = append(config.RouteConfigs, routeConfig)
 	}
 
 	return &config
 }
 
+// parseParameterLimits parses the limits setting of a route.
+func parseParameterLimits(data map[string]interface{}) *ParameterLimits {
+	uints := func(value interface{}) []uint64 {
+		var uints []uint64
+		switch value := value.(type) {
+		case float64:
+			uints = append(uints, uint64(value))
+		case []interface{}:
+			for _, number := range value {
+				if number, ok := number.(float64); ok {
+					uints = append(uints, uint64(number))
+				}
+			}
+		}
+		return uints
+	}
+
+	limits := &ParameterLimits{
+		Widths:    uints(data["widths"]),
+		Heights:   uints(data["heights"]),
+		Qualities: uints(data["qualities"]),
+	}
+	if maxWidth, ok := data["max_width"].(float64); ok {
+		limits.MaxWidth = uint64(maxWidth)
+	}
+	if maxHeight, ok := data["max_height"].(float64); ok {
+		limits.MaxHeight = uint64(maxHeight)
+	}
+	if minQuality, ok := data["min_quality"].(float64); ok {
+		limits.MinQuality = uint64(minQuality)
+	}
+	if maxQuality, ok := data["max_quality"].(float64); ok {
+		limits.MaxQuality = uint64(maxQuality)
+	}
+	limits.MaxBlur, _ = data["max_blur"].(float64)
+	switch formats := data["formats"].(type) {
+	case string:
+		limits.Formats = []string{formats}
+	case []interface{}:
+		for _, format := range formats {
+			if format, ok := format.(string); ok {
+				limits.Formats = append(limits.Formats, format)
+			}
+		}
+	}
+	return limits
+}
+
 func (c *configParser) parseServerConfig() *ServerConfig {
-	return &ServerConfig{
-		Port:         c.uintForKeypath("server.port"),
-		ReadTimeout:  c.uintForKeypath("server.read_timeout"),
-		WriteTimeout: c.uintForKeypath("server.write_timeout"),
+	config := &ServerConfig{
+		BindAddress:         c.stringForKeypath("server.bind_address"),
+		Port:                c.uintForKeypath("server.port"),
+		ReadTimeout:         c.uintForKeypath("server.read_timeout"),
+		ReadHeaderTimeout:   c.uintForKeypath("server.read_header_timeout"),
+		WriteTimeout:        c.uintForKeypath("server.write_timeout"),
+		IdleTimeout:         c.uintForKeypath("server.idle_timeout"),
+		MaxHeaderBytes:      c.uintForKeypath("server.max_header_bytes"),
+		DisableKeepAlives:   c.boolForKeypath("server.disable_keep_alives"),
+		DisableHTTP2:        c.boolForKeypath("server.disable_http2"),
+		ProcessingWorkers:   c.uintForKeypath("server.processing_workers"),
+		ProcessingQueueSize: c.uintForKeypath("server.processing_queue_size"),
+		ProcessingTimeout:   c.uintForKeypath("server.processing_timeout"),
+		ShutdownTimeout:     c.uintForKeypath("server.shutdown_timeout"),
+		AdminToken:          c.stringForKeypath("server.admin_token"),
+		WarmUpWebhookSecret: c.stringForKeypath("server.warm_up_webhook_secret"),
+		MaxUploadSize:       c.uintForKeypath("server.max_upload_size"),
+		MetricsPort:         c.uintForKeypath("server.metrics_port"),
+		DebugAddress:        c.stringForKeypath("server.debug_address"),
+		TLSCertFile:         c.stringForKeypath("server.tls_cert_file"),
+		TLSKeyFile:          c.stringForKeypath("server.tls_key_file"),
+		TLSMinVersion:       c.stringForKeypath("server.tls_min_version"),
+		TLSReload:           c.boolForKeypath("server.tls_reload"),
+		LivenessPath:        c.stringForKeypath("server.liveness_path"),
+		ReadinessPath:       c.stringForKeypath("server.readiness_path"),
+
+		MaxConcurrentRequests: c.uintForKeypath("server.max_concurrent_requests"),
+		RequestQueueSize:      c.uintForKeypath("server.request_queue_size"),
+		RequestQueueTimeout:   c.uintForKeypath("server.request_queue_timeout"),
+
+		TrustedProxies: c.stringsForKeypath("server.trusted_proxies"),
+
+		AccessLog:       c.stringForKeypath("server.access_log"),
+		AccessLogFormat: AccessLogFormat(c.stringForKeypath("server.access_log_format")),
+
+		TracingEndpoint:    c.stringForKeypath("server.tracing.endpoint"),
+		TracingServiceName: c.stringForKeypath("server.tracing.service_name"),
+		TracingSampleRate:  c.floatForKeypath("server.tracing.sample_rate"),
+
+		CacheControl:         c.stringForKeypath("server.cache_control"),
+		Expires:              c.uintForKeypath("server.expires"),
+		StaleWhileRevalidate: c.uintForKeypath("server.stale_while_revalidate"),
+	}
+
+	if config.MaxUploadSize == 0 {
+		config.MaxUploadSize = 10 << 20
+	}
+
+	// The administration endpoints are only served by the main listener if
+	// no other listener serves them.
+	mainListener := &ListenerConfig{
+		Name:        "default",
+		BindAddress: config.BindAddress,
+		Port:        config.Port,
+		Routes:      c.stringsForKeypath("server.routes"),
+		Admin:       true,
+	}
+	config.Listeners = []*ListenerConfig{mainListener}
+	server, _ := c.data["server"].(map[string]interface{})
+	listeners, _ := server["listeners"].(map[string]interface{})
+	for _, name := range sortedConfigKeys(listeners) {
+		listener := &ListenerConfig{
+			Name:        name,
+			BindAddress: c.stringForKeypath("server.listeners.%s.bind_address", name),
+			Port:        c.uintForKeypath("server.listeners.%s.port", name),
+			Routes:      c.stringsForKeypath("server.listeners.%s.routes", name),
+			Admin:       c.boolForKeypath("server.listeners.%s.admin", name),
+		}
+		if listener.Admin {
+			mainListener.Admin = false
+		}
+		config.Listeners = append(config.Listeners, listener)
+	}
+	if admin, ok := server["admin"].(bool); ok && !admin {
+		mainListener.Admin = false
+	}
+	// Connections that are slow to send their headers, or idle, are closed
+	// even if no other timeout is configured.
+	if config.ReadHeaderTimeout == 0 {
+		config.ReadHeaderTimeout = 10
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = 120
+	}
+	if config.MaxHeaderBytes == 0 {
+		config.MaxHeaderBytes = 1 << 20
+	}
+	if config.TLSMinVersion == "" {
+		config.TLSMinVersion = "1.2"
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 30
+	}
+	if config.LivenessPath == "" {
+		config.LivenessPath = "/healthz"
+	}
+	if config.ReadinessPath == "" {
+		config.ReadinessPath = "/readyz"
+	}
+	if config.AccessLog == "" {
+		config.AccessLog = "stdout"
+	}
+	if config.AccessLogFormat == "" {
+		config.AccessLogFormat = AccessLogFormatCommon
+	}
+	if config.TracingServiceName == "" {
+		config.TracingServiceName = "halfshell"
 	}
+	if config.TracingSampleRate <= 0 || config.TracingSampleRate > 1 {
+		config.TracingSampleRate = 1
+	}
+
+	return config
 }
 
 func (c *configParser) parseStatterConfig() *StatterConfig {
@@ -203,31 +846,143 @@ func (c *configParser) parseStatterConfig() *StatterConfig {
 		enabled = true
 	}
 
+	format := StatterFormat(c.stringForKeypath("statsd.format"))
+	if format == "" {
+		format = StatterFormatStatsD
+	}
+
 	return &StatterConfig{
 		Host:    host,
 		Port:    uint64(port),
 		Enabled: enabled.(bool),
+		Format:  format,
+		Tags:    c.stringMapForKeypath("statsd.tags"),
+	}
+}
+
+func (c *configParser) parseLogConfig() *LogConfig {
+	config := &LogConfig{Level: LogLevelDebug, ComponentLevels: make(map[string]LogLevel)}
+	parseLevel := func(name string) LogLevel {
+		level, err := ParseLogLevel(name)
+		if err != nil {
+			c.fail("Invalid logging configuration: %v", err)
+		}
+		return level
+	}
+
+	if name := c.stringForKeypath("logging.level"); name != "" {
+		config.Level = parseLevel(name)
 	}
+	for pattern, name := range c.stringMapForKeypath("logging.levels") {
+		config.ComponentLevels[pattern] = parseLevel(name)
+	}
+	return config
 }
 
 func (c *configParser) parseSourceConfig(sourceName string) *SourceConfig {
-	return &SourceConfig{
+	config := &SourceConfig{
 		Name:        sourceName,
 		Type:        ImageSourceType(c.stringForKeypath("sources.%s.type", sourceName)),
 		S3AccessKey: c.stringForKeypath("sources.%s.s3_access_key", sourceName),
 		S3SecretKey: c.stringForKeypath("sources.%s.s3_secret_key", sourceName),
 		S3Bucket:    c.stringForKeypath("sources.%s.s3_bucket", sourceName),
+		S3Region:    c.stringForKeypath("sources.%s.s3_region", sourceName),
+		S3Endpoint:  c.stringForKeypath("sources.%s.s3_endpoint", sourceName),
 		Directory:   c.stringForKeypath("sources.%s.directory", sourceName),
 		Host:        c.stringForKeypath("sources.%s.host", sourceName),
+
+		S3Key:            c.stringForKeypath("sources.%s.s3_key", sourceName),
+		S3AllowedBuckets: c.stringsForKeypath("sources.%s.s3_allowed_buckets", sourceName),
+
+		S3PathStyle:          c.boolForKeypath("sources.%s.s3_path_style", sourceName),
+		S3InsecureSkipVerify: c.boolForKeypath("sources.%s.s3_insecure_skip_verify", sourceName),
+
+		S3Presigned:      c.boolForKeypath("sources.%s.s3_presigned", sourceName),
+		S3PresignExpires: c.uintForKeypath("sources.%s.s3_presign_expires", sourceName),
+		S3RequesterPays:  c.boolForKeypath("sources.%s.s3_requester_pays", sourceName),
+		S3SSECustomerKey: c.stringForKeypath("sources.%s.s3_sse_customer_key", sourceName),
+
+		AllowedHosts:         c.stringsForKeypath("sources.%s.allowed_hosts", sourceName),
+		AllowPrivateNetworks: c.boolForKeypath("sources.%s.allow_private_networks", sourceName),
+		Proxy:                c.stringForKeypath("sources.%s.proxy", sourceName),
+
+		Headers:        c.stringMapForKeypath("sources.%s.headers", sourceName),
+		ForwardHeaders: c.stringsForKeypath("sources.%s.forward_headers", sourceName),
+
+		BasicAuthUsername: c.stringForKeypath("sources.%s.basic_auth_username", sourceName),
+		BasicAuthPassword: c.stringForKeypath("sources.%s.basic_auth_password", sourceName),
+		BearerToken:       c.stringForKeypath("sources.%s.bearer_token", sourceName),
+		TLSClientCertFile: c.stringForKeypath("sources.%s.tls_client_cert_file", sourceName),
+		TLSClientKeyFile:  c.stringForKeypath("sources.%s.tls_client_key_file", sourceName),
+		TLSCAFile:         c.stringForKeypath("sources.%s.tls_ca_file", sourceName),
+
+		BaseURL:            c.stringForKeypath("sources.%s.base_url", sourceName),
+		EmbeddedURLs:       c.boolForKeypath("sources.%s.embedded_urls", sourceName),
+		Timeout:            c.uintForKeypath("sources.%s.timeout", sourceName),
+		MaxIdleConnections: c.uintForKeypath("sources.%s.max_idle_connections", sourceName),
+		RedirectPolicy:     c.stringForKeypath("sources.%s.redirect_policy", sourceName),
+		MaxRedirects:       c.uintForKeypath("sources.%s.max_redirects", sourceName),
+
+		AllowInsecureRedirects: c.boolForKeypath("sources.%s.allow_insecure_redirects", sourceName),
+
+		ConnectTimeout:  c.uintForKeypath("sources.%s.connect_timeout", sourceName),
+		ReadTimeout:     c.uintForKeypath("sources.%s.read_timeout", sourceName),
+		MaxOriginalSize: c.uintForKeypath("sources.%s.max_original_size", sourceName),
+
+		MaxIdleConnectionsTotal: c.uintForKeypath("sources.%s.max_idle_connections_total", sourceName),
+		MaxConnectionsPerHost:   c.uintForKeypath("sources.%s.max_connections_per_host", sourceName),
+		IdleConnectionTimeout:   c.uintForKeypath("sources.%s.idle_connection_timeout", sourceName),
+		DNSCacheTTL:             c.uintForKeypath("sources.%s.dns_cache_ttl", sourceName),
+
+		Retries:       c.uintForKeypath("sources.%s.retries", sourceName),
+		RetryBackoff:  c.uintForKeypath("sources.%s.retry_backoff", sourceName),
+		RetryStatuses: c.uintsForKeypath("sources.%s.retry_statuses", sourceName),
+
+		CacheMaxSize: c.uintForKeypath("sources.%s.cache_max_size", sourceName),
+		CacheTTL:     c.uintForKeypath("sources.%s.cache_ttl", sourceName),
+
+		NotFoundTTL:       c.uintForKeypath("sources.%s.not_found_ttl", sourceName),
+		NotFoundCacheSize: c.uintForKeypath("sources.%s.not_found_cache_size", sourceName),
+
+		VideoFrames: c.boolForKeypath("sources.%s.video_frames", sourceName),
+		FFmpegPath:  c.stringForKeypath("sources.%s.ffmpeg_path", sourceName),
+
+		Options: c.valueForKeypath(reflect.Map, "sources.%s.options", sourceName).(map[string]interface{}),
+	}
+
+	config.setDefaults()
+	return config
+}
+
+// NewSourceConfig returns the configuration of a source with the defaults of
+// the configuration file, for using sources without one.
+func NewSourceConfig(name string, sourceType ImageSourceType) *SourceConfig {
+	config := &SourceConfig{Name: name, Type: sourceType}
+	config.setDefaults()
+	return config
+}
+
+func (config *SourceConfig) setDefaults() {
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = 100
+	}
+
+	if len(config.RetryStatuses) == 0 {
+		config.RetryStatuses = defaultRetryStatuses
+	}
+
+	if config.FFmpegPath == "" {
+		config.FFmpegPath = "ffmpeg"
+	}
+
+	if config.S3PresignExpires == 0 {
+		config.S3PresignExpires = 300
 	}
 }
 
 func (c *configParser) parseProcessorConfig(processorName string) *ProcessorConfig {
 	scaleModeName := c.stringForKeypath("processors.%s.default_scale_mode", processorName)
 	scaleMode, _ := ScaleModes[scaleModeName]
-	if scaleMode == 0 {
-		scaleMode = ScaleFill
-	}
 
 	maxDimensions := ImageDimensions{
 		Width:  uint(c.uintForKeypath("processors.%s.max_image_width", processorName)),
@@ -248,25 +1003,148 @@ func (c *configParser) parseProcessorConfig(processorName string) *ProcessorConf
 	}
 
 	config := &ProcessorConfig{
-		Name: processorName,
+		Name:                    processorName,
+		Backend:                 ImageProcessorBackend(c.stringForKeypath("processors.%s.backend", processorName)),
 		ImageCompressionQuality: c.uintForKeypath("processors.%s.image_compression_quality", processorName),
 		DefaultScaleMode:        scaleMode,
 		DefaultImageHeight:      c.uintForKeypath("processors.%s.default_image_height", processorName),
 		DefaultImageWidth:       c.uintForKeypath("processors.%s.default_image_width", processorName),
 		MaxImageDimensions:      maxDimensions,
 		MaxBlurRadiusPercentage: c.floatForKeypath("processors.%s.max_blur_radius_percentage", processorName),
+		MaxSourcePixels:         c.uintForKeypath("processors.%s.max_source_pixels", processorName),
+		MaxSourceFrames:         c.uintForKeypath("processors.%s.max_source_frames", processorName),
 		AutoOrient:              c.boolForKeypath("processors.%s.auto_orient", processorName),
-		Formats:                 formats,
+		ResourceLimits: ResourceLimitsConfig{
+			Memory:  c.uintForKeypath("processors.%s.resource_limits.memory", processorName),
+			Map:     c.uintForKeypath("processors.%s.resource_limits.map", processorName),
+			Disk:    c.uintForKeypath("processors.%s.resource_limits.disk", processorName),
+			Threads: c.uintForKeypath("processors.%s.resource_limits.threads", processorName),
+			Time:    c.uintForKeypath("processors.%s.resource_limits.time", processorName),
+		},
+		PNGPaletteColors: c.uintForKeypath("processors.%s.png_palette_colors", processorName),
+		PNGPaletteDither: c.boolForKeypath("processors.%s.png_palette_dither", processorName),
+		BlurHashHeader:   c.boolForKeypath("processors.%s.blurhash_header", processorName),
+		BackgroundColor:  c.stringForKeypath("processors.%s.background_color", processorName),
+		Formats:          formats,
+		Options:          c.valueForKeypath(reflect.Map, "processors.%s.options", processorName).(map[string]interface{}),
+		Cache: CacheConfig{
+			Type:    CacheType(c.stringForKeypath("processors.%s.cache.type", processorName)),
+			MaxSize: c.uintForKeypath("processors.%s.cache.max_size", processorName),
+			Path:    c.stringForKeypath("processors.%s.cache.path", processorName),
+			Address: c.stringForKeypath("processors.%s.cache.address", processorName),
+			TTL:     c.uintForKeypath("processors.%s.cache.ttl", processorName),
+
+			S3Bucket:    c.stringForKeypath("processors.%s.cache.s3_bucket", processorName),
+			S3AccessKey: c.stringForKeypath("processors.%s.cache.s3_access_key", processorName),
+			S3SecretKey: c.stringForKeypath("processors.%s.cache.s3_secret_key", processorName),
+			S3Region:    c.stringForKeypath("processors.%s.cache.s3_region", processorName),
+			S3Endpoint:  c.stringForKeypath("processors.%s.cache.s3_endpoint", processorName),
+			Prefix:      c.stringForKeypath("processors.%s.cache.prefix", processorName),
+
+			S3PathStyle:          c.boolForKeypath("processors.%s.cache.s3_path_style", processorName),
+			S3InsecureSkipVerify: c.boolForKeypath("processors.%s.cache.s3_insecure_skip_verify", processorName),
+
+			MaxAge:               c.uintForKeypath("processors.%s.cache.max_age", processorName),
+			StaleWhileRevalidate: c.uintForKeypath("processors.%s.cache.stale_while_revalidate", processorName),
+			StaleIfError:         c.uintForKeypath("processors.%s.cache.stale_if_error", processorName),
+		},
+
+		AutoQualityThreshold: c.floatForKeypath("processors.%s.auto_quality_threshold", processorName),
+		ChromaSubsampling:    parseChromaSubsampling(c.stringForKeypath("processors.%s.chroma_subsampling", processorName)),
+		Metadata:             c.stringForKeypath("processors.%s.metadata", processorName),
+		MaxSheetTiles:        c.uintForKeypath("processors.%s.max_sheet_tiles", processorName),
+		Sharpen:              c.parseSharpenConfig(processorName),
 
 		// DEPRECATED
 		MaintainAspectRatio: c.boolForKeypath("processors.%s.maintain_aspect_ratio", processorName),
 	}
 
+	config.setDefaults()
+	return config
+}
+
+// parseSharpenConfig parses the sharpen block of a processor. Sharpening is
+// enabled unless the block, or that of the default processor, disables it.
+func (c *configParser) parseSharpenConfig(processorName string) SharpenConfig {
+	enabled := true
+	processors, _ := c.data["processors"].(map[string]interface{})
+	for _, name := range []string{"default", processorName} {
+		processor, _ := processors[name].(map[string]interface{})
+		sharpen, _ := processor["sharpen"].(map[string]interface{})
+		if value, ok := sharpen["enabled"].(bool); ok {
+			enabled = value
+		}
+	}
+
+	return SharpenConfig{
+		Enabled:   enabled,
+		Radius:    c.floatForKeypath("processors.%s.sharpen.radius", processorName),
+		Sigma:     c.floatForKeypath("processors.%s.sharpen.sigma", processorName),
+		Amount:    c.floatForKeypath("processors.%s.sharpen.amount", processorName),
+		Threshold: c.floatForKeypath("processors.%s.sharpen.threshold", processorName),
+	}
+}
+
+// NewProcessorConfig returns the configuration of a processor with the
+// defaults of the configuration file, for using processors without one.
+func NewProcessorConfig(name string) *ProcessorConfig {
+	config := &ProcessorConfig{
+		Name:    name,
+		Formats: make(map[string]FormatConfig),
+		Sharpen: SharpenConfig{Enabled: true},
+	}
+	config.setDefaults()
+	return config
+}
+
+func (config *ProcessorConfig) setDefaults() {
+	if config.Backend == "" {
+		config.Backend = defaultImageProcessorBackend
+	}
+
+	if config.DefaultScaleMode == 0 {
+		config.DefaultScaleMode = ScaleFill
+	}
+
+	if config.Cache.MaxSize == 0 {
+		config.Cache.MaxSize = 128
+	}
+
+	if config.BackgroundColor == "" {
+		config.BackgroundColor = "white"
+	}
+
+	if config.MaxSheetTiles == 0 {
+		config.MaxSheetTiles = 100
+	}
+
+	if config.Metadata == "" {
+		config.Metadata = MetadataStrip
+	}
+
+	if config.Sharpen.Sigma == 0 {
+		config.Sharpen.Sigma = 0.5
+	}
+
+	if config.Sharpen.Amount == 0 {
+		config.Sharpen.Amount = 0.8
+	}
+
+	if config.AutoQualityThreshold == 0 {
+		config.AutoQualityThreshold = 0.003
+	}
+
 	if config.MaintainAspectRatio {
 		config.DefaultScaleMode = ScaleAspectFit
 	}
+}
 
-	return config
+// ImageLimits returns the limits of the images the processor accepts.
+func (config *ProcessorConfig) ImageLimits() ImageLimits {
+	return ImageLimits{
+		MaxPixels: config.MaxSourcePixels,
+		MaxFrames: config.MaxSourceFrames,
+	}
 }
 
 func (c *configParser) valueForKeypath(valueType reflect.Kind, keypathFormat string, v ...interface{}) interface{} {
@@ -274,15 +1152,16 @@ func (c *configParser) valueForKeypath(valueType reflect.Kind, keypathFormat str
 	components := strings.Split(keypath, ".")
 	var currentData = c.data
 	for _, component := range components[:len(components)-1] {
-		currentData = currentData[component].(map[string]interface{})
+		currentData, _ = currentData[component].(map[string]interface{})
 	}
 	value := currentData[components[len(components)-1]]
-	if value == nil && len(v) > 0 {
-		return c.valueForKeypath(valueType, fmt.Sprintf(keypathFormat, "default"))
+	if value == nil && len(v) > 0 && v[0] != "default" {
+		defaultArgs := append([]interface{}{"default"}, v[1:]...)
+		return c.valueForKeypath(valueType, keypathFormat, defaultArgs...)
 	}
 
 	switch value.(type) {
-	case string, bool, float64:
+	case string, bool, float64, []interface{}, map[string]interface{}:
 		return value
 	case nil:
 		switch valueType {
@@ -292,6 +1171,10 @@ func (c *configParser) valueForKeypath(valueType reflect.Kind, keypathFormat str
 			return ""
 		case reflect.Bool:
 			return false
+		case reflect.Slice:
+			return []interface{}{}
+		case reflect.Map:
+			return map[string]interface{}{}
 		default:
 			panic("Unreachable")
 		}
@@ -312,6 +1195,46 @@ func (c *configParser) uintForKeypath(keypathFormat string, v ...interface{}) ui
 	return uint64(c.floatForKeypath(keypathFormat, v...))
 }
 
+// stringsForKeypath returns the list of strings at the keypath. A single
+// string is returned as a list of one.
+func (c *configParser) stringsForKeypath(keypathFormat string, v ...interface{}) []string {
+	var strs []string
+	switch value := c.valueForKeypath(reflect.Slice, keypathFormat, v...).(type) {
+	case string:
+		strs = append(strs, value)
+	case []interface{}:
+		for _, str := range value {
+			strs = append(strs, fmt.Sprint(str))
+		}
+	}
+	return strs
+}
+
+func (c *configParser) uintsForKeypath(keypathFormat string, v ...interface{}) []uint64 {
+	var uints []uint64
+	switch value := c.valueForKeypath(reflect.Slice, keypathFormat, v...).(type) {
+	case float64:
+		uints = append(uints, uint64(value))
+	case []interface{}:
+		for _, number := range value {
+			if number, ok := number.(float64); ok {
+				uints = append(uints, uint64(number))
+			}
+		}
+	}
+	return uints
+}
+
+func (c *configParser) stringMapForKeypath(keypathFormat string, v ...interface{}) map[string]string {
+	strs := make(map[string]string)
+	if value, ok := c.valueForKeypath(reflect.Map, keypathFormat, v...).(map[string]interface{}); ok {
+		for key, str := range value {
+			strs[key] = fmt.Sprint(str)
+		}
+	}
+	return strs
+}
+
 func (c *configParser) boolForKeypath(keypathFormat string, v ...interface{}) bool {
 	return c.valueForKeypath(reflect.Bool, keypathFormat, v...).(bool)
 }
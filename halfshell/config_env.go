@@ -0,0 +1,123 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// configEnvironmentPrefix is the prefix of the environment variables
+// overriding configuration settings.
+const configEnvironmentPrefix = "HALFSHELL_"
+
+// environmentVariablePattern matches the ${VAR} references in configuration
+// values.
+var environmentVariablePattern = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// expandEnvironment replaces the ${VAR} references in the string values of
+// the configuration with the values of the environment variables. Referencing
+// an undefined variable is an error, so secrets don't silently end up empty.
+func expandEnvironment(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		var err error
+		expanded := environmentVariablePattern.ReplaceAllStringFunc(value, func(reference string) string {
+			name := environmentVariablePattern.FindStringSubmatch(reference)[1]
+			variable, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("Undefined environment variable %s", name)
+			}
+			return variable
+		})
+		return expanded, err
+	case map[string]interface{}:
+		for key, child := range value {
+			expanded, err := expandEnvironment(child)
+			if err != nil {
+				return nil, err
+			}
+			value[key] = expanded
+		}
+	case []interface{}:
+		for i, child := range value {
+			expanded, err := expandEnvironment(child)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = expanded
+		}
+	}
+	return value, nil
+}
+
+// applyEnvironmentOverrides sets the settings named by HALFSHELL_* variables
+// of environ, e.g. HALFSHELL_SOURCES__DEFAULT__S3_SECRET_KEY sets the
+// s3_secret_key of the default source. Double underscores separate the levels
+// of the configuration. Names are matched case-insensitively, with
+// underscores matching hyphens, so existing settings keep their case. Values
+// are parsed as JSON if they can be, and taken as strings otherwise.
+func applyEnvironmentOverrides(data map[string]interface{}, environ []string) {
+	for _, variable := range environ {
+		if !strings.HasPrefix(variable, configEnvironmentPrefix) {
+			continue
+		}
+		nameValue := strings.SplitN(strings.TrimPrefix(variable, configEnvironmentPrefix), "=", 2)
+		if len(nameValue) != 2 || nameValue[0] == "" {
+			continue
+		}
+
+		var value interface{}
+		if err := json.Unmarshal([]byte(nameValue[1]), &value); err != nil {
+			value = nameValue[1]
+		}
+
+		components := strings.Split(nameValue[0], "__")
+		currentData := data
+		for i, component := range components {
+			key := configKeyForEnvironmentName(currentData, component)
+			if i == len(components)-1 {
+				currentData[key] = value
+				break
+			}
+			child, ok := currentData[key].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				currentData[key] = child
+			}
+			currentData = child
+		}
+	}
+}
+
+// configKeyForEnvironmentName returns the key of data named by the component
+// of an environment variable name, or the lowercased name if there is none.
+func configKeyForEnvironmentName(data map[string]interface{}, name string) string {
+	for key := range data {
+		if strings.EqualFold(strings.Replace(key, "-", "_", -1), name) {
+			return key
+		}
+	}
+	return strings.ToLower(name)
+}
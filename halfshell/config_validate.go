@@ -0,0 +1,791 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigError lists all the problems of an invalid configuration file.
+type ConfigError struct {
+	Filepath string
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("Invalid configuration in %s:\n  %s", e.Filepath, strings.Join(e.Problems, "\n  "))
+}
+
+// configKind is the kind of value expected for a setting.
+type configKind string
+
+const (
+	configString  configKind = "a string"
+	configNumber  configKind = "a number"
+	configBool    configKind = "a boolean"
+	configStrings configKind = "a string or a list of strings"
+	configNumbers configKind = "a number or a list of numbers"
+	configObject  configKind = "an object"
+)
+
+// configSchema maps the names of the settings of an object to their
+// configKind, or to the configSchema of nested objects.
+type configSchema map[string]interface{}
+
+// configMapOf is the schema of objects with arbitrary names, whose values all
+// have the same schema.
+type configMapOf struct {
+	schema configSchema
+}
+
+var (
+	cacheConfigSchema = configSchema{
+		"type":                    configString,
+		"max_size":                configNumber,
+		"path":                    configString,
+		"prefix":                  configString,
+		"address":                 configString,
+		"ttl":                     configNumber,
+		"s3_bucket":               configString,
+		"s3_access_key":           configString,
+		"s3_secret_key":           configString,
+		"s3_region":               configString,
+		"s3_endpoint":             configString,
+		"s3_path_style":           configBool,
+		"s3_insecure_skip_verify": configBool,
+		"max_age":                 configNumber,
+		"stale_while_revalidate":  configNumber,
+		"stale_if_error":          configNumber,
+	}
+
+	sourceConfigSchema = configSchema{
+		"type":                       configString,
+		"s3_access_key":              configString,
+		"s3_secret_key":              configString,
+		"s3_bucket":                  configString,
+		"s3_key":                     configString,
+		"s3_allowed_buckets":         configStrings,
+		"s3_region":                  configString,
+		"s3_endpoint":                configString,
+		"s3_path_style":              configBool,
+		"s3_insecure_skip_verify":    configBool,
+		"s3_presigned":               configBool,
+		"s3_presign_expires":         configNumber,
+		"s3_requester_pays":          configBool,
+		"s3_sse_customer_key":        configString,
+		"directory":                  configString,
+		"host":                       configString,
+		"base_url":                   configString,
+		"embedded_urls":              configBool,
+		"timeout":                    configNumber,
+		"connect_timeout":            configNumber,
+		"read_timeout":               configNumber,
+		"max_original_size":          configNumber,
+		"max_idle_connections":       configNumber,
+		"max_idle_connections_total": configNumber,
+		"max_connections_per_host":   configNumber,
+		"idle_connection_timeout":    configNumber,
+		"dns_cache_ttl":              configNumber,
+		"redirect_policy":            configString,
+		"max_redirects":              configNumber,
+		"allow_insecure_redirects":   configBool,
+		"allowed_hosts":              configStrings,
+		"allow_private_networks":     configBool,
+		"proxy":                      configString,
+		"headers":                    configObject,
+		"forward_headers":            configStrings,
+		"basic_auth_username":        configString,
+		"basic_auth_password":        configString,
+		"bearer_token":               configString,
+		"tls_client_cert_file":       configString,
+		"tls_client_key_file":        configString,
+		"tls_ca_file":                configString,
+		"retries":                    configNumber,
+		"retry_backoff":              configNumber,
+		"retry_statuses":             configNumbers,
+		"cache_max_size":             configNumber,
+		"cache_ttl":                  configNumber,
+		"not_found_ttl":              configNumber,
+		"not_found_cache_size":       configNumber,
+		"video_frames":               configBool,
+		"ffmpeg_path":                configString,
+		"options":                    configObject,
+	}
+
+	processorConfigSchema = configSchema{
+		"backend":                    configString,
+		"options":                    configObject,
+		"image_compression_quality":  configNumber,
+		"maintain_aspect_ratio":      configBool,
+		"default_scale_mode":         configString,
+		"default_image_width":        configNumber,
+		"default_image_height":       configNumber,
+		"max_image_width":            configNumber,
+		"max_image_height":           configNumber,
+		"max_source_pixels":          configNumber,
+		"max_source_frames":          configNumber,
+		"max_blur_radius_percentage": configNumber,
+		"auto_orient":                configBool,
+		"png_palette_colors":         configNumber,
+		"png_palette_dither":         configBool,
+		"auto_quality_threshold":     configNumber,
+		"chroma_subsampling":         configString,
+		"metadata":                   configString,
+		"max_sheet_tiles":            configNumber,
+		"blurhash_header":            configBool,
+		"background_color":           configString,
+		"resource_limits": configSchema{
+			"memory":  configNumber,
+			"map":     configNumber,
+			"disk":    configNumber,
+			"threads": configNumber,
+			"time":    configNumber,
+		},
+		"sharpen": configSchema{
+			"enabled":   configBool,
+			"radius":    configNumber,
+			"sigma":     configNumber,
+			"amount":    configNumber,
+			"threshold": configNumber,
+		},
+		"cache": cacheConfigSchema,
+		"formats": configMapOf{configSchema{
+			"width":  configNumber,
+			"height": configNumber,
+			"blur":   configNumber,
+		}},
+	}
+
+	routeConfigSchema = configSchema{
+		"name":                    configString,
+		"source":                  configStrings,
+		"processor":               configStrings,
+		"cache_control":           configString,
+		"expires":                 configNumber,
+		"stale_while_revalidate":  configNumber,
+		"surrogate_keys":          configString,
+		"surrogate_key_header":    configString,
+		"signing_keys":            configStrings,
+		"require_expires":         configBool,
+		"allow_uploads":           configBool,
+		"placeholder":             configString,
+		"placeholder_source":      configString,
+		"placeholder_status":      configNumber,
+		"defaults":                configObject,
+		"parameters":              configObject,
+		"rate_limit":              configNumber,
+		"rate_limit_burst":        configNumber,
+		"max_concurrent_requests": configNumber,
+		"request_queue_size":      configNumber,
+		"passthrough":             configBool,
+		"script":                  configString,
+		"client_hints":            configBool,
+		"auto_format":             configBool,
+		"auto_formats":            configStrings,
+		"limits": configSchema{
+			"widths":      configNumbers,
+			"heights":     configNumbers,
+			"max_width":   configNumber,
+			"max_height":  configNumber,
+			"max_blur":    configNumber,
+			"qualities":   configNumbers,
+			"min_quality": configNumber,
+			"max_quality": configNumber,
+			"formats":     configStrings,
+		},
+	}
+
+	configFileSchema = configSchema{
+		"server": configSchema{
+			"bind_address":            configString,
+			"port":                    configNumber,
+			"read_timeout":            configNumber,
+			"read_header_timeout":     configNumber,
+			"write_timeout":           configNumber,
+			"idle_timeout":            configNumber,
+			"max_header_bytes":        configNumber,
+			"disable_keep_alives":     configBool,
+			"disable_http2":           configBool,
+			"processing_workers":      configNumber,
+			"processing_queue_size":   configNumber,
+			"max_concurrent_requests": configNumber,
+			"request_queue_size":      configNumber,
+			"request_queue_timeout":   configNumber,
+			"processing_timeout":      configNumber,
+			"shutdown_timeout":        configNumber,
+			"admin_token":             configString,
+			"warm_up_webhook_secret":  configString,
+			"max_upload_size":         configNumber,
+			"metrics_port":            configNumber,
+			"debug_address":           configString,
+			"tls_cert_file":           configString,
+			"tls_key_file":            configString,
+			"tls_min_version":         configString,
+			"tls_reload":              configBool,
+			"liveness_path":           configString,
+			"readiness_path":          configString,
+			"access_log":              configString,
+			"access_log_format":       configString,
+			"cache_control":           configString,
+			"expires":                 configNumber,
+			"stale_while_revalidate":  configNumber,
+			"trusted_proxies":         configStrings,
+			"routes":                  configStrings,
+			"admin":                   configBool,
+			"listeners": configMapOf{configSchema{
+				"bind_address": configString,
+				"port":         configNumber,
+				"routes":       configStrings,
+				"admin":        configBool,
+			}},
+			"tracing": configSchema{
+				"endpoint":     configString,
+				"service_name": configString,
+				"sample_rate":  configNumber,
+			},
+		},
+		"statsd": configSchema{
+			"host":    configString,
+			"port":    configNumber,
+			"enabled": configBool,
+			"format":  configString,
+			"tags":    configObject,
+		},
+		"logging": configSchema{
+			"level":  configString,
+			"levels": configObject,
+		},
+		"plugins":    configStrings,
+		"sources":    configMapOf{sourceConfigSchema},
+		"processors": configMapOf{processorConfigSchema},
+		"routes":     configMapOf{routeConfigSchema},
+	}
+)
+
+// validateConfig returns all the problems of the configuration data, each
+// prefixed with the JSON path of the setting at fault.
+func validateConfig(data map[string]interface{}) []string {
+	v := &configValidator{data: data}
+	v.checkSchema("$", data, configFileSchema)
+	for _, section := range []string{"sources", "processors", "routes"} {
+		if _, ok := data[section].(map[string]interface{}); !ok {
+			v.problem(configPath("$", section), "missing, it must be an object")
+		}
+	}
+	v.checkServer()
+	v.checkSources()
+	v.checkProcessors()
+	v.checkRoutes()
+	v.checkListeners()
+	return v.problems
+}
+
+type configValidator struct {
+	data     map[string]interface{}
+	problems []string
+}
+
+func (v *configValidator) problem(path, format string, args ...interface{}) {
+	v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+// configIdentifierPattern matches the names written as is in JSON paths.
+var configIdentifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// configPath returns the JSON path of the setting name of the object at path.
+func configPath(path, name string) string {
+	if configIdentifierPattern.MatchString(name) {
+		return path + "." + name
+	}
+	return path + "[" + strconv.Quote(name) + "]"
+}
+
+// checkSchema checks the names and kinds of the settings of an object.
+func (v *configValidator) checkSchema(path string, data map[string]interface{}, schema configSchema) {
+	for _, name := range sortedConfigKeys(data) {
+		value := data[name]
+		settingPath := configPath(path, name)
+		expected, ok := schema[name]
+		if !ok {
+			if suggestion := closestConfigKey(name, schema); suggestion != "" {
+				v.problem(settingPath, "unknown setting, did you mean %q?", suggestion)
+			} else {
+				v.problem(settingPath, "unknown setting")
+			}
+			continue
+		}
+
+		switch expected := expected.(type) {
+		case configKind:
+			if !configValueIs(value, expected) {
+				v.problem(settingPath, "must be %s, not %s", expected, configValueKind(value))
+			}
+		case configSchema:
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				v.problem(settingPath, "must be %s, not %s", configObject, configValueKind(value))
+				continue
+			}
+			v.checkSchema(settingPath, object, expected)
+		case configMapOf:
+			objects, ok := value.(map[string]interface{})
+			if !ok {
+				v.problem(settingPath, "must be %s, not %s", configObject, configValueKind(value))
+				continue
+			}
+			for _, objectName := range sortedConfigKeys(objects) {
+				objectPath := configPath(settingPath, objectName)
+				object, ok := objects[objectName].(map[string]interface{})
+				if !ok {
+					v.problem(objectPath, "must be %s, not %s", configObject, configValueKind(objects[objectName]))
+					continue
+				}
+				v.checkSchema(objectPath, object, expected.schema)
+			}
+		}
+	}
+}
+
+func configValueIs(value interface{}, kind configKind) bool {
+	switch kind {
+	case configString:
+		_, ok := value.(string)
+		return ok
+	case configNumber:
+		number, ok := value.(float64)
+		return ok && number >= 0
+	case configBool:
+		_, ok := value.(bool)
+		return ok
+	case configObject:
+		_, ok := value.(map[string]interface{})
+		return ok
+	case configStrings, configNumbers:
+		element := configString
+		if kind == configNumbers {
+			element = configNumber
+		}
+		if configValueIs(value, element) {
+			return true
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, item := range list {
+			if !configValueIs(item, element) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func configValueKind(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return "a string"
+	case float64:
+		if value < 0 {
+			return "a negative number"
+		}
+		return "a number"
+	case bool:
+		return "a boolean"
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "an object"
+	}
+	return "null"
+}
+
+// closestConfigKey returns the setting of schema closest to the misspelled
+// name, if any is close enough.
+func closestConfigKey(name string, schema configSchema) string {
+	closest, closestDistance := "", 3
+	for key := range schema {
+		if distance := editDistance(name, key); distance < closestDistance ||
+			(distance == closestDistance && key < closest) {
+			closest, closestDistance = key, distance
+		}
+	}
+	return closest
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func sortedConfigKeys(data map[string]interface{}) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ownSetting returns the setting name of the object in section, if it is set
+// on the object itself.
+func (v *configValidator) ownSetting(section, objectName, name string) (interface{}, bool) {
+	objects, _ := v.data[section].(map[string]interface{})
+	object, _ := objects[objectName].(map[string]interface{})
+	value, ok := object[name]
+	return value, ok
+}
+
+// inheritedSetting returns the setting name of the object in section, or of
+// its default object if it isn't set.
+func (v *configValidator) inheritedSetting(section, objectName, name string) interface{} {
+	if value, ok := v.ownSetting(section, objectName, name); ok {
+		return value
+	}
+	value, _ := v.ownSetting(section, "default", name)
+	return value
+}
+
+func (v *configValidator) checkServer() {
+	server, _ := v.data["server"].(map[string]interface{})
+	if format, ok := server["access_log_format"].(string); ok {
+		switch AccessLogFormat(format) {
+		case AccessLogFormatCommon, AccessLogFormatCombined, AccessLogFormatJSON:
+		default:
+			v.problem("$.server.access_log_format", "must be %q, %q or %q", AccessLogFormatCommon,
+				AccessLogFormatCombined, AccessLogFormatJSON)
+		}
+	}
+	if version, ok := server["tls_min_version"].(string); ok {
+		if _, ok := tlsVersions[version]; !ok {
+			v.problem("$.server.tls_min_version", "must be \"1.0\", \"1.1\", \"1.2\" or \"1.3\"")
+		}
+	}
+	_, hasCertFile := server["tls_cert_file"]
+	_, hasKeyFile := server["tls_key_file"]
+	if hasCertFile != hasKeyFile {
+		v.problem("$.server", "tls_cert_file and tls_key_file must be set together")
+	}
+	if _, ok := server["max_concurrent_requests"]; !ok {
+		for _, name := range []string{"request_queue_size", "request_queue_timeout"} {
+			if _, ok := server[name]; ok {
+				v.problem(configPath("$.server", name), "has no effect without max_concurrent_requests")
+			}
+		}
+	}
+	switch proxies := server["trusted_proxies"].(type) {
+	case string:
+		if _, err := ParseTrustedProxies([]string{proxies}); err != nil {
+			v.problem("$.server.trusted_proxies", "%v", err)
+		}
+	case []interface{}:
+		for i, proxy := range proxies {
+			proxy, _ := proxy.(string)
+			if _, err := ParseTrustedProxies([]string{proxy}); err != nil {
+				v.problem(fmt.Sprintf("$.server.trusted_proxies[%d]", i), "%v", err)
+			}
+		}
+	}
+	tracing, _ := server["tracing"].(map[string]interface{})
+	if sampleRate, ok := tracing["sample_rate"].(float64); ok && sampleRate > 1 {
+		v.problem("$.server.tracing.sample_rate", "must be between 0 and 1")
+	}
+
+	statsd, _ := v.data["statsd"].(map[string]interface{})
+	if format, ok := statsd["format"].(string); ok &&
+		StatterFormat(format) != StatterFormatStatsD && StatterFormat(format) != StatterFormatDogStatsD {
+		v.problem("$.statsd.format", "must be %q or %q", StatterFormatStatsD, StatterFormatDogStatsD)
+	}
+
+	logging, _ := v.data["logging"].(map[string]interface{})
+	if level, ok := logging["level"].(string); ok {
+		if _, err := ParseLogLevel(level); err != nil {
+			v.problem("$.logging.level", "%v", err)
+		}
+	}
+	levels, _ := logging["levels"].(map[string]interface{})
+	for _, pattern := range sortedConfigKeys(levels) {
+		level, _ := levels[pattern].(string)
+		if _, err := ParseLogLevel(level); err != nil {
+			v.problem(configPath("$.logging.levels", pattern), "%v", err)
+		}
+	}
+}
+
+func (v *configValidator) checkSources() {
+	sources, _ := v.data["sources"].(map[string]interface{})
+	for _, name := range sortedConfigKeys(sources) {
+		path := configPath("$.sources", name)
+		// Inherited settings are checked on the default source.
+		if sourceType, ok := v.ownSetting("sources", name, "type"); ok {
+			sourceType, _ := sourceType.(string)
+			if _, ok := imageSourceTypeToFactoryFunctionMap[ImageSourceType(sourceType)]; !ok {
+				v.problem(configPath(path, "type"), "unknown source type %q", sourceType)
+			}
+		} else if v.inheritedSetting("sources", name, "type") == nil {
+			v.problem(path, "no type set, neither on the source nor on the default source")
+		}
+		if policy, ok := v.ownSetting("sources", name, "redirect_policy"); ok {
+			policy, _ := policy.(string)
+			if !RedirectPolicies[policy] {
+				v.problem(configPath(path, "redirect_policy"), "unknown redirect policy %q, it must be follow, same_host or none", policy)
+			}
+		}
+		if proxy, ok := v.ownSetting("sources", name, "proxy"); ok {
+			proxy, _ := proxy.(string)
+			if _, err := parseProxyURL(proxy); err != nil {
+				v.problem(configPath(path, "proxy"), "invalid proxy URL %q", proxy)
+			}
+		}
+		if expires, ok := v.ownSetting("sources", name, "s3_presign_expires"); ok {
+			if expires, _ := expires.(float64); expires > maxS3PresignExpires {
+				v.problem(configPath(path, "s3_presign_expires"), "%v exceeds the maximum of %d seconds", expires, maxS3PresignExpires)
+			}
+		}
+	}
+}
+
+func (v *configValidator) checkProcessors() {
+	processors, _ := v.data["processors"].(map[string]interface{})
+	for _, name := range sortedConfigKeys(processors) {
+		path := configPath("$.processors", name)
+		// Inherited settings are checked on the default processor.
+		if backend, ok := v.ownSetting("processors", name, "backend"); ok {
+			backend, _ := backend.(string)
+			if _, ok := imageProcessorBackendToFactoryFunctionMap[ImageProcessorBackend(backend)]; !ok {
+				v.problem(configPath(path, "backend"), "unknown or unavailable backend %q", backend)
+			}
+		}
+		if scaleMode, ok := v.ownSetting("processors", name, "default_scale_mode"); ok {
+			scaleMode, _ := scaleMode.(string)
+			if _, ok := ScaleModes[scaleMode]; !ok {
+				v.problem(configPath(path, "default_scale_mode"), "unknown scale mode %q", scaleMode)
+			}
+		}
+		if subsampling, ok := v.ownSetting("processors", name, "chroma_subsampling"); ok {
+			subsampling, _ := subsampling.(string)
+			if parseChromaSubsampling(subsampling) == "" {
+				v.problem(configPath(path, "chroma_subsampling"), "unknown chroma subsampling %q, it must be 4:4:4, 4:2:2 or 4:2:0", subsampling)
+			}
+		}
+		if metadata, ok := v.ownSetting("processors", name, "metadata"); ok {
+			metadata, _ := metadata.(string)
+			if !MetadataModes[metadata] {
+				v.problem(configPath(path, "metadata"), "unknown metadata mode %q, it must be strip or scrub", metadata)
+			}
+		}
+		for _, dimension := range []string{"width", "height"} {
+			_, ownDefault := v.ownSetting("processors", name, "default_image_"+dimension)
+			_, ownMax := v.ownSetting("processors", name, "max_image_"+dimension)
+			defaultValue, _ := v.inheritedSetting("processors", name, "default_image_"+dimension).(float64)
+			maxValue, _ := v.inheritedSetting("processors", name, "max_image_"+dimension).(float64)
+			if (ownDefault || ownMax) && maxValue > 0 && defaultValue > maxValue {
+				v.problem(configPath(path, "default_image_"+dimension), "%v exceeds max_image_%s %v",
+					defaultValue, dimension, maxValue)
+			}
+		}
+	}
+}
+
+func (v *configValidator) checkRoutes() {
+	sources, _ := v.data["sources"].(map[string]interface{})
+	processors, _ := v.data["processors"].(map[string]interface{})
+	routes, _ := v.data["routes"].(map[string]interface{})
+
+	checkReferences := func(path string, value interface{}, section string, objects map[string]interface{}) {
+		var references []string
+		switch value := value.(type) {
+		case nil:
+			v.problem(path, "missing, it must be %s", configStrings)
+		case string:
+			references = []string{value}
+		case []interface{}:
+			if len(value) == 0 {
+				v.problem(path, "must not be empty")
+			}
+			for _, reference := range value {
+				if reference, ok := reference.(string); ok {
+					references = append(references, reference)
+				}
+			}
+		}
+		for _, reference := range references {
+			if _, ok := objects[reference]; !ok {
+				v.problem(path, "no %s named %q", section, reference)
+			}
+		}
+	}
+
+	for _, patternString := range sortedConfigKeys(routes) {
+		path := configPath("$.routes", patternString)
+		route, ok := routes[patternString].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		pattern, err := regexp.Compile(patternString)
+		if err != nil {
+			v.problem(path, "invalid pattern: %v", err)
+		} else if !configPatternHasImagePath(pattern) {
+			v.problem(path, "the pattern has no 'image_path' named group")
+		}
+
+		if name, _ := route["name"].(string); name == "" {
+			v.problem(configPath(path, "name"), "missing, it must be a non-empty string")
+		}
+
+		checkReferences(configPath(path, "source"), route["source"], "source", sources)
+		checkReferences(configPath(path, "processor"), route["processor"], "processor", processors)
+		if placeholderSource, ok := route["placeholder_source"].(string); ok {
+			if _, ok := sources[placeholderSource]; !ok {
+				v.problem(configPath(path, "placeholder_source"), "no source named %q", placeholderSource)
+			}
+		}
+		if _, ok := route["rate_limit"]; !ok {
+			if _, ok := route["rate_limit_burst"]; ok {
+				v.problem(configPath(path, "rate_limit_burst"), "has no effect without rate_limit")
+			}
+		}
+		v.checkParameterLimits(configPath(path, "limits"), route["limits"])
+		v.checkAutoFormats(configPath(path, "auto_formats"), route["auto_formats"])
+		if _, ok := route["max_concurrent_requests"]; !ok {
+			if _, ok := route["request_queue_size"]; ok {
+				v.problem(configPath(path, "request_queue_size"), "has no effect without max_concurrent_requests")
+			}
+		}
+	}
+}
+
+// checkParameterLimits checks that the formats of a route's limits exist.
+func (v *configValidator) checkParameterLimits(path string, value interface{}) {
+	limits, _ := value.(map[string]interface{})
+	var formats []interface{}
+	switch value := limits["formats"].(type) {
+	case string:
+		formats = []interface{}{value}
+	case []interface{}:
+		formats = value
+	}
+	for _, format := range formats {
+		if format, ok := format.(string); ok {
+			if _, ok := OutputFormats[strings.ToLower(format)]; !ok {
+				v.problem(configPath(path, "formats"), "unknown format %q", format)
+			}
+		}
+	}
+}
+
+// checkAutoFormats checks that a route negotiates formats that are encoded
+// and have a media type of their own.
+func (v *configValidator) checkAutoFormats(path string, value interface{}) {
+	var formats []interface{}
+	switch value := value.(type) {
+	case string:
+		formats = []interface{}{value}
+	case []interface{}:
+		formats = value
+	}
+	for _, format := range formats {
+		if format, ok := format.(string); ok {
+			if _, ok := OutputFormats[strings.ToLower(format)]; !ok || strings.EqualFold(format, "jpg") {
+				v.problem(path, "unknown format %q", format)
+			}
+		}
+	}
+}
+
+// checkListeners checks that the listeners serve existing routes.
+func (v *configValidator) checkListeners() {
+	routeNames := make(map[string]interface{})
+	routes, _ := v.data["routes"].(map[string]interface{})
+	for _, route := range routes {
+		route, _ := route.(map[string]interface{})
+		if name, ok := route["name"].(string); ok {
+			routeNames[name] = route
+		}
+	}
+
+	checkRouteNames := func(path string, value interface{}) {
+		var names []interface{}
+		switch value := value.(type) {
+		case string:
+			names = []interface{}{value}
+		case []interface{}:
+			names = value
+		}
+		for _, name := range names {
+			if name, ok := name.(string); ok {
+				if _, ok := routeNames[name]; !ok {
+					v.problem(path, "no route named %q", name)
+				}
+			}
+		}
+	}
+
+	server, _ := v.data["server"].(map[string]interface{})
+	checkRouteNames("$.server.routes", server["routes"])
+	listeners, _ := server["listeners"].(map[string]interface{})
+	for _, name := range sortedConfigKeys(listeners) {
+		listener, _ := listeners[name].(map[string]interface{})
+		path := configPath("$.server.listeners", name)
+		checkRouteNames(configPath(path, "routes"), listener["routes"])
+		if _, ok := listener["port"]; !ok {
+			v.problem(configPath(path, "port"), "missing, it must be %s", configNumber)
+		}
+	}
+}
+
+func configPatternHasImagePath(pattern *regexp.Regexp) bool {
+	for _, name := range pattern.SubexpNames() {
+		if name == "image_path" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package halfshell implements the Halfshell image server. Besides running the
+// server, it can be used as a library to retrieve and process images in other
+// programs:
+//
+//	halfshell.Initialize()
+//	defer halfshell.Terminate()
+//
+//	sourceConfig := halfshell.NewSourceConfig("images", halfshell.ImageSourceTypeS3)
+//	sourceConfig.S3Bucket = "my-images"
+//	source, err := halfshell.NewImageSource(sourceConfig, nil)
+//
+//	processorConfig := halfshell.NewProcessorConfig("thumbnails")
+//	processor, err := halfshell.NewImageProcessor(processorConfig)
+//
+//	options, err := halfshell.ParseImageProcessorOptions(query, processorConfig)
+//	image, err := source.GetImage(ctx, &halfshell.ImageSourceOptions{
+//		Path:   "/photo.jpg",
+//		Limits: processorConfig.ImageLimits(),
+//	})
+//	defer image.Destroy()
+//	err = processor.ProcessImage(ctx, image, options)
+//	data, _ := image.GetBytes()
+//
+// The constructors taking a configuration return errors, unlike their
+// WithConfig counterparts used by the server, which exit. Logs are written to
+// the standard output unless redirected with SetLogOutput, and filtered with
+// SetLogLevel and SetComponentLogLevel.
+//
+// Custom builds of the server can take part in the handling of requests with
+// hooks registered with RegisterHook, e.g. to check authorization:
+//
+//	type authHook struct{}
+//
+//	func (authHook) PreFetch(w *halfshell.ResponseWriter, r *halfshell.Request) error {
+//		if r.Header.Get("X-Api-Key") != apiKey {
+//			return halfshell.NewHTTPError("Forbidden", http.StatusForbidden)
+//		}
+//		return nil
+//	}
+//
+//	func init() {
+//		halfshell.RegisterHook(authHook{})
+//	}
+package halfshell
@@ -21,10 +21,18 @@
 package halfshell
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"text/template"
-
-	"github.com/rafikk/imagick/imagick"
+	"time"
 )
 
 // Halfshell is the primary struct of the program. It holds onto the
@@ -35,21 +43,125 @@ type Halfshell struct {
 	Routes []*Route
 	Server *Server
 	Logger *Logger
+
+	// ConfigPath is the file the configuration is reloaded from. The
+	// configuration can't be reloaded if it is empty.
+	ConfigPath string
+
+	// Overrides, if set, is applied to reloaded configurations, e.g. to keep
+	// the settings given on the command line.
+	Overrides func(*Config)
+
+	// caches are the caches of the routes by configuration, which are kept
+	// across reloads.
+	caches    map[CacheConfig]Cache
+	reloading sync.Mutex
 }
 
 // NewWithConfig creates a new Halfshell instance from an instance of Config.
 func NewWithConfig(config *Config) *Halfshell {
+	h := &Halfshell{
+		Pid:    os.Getpid(),
+		Config: config,
+		Logger: NewLogger("main"),
+	}
+
+	routes, caches, err := h.newRoutes(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	h.Routes = routes
+	h.caches = caches
+	h.Server = NewServerWithConfigAndRoutes(config.ServerConfig, routes)
+	h.Server.Reload = h.Reload
+	return h
+}
+
+// newRoutes creates the routes of config and their caches, and applies its
+// log levels. The current caches are reused for unchanged cache
+// configurations, but only the caches the routes use are returned.
+func (h *Halfshell) newRoutes(config *Config) ([]*Route, map[CacheConfig]Cache, error) {
 	routes := make([]*Route, 0, len(config.RouteConfigs))
+	caches := make(map[CacheConfig]Cache)
 	for _, routeConfig := range config.RouteConfigs {
-		routes = append(routes, NewRouteWithConfig(routeConfig, config.StatterConfig))
+		route, err := NewRoute(routeConfig, config.StatterConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid route %s: %v", routeConfig.Name, err)
+		}
+
+		// Routes with the same cache configuration, such as one inherited
+		// from the default processor, share a cache. Cache keys are prefixed
+		// with the route name, so entries don't collide.
+		cacheConfig := routeConfig.ProcessorConfig.Cache
+		cache, ok := caches[cacheConfig]
+		if !ok {
+			cache, ok = h.caches[cacheConfig]
+		}
+		if !ok {
+			cache, err = NewCache(&cacheConfig)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Invalid cache: %v", err)
+			}
+		}
+		caches[cacheConfig] = cache
+		route.Cache = cache
+
+		routes = append(routes, route)
 	}
 
-	return &Halfshell{
-		Pid:    os.Getpid(),
-		Config: config,
-		Routes: routes,
-		Server: NewServerWithConfigAndRoutes(config.ServerConfig, routes),
-		Logger: NewLogger("main"),
+	if config.LogConfig != nil {
+		setLogLevels(config.LogConfig.Level, config.LogConfig.ComponentLevels)
+	}
+	return routes, caches, nil
+}
+
+// Reload reloads the configuration file and replaces the routes, sources and
+// processors of the running server. Caches with an unchanged configuration
+// are kept. Server settings, such as the port, only change on restart. The
+// running configuration is kept if the new one is invalid.
+func (h *Halfshell) Reload() error {
+	if h.ConfigPath == "" {
+		return errors.New("No configuration file to reload")
+	}
+
+	h.reloading.Lock()
+	defer h.reloading.Unlock()
+
+	config, err := LoadConfigFromFile(h.ConfigPath)
+	if err != nil {
+		return err
+	}
+	if h.Overrides != nil {
+		h.Overrides(config)
+	}
+	// The caches are only replaced once the new configuration is known to be
+	// valid, so caches no route uses any more are dropped.
+	routes, caches, err := h.newRoutes(config)
+	if err != nil {
+		return err
+	}
+
+	config.ServerConfig = h.Config.ServerConfig
+	h.Config = config
+	h.Routes = routes
+	h.caches = caches
+	h.applyResourceLimits()
+	h.Server.SetRoutes(routes)
+	h.Logger.Infof("Reloaded configuration from %s with %d routes", h.ConfigPath, len(routes))
+	return nil
+}
+
+// reloadOnSignal reloads the configuration whenever the process receives
+// SIGHUP.
+func (h *Halfshell) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		err := h.Reload()
+		if err != nil {
+			h.Logger.Errorf("Unable to reload configuration: %v", err)
+		}
 	}
 }
 
@@ -59,8 +171,113 @@ func (h *Halfshell) Run() {
 	var tmpl, _ = template.New("start").Parse(StartupTemplateString)
 	_ = tmpl.Execute(os.Stdout, h)
 
-	imagick.Initialize()
-	defer imagick.Terminate()
+	Initialize()
+	defer Terminate()
+
+	h.applyResourceLimits()
+
+	if h.Config.ServerConfig.MetricsPort > 0 {
+		go h.serveMetrics()
+	}
+	if h.Config.ServerConfig.DebugAddress != "" {
+		go h.serveDebug()
+	}
+
+	drained := make(chan struct{})
+	go h.drainOnSignal(drained)
+	go h.reloadOnSignal()
+
+	for _, listener := range h.Server.Listeners {
+		go func(listener *http.Server) {
+			err := listenAndServe(listener)
+			if err != http.ErrServerClosed {
+				h.Logger.Errorf("Unable to listen on %s: %v", listener.Addr, err)
+			}
+		}(listener)
+	}
+
+	err := listenAndServe(h.Server.Server)
+	if err != http.ErrServerClosed {
+		h.Logger.Errorf("Server stopped: %v", err)
+		return
+	}
+	<-drained
+}
+
+// listenAndServe serves the connections of a listener, with TLS if it is
+// configured.
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// drainOnSignal stops the server gracefully once the process receives
+// SIGTERM or SIGINT, and closes drained once the requests in progress have
+// been answered or the shutdown timeout has passed.
+func (h *Halfshell) drainOnSignal(drained chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	signal.Stop(signals)
+
+	timeout := time.Duration(h.Config.ServerConfig.ShutdownTimeout) * time.Second
+	h.Logger.Infof("Received %v, draining requests for up to %v", sig, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := h.Server.Drain(ctx)
+	if err != nil {
+		h.Logger.Warnf("Requests still in progress at shutdown: %v", err)
+	}
+	close(drained)
+}
 
-	h.Server.ListenAndServe()
+// serveMetrics serves the Prometheus metrics on the metrics port, apart from
+// the image requests.
+func (h *Halfshell) serveMetrics() {
+	DefaultMetrics.SetGauge("halfshell_imagemagick_memory_bytes", "Memory allocated by ImageMagick.",
+		func() float64 { return float64(imageMagickResource(imageMagickMemory)) })
+	DefaultMetrics.SetGauge("halfshell_imagemagick_map_bytes", "Memory mapped by ImageMagick.",
+		func() float64 { return float64(imageMagickResource(imageMagickMap)) })
+	DefaultMetrics.SetGauge("halfshell_processing_workers_active", "Images being processed.",
+		func() float64 { return float64(h.Server.WorkerPool.Active()) })
+	DefaultMetrics.SetGauge("halfshell_requests_in_flight", "Image requests being handled.",
+		func() float64 { return float64(h.Server.RequestPool.Active()) })
+	DefaultMetrics.SetGauge("halfshell_requests_queued", "Image requests waiting to be handled.",
+		func() float64 { return float64(h.Server.RequestPool.Queued()) })
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", DefaultMetrics)
+	address := fmt.Sprintf(":%d", h.Config.ServerConfig.MetricsPort)
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		h.Logger.Errorf("Unable to serve metrics on %s: %v", address, err)
+	}
+}
+
+// serveDebug serves the pprof profiles and the expvar variables on the debug
+// address, apart from the image requests.
+func (h *Halfshell) serveDebug() {
+	expvar.Publish("imagemagick_memory_bytes", expvar.Func(func() interface{} {
+		return imageMagickResource(imageMagickMemory)
+	}))
+	expvar.Publish("imagemagick_map_bytes", expvar.Func(func() interface{} {
+		return imageMagickResource(imageMagickMap)
+	}))
+	expvar.Publish("processing_workers_active", expvar.Func(func() interface{} {
+		return h.Server.WorkerPool.Active()
+	}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	err := http.ListenAndServe(h.Config.ServerConfig.DebugAddress, mux)
+	if err != nil {
+		h.Logger.Errorf("Unable to serve debug endpoints on %s: %v", h.Config.ServerConfig.DebugAddress, err)
+	}
 }
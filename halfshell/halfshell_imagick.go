@@ -0,0 +1,127 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+// +build cgo
+
+package halfshell
+
+import (
+	"sync/atomic"
+
+	"github.com/rafikk/imagick/imagick"
+)
+
+// limitedResources are the ImageMagick resources configured by the
+// processors' resource_limits.
+var limitedResources = []imagick.ResourceType{
+	imagick.RESOURCE_MEMORY,
+	imagick.RESOURCE_MAP,
+	imagick.RESOURCE_DISK,
+	imagick.RESOURCE_THREAD,
+	imagick.RESOURCE_TIME,
+}
+
+// defaultResourceLimits are the ImageMagick resource limits in place before
+// any were applied, restored when a reloaded configuration no longer limits a
+// resource.
+var defaultResourceLimits map[imagick.ResourceType]int64
+
+// Initialize initializes ImageMagick. Programs using the package as a library
+// must call it before processing images, and Terminate once they are done.
+func Initialize() {
+	imagick.Initialize()
+	if defaultResourceLimits == nil {
+		defaultResourceLimits = make(map[imagick.ResourceType]int64)
+		for _, resource := range limitedResources {
+			defaultResourceLimits[resource] = imagick.GetResourceLimit(resource)
+		}
+	}
+	atomic.StoreInt32(&imagickInitialized, 1)
+}
+
+// Terminate releases the resources of ImageMagick.
+func Terminate() {
+	atomic.StoreInt32(&imagickInitialized, 0)
+	imagick.Terminate()
+}
+
+// applyResourceLimits sets the ImageMagick resource limits. The limits are
+// global to the process, so the most restrictive limit configured by any of
+// the routes' processors is used. Resources no processor limits are set back
+// to their default limits, so the limits can be applied again after the
+// configuration is reloaded.
+func (h *Halfshell) applyResourceLimits() {
+	limits := make(map[imagick.ResourceType]int64)
+	setLimit := func(resource imagick.ResourceType, value uint64, unit int64) {
+		if value == 0 {
+			return
+		}
+		limit := int64(value) * unit
+		if current, ok := limits[resource]; !ok || limit < current {
+			limits[resource] = limit
+		}
+	}
+
+	for _, routeConfig := range h.Config.RouteConfigs {
+		for _, processorConfig := range routeConfig.ProcessorConfigs {
+			resourceLimits := processorConfig.ResourceLimits
+			setLimit(imagick.RESOURCE_MEMORY, resourceLimits.Memory, 1<<20)
+			setLimit(imagick.RESOURCE_MAP, resourceLimits.Map, 1<<20)
+			setLimit(imagick.RESOURCE_DISK, resourceLimits.Disk, 1<<20)
+			setLimit(imagick.RESOURCE_THREAD, resourceLimits.Threads, 1)
+			setLimit(imagick.RESOURCE_TIME, resourceLimits.Time, 1)
+		}
+	}
+
+	for _, resource := range limitedResources {
+		limit, ok := limits[resource]
+		if !ok {
+			limit, ok = defaultResourceLimits[resource]
+		}
+		if !ok {
+			continue
+		}
+		err := imagick.SetResourceLimit(resource, limit)
+		if err != nil {
+			h.Logger.Errorf("Unable to set ImageMagick resource limit %d: %v", resource, err)
+		}
+	}
+}
+
+// The ImageMagick resources reported in the metrics.
+const (
+	imageMagickMemory = imagick.RESOURCE_MEMORY
+	imageMagickMap    = imagick.RESOURCE_MAP
+)
+
+// imageMagickResource returns the amount of resource used by ImageMagick.
+func imageMagickResource(resource imagick.ResourceType) int64 {
+	return imagick.GetResource(resource)
+}
+
+// imageMagickVersion returns the version of ImageMagick.
+func imageMagickVersion() string {
+	version, _ := imagick.GetVersion()
+	return version
+}
+
+// defaultImageProcessorBackend is the backend of processors without one.
+const defaultImageProcessorBackend = ImageProcessorBackendImageMagick
@@ -0,0 +1,96 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readinessTimeout bounds the time spent checking the sources for readiness.
+const readinessTimeout = 2 * time.Second
+
+// imagickInitialized is set while ImageMagick is initialized.
+var imagickInitialized int32
+
+// LivenessHandler answers liveness probes, which only require the process to
+// serve requests.
+func (s *Server) LivenessHandler(w *ResponseWriter, r *Request) {
+	w.WriteText("OK")
+}
+
+// ReadinessHandler answers readiness probes. The server is ready if
+// ImageMagick is initialized, the worker pool accepts requests and the
+// routes' sources are reachable. Otherwise, the failed checks are listed in a
+// 503 Service Unavailable response.
+func (s *Server) ReadinessHandler(w *ResponseWriter, r *Request) {
+	var failures []string
+	if atomic.LoadInt32(&imagickInitialized) == 0 {
+		failures = append(failures, "ImageMagick is not initialized")
+	}
+	if s.WorkerPool.Saturated() {
+		failures = append(failures, "Worker pool is saturated")
+	}
+	failures = append(failures, s.checkSources(r.Context())...)
+
+	if len(failures) > 0 {
+		s.Logger.Warnf("Not ready: %s", strings.Join(failures, "; "))
+		w.WriteError(strings.Join(failures, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteText("OK")
+}
+
+// checkSources checks the sources of the routes concurrently and returns
+// their failures.
+func (s *Server) checkSources(ctx context.Context) []string {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures []string
+	)
+	check := func(routeName string, source ImageSource) {
+		defer wg.Done()
+		if err := CheckSourceHealth(ctx, source); err != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			failures = append(failures, fmt.Sprintf("Source of route %s is unreachable: %v", routeName, err))
+		}
+	}
+	for _, route := range s.routes() {
+		wg.Add(1)
+		go check(route.Name, route.Source)
+		if route.PlaceholderSource != nil {
+			wg.Add(1)
+			go check(route.Name, route.PlaceholderSource)
+		}
+	}
+	wg.Wait()
+	return failures
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+)
+
+// Hooks let custom builds take part in the handling of image requests, e.g.
+// to check authorization, rewrite processing options or add response
+// headers, without changing the server. A hook implements any of the
+// following interfaces, and is registered with RegisterHook. Hooks returning
+// an error end the request with it: an HTTPError is written as is, other
+// errors as a 500 Internal Server Error.
+
+// PreFetchHook is called before the image of a request is retrieved from the
+// source, or read from the cache. It may change the request's source and
+// processing options, which determine the derivative served.
+type PreFetchHook interface {
+	PreFetch(w *ResponseWriter, r *Request) error
+}
+
+// PostFetchHook is called once the original image has been retrieved from
+// the source. It isn't called for derivatives served from the cache, and is
+// called once for concurrent requests sharing a fetch.
+type PostFetchHook interface {
+	PostFetch(r *Request, image *Image) error
+}
+
+// PreProcessHook is called before an image, retrieved or uploaded, is
+// processed. It may modify the image, as long as it does so the same way for
+// the same processing options, since the result is cached.
+type PreProcessHook interface {
+	PreProcess(r *Request, image *Image) error
+}
+
+// PostProcessHook is called before a processed image is written, whether it
+// was processed for the request or served from the cache.
+type PostProcessHook interface {
+	PostProcess(w *ResponseWriter, r *Request, image *ProcessedImage) error
+}
+
+var (
+	preFetchHooks    []PreFetchHook
+	postFetchHooks   []PostFetchHook
+	preProcessHooks  []PreProcessHook
+	postProcessHooks []PostProcessHook
+)
+
+// RegisterHook registers hook for each of the hook interfaces it implements.
+// Hooks are called in the order they were registered. Like sources, hooks
+// must be registered before the server starts, e.g. in an init function.
+func RegisterHook(hook interface{}) {
+	registered := false
+	if h, ok := hook.(PreFetchHook); ok {
+		preFetchHooks = append(preFetchHooks, h)
+		registered = true
+	}
+	if h, ok := hook.(PostFetchHook); ok {
+		postFetchHooks = append(postFetchHooks, h)
+		registered = true
+	}
+	if h, ok := hook.(PreProcessHook); ok {
+		preProcessHooks = append(preProcessHooks, h)
+		registered = true
+	}
+	if h, ok := hook.(PostProcessHook); ok {
+		postProcessHooks = append(postProcessHooks, h)
+		registered = true
+	}
+	if !registered {
+		panic(fmt.Sprintf("halfshell: %T implements no hook interface", hook))
+	}
+}
+
+func runPreFetchHooks(w *ResponseWriter, r *Request) error {
+	for _, hook := range preFetchHooks {
+		if err := hook.PreFetch(w, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runPostFetchHooks(r *Request, image *Image) error {
+	for _, hook := range postFetchHooks {
+		if err := hook.PostFetch(r, image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runPreProcessHooks(r *Request, image *Image) error {
+	for _, hook := range preProcessHooks {
+		if err := hook.PreProcess(r, image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runPostProcessHooks(w *ResponseWriter, r *Request, image *ProcessedImage) error {
+	for _, hook := range postProcessHooks {
+		if err := hook.PostProcess(w, r, image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
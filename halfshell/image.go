@@ -21,39 +21,78 @@
 package halfshell
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"strconv"
 	"strings"
-
-	"github.com/rafikk/imagick/imagick"
+	"time"
 )
 
 var EmptyImageDimensions = ImageDimensions{}
 var EmptyResizeDimensions = ResizeDimensions{}
 var DefaultFocalPoint = Focalpoint{0.5, 0.5}
+var EmptyImageRegion = ImageRegion{}
 
+// Image is an image being served. Images read for ImageMagick hold the
+// decoded image in Wand. Images read for the go backend, or in binaries built
+// without cgo, have no wand and are kept encoded.
 type Image struct {
-	Wand      *imagick.MagickWand
+	Wand      *magickWand
 	Signature string
 	destroyed bool
+
+	// LastModified is the modification time of the original image reported
+	// by its source, if known.
+	LastModified time.Time
+
+	// blob holds the encoded bytes the image was read from, until the wand is
+	// modified. It is the image itself for images without a wand.
+	blob []byte
+}
+
+// ErrImageTooLarge is returned when an image exceeds the configured ImageLimits.
+var ErrImageTooLarge = errors.New("Image exceeds the maximum pixel or frame count")
+
+// ImageLimits bounds the size of images that are decoded. A value of 0 sets no
+// limit.
+type ImageLimits struct {
+	MaxPixels uint64
+	MaxFrames uint64
 }
 
 func NewImageFromBuffer(buffer io.Reader) (image *Image, err error) {
+	return NewImageFromBufferWithLimits(buffer, ImageLimits{})
+}
+
+// NewEncodedImageFromBuffer reads an image without decoding it, returning
+// ErrImageTooLarge if its header reports more pixels or frames than allowed.
+// The image is decoded by the processor, e.g. the go backend.
+func NewEncodedImageFromBuffer(buffer io.Reader, limits ImageLimits) (*Image, error) {
 	bytes, err := ioutil.ReadAll(buffer)
 	if err != nil {
 		return nil, err
 	}
 
-	image = &Image{Wand: imagick.NewMagickWand()}
-	err = image.Wand.ReadImageBlob(bytes)
+	err = checkImageLimits(bytes, limits)
 	if err != nil {
 		return nil, err
 	}
 
-	return image, nil
+	return &Image{blob: bytes}, nil
+}
+
+// NewRawImageFromBuffer reads the encoded bytes of an image without decoding
+// them. The image has no wand, so it can only be served as is.
+func NewRawImageFromBuffer(buffer io.Reader) (*Image, error) {
+	bytes, err := ioutil.ReadAll(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return &Image{blob: bytes}, nil
 }
 
 func NewImageFromFile(file *os.File) (image *Image, err error) {
@@ -61,42 +100,41 @@ func NewImageFromFile(file *os.File) (image *Image, err error) {
 	return image, err
 }
 
-func (i *Image) GetMIMEType() string {
-	return fmt.Sprintf("image/%s", strings.ToLower(i.Wand.GetImageFormat()))
-}
-
-func (i *Image) GetBytes() (bytes []byte, size int) {
-	bytes = i.Wand.GetImageBlob()
-	size = len(bytes)
-	return bytes, size
-}
-
-func (i *Image) GetWidth() uint {
-	return i.Wand.GetImageWidth()
-}
-
-func (i *Image) GetHeight() uint {
-	return i.Wand.GetImageHeight()
+// NewImageFromFileWithLimits reads an image from a file, subject to limits.
+func NewImageFromFileWithLimits(file *os.File, limits ImageLimits) (image *Image, err error) {
+	return NewImageFromBufferWithLimits(file, limits)
 }
 
 func (i *Image) GetDimensions() ImageDimensions {
 	return ImageDimensions{i.GetWidth(), i.GetHeight()}
 }
 
-func (i *Image) GetSignature() string {
-	return i.Wand.GetImageSignature()
+type ImageDimensions struct {
+	Width  uint
+	Height uint
 }
 
-func (i *Image) Destroy() {
-	if !i.destroyed {
-		i.Wand.Destroy()
-		i.destroyed = true
+// NewImageDimensionsFromString parses ImageDimensions from a string of the
+// form "WxH". Either side may be omitted, e.g. "800x" or "x600".
+func NewImageDimensionsFromString(s string) (ImageDimensions, error) {
+	components := strings.Split(s, "x")
+	if len(components) > 2 {
+		return EmptyImageDimensions, fmt.Errorf("Invalid dimensions: %s", s)
 	}
-}
 
-type ImageDimensions struct {
-	Width  uint
-	Height uint
+	var values [2]uint
+	for i, component := range components {
+		if component == "" {
+			continue
+		}
+		value, err := strconv.ParseUint(component, 10, 32)
+		if err != nil {
+			return EmptyImageDimensions, fmt.Errorf("Invalid dimensions: %s", s)
+		}
+		values[i] = uint(value)
+	}
+
+	return ImageDimensions{values[0], values[1]}, nil
 }
 
 func (d ImageDimensions) AspectRatio() float64 {
@@ -107,6 +145,25 @@ func (d ImageDimensions) String() string {
 	return fmt.Sprintf("%dx%d", d.Width, d.Height)
 }
 
+// ImageScale holds dimensions relative to those of the original image, as
+// fractions of them. A fraction of 0 is unspecified.
+type ImageScale struct {
+	Width  float64
+	Height float64
+}
+
+// Dimensions returns the dimensions of an image of the given dimensions
+// scaled by s.
+func (s ImageScale) Dimensions(dimensions ImageDimensions) ImageDimensions {
+	scale := func(fraction float64, value uint) uint {
+		if fraction == 0 {
+			return 0
+		}
+		return uint(math.Max(1, math.Floor(fraction*float64(value)+0.5)))
+	}
+	return ImageDimensions{scale(s.Width, dimensions.Width), scale(s.Height, dimensions.Height)}
+}
+
 type ResizeDimensions struct {
 	Scale ImageDimensions
 	Crop  ImageDimensions
@@ -139,3 +196,119 @@ func NewFocalpointFromString(s string) (fp Focalpoint) {
 
 	return Focalpoint{x, y}
 }
+
+// ImageRegion is a rectangle within an image, in pixels.
+type ImageRegion struct {
+	X      uint
+	Y      uint
+	Width  uint
+	Height uint
+}
+
+// NewImageRegionFromString parses an ImageRegion from a string. The string
+// format should be: "X,Y,W,H". For example: "10,20,100,50".
+func NewImageRegionFromString(s string) ImageRegion {
+	components := strings.Split(s, ",")
+	if len(components) != 4 {
+		return EmptyImageRegion
+	}
+
+	var values [4]uint
+	for i, component := range components {
+		value, err := strconv.ParseUint(strings.TrimSpace(component), 10, 32)
+		if err != nil {
+			return EmptyImageRegion
+		}
+		values[i] = uint(value)
+	}
+
+	return ImageRegion{values[0], values[1], values[2], values[3]}
+}
+
+// Clamp returns the intersection of the region with an image of the given
+// dimensions.
+func (r ImageRegion) Clamp(dimensions ImageDimensions) ImageRegion {
+	if r.X >= dimensions.Width || r.Y >= dimensions.Height {
+		return EmptyImageRegion
+	}
+	if r.X+r.Width > dimensions.Width {
+		r.Width = dimensions.Width - r.X
+	}
+	if r.Y+r.Height > dimensions.Height {
+		r.Height = dimensions.Height - r.Y
+	}
+	return r
+}
+
+func (r ImageRegion) String() string {
+	return fmt.Sprintf("%d,%d,%dx%d", r.X, r.Y, r.Width, r.Height)
+}
+
+// Zoom returns the region of r a zoom by the given factor shows, centered on
+// the focal point as far as r allows.
+func (r ImageRegion) Zoom(zoom float64, focalpoint Focalpoint) ImageRegion {
+	width := math.Max(1, math.Floor(float64(r.Width)/zoom+0.5))
+	height := math.Max(1, math.Floor(float64(r.Height)/zoom+0.5))
+	x := math.Max(0, math.Min(focalpoint.X*float64(r.Width)-width/2, float64(r.Width)-width))
+	y := math.Max(0, math.Min(focalpoint.Y*float64(r.Height)-height/2, float64(r.Height)-height))
+	return ImageRegion{r.X + uint(x), r.Y + uint(y), uint(width), uint(height)}
+}
+
+// ImageCrop is a rectangle of an image to crop it to. Its values are pixels,
+// or percentages of the dimensions of the image if Percent is set.
+type ImageCrop struct {
+	X       float64
+	Y       float64
+	Width   float64
+	Height  float64
+	Percent bool
+}
+
+// NewImageCropFromString parses an ImageCrop from a string. The string format
+// should be: "X,Y,W,H", in pixels, or with every value a percentage suffixed
+// with "p" or "%". For example: "10,20,100,50" or "10p,10p,80p,80p".
+func NewImageCropFromString(s string) ImageCrop {
+	components := strings.Split(s, ",")
+	if len(components) != 4 {
+		return ImageCrop{}
+	}
+
+	var values [4]float64
+	percentages := 0
+	for i, component := range components {
+		component = strings.TrimSpace(component)
+		if strings.HasSuffix(component, "p") || strings.HasSuffix(component, "%") {
+			component = component[:len(component)-1]
+			percentages++
+		}
+		value, err := strconv.ParseFloat(component, 64)
+		if err != nil || value < 0 || math.IsInf(value, 0) {
+			return ImageCrop{}
+		}
+		values[i] = value
+	}
+	if percentages != 0 && percentages != len(components) {
+		return ImageCrop{}
+	}
+
+	return ImageCrop{values[0], values[1], values[2], values[3], percentages != 0}
+}
+
+// Region returns the region of an image of the given dimensions the crop
+// keeps.
+func (c ImageCrop) Region(dimensions ImageDimensions) ImageRegion {
+	x, y, width, height := c.X, c.Y, c.Width, c.Height
+	if c.Percent {
+		x *= float64(dimensions.Width) / 100
+		width *= float64(dimensions.Width) / 100
+		y *= float64(dimensions.Height) / 100
+		height *= float64(dimensions.Height) / 100
+	}
+	region := ImageRegion{
+		X:      uint(x + 0.5),
+		Y:      uint(y + 0.5),
+		Width:  uint(width + 0.5),
+		Height: uint(height + 0.5),
+	}
+	return region.Clamp(dimensions)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// ImageAdjustments are photographic corrections of an image. Brightness,
+// Contrast and Saturation range from -100 to 100, Hue is a rotation from -180
+// to 180 degrees and Gamma a gamma correction, where 1 leaves the image
+// unchanged. Zero values leave the image unchanged.
+type ImageAdjustments struct {
+	Brightness float64
+	Contrast   float64
+	Saturation float64
+	Hue        float64
+	Gamma      float64
+}
+
+// maxGamma is the largest gamma correction of adjustments.
+const maxGamma = 10
+
+// parseImageAdjustments parses the adjustment parameters returned by param.
+// Values out of range are clamped, and invalid values ignored.
+func parseImageAdjustments(param func(string) string) ImageAdjustments {
+	value := func(name string, limit float64) float64 {
+		v, err := strconv.ParseFloat(param(name), 64)
+		if err != nil || math.IsNaN(v) {
+			return 0
+		}
+		return math.Max(-limit, math.Min(v, limit))
+	}
+
+	gamma := value("gamma", maxGamma)
+	if gamma < 0 {
+		gamma = 0
+	}
+
+	return ImageAdjustments{
+		Brightness: value("bri", 100),
+		Contrast:   value("con", 100),
+		Saturation: value("sat", 100),
+		Hue:        value("hue", 180),
+		Gamma:      gamma,
+	}
+}
+
+// adjustmentOperationParser returns the parser of the operation name, which
+// takes a single value between min and max and sets it with set.
+func adjustmentOperationParser(name string, min, max float64, set func(*ImageAdjustments, float64)) imageOperationParser {
+	return func(args []string) (ImageProcessorOptions, error) {
+		options := ImageProcessorOptions{}
+		if len(args) != 1 {
+			return options, fmt.Errorf("expected %s:value", name)
+		}
+		value, err := strconv.ParseFloat(args[0], 64)
+		if err != nil || value < min || value > max {
+			return options, fmt.Errorf("expected a %s between %v and %v", name, min, max)
+		}
+		set(&options.Adjustments, value)
+		return options, nil
+	}
+}
+
+var (
+	parseBrightnessOperation = adjustmentOperationParser("bri", -100, 100, func(a *ImageAdjustments, v float64) { a.Brightness = v })
+	parseContrastOperation   = adjustmentOperationParser("con", -100, 100, func(a *ImageAdjustments, v float64) { a.Contrast = v })
+	parseSaturationOperation = adjustmentOperationParser("sat", -100, 100, func(a *ImageAdjustments, v float64) { a.Saturation = v })
+	parseHueOperation        = adjustmentOperationParser("hue", -180, 180, func(a *ImageAdjustments, v float64) { a.Hue = v })
+	parseGammaOperation      = adjustmentOperationParser("gamma", 0.01, maxGamma, func(a *ImageAdjustments, v float64) { a.Gamma = v })
+)
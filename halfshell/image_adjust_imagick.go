@@ -0,0 +1,61 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+// +build cgo
+
+package halfshell
+
+import (
+	"github.com/rafikk/imagick/imagick"
+)
+
+// adjust applies the requested adjustments to the image (or the requested
+// region).
+func (ip *imageProcessor) adjust(image *Image, request *ImageProcessorOptions) error {
+	adjustments := request.Adjustments
+	if adjustments == (ImageAdjustments{}) {
+		return nil
+	}
+
+	return ip.applyToRegion(image, request.Region, func(wand *imagick.MagickWand) error {
+		if adjustments.Gamma != 0 && adjustments.Gamma != 1 {
+			if err := wand.GammaImage(adjustments.Gamma); err != nil {
+				return err
+			}
+		}
+		if adjustments.Contrast != 0 {
+			if err := wand.BrightnessContrastImage(0, adjustments.Contrast); err != nil {
+				return err
+			}
+		}
+		if adjustments.Brightness != 0 || adjustments.Saturation != 0 || adjustments.Hue != 0 {
+			// ImageMagick takes percentages of the current values, and a hue
+			// of 0 to 200 for a rotation of -180 to 180 degrees.
+			brightness := 100 + adjustments.Brightness
+			saturation := 100 + adjustments.Saturation
+			hue := 100 + adjustments.Hue*100/180
+			if err := wand.ModulateImage(brightness, saturation, hue); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
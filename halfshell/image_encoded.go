@@ -0,0 +1,97 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// The images without a wand are described and decoded with the image package,
+// which supports JPEG, PNG, GIF and WebP.
+
+// decodeImageConfig reads the format and dimensions of an encoded image from
+// its header.
+func decodeImageConfig(data []byte) (image.Config, string, error) {
+	return image.DecodeConfig(bytes.NewReader(data))
+}
+
+func (i *Image) encodedMIMEType() string {
+	_, format, _ := decodeImageConfig(i.blob)
+	return "image/" + format
+}
+
+func (i *Image) encodedDimensions() ImageDimensions {
+	config, _, err := decodeImageConfig(i.blob)
+	if err != nil {
+		return EmptyImageDimensions
+	}
+	return ImageDimensions{uint(config.Width), uint(config.Height)}
+}
+
+// encodedSignature returns the SHA-256 hash of the encoded image, in place of
+// the signature of its pixels computed by ImageMagick.
+func (i *Image) encodedSignature() string {
+	hash := sha256.Sum256(i.blob)
+	return hex.EncodeToString(hash[:])
+}
+
+func (i *Image) encodedThumbnail(maxDimension uint) (image.Image, error) {
+	src, _, err := image.Decode(bytes.NewReader(i.blob))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	dimensions := thumbnailDimensions(ImageDimensions{uint(bounds.Dx()), uint(bounds.Dy())}, maxDimension)
+	dst := image.NewRGBA(image.Rect(0, 0, int(dimensions.Width), int(dimensions.Height)))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	return dst, nil
+}
+
+// thumbnailDimensions scales dimensions down to fit within maxDimension pixels
+// on each side.
+func thumbnailDimensions(dimensions ImageDimensions, maxDimension uint) ImageDimensions {
+	if dimensions.Width <= maxDimension && dimensions.Height <= maxDimension {
+		return dimensions
+	}
+
+	if dimensions.AspectRatio() > 1 {
+		dimensions = ImageDimensions{maxDimension, aspectHeight(dimensions.AspectRatio(), maxDimension)}
+	} else {
+		dimensions = ImageDimensions{aspectWidth(dimensions.AspectRatio(), maxDimension), maxDimension}
+	}
+	if dimensions.Width == 0 {
+		dimensions.Width = 1
+	}
+	if dimensions.Height == 0 {
+		dimensions.Height = 1
+	}
+	return dimensions
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+// +build cgo
+
+package halfshell
+
+import (
+	"github.com/rafikk/imagick/imagick"
+)
+
+// pad extends an image smaller than the requested dimensions, such as one
+// fitted into a different aspect ratio, to the requested dimensions, with the
+// image in the middle.
+func (ip *imageProcessor) pad(img *Image, req *ImageProcessorOptions) error {
+	if req.Fill == "" || req.Dimensions.Width == 0 || req.Dimensions.Height == 0 {
+		return nil
+	}
+
+	dimensions := img.GetDimensions()
+	target := clampDimensionsToMaxima(dimensions, req.Dimensions, ip.Config.MaxImageDimensions)
+	if dimensions.Width >= target.Width && dimensions.Height >= target.Height {
+		return nil
+	}
+	x := (int(target.Width) - int(dimensions.Width)) / 2
+	y := (int(target.Height) - int(dimensions.Height)) / 2
+
+	if req.Fill != FillBlur {
+		color := imagick.NewPixelWand()
+		defer color.Destroy()
+		color.SetColor(req.Fill)
+		err := img.Wand.SetImageBackgroundColor(color)
+		if err != nil {
+			return err
+		}
+		return img.Wand.ExtentImage(target.Width, target.Height, -x, -y)
+	}
+
+	// The background is a copy of the image covering the requested
+	// dimensions, blurred at a fraction of their size and scaled back up.
+	background := &Image{Wand: img.Wand.Clone()}
+	small := ImageDimensions{
+		Width:  (target.Width + fillBlurScale - 1) / fillBlurScale,
+		Height: (target.Height + fillBlurScale - 1) / fillBlurScale,
+	}
+	err := ip.coverApply(background, small)
+	if err == nil {
+		err = background.Wand.GaussianBlurImage(0, 2)
+	}
+	if err == nil {
+		err = background.Wand.ResizeImage(target.Width, target.Height, imagick.FILTER_TRIANGLE, 1)
+	}
+	if err == nil {
+		err = background.Wand.CompositeImage(img.Wand, imagick.COMPOSITE_OP_OVER, x, y)
+	}
+	if err != nil {
+		background.Wand.Destroy()
+		return err
+	}
+
+	img.Wand.Destroy()
+	img.Wand = background.Wand
+	return nil
+}
+
+// coverApply scales the image to cover the given dimensions and crops the
+// middle of it.
+func (ip *imageProcessor) coverApply(img *Image, dimensions ImageDimensions) error {
+	aspectRatio := img.GetDimensions().AspectRatio()
+	scale := dimensions
+	if aspectRatio > dimensions.AspectRatio() {
+		scale.Width = aspectWidth(aspectRatio, dimensions.Height)
+	} else {
+		scale.Height = aspectHeight(aspectRatio, dimensions.Width)
+	}
+	err := img.Wand.ResizeImage(scale.Width, scale.Height, imagick.FILTER_LANCZOS, 1)
+	if err != nil {
+		return err
+	}
+	return ip.cropApply(img, dimensions, Focalpoint{X: 0.5, Y: 0.5})
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// defaultSepiaThreshold is the threshold of sepia toning, as a percentage of
+// the brightness range, for requests that don't specify one.
+const defaultSepiaThreshold = 80
+
+// maxPosterizeLevels is the largest number of levels of posterization, past
+// which 8-bit images are left unchanged.
+const maxPosterizeLevels = 256
+
+// parsePosterizeLevels parses a number of color levels per channel, from 2 to
+// maxPosterizeLevels. It returns 0 if s isn't one.
+func parsePosterizeLevels(s string) uint {
+	levels, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || levels < 2 || levels > maxPosterizeLevels {
+		return 0
+	}
+	return uint(levels)
+}
+
+// parseThreshold parses a threshold as a percentage of the brightness range.
+// It returns 0 if s isn't one.
+func parseThreshold(s string) float64 {
+	threshold, err := strconv.ParseFloat(s, 64)
+	if err != nil || threshold <= 0 || threshold > 100 {
+		return 0
+	}
+	return threshold
+}
+
+// parseSepiaThreshold parses the value of a sepia parameter, "true" or a
+// threshold as a percentage of the brightness range. It returns 0 if s is
+// neither.
+func parseSepiaThreshold(s string) float64 {
+	if s == "true" {
+		return defaultSepiaThreshold
+	}
+	return parseThreshold(s)
+}
+
+func parseGrayscaleOperation(args []string) (ImageProcessorOptions, error) {
+	if len(args) != 0 {
+		return ImageProcessorOptions{}, fmt.Errorf("expected grayscale")
+	}
+	return ImageProcessorOptions{Grayscale: true}, nil
+}
+
+func parseSepiaOperation(args []string) (ImageProcessorOptions, error) {
+	if len(args) > 1 {
+		return ImageProcessorOptions{}, fmt.Errorf("expected sepia[:percentage]")
+	}
+	options := ImageProcessorOptions{Sepia: defaultSepiaThreshold}
+	if len(args) == 1 {
+		options.Sepia = parseThreshold(args[0])
+		if options.Sepia == 0 {
+			return ImageProcessorOptions{}, fmt.Errorf("expected sepia[:percentage]")
+		}
+	}
+	return options, nil
+}
+
+func parseInvertOperation(args []string) (ImageProcessorOptions, error) {
+	if len(args) != 0 {
+		return ImageProcessorOptions{}, fmt.Errorf("expected invert")
+	}
+	return ImageProcessorOptions{Invert: true}, nil
+}
+
+func parsePosterizeOperation(args []string) (ImageProcessorOptions, error) {
+	if len(args) != 1 || parsePosterizeLevels(args[0]) == 0 {
+		return ImageProcessorOptions{}, fmt.Errorf("expected posterize:levels, from 2 to %d", maxPosterizeLevels)
+	}
+	return ImageProcessorOptions{Posterize: parsePosterizeLevels(args[0])}, nil
+}
+
+func parseThresholdOperation(args []string) (ImageProcessorOptions, error) {
+	if len(args) != 1 || parseThreshold(args[0]) == 0 {
+		return ImageProcessorOptions{}, fmt.Errorf("expected threshold:percentage")
+	}
+	return ImageProcessorOptions{Threshold: parseThreshold(args[0])}, nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+// +build cgo
+
+package halfshell
+
+import (
+	"github.com/rafikk/imagick/imagick"
+)
+
+// grayscale converts the image (or the requested region) to grayscale. Whole
+// images are converted to the gray colorspace, so JPEGs are written with a
+// single channel rather than three equal ones.
+func (ip *imageProcessor) grayscale(image *Image, request *ImageProcessorOptions) error {
+	if !request.Grayscale {
+		return nil
+	}
+
+	if request.Region != EmptyImageRegion {
+		return ip.applyToRegion(image, request.Region, func(wand *imagick.MagickWand) error {
+			return wand.ModulateImage(100, 0, 100)
+		})
+	}
+
+	err := image.Wand.TransformImageColorspace(imagick.COLORSPACE_GRAY)
+	if err != nil {
+		return err
+	}
+	return image.Wand.SetImageType(imagick.IMAGE_TYPE_GRAYSCALE)
+}
+
+// sepia tones the image (or the requested region) with the requested
+// threshold.
+func (ip *imageProcessor) sepia(image *Image, request *ImageProcessorOptions) error {
+	if request.Sepia == 0 {
+		return nil
+	}
+
+	return ip.applyToRegion(image, request.Region, func(wand *imagick.MagickWand) error {
+		return wand.SepiaToneImage(request.Sepia / 100 * imagick.QUANTUM_RANGE)
+	})
+}
+
+// invert negates the colors of the image (or the requested region).
+func (ip *imageProcessor) invert(image *Image, request *ImageProcessorOptions) error {
+	if !request.Invert {
+		return nil
+	}
+
+	return ip.applyToRegion(image, request.Region, func(wand *imagick.MagickWand) error {
+		return wand.NegateImage(false)
+	})
+}
+
+// posterize reduces each channel of the image (or the requested region) to
+// the requested number of levels.
+func (ip *imageProcessor) posterize(image *Image, request *ImageProcessorOptions) error {
+	if request.Posterize == 0 {
+		return nil
+	}
+
+	return ip.applyToRegion(image, request.Region, func(wand *imagick.MagickWand) error {
+		return wand.PosterizeImage(request.Posterize, false)
+	})
+}
+
+// threshold turns the image (or the requested region) black and white:
+// pixels brighter than the requested percentage of the brightness range
+// become white, and all others black.
+func (ip *imageProcessor) threshold(image *Image, request *ImageProcessorOptions) error {
+	if request.Threshold == 0 {
+		return nil
+	}
+
+	return ip.applyToRegion(image, request.Region, func(wand *imagick.MagickWand) error {
+		// Thresholding the brightness rather than each channel keeps colored
+		// pixels from turning into primary colors.
+		if err := wand.TransformImageColorspace(imagick.COLORSPACE_GRAY); err != nil {
+			return err
+		}
+		return wand.ThresholdImage(request.Threshold / 100 * imagick.QUANTUM_RANGE)
+	})
+}
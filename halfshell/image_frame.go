@@ -0,0 +1,99 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// An ImageVignette darkens the edges of an image towards Color. Strength is
+// the proportion of the image the vignette fades over, from 0 to 1.
+type ImageVignette struct {
+	Strength float64
+	Color    string
+}
+
+// An ImageBorder surrounds an image with a border of Width pixels of Color.
+type ImageBorder struct {
+	Width uint
+	Color string
+}
+
+// defaultFrameColor is the color of vignettes and borders that don't specify
+// one.
+const defaultFrameColor = "black"
+
+// parseImageVignette parses a vignette of the form "strength[,color]".
+func parseImageVignette(args []string) (ImageVignette, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return ImageVignette{}, fmt.Errorf("expected a strength and an optional color")
+	}
+	strength, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || strength <= 0 || strength > 1 {
+		return ImageVignette{}, fmt.Errorf("invalid strength %s", args[0])
+	}
+	vignette := ImageVignette{Strength: strength, Color: defaultFrameColor}
+	if len(args) == 2 {
+		color, ok := parseColor(args[1])
+		if !ok {
+			return ImageVignette{}, fmt.Errorf("invalid color %s", args[1])
+		}
+		vignette.Color = color
+	}
+	return vignette, nil
+}
+
+// parseImageBorder parses a border of the form "width[,color]".
+func parseImageBorder(args []string) (ImageBorder, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return ImageBorder{}, fmt.Errorf("expected a width and an optional color")
+	}
+	width, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil || width == 0 {
+		return ImageBorder{}, fmt.Errorf("invalid width %s", args[0])
+	}
+	border := ImageBorder{Width: uint(width), Color: defaultFrameColor}
+	if len(args) == 2 {
+		color, ok := parseColor(args[1])
+		if !ok {
+			return ImageBorder{}, fmt.Errorf("invalid color %s", args[1])
+		}
+		border.Color = color
+	}
+	return border, nil
+}
+
+func parseVignetteOperation(args []string) (ImageProcessorOptions, error) {
+	vignette, err := parseImageVignette(args)
+	if err != nil {
+		return ImageProcessorOptions{}, fmt.Errorf("expected vignette:strength[:color], %v", err)
+	}
+	return ImageProcessorOptions{Vignette: vignette}, nil
+}
+
+func parseBorderOperation(args []string) (ImageProcessorOptions, error) {
+	border, err := parseImageBorder(args)
+	if err != nil {
+		return ImageProcessorOptions{}, fmt.Errorf("expected border:width[:color], %v", err)
+	}
+	return ImageProcessorOptions{Border: border}, nil
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+// +build cgo
+
+package halfshell
+
+import (
+	"math"
+
+	"github.com/rafikk/imagick/imagick"
+)
+
+// vignette fades the edges of the image into the requested color.
+func (ip *imageProcessor) vignette(image *Image, request *ImageProcessorOptions) error {
+	if request.Vignette.Strength == 0 {
+		return nil
+	}
+
+	color := imagick.NewPixelWand()
+	defer color.Destroy()
+	color.SetColor(request.Vignette.Color)
+	err := image.Wand.SetImageBackgroundColor(color)
+	if err != nil {
+		return err
+	}
+
+	// The vignette is an ellipse inset from the edges of the image by a
+	// fraction of its size, blurred over that same fraction.
+	width := float64(image.Wand.GetImageWidth())
+	height := float64(image.Wand.GetImageHeight())
+	inset := request.Vignette.Strength / 4
+	sigma := inset * math.Min(width, height)
+	return image.Wand.VignetteImage(0, sigma, int(inset*width), int(inset*height))
+}
+
+// border surrounds the image with a border of the requested width and color,
+// which adds twice the width to each of its dimensions.
+func (ip *imageProcessor) border(image *Image, request *ImageProcessorOptions) error {
+	if request.Border.Width == 0 {
+		return nil
+	}
+
+	color := imagick.NewPixelWand()
+	defer color.Destroy()
+	color.SetColor(request.Border.Color)
+	return image.Wand.BorderImage(color, request.Border.Width, request.Border.Width)
+}
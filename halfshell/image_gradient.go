@@ -0,0 +1,126 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// An ImageGradient is a linear gradient composited over an image, such as a
+// scrim that keeps text placed over the image legible.
+type ImageGradient struct {
+	// Color is the color of the gradient.
+	Color string
+
+	// Direction is the edge of the image where the gradient is the most
+	// opaque: "top", "bottom", "left" or "right". It fades out towards the
+	// opposite edge.
+	Direction string
+
+	// Opacity is the opacity of the gradient at its edge, from 0 to 1.
+	Opacity float64
+
+	// Extent is the proportion of the image the gradient covers, from its
+	// edge.
+	Extent float64
+}
+
+// GradientDirections are the accepted directions of gradients.
+var GradientDirections = map[string]bool{
+	"top":    true,
+	"bottom": true,
+	"left":   true,
+	"right":  true,
+}
+
+const (
+	defaultGradientDirection = "bottom"
+	defaultGradientOpacity   = 0.6
+	defaultGradientExtent    = 0.5
+)
+
+// parseImageGradient parses the gradient parameters returned by param. The
+// gradient is empty if no gradient color is requested, and invalid settings
+// are replaced with their defaults.
+func parseImageGradient(param func(string) string) ImageGradient {
+	color, ok := parseColor(param("gradient"))
+	if !ok {
+		return ImageGradient{}
+	}
+
+	direction := param("gradient_direction")
+	if !GradientDirections[direction] {
+		direction = defaultGradientDirection
+	}
+	opacity, err := strconv.ParseFloat(param("gradient_opacity"), 64)
+	if err != nil || opacity <= 0 || opacity > 1 {
+		opacity = defaultGradientOpacity
+	}
+	extent, err := strconv.ParseFloat(param("gradient_extent"), 64)
+	if err != nil || extent <= 0 || extent > 1 {
+		extent = defaultGradientExtent
+	}
+
+	return ImageGradient{
+		Color:     color,
+		Direction: direction,
+		Opacity:   opacity,
+		Extent:    extent,
+	}
+}
+
+func parseGradientOperation(args []string) (ImageProcessorOptions, error) {
+	if len(args) < 1 || len(args) > 4 {
+		return ImageProcessorOptions{}, fmt.Errorf("expected gradient:color[:direction[:opacity[:extent]]]")
+	}
+	color, ok := parseColor(args[0])
+	if !ok {
+		return ImageProcessorOptions{}, fmt.Errorf("invalid color %s", args[0])
+	}
+	gradient := ImageGradient{
+		Color:     color,
+		Direction: defaultGradientDirection,
+		Opacity:   defaultGradientOpacity,
+		Extent:    defaultGradientExtent,
+	}
+	if len(args) > 1 {
+		if !GradientDirections[args[1]] {
+			return ImageProcessorOptions{}, fmt.Errorf("unknown direction %s", args[1])
+		}
+		gradient.Direction = args[1]
+	}
+	if len(args) > 2 {
+		opacity, err := strconv.ParseFloat(args[2], 64)
+		if err != nil || opacity <= 0 || opacity > 1 {
+			return ImageProcessorOptions{}, fmt.Errorf("invalid opacity %s", args[2])
+		}
+		gradient.Opacity = opacity
+	}
+	if len(args) > 3 {
+		extent, err := strconv.ParseFloat(args[3], 64)
+		if err != nil || extent <= 0 || extent > 1 {
+			return ImageProcessorOptions{}, fmt.Errorf("invalid extent %s", args[3])
+		}
+		gradient.Extent = extent
+	}
+	return ImageProcessorOptions{Gradient: gradient}, nil
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+// +build cgo
+
+package halfshell
+
+import (
+	"math"
+
+	"github.com/rafikk/imagick/imagick"
+)
+
+// gradient composites the requested gradient over the image.
+func (ip *imageProcessor) gradient(image *Image, request *ImageProcessorOptions) error {
+	gradient := request.Gradient
+	if gradient.Color == "" {
+		return nil
+	}
+
+	width, height := image.Wand.GetImageWidth(), image.Wand.GetImageHeight()
+	horizontal := gradient.Direction == "left" || gradient.Direction == "right"
+	// The ramp is built vertically, opaque at the bottom, and transposed for
+	// horizontal gradients.
+	length, breadth := height, width
+	if horizontal {
+		length, breadth = width, height
+	}
+	extent := uint(math.Max(1, gradient.Extent*float64(length)+0.5))
+
+	ramp := imagick.NewMagickWand()
+	defer ramp.Destroy()
+	err := ramp.SetSize(breadth, extent)
+	if err != nil {
+		return err
+	}
+	err = ramp.ReadImage("gradient:black-white")
+	if err != nil {
+		return err
+	}
+	switch gradient.Direction {
+	case "top":
+		err = ramp.FlipImage()
+	case "left":
+		if err = ramp.TransposeImage(); err == nil {
+			err = ramp.FlopImage()
+		}
+	case "right":
+		err = ramp.TransposeImage()
+	}
+	if err != nil {
+		return err
+	}
+
+	color := imagick.NewPixelWand()
+	defer color.Destroy()
+	color.SetColor(gradient.Color)
+
+	// The ramp is the alpha channel of an image of the gradient's color.
+	scrim := imagick.NewMagickWand()
+	defer scrim.Destroy()
+	err = scrim.NewImage(ramp.GetImageWidth(), ramp.GetImageHeight(), color)
+	if err != nil {
+		return err
+	}
+	err = scrim.CompositeImage(ramp, imagick.COMPOSITE_OP_COPY_OPACITY, 0, 0)
+	if err != nil {
+		return err
+	}
+	err = scrim.EvaluateImageChannel(imagick.CHANNEL_ALPHA, imagick.EVAL_OP_MULTIPLY, gradient.Opacity)
+	if err != nil {
+		return err
+	}
+
+	x, y := 0, 0
+	switch gradient.Direction {
+	case "bottom":
+		y = int(height) - int(extent)
+	case "right":
+		x = int(width) - int(extent)
+	}
+	return image.Wand.CompositeImage(scrim, imagick.COMPOSITE_OP_OVER, x, y)
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+// +build cgo
+
+package halfshell
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/rafikk/imagick/imagick"
+)
+
+type magickWand = imagick.MagickWand
+
+// NewImageFromBufferWithLimits reads an image, returning ErrImageTooLarge
+// without decoding it if its header reports more pixels or frames than
+// allowed. This protects against decompression bombs, small files which
+// decode to gigabytes of pixel data.
+func NewImageFromBufferWithLimits(buffer io.Reader, limits ImageLimits) (image *Image, err error) {
+	bytes, err := ioutil.ReadAll(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	if limits != (ImageLimits{}) {
+		err = checkImageLimits(bytes, limits)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	image = &Image{Wand: imagick.NewMagickWand(), blob: bytes}
+	err = image.Wand.ReadImageBlob(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return image, nil
+}
+
+func checkImageLimits(bytes []byte, limits ImageLimits) error {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+
+	err := wand.PingImageBlob(bytes)
+	if err != nil {
+		return err
+	}
+
+	frames := uint64(wand.GetNumberImages())
+	if limits.MaxFrames > 0 && frames > limits.MaxFrames {
+		return ErrImageTooLarge
+	}
+
+	pixels := uint64(wand.GetImageWidth()) * uint64(wand.GetImageHeight())
+	if limits.MaxPixels > 0 && pixels > limits.MaxPixels {
+		return ErrImageTooLarge
+	}
+
+	return nil
+}
+
+// SetBytes replaces the image with the given encoded image data.
+func (i *Image) SetBytes(bytes []byte) error {
+	wand := imagick.NewMagickWand()
+	err := wand.ReadImageBlob(bytes)
+	if err != nil {
+		wand.Destroy()
+		return err
+	}
+
+	if i.Wand != nil {
+		i.Wand.Destroy()
+	}
+	i.Wand = wand
+	i.blob = bytes
+	return nil
+}
+
+// setEncodedBytes replaces the image with the given encoded image data,
+// without decoding it.
+func (i *Image) setEncodedBytes(bytes []byte) {
+	if i.Wand != nil {
+		i.Wand.Destroy()
+		i.Wand = nil
+	}
+	i.blob = bytes
+}
+
+// ensureWand decodes images kept encoded, e.g. the output of the go backend,
+// before they are processed with ImageMagick.
+func (i *Image) ensureWand() error {
+	if i.Wand != nil {
+		return nil
+	}
+
+	wand := imagick.NewMagickWand()
+	err := wand.ReadImageBlob(i.blob)
+	if err != nil {
+		wand.Destroy()
+		return err
+	}
+
+	i.Wand = wand
+	return nil
+}
+
+// getEncodedBytes returns the encoded image data, without re-encoding the
+// image if it hasn't been modified since it was read.
+func (i *Image) getEncodedBytes() []byte {
+	if i.blob != nil {
+		return i.blob
+	}
+	return i.Wand.GetImageBlob()
+}
+
+func (i *Image) GetMIMEType() string {
+	if i.Wand == nil {
+		return i.encodedMIMEType()
+	}
+	return fmt.Sprintf("image/%s", strings.ToLower(i.Wand.GetImageFormat()))
+}
+
+func (i *Image) GetBytes() (bytes []byte, size int) {
+	if i.Wand == nil {
+		return i.blob, len(i.blob)
+	}
+	bytes = i.Wand.GetImageBlob()
+	size = len(bytes)
+	return bytes, size
+}
+
+func (i *Image) GetWidth() uint {
+	if i.Wand == nil {
+		return i.encodedDimensions().Width
+	}
+	return i.Wand.GetImageWidth()
+}
+
+func (i *Image) GetHeight() uint {
+	if i.Wand == nil {
+		return i.encodedDimensions().Height
+	}
+	return i.Wand.GetImageHeight()
+}
+
+func (i *Image) GetSignature() string {
+	if i.Wand == nil {
+		return i.encodedSignature()
+	}
+	return i.Wand.GetImageSignature()
+}
+
+// GetThumbnail returns a decoded copy of the image scaled down to fit within
+// maxDimension pixels on each side. It is intended for analysis (hashing,
+// color extraction) rather than for output.
+func (i *Image) GetThumbnail(maxDimension uint) (image.Image, error) {
+	if i.Wand == nil {
+		return i.encodedThumbnail(maxDimension)
+	}
+
+	wand := i.Wand.Clone()
+	defer wand.Destroy()
+
+	dimensions := i.GetDimensions()
+	thumbnail := thumbnailDimensions(dimensions, maxDimension)
+	if thumbnail != dimensions {
+		if err := wand.ScaleImage(thumbnail.Width, thumbnail.Height); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := wand.SetImageFormat("PNG"); err != nil {
+		return nil, err
+	}
+
+	return png.Decode(bytes.NewReader(wand.GetImageBlob()))
+}
+
+func (i *Image) Destroy() {
+	if !i.destroyed && i.Wand != nil {
+		i.Wand.Destroy()
+		i.destroyed = true
+	}
+}
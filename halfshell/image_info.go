@@ -0,0 +1,75 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"context"
+	"net/http"
+)
+
+// ImageInfo describes an original image, as returned for requests with the
+// info output.
+type ImageInfo struct {
+	Width       uint   `json:"width"`
+	Height      uint   `json:"height"`
+	Format      string `json:"format"`
+	ContentType string `json:"content_type"`
+	Bytes       int    `json:"bytes"`
+	Orientation int    `json:"orientation,omitempty"`
+	Frames      uint   `json:"frames"`
+	Colorspace  string `json:"colorspace,omitempty"`
+}
+
+// InfoRequestHandler answers requests with the info output with a JSON
+// description of the original image, e.g. for clients building crop
+// interfaces. The original is retrieved without being decoded.
+func (s *Server) InfoRequestHandler(w *ResponseWriter, r *Request) {
+	ctx := r.Context()
+	if s.ProcessingTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ProcessingTimeout)
+		defer cancel()
+	}
+
+	sourceOptions := *r.SourceOptions
+	sourceOptions.Raw = true
+	sourceCtx, span := StartSpan(ctx, "source.fetch", SpanKindInternal)
+	span.SetAttribute("halfshell.source.path", sourceOptions.Key())
+	image, err := r.Route.Source.GetImage(sourceCtx, &sourceOptions)
+	span.SetError(err)
+	span.Finish()
+	if err != nil {
+		w.WriteHTTPError(s.sourceError(ctx, r, err))
+		return
+	}
+	defer image.Destroy()
+
+	info, err := NewImageInfo(image.getEncodedBytes())
+	if err != nil {
+		s.Logger.Warnf("Error reading image info %s: %v", r.SourceOptions.Path, err)
+		w.WriteError("Unprocessable Entity", http.StatusUnprocessableEntity)
+		return
+	}
+
+	s.Logger.Infof("Returning info of image %s", r.SourceOptions.Path)
+	s.setCacheHeaders(w, r)
+	w.WriteJSON(info)
+}
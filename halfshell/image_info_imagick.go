@@ -0,0 +1,65 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+// +build cgo
+
+package halfshell
+
+import (
+	"strings"
+
+	"github.com/rafikk/imagick/imagick"
+)
+
+// colorspaceNames names the common color spaces of images.
+var colorspaceNames = map[imagick.ColorspaceType]string{
+	imagick.COLORSPACE_RGB:         "rgb",
+	imagick.COLORSPACE_SRGB:        "srgb",
+	imagick.COLORSPACE_GRAY:        "gray",
+	imagick.COLORSPACE_CMYK:        "cmyk",
+	imagick.COLORSPACE_LAB:         "lab",
+	imagick.COLORSPACE_YCBCR:       "ycbcr",
+	imagick.COLORSPACE_TRANSPARENT: "transparent",
+}
+
+// NewImageInfo describes the image encoded in data. The image is pinged
+// rather than decoded, so only its headers are read.
+func NewImageInfo(data []byte) (*ImageInfo, error) {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+
+	if err := wand.PingImageBlob(data); err != nil {
+		return nil, err
+	}
+	wand.ResetIterator()
+
+	format := strings.ToLower(wand.GetImageFormat())
+	return &ImageInfo{
+		Width:       wand.GetImageWidth(),
+		Height:      wand.GetImageHeight(),
+		Format:      format,
+		ContentType: "image/" + format,
+		Bytes:       len(data),
+		Orientation: int(wand.GetImageOrientation()),
+		Frames:      wand.GetNumberImages(),
+		Colorspace:  colorspaceNames[wand.GetImageColorspace()],
+	}, nil
+}
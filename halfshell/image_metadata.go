@@ -0,0 +1,218 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Metadata modes of processors, deciding what metadata processed images keep.
+const (
+	// MetadataStrip removes all metadata from resized images.
+	MetadataStrip = "strip"
+
+	// MetadataScrub removes the private EXIF fields of all images, such as
+	// their location and serial numbers, and keeps the rest of the EXIF data
+	// and the color profile. Other metadata is removed.
+	MetadataScrub = "scrub"
+)
+
+// MetadataModes are the accepted metadata modes.
+var MetadataModes = map[string]bool{
+	MetadataStrip: true,
+	MetadataScrub: true,
+}
+
+// EXIF tags pointing to other IFDs.
+const (
+	exifTagExifIFD = 0x8769
+	exifTagGPSIFD  = 0x8825
+)
+
+// exifPrivateTags are the EXIF tags removed by MetadataScrub.
+var exifPrivateTags = map[uint16]bool{
+	exifTagGPSIFD: true, // GPSInfo
+	0x927c:        true, // MakerNote, which often holds the serial numbers
+	0xa420:        true, // ImageUniqueID
+	0xa430:        true, // CameraOwnerName
+	0xa431:        true, // BodySerialNumber
+	0xa435:        true, // LensSerialNumber
+	0xc62f:        true, // CameraSerialNumber
+}
+
+// exifTypeSizes are the sizes in bytes of the values of each EXIF type.
+var exifTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// ErrInvalidExif is returned when EXIF data can't be parsed.
+var ErrInvalidExif = errors.New("Invalid EXIF data")
+
+// scrubExif returns a copy of the EXIF profile data without the private tags.
+// Removed entries and the values they point to are overwritten with zeros,
+// so no other offset changes.
+func scrubExif(data []byte) ([]byte, error) {
+	data = append([]byte(nil), data...)
+	tiff := bytes.TrimPrefix(data, []byte("Exif\x00\x00"))
+	if len(tiff) < 8 {
+		return nil, ErrInvalidExif
+	}
+
+	e := &exifData{tiff: tiff, visited: map[uint32]bool{}}
+	switch string(tiff[0:2]) {
+	case "II":
+		e.order = binary.LittleEndian
+	case "MM":
+		e.order = binary.BigEndian
+	default:
+		return nil, ErrInvalidExif
+	}
+	if e.order.Uint16(tiff[2:4]) != 42 {
+		return nil, ErrInvalidExif
+	}
+
+	// IFD0 describes the image and IFD1 its thumbnail.
+	offset := e.order.Uint32(tiff[4:8])
+	for offset != 0 {
+		next, err := e.scrubIFD(offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next
+	}
+	return data, nil
+}
+
+type exifData struct {
+	tiff    []byte
+	order   binary.ByteOrder
+	visited map[uint32]bool
+}
+
+type exifEntry struct {
+	Tag   uint16
+	Type  uint16
+	Count uint32
+	Value uint32
+	raw   []byte
+}
+
+// entries returns the entries of the IFD at offset and the offset of the
+// next IFD.
+func (e *exifData) entries(offset uint32) ([]exifEntry, uint32, error) {
+	if e.visited[offset] || uint64(offset)+2 > uint64(len(e.tiff)) {
+		return nil, 0, ErrInvalidExif
+	}
+	e.visited[offset] = true
+
+	count := uint32(e.order.Uint16(e.tiff[offset:]))
+	end := uint64(offset) + 2 + 12*uint64(count) + 4
+	if end > uint64(len(e.tiff)) {
+		return nil, 0, ErrInvalidExif
+	}
+
+	entries := make([]exifEntry, count)
+	for i := range entries {
+		raw := e.tiff[offset+2+12*uint32(i) : offset+2+12*uint32(i)+12]
+		entries[i] = exifEntry{
+			Tag:   e.order.Uint16(raw[0:2]),
+			Type:  e.order.Uint16(raw[2:4]),
+			Count: e.order.Uint32(raw[4:8]),
+			Value: e.order.Uint32(raw[8:12]),
+			raw:   append([]byte(nil), raw...),
+		}
+	}
+	return entries, e.order.Uint32(e.tiff[end-4 : end]), nil
+}
+
+// scrubIFD removes the private entries of the IFD at offset, and of the EXIF
+// IFD it points to. It returns the offset of the next IFD.
+func (e *exifData) scrubIFD(offset uint32) (uint32, error) {
+	entries, next, err := e.entries(offset)
+	if err != nil {
+		return 0, err
+	}
+
+	kept := entries[:0]
+	for _, entry := range entries {
+		switch {
+		case entry.Tag == exifTagGPSIFD:
+			if err := e.clearIFD(entry.Value); err != nil {
+				return 0, err
+			}
+		case exifPrivateTags[entry.Tag]:
+			e.clearValue(entry)
+		case entry.Tag == exifTagExifIFD:
+			if _, err := e.scrubIFD(entry.Value); err != nil {
+				return 0, err
+			}
+			kept = append(kept, entry)
+		default:
+			kept = append(kept, entry)
+		}
+	}
+
+	// The kept entries are moved up, followed by the offset of the next IFD,
+	// and the space left is cleared.
+	end := offset + 2 + 12*uint32(len(entries)) + 4
+	e.order.PutUint16(e.tiff[offset:], uint16(len(kept)))
+	position := offset + 2
+	for _, entry := range kept {
+		copy(e.tiff[position:], entry.raw)
+		position += 12
+	}
+	e.order.PutUint32(e.tiff[position:], next)
+	position += 4
+	for ; position < end; position++ {
+		e.tiff[position] = 0
+	}
+	return next, nil
+}
+
+// clearIFD overwrites the IFD at offset and the values it points to.
+func (e *exifData) clearIFD(offset uint32) error {
+	entries, _, err := e.entries(offset)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		e.clearValue(entry)
+	}
+	end := offset + 2 + 12*uint32(len(entries)) + 4
+	for position := offset; position < end; position++ {
+		e.tiff[position] = 0
+	}
+	return nil
+}
+
+// clearValue overwrites the value of an entry stored outside of the IFD.
+// Values of up to 4 bytes are stored in the entry itself.
+func (e *exifData) clearValue(entry exifEntry) {
+	size := uint64(exifTypeSizes[entry.Type]) * uint64(entry.Count)
+	if size <= 4 || uint64(entry.Value)+size > uint64(len(e.tiff)) {
+		return
+	}
+	for position := uint64(entry.Value); position < uint64(entry.Value)+size; position++ {
+		e.tiff[position] = 0
+	}
+}
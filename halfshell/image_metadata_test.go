@@ -0,0 +1,321 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testExifEntry is an IFD entry of a test EXIF blob. Entries without a value
+// point to the IFD at index ref.
+type testExifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+	ref   int
+}
+
+// testIFD is an IFD of a test EXIF blob, followed by the IFD at index next,
+// or by none if next is 0.
+type testIFD struct {
+	entries []testExifEntry
+	next    int
+}
+
+// buildTestExif lays out the IFDs one after the other, each followed by the
+// values that don't fit in its entries, the way cameras write them.
+func buildTestExif(order binary.ByteOrder, ifds []testIFD) []byte {
+	offsets := make([]uint32, len(ifds))
+	offset := uint32(8)
+	for i, ifd := range ifds {
+		offsets[i] = offset
+		offset += 2 + 12*uint32(len(ifd.entries)) + 4
+		for _, entry := range ifd.entries {
+			if len(entry.value) > 4 {
+				offset += uint32(len(entry.value)+1) &^ 1
+			}
+		}
+	}
+
+	tiff := make([]byte, offset)
+	if order == binary.ByteOrder(binary.LittleEndian) {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], offsets[0])
+	for i, ifd := range ifds {
+		position := offsets[i]
+		values := position + 2 + 12*uint32(len(ifd.entries)) + 4
+		order.PutUint16(tiff[position:], uint16(len(ifd.entries)))
+		for j, entry := range ifd.entries {
+			raw := tiff[position+2+12*uint32(j):]
+			order.PutUint16(raw[0:], entry.tag)
+			order.PutUint16(raw[2:], entry.typ)
+			order.PutUint32(raw[4:], entry.count)
+			switch {
+			case entry.value == nil:
+				order.PutUint32(raw[8:], offsets[entry.ref])
+			case len(entry.value) <= 4:
+				copy(raw[8:12], entry.value)
+			default:
+				order.PutUint32(raw[8:], values)
+				copy(tiff[values:], entry.value)
+				values += uint32(len(entry.value)+1) &^ 1
+			}
+		}
+		var next uint32
+		if ifd.next != 0 {
+			next = offsets[ifd.next]
+		}
+		order.PutUint32(tiff[position+2+12*uint32(len(ifd.entries)):], next)
+	}
+	return append([]byte("Exif\x00\x00"), tiff...)
+}
+
+func testExifASCII(s string) testExifEntry {
+	return testExifEntry{typ: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+func testExifRationals(order binary.ByteOrder, values ...uint32) []byte {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		order.PutUint32(data[4*i:], value)
+	}
+	return data
+}
+
+func testExifTag(tag uint16, entry testExifEntry) testExifEntry {
+	entry.tag = tag
+	return entry
+}
+
+// testCameraExif returns the EXIF blob of a photo with its GPS position,
+// maker note, serial numbers and thumbnail.
+func testCameraExif(order binary.ByteOrder) []byte {
+	short := make([]byte, 2)
+	order.PutUint16(short, 1)
+	return buildTestExif(order, []testIFD{
+		{
+			// IFD0
+			entries: []testExifEntry{
+				testExifTag(0x010f, testExifASCII("Canon")),
+				testExifTag(0x0110, testExifASCII("Canon EOS 5D Mark IV")),
+				{tag: 0x0112, typ: 3, count: 1, value: short},
+				{tag: exifTagExifIFD, typ: 4, count: 1, ref: 1},
+				{tag: exifTagGPSIFD, typ: 4, count: 1, ref: 2},
+			},
+			next: 3,
+		},
+		{
+			// Exif IFD
+			entries: []testExifEntry{
+				{tag: 0x829a, typ: 5, count: 1, value: testExifRationals(order, 1, 250)},
+				{tag: 0x927c, typ: 7, count: 24, value: []byte("MAKERNOTE-SERIAL-1234567")},
+				testExifTag(0xa420, testExifASCII("UNIQUEID-ABCDEF0123456789")),
+				testExifTag(0xa430, testExifASCII("Jane Doe Photography")),
+				testExifTag(0xa431, testExifASCII("BODY0123456789")),
+				testExifTag(0xa434, testExifASCII("EF24-70mm f/2.8L II USM")),
+				testExifTag(0xa435, testExifASCII("LENS0000987654")),
+			},
+		},
+		{
+			// GPS IFD
+			entries: []testExifEntry{
+				{tag: 0x0000, typ: 1, count: 4, value: []byte{2, 3, 0, 0}},
+				testExifTag(0x0001, testExifASCII("N")),
+				{tag: 0x0002, typ: 5, count: 3, value: testExifRationals(order, 48, 1, 51, 1, 2976, 100)},
+				testExifTag(0x0003, testExifASCII("E")),
+				{tag: 0x0004, typ: 5, count: 3, value: testExifRationals(order, 2, 1, 17, 1, 4021, 100)},
+			},
+		},
+		{
+			// IFD1
+			entries: []testExifEntry{
+				{tag: 0x0103, typ: 3, count: 1, value: short},
+				testExifTag(0xc62f, testExifASCII("CAMSERIAL-998877")),
+			},
+		},
+	})
+}
+
+// testExifTags returns the tags of IFD0, the Exif IFD and IFD1.
+func testExifTags(t *testing.T, data []byte, order binary.ByteOrder) (ifd0, exif, ifd1 []uint16) {
+	tiff := bytes.TrimPrefix(data, []byte("Exif\x00\x00"))
+	e := &exifData{tiff: tiff, order: order, visited: map[uint32]bool{}}
+	entries, next, err := e.entries(order.Uint32(tiff[4:8]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		ifd0 = append(ifd0, entry.Tag)
+		if entry.Tag == exifTagExifIFD {
+			exifEntries, _, err := e.entries(entry.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, exifEntry := range exifEntries {
+				exif = append(exif, exifEntry.Tag)
+			}
+		}
+	}
+	if next != 0 {
+		entries, _, err := e.entries(next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			ifd1 = append(ifd1, entry.Tag)
+		}
+	}
+	return ifd0, exif, ifd1
+}
+
+func equalTags(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestScrubExif(t *testing.T) {
+	tests := []struct {
+		name  string
+		order binary.ByteOrder
+	}{
+		{"little-endian", binary.LittleEndian},
+		{"big-endian", binary.BigEndian},
+	}
+	for _, test := range tests {
+		data := testCameraExif(test.order)
+		original := append([]byte(nil), data...)
+		scrubbed, err := scrubExif(data)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(data, original) {
+			t.Errorf("%s: input was modified", test.name)
+		}
+		if len(scrubbed) != len(data) {
+			t.Errorf("%s: expected %d bytes, got %d", test.name, len(data), len(scrubbed))
+		}
+
+		ifd0, exif, ifd1 := testExifTags(t, scrubbed, test.order)
+		if expected := []uint16{0x010f, 0x0110, 0x0112, exifTagExifIFD}; !equalTags(ifd0, expected) {
+			t.Errorf("%s: expected IFD0 tags %x, got %x", test.name, expected, ifd0)
+		}
+		if expected := []uint16{0x829a, 0xa434}; !equalTags(exif, expected) {
+			t.Errorf("%s: expected Exif IFD tags %x, got %x", test.name, expected, exif)
+		}
+		if expected := []uint16{0x0103}; !equalTags(ifd1, expected) {
+			t.Errorf("%s: expected IFD1 tags %x, got %x", test.name, expected, ifd1)
+		}
+
+		for _, value := range [][]byte{
+			[]byte("MAKERNOTE-SERIAL"),
+			[]byte("UNIQUEID"),
+			[]byte("Jane Doe"),
+			[]byte("BODY0123456789"),
+			[]byte("LENS0000987654"),
+			[]byte("CAMSERIAL"),
+			testExifRationals(test.order, 48, 1, 51, 1, 2976, 100),
+			testExifRationals(test.order, 2, 1, 17, 1, 4021, 100),
+		} {
+			if bytes.Contains(scrubbed, value) {
+				t.Errorf("%s: private value %q was kept", test.name, value)
+			}
+		}
+		for _, value := range [][]byte{
+			[]byte("Canon EOS 5D Mark IV\x00"),
+			[]byte("EF24-70mm f/2.8L II USM\x00"),
+			testExifRationals(test.order, 1, 250),
+		} {
+			if !bytes.Contains(scrubbed, value) {
+				t.Errorf("%s: value %q was removed", test.name, value)
+			}
+		}
+	}
+}
+
+func TestScrubExifInvalid(t *testing.T) {
+	order := binary.BigEndian
+	outOfRange := make([]byte, 4)
+	order.PutUint32(outOfRange, 0xfffffff0)
+	truncated := testCameraExif(order)
+	truncated = truncated[:6+8+2+12*3]
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"header only", []byte("Exif\x00\x00")},
+		{"short header", []byte("Exif\x00\x00MM\x00\x2a")},
+		{"unknown byte order", []byte("XX\x00\x2a\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00")},
+		{"wrong magic", []byte("MM\x00\x2b\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00")},
+		{"IFD0 out of range", []byte("MM\x00\x2a\xff\xff\xff\xf0")},
+		{"IFD0 past the end", []byte("MM\x00\x2a\x00\x00\x00\x08")},
+		{"truncated entries", truncated},
+		{"IFD pointing to itself", buildTestExif(order, []testIFD{
+			{entries: []testExifEntry{{tag: 0x0112, typ: 3, count: 1, value: []byte{0, 1}}}, next: 1},
+			{entries: []testExifEntry{{tag: 0x0103, typ: 3, count: 1, value: []byte{0, 6}}}, next: 1},
+		})},
+		{"Exif IFD pointing to IFD0", buildTestExif(order, []testIFD{
+			{entries: []testExifEntry{{tag: exifTagExifIFD, typ: 4, count: 1, ref: 0}}},
+		})},
+		{"Exif IFD pointing to its parent", buildTestExif(order, []testIFD{
+			{entries: []testExifEntry{{tag: exifTagExifIFD, typ: 4, count: 1, ref: 1}}},
+			{entries: []testExifEntry{{tag: exifTagExifIFD, typ: 4, count: 1, ref: 0}}},
+		})},
+		{"GPS IFD out of range", buildTestExif(order, []testIFD{
+			{entries: []testExifEntry{{tag: exifTagGPSIFD, typ: 4, count: 1, value: outOfRange}}},
+		})},
+		{"GPS IFD pointing to IFD0", buildTestExif(order, []testIFD{
+			{entries: []testExifEntry{{tag: exifTagGPSIFD, typ: 4, count: 1, ref: 0}}},
+		})},
+	}
+	for _, test := range tests {
+		if _, err := scrubExif(test.data); err != ErrInvalidExif {
+			t.Errorf("%s: expected ErrInvalidExif, got %v", test.name, err)
+		}
+	}
+}
+
+func TestScrubExifTruncated(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		data := testCameraExif(order)
+		for n := 0; n < len(data); n++ {
+			if _, err := scrubExif(data[:n]); err != nil && err != ErrInvalidExif {
+				t.Errorf("%s, %d bytes: unexpected error %v", order, n, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ImageOperation is a single stage of an operation pipeline, e.g. "resize:800x"
+// or "grayscale". Operations are applied in the order they are requested,
+// which allows expressing order-dependent edits the flat request parameters
+// can't.
+type ImageOperation struct {
+	Name    string
+	Options ImageProcessorOptions
+}
+
+// MaxImageOperations is the largest number of operations in a pipeline.
+const MaxImageOperations = 16
+
+// flatOperationParameters are the flat request parameters whose effects
+// operation pipelines replace. Pipelines ignore them, so requests combining
+// them with one are rejected rather than having them silently dropped.
+var flatOperationParameters = []string{
+	"w", "h", "scale", "format", "scale_mode", "blur", "pixelate", "trim",
+	"radius", "mask", "bri", "con", "sat", "hue", "gamma", "grayscale", "sepia",
+	"invert", "posterize", "threshold", "duotone", "tint", "vignette",
+	"gradient", "border",
+}
+
+type imageOperationParser func(args []string) (ImageProcessorOptions, error)
+
+// imageOperationParsers parse the arguments of each operation. The stages
+// applying them are in imageOperationStages.
+var imageOperationParsers = map[string]imageOperationParser{
+	"resize":    parseResizeOperation,
+	"crop":      parseCropOperation,
+	"blur":      parseBlurOperation,
+	"pixelate":  parsePixelateOperation,
+	"trim":      parseTrimOperation,
+	"radius":    parseRadiusOperation,
+	"mask":      parseMaskOperation,
+	"format":    parseFormatOperation,
+	"bri":       parseBrightnessOperation,
+	"con":       parseContrastOperation,
+	"sat":       parseSaturationOperation,
+	"hue":       parseHueOperation,
+	"gamma":     parseGammaOperation,
+	"grayscale": parseGrayscaleOperation,
+	"sepia":     parseSepiaOperation,
+	"invert":    parseInvertOperation,
+	"posterize": parsePosterizeOperation,
+	"threshold": parseThresholdOperation,
+	"duotone":   parseDuotoneOperation,
+	"tint":      parseTintOperation,
+	"vignette":  parseVignetteOperation,
+	"gradient":  parseGradientOperation,
+	"border":    parseBorderOperation,
+}
+
+// ParseImageOperations parses an operation pipeline of the form
+// "name:arg:arg,name:arg,...". For example: "resize:800x,crop:1:1,blur:0.5".
+func ParseImageOperations(s string) ([]ImageOperation, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	components := strings.Split(s, ",")
+	if len(components) > MaxImageOperations {
+		return nil, fmt.Errorf("Too many operations: %d (maximum %d)", len(components), MaxImageOperations)
+	}
+
+	var operations []ImageOperation
+	for _, component := range components {
+		args := strings.Split(strings.TrimSpace(component), ":")
+		name := args[0]
+		parse, ok := imageOperationParsers[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown operation: %s", name)
+		}
+		options, err := parse(args[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid operation %s: %v", component, err)
+		}
+		operations = append(operations, ImageOperation{Name: name, Options: options})
+	}
+
+	return operations, nil
+}
+
+// checkFlatOperationParameters returns an error if param returns a value for
+// any of the flat parameters an operation pipeline replaces.
+func checkFlatOperationParameters(param func(string) string) error {
+	for _, name := range flatOperationParameters {
+		if param(name) != "" {
+			return fmt.Errorf("Operations can't be combined with the %s parameter", name)
+		}
+	}
+	return nil
+}
+
+func parseResizeOperation(args []string) (ImageProcessorOptions, error) {
+	options := ImageProcessorOptions{}
+	if len(args) < 1 || len(args) > 2 {
+		return options, fmt.Errorf("expected resize:WxH[:scale_mode]")
+	}
+	dimensions, err := NewImageDimensionsFromString(args[0])
+	if err != nil {
+		return options, err
+	}
+	options.Dimensions = dimensions
+	if len(args) == 2 {
+		scaleMode, ok := ScaleModes[args[1]]
+		if !ok {
+			return options, fmt.Errorf("unknown scale mode %s", args[1])
+		}
+		options.ScaleMode = scaleMode
+	}
+	return options, nil
+}
+
+func parseCropOperation(args []string) (ImageProcessorOptions, error) {
+	options := ImageProcessorOptions{}
+	if len(args) != 2 {
+		return options, fmt.Errorf("expected crop:W:H")
+	}
+	width, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || width <= 0 {
+		return options, fmt.Errorf("invalid aspect ratio width %s", args[0])
+	}
+	height, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || height <= 0 {
+		return options, fmt.Errorf("invalid aspect ratio height %s", args[1])
+	}
+	options.AspectRatio = width / height
+	return options, nil
+}
+
+func parseBlurOperation(args []string) (ImageProcessorOptions, error) {
+	options := ImageProcessorOptions{}
+	if len(args) != 1 {
+		return options, fmt.Errorf("expected blur:radius")
+	}
+	blurRadius, err := strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		return options, err
+	}
+	options.BlurRadius = blurRadius
+	return options, nil
+}
+
+func parsePixelateOperation(args []string) (ImageProcessorOptions, error) {
+	options := ImageProcessorOptions{}
+	if len(args) != 1 {
+		return options, fmt.Errorf("expected pixelate:size")
+	}
+	size, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return options, err
+	}
+	options.Pixelate = uint(size)
+	return options, nil
+}
+
+func parseTrimOperation(args []string) (ImageProcessorOptions, error) {
+	options := ImageProcessorOptions{Trim: true}
+	if len(args) > 1 {
+		return options, fmt.Errorf("expected trim[:fuzz]")
+	}
+	if len(args) == 1 {
+		fuzz, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return options, err
+		}
+		options.TrimFuzz = fuzz
+	}
+	return options, nil
+}
+
+func parseRadiusOperation(args []string) (ImageProcessorOptions, error) {
+	options := ImageProcessorOptions{}
+	if len(args) != 1 {
+		return options, fmt.Errorf("expected radius:pixels")
+	}
+	radius, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return options, err
+	}
+	options.CornerRadius = uint(radius)
+	return options, nil
+}
+
+func parseMaskOperation(args []string) (ImageProcessorOptions, error) {
+	options := ImageProcessorOptions{}
+	if len(args) != 1 || args[0] != MaskCircle {
+		return options, fmt.Errorf("expected mask:circle")
+	}
+	options.Mask = args[0]
+	return options, nil
+}
+
+func parseFormatOperation(args []string) (ImageProcessorOptions, error) {
+	options := ImageProcessorOptions{}
+	if len(args) != 1 {
+		return options, fmt.Errorf("expected format:name")
+	}
+	format, ok := OutputFormats[strings.ToLower(args[0])]
+	if !ok {
+		return options, fmt.Errorf("unknown format %s", args[0])
+	}
+	options.OutputFormat = format
+	return options, nil
+}
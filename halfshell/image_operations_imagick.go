@@ -0,0 +1,54 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+// +build cgo
+
+package halfshell
+
+type imageStage func(*imageProcessor, *Image, *ImageProcessorOptions) error
+
+// imageOperationStages apply the operations parsed by imageOperationParsers
+// with ImageMagick.
+var imageOperationStages = map[string]imageStage{
+	"resize":    (*imageProcessor).resize,
+	"crop":      (*imageProcessor).cropToAspectRatio,
+	"blur":      (*imageProcessor).blur,
+	"pixelate":  (*imageProcessor).pixelate,
+	"trim":      (*imageProcessor).trim,
+	"radius":    (*imageProcessor).mask,
+	"mask":      (*imageProcessor).mask,
+	"format":    (*imageProcessor).convert,
+	"bri":       (*imageProcessor).adjust,
+	"con":       (*imageProcessor).adjust,
+	"sat":       (*imageProcessor).adjust,
+	"hue":       (*imageProcessor).adjust,
+	"gamma":     (*imageProcessor).adjust,
+	"grayscale": (*imageProcessor).grayscale,
+	"sepia":     (*imageProcessor).sepia,
+	"invert":    (*imageProcessor).invert,
+	"posterize": (*imageProcessor).posterize,
+	"threshold": (*imageProcessor).threshold,
+	"duotone":   (*imageProcessor).duotone,
+	"tint":      (*imageProcessor).tint,
+	"vignette":  (*imageProcessor).vignette,
+	"gradient":  (*imageProcessor).gradient,
+	"border":    (*imageProcessor).border,
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// An ImageOverlay is a second image of the route's source composited over the
+// processed image, such as a badge.
+type ImageOverlay struct {
+	// Path is the source path of the overlay image.
+	Path string
+
+	// Gravity is the edge or corner the overlay is placed against, such as
+	// "northeast", or "center".
+	Gravity string
+
+	// X and Y offset the overlay from its gravity, inwards.
+	X, Y int
+
+	// Width is the width of the overlay as a fraction of the width of the
+	// image. The overlay keeps its own size if it is 0.
+	Width float64
+
+	// Opacity is the opacity of the overlay, from 0 to 1.
+	Opacity float64
+}
+
+// OverlayGravities are the accepted gravities of overlays.
+var OverlayGravities = map[string]bool{
+	"center":    true,
+	"north":     true,
+	"northeast": true,
+	"east":      true,
+	"southeast": true,
+	"south":     true,
+	"southwest": true,
+	"west":      true,
+	"northwest": true,
+}
+
+// parseImageOverlay parses the overlay parameters returned by param. The
+// overlay is empty if no overlay path is requested.
+func parseImageOverlay(param func(string) string) ImageOverlay {
+	path := param("overlay")
+	if path == "" {
+		return ImageOverlay{}
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	gravity := strings.ToLower(param("overlay_gravity"))
+	if !OverlayGravities[gravity] {
+		gravity = "center"
+	}
+	x, _ := strconv.Atoi(param("overlay_x"))
+	y, _ := strconv.Atoi(param("overlay_y"))
+	width, _ := strconv.ParseFloat(param("overlay_width"), 64)
+	opacity, err := strconv.ParseFloat(param("overlay_opacity"), 64)
+	if err != nil || opacity > 1 {
+		opacity = 1
+	}
+
+	return ImageOverlay{
+		Path:    path,
+		Gravity: gravity,
+		X:       x,
+		Y:       y,
+		Width:   math.Max(0, math.Min(width, 1)),
+		Opacity: math.Max(0, opacity),
+	}
+}
+
+// position returns the position of an overlay of the given dimensions over an
+// image of the given dimensions.
+func (o ImageOverlay) position(image, overlay ImageDimensions) (int, int) {
+	x := (int(image.Width) - int(overlay.Width)) / 2
+	y := (int(image.Height) - int(overlay.Height)) / 2
+	if strings.HasSuffix(o.Gravity, "west") {
+		x = o.X
+	} else if strings.HasSuffix(o.Gravity, "east") {
+		x = int(image.Width) - int(overlay.Width) - o.X
+	} else {
+		x += o.X
+	}
+	if strings.HasPrefix(o.Gravity, "north") {
+		y = o.Y
+	} else if strings.HasPrefix(o.Gravity, "south") {
+		y = int(image.Height) - int(overlay.Height) - o.Y
+	} else {
+		y += o.Y
+	}
+	return x, y
+}
+
+// fetchOverlay retrieves the overlay image requested by r from the route's
+// source. It returns nil if r requests no overlay.
+func (s *Server) fetchOverlay(ctx context.Context, r *Request) (*Image, error) {
+	overlay := r.ProcessorOptions.Overlay
+	if overlay.Path == "" {
+		return nil, nil
+	}
+
+	ctx, span := StartSpan(ctx, "source.fetch", SpanKindInternal)
+	defer span.Finish()
+	sourceOptions := &ImageSourceOptions{
+		Path:   overlay.Path,
+		Limits: r.SourceOptions.Limits,
+		Bucket: r.SourceOptions.Bucket,
+		Header: r.SourceOptions.Header,
+	}
+	span.SetAttribute("halfshell.source.path", sourceOptions.Key())
+	image, err := r.Route.Source.GetImage(ctx, sourceOptions)
+	span.SetError(err)
+	return image, err
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+// +build cgo
+
+package halfshell
+
+import (
+	"math"
+
+	"github.com/rafikk/imagick/imagick"
+)
+
+// overlay composites the overlay image of the request over the image.
+func (ip *imageProcessor) overlay(image *Image, request *ImageProcessorOptions) error {
+	if request.OverlayImage == nil {
+		return nil
+	}
+
+	err := request.OverlayImage.ensureWand()
+	if err != nil {
+		return err
+	}
+
+	wand := request.OverlayImage.Wand.Clone()
+	defer wand.Destroy()
+
+	if request.Overlay.Width > 0 {
+		aspectRatio := float64(wand.GetImageWidth()) / float64(wand.GetImageHeight())
+		width := uint(math.Max(1, request.Overlay.Width*float64(image.GetWidth())))
+		height := uint(math.Max(1, float64(aspectHeight(aspectRatio, width))))
+		err = wand.ResizeImage(width, height, imagick.FILTER_LANCZOS, 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	if request.Overlay.Opacity < 1 {
+		err = wand.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_ACTIVATE)
+		if err != nil {
+			return err
+		}
+		err = wand.EvaluateImageChannel(imagick.CHANNEL_ALPHA, imagick.EVAL_OP_MULTIPLY, request.Overlay.Opacity)
+		if err != nil {
+			return err
+		}
+	}
+
+	x, y := request.Overlay.position(image.GetDimensions(),
+		ImageDimensions{wand.GetImageWidth(), wand.GetImageHeight()})
+	return image.Wand.CompositeImage(wand, imagick.COMPOSITE_OP_OVER, x, y)
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"math"
+)
+
+const (
+	DefaultPaletteSize = 5
+	MaxPaletteSize     = 32
+
+	// The image is downsampled to fit within this size before quantizing.
+	paletteSampleSize = 64
+)
+
+// ImagePalette describes the dominant color and the most common colors of an
+// image.
+type ImagePalette struct {
+	DominantColor string         `json:"dominant_color"`
+	Palette       []PaletteColor `json:"palette"`
+}
+
+// PaletteColor is a color of the palette, as a hex string, along with the
+// fraction of the image it covers.
+type PaletteColor struct {
+	Color    string  `json:"color"`
+	Fraction float64 `json:"fraction"`
+}
+
+func colorComponentToByte(value float64) uint8 {
+	return uint8(math.Floor(math.Max(0, math.Min(1, value))*255 + 0.5))
+}
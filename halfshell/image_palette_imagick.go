@@ -0,0 +1,96 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+// +build cgo
+
+package halfshell
+
+import (
+	"fmt"
+	"sort"
+)
+
+// GetPalette quantizes a downsampled copy of the image to at most size colors
+// and returns them ordered by how much of the image they cover.
+func (i *Image) GetPalette(size uint) (*ImagePalette, error) {
+	if size == 0 {
+		size = DefaultPaletteSize
+	}
+	if size > MaxPaletteSize {
+		size = MaxPaletteSize
+	}
+
+	err := i.ensureWand()
+	if err != nil {
+		return nil, err
+	}
+
+	wand := i.Wand.Clone()
+	defer wand.Destroy()
+
+	dimensions := i.GetDimensions()
+	if dimensions.Width > paletteSampleSize || dimensions.Height > paletteSampleSize {
+		dimensions = clampDimensionsToMaxima(dimensions, dimensions,
+			ImageDimensions{paletteSampleSize, paletteSampleSize})
+		if dimensions.Width == 0 {
+			dimensions.Width = 1
+		}
+		if dimensions.Height == 0 {
+			dimensions.Height = 1
+		}
+		if err := wand.ScaleImage(dimensions.Width, dimensions.Height); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := wand.QuantizeImage(size, wand.GetImageColorspace(), 0, false, false); err != nil {
+		return nil, err
+	}
+
+	_, pixelWands := wand.GetImageHistogram()
+	if len(pixelWands) == 0 {
+		return nil, fmt.Errorf("Unable to compute histogram")
+	}
+
+	var total uint
+	for _, pw := range pixelWands {
+		total += pw.GetColorCount()
+	}
+
+	sort.Slice(pixelWands, func(a, b int) bool {
+		return pixelWands[a].GetColorCount() > pixelWands[b].GetColorCount()
+	})
+
+	palette := &ImagePalette{Palette: make([]PaletteColor, 0, len(pixelWands))}
+	for _, pw := range pixelWands {
+		palette.Palette = append(palette.Palette, PaletteColor{
+			Color: fmt.Sprintf("#%02x%02x%02x",
+				colorComponentToByte(pw.GetRed()),
+				colorComponentToByte(pw.GetGreen()),
+				colorComponentToByte(pw.GetBlue())),
+			Fraction: float64(pw.GetColorCount()) / float64(total),
+		})
+		pw.Destroy()
+	}
+	palette.DominantColor = palette.Palette[0].Color
+
+	return palette, nil
+}
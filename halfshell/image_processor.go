@@ -21,9 +21,11 @@
 package halfshell
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"math"
-
-	"github.com/rafikk/imagick/imagick"
+	"os"
 )
 
 const (
@@ -33,6 +35,51 @@ const (
 	ScaleAspectCrop = 23
 )
 
+const (
+	OutputImage    = ""
+	OutputBlurHash = "blurhash"
+	OutputPalette  = "palette"
+	OutputInfo     = "info"
+	OutputSheet    = "sheet"
+)
+
+const (
+	MaskNone   = ""
+	MaskCircle = "circle"
+)
+
+// OutputFormats maps the accepted names of output formats to the
+// corresponding ImageMagick format.
+var OutputFormats = map[string]string{
+	"jpg":  "JPEG",
+	"jpeg": "JPEG",
+	"png":  "PNG",
+	"webp": "WEBP",
+	"avif": "AVIF",
+	"gif":  "GIF",
+}
+
+// ChromaSubsamplings maps the accepted JPEG chroma subsamplings to the
+// corresponding ImageMagick sampling factors. Full chroma resolution (4:4:4)
+// keeps text and sharp colored edges crisp, at the cost of larger files.
+var ChromaSubsamplings = map[string]string{
+	"4:4:4": "1x1,1x1,1x1",
+	"4:2:2": "2x1,1x1,1x1",
+	"4:2:0": "2x2,1x1,1x1",
+}
+
+// parseChromaSubsampling returns the chroma subsampling named s, which may be
+// written without colons, e.g. "444". It returns "" if s names none.
+func parseChromaSubsampling(s string) string {
+	if len(s) == 3 {
+		s = s[0:1] + ":" + s[1:2] + ":" + s[2:3]
+	}
+	if _, ok := ChromaSubsamplings[s]; ok {
+		return s
+	}
+	return ""
+}
+
 var ScaleModes = map[string]uint{
 	"fill":        ScaleFill,
 	"aspect_fit":  ScaleAspectFit,
@@ -40,130 +87,200 @@ var ScaleModes = map[string]uint{
 	"aspect_crop": ScaleAspectCrop,
 }
 
+type ImageProcessorBackend string
+type ImageProcessorFactoryFunction func(*ProcessorConfig) ImageProcessor
+
+const (
+	ImageProcessorBackendImageMagick ImageProcessorBackend = "imagemagick"
+)
+
+var (
+	imageProcessorBackendToFactoryFunctionMap = make(map[ImageProcessorBackend]ImageProcessorFactoryFunction)
+)
+
 type ImageProcessor interface {
-	ProcessImage(*Image, *ImageProcessorOptions) error
+	ProcessImage(context.Context, *Image, *ImageProcessorOptions) error
 }
 
-type ImageProcessorOptions struct {
-	Dimensions ImageDimensions
-	BlurRadius float64
-	ScaleMode  uint
-	Focalpoint Focalpoint
+// RegisterProcessor makes an ImageProcessor implementation available as a
+// processor backend.
+func RegisterProcessor(backend ImageProcessorBackend, factory ImageProcessorFactoryFunction) {
+	imageProcessorBackendToFactoryFunctionMap[backend] = factory
 }
 
-type imageProcessor struct {
-	Config *ProcessorConfig
-	Logger *Logger
+// NewImageProcessor creates an ImageProcessor using the backend selected in
+// the configuration.
+func NewImageProcessor(config *ProcessorConfig) (ImageProcessor, error) {
+	factory := imageProcessorBackendToFactoryFunctionMap[config.Backend]
+	if factory == nil {
+		return nil, fmt.Errorf("Unknown image processor backend: %s", config.Backend)
+	}
+	return factory(config), nil
 }
 
+// NewImageProcessorWithConfig is like NewImageProcessor, but exits if the
+// processor can't be created.
 func NewImageProcessorWithConfig(config *ProcessorConfig) ImageProcessor {
-	return &imageProcessor{
-		Config: config,
-		Logger: NewLogger("image_processor.%s", config.Name),
+	processor, err := NewImageProcessor(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid processor %s: %v\n", config.Name, err)
+		os.Exit(1)
 	}
+	return processor
 }
 
-func (ip *imageProcessor) ProcessImage(img *Image, req *ImageProcessorOptions) error {
-	if req.Dimensions == EmptyImageDimensions {
-		req.Dimensions.Width = uint(ip.Config.DefaultImageWidth)
-		req.Dimensions.Height = uint(ip.Config.DefaultImageHeight)
-	}
+type ImageProcessorOptions struct {
+	Dimensions    ImageDimensions
+	RelativeSize  ImageScale
+	BlurRadius    float64
+	ScaleMode     uint
+	Focalpoint    Focalpoint
+	PaletteColors uint
+	Colors        uint
+	Output        string
+	Pixelate      uint
+	Region        ImageRegion
+	Crop          ImageCrop
+	Zoom          float64
+	Trim          bool
+	TrimFuzz      float64
+	CornerRadius  uint
+	Mask          string
+	OutputFormat  string
+	Background    string
+	Fill          string
+	AspectRatio   float64
+	Operations    []ImageOperation
+	Quality       uint
+	AutoQuality   bool
+	MaxBytes      uint64
+	Subsampling   string
+	Overlay       ImageOverlay
+	Sheet         ImageSheet
+	Adjustments   ImageAdjustments
+	Grayscale     bool
+	Sepia         float64
+	Invert        bool
+	Posterize     uint
+	Threshold     float64
+	Duotone       ImageDuotone
+	Tint          ImageTint
+	Vignette      ImageVignette
+	Gradient      ImageGradient
+	Border        ImageBorder
+
+	// OverlayImage is the image of Overlay, retrieved before the image is
+	// processed.
+	OverlayImage *Image `json:"-"`
+}
 
-	var err error
+type chainedImageProcessor []ImageProcessor
 
-	err = ip.orient(img, req)
-	if err != nil {
-		ip.Logger.Errorf("Error orienting image: %s", err)
-		return err
+// NewChainedImageProcessor returns an ImageProcessor that applies each of the
+// given processors in order, e.g. a resizing processor followed by a
+// watermarking processor. A single processor is returned as is.
+func NewChainedImageProcessor(processors ...ImageProcessor) ImageProcessor {
+	if len(processors) == 1 {
+		return processors[0]
 	}
+	return chainedImageProcessor(processors)
+}
 
-	err = ip.resize(img, req)
+// ProcessImage applies the request to the image with the first processor. The
+// following processors only apply the stages configured for them, and the
+// output settings of the request.
+func (c chainedImageProcessor) ProcessImage(ctx context.Context, img *Image, req *ImageProcessorOptions) error {
+	err := c[0].ProcessImage(ctx, img, req)
 	if err != nil {
-		ip.Logger.Errorf("Error resizing image: %s", err)
 		return err
 	}
 
-	err = ip.blur(img, req)
-	if err != nil {
-		ip.Logger.Errorf("Error blurring image: %s", err)
-		return err
+	for _, processor := range c[1:] {
+		err = processor.ProcessImage(ctx, img, req.chainedOptions(img.GetDimensions()))
+		if err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
-func (ip *imageProcessor) orient(img *Image, req *ImageProcessorOptions) error {
-	if !ip.Config.AutoOrient {
-		return nil
-	}
-
-	orientation := img.Wand.GetImageOrientation()
-
-	switch orientation {
-	case imagick.ORIENTATION_UNDEFINED:
-	case imagick.ORIENTATION_TOP_LEFT:
-		return nil
+// chainedOptions returns the options of the processors following the first
+// in a chain, for an image of the given dimensions. The geometry and effects
+// requested have already been applied, so only the output settings are kept.
+func (o *ImageProcessorOptions) chainedOptions(dimensions ImageDimensions) *ImageProcessorOptions {
+	return &ImageProcessorOptions{
+		Dimensions:    dimensions,
+		Focalpoint:    o.Focalpoint,
+		PaletteColors: o.PaletteColors,
+		Colors:        o.Colors,
+		Output:        o.Output,
+		OutputFormat:  o.OutputFormat,
+		Background:    o.Background,
+		Quality:       o.Quality,
+		AutoQuality:   o.AutoQuality,
+		MaxBytes:      o.MaxBytes,
+		Subsampling:   o.Subsampling,
 	}
+}
 
-	transparent := imagick.NewPixelWand()
-	defer transparent.Destroy()
-	transparent.SetColor("none")
-
-	var err error
-
-	switch orientation {
-	case imagick.ORIENTATION_TOP_RIGHT:
-		err = img.Wand.FlopImage()
-	case imagick.ORIENTATION_BOTTOM_RIGHT:
-		err = img.Wand.RotateImage(transparent, 180)
-	case imagick.ORIENTATION_BOTTOM_LEFT:
-		err = img.Wand.FlipImage()
-	case imagick.ORIENTATION_LEFT_TOP:
-		err = img.Wand.TransposeImage()
-	case imagick.ORIENTATION_RIGHT_TOP:
-		err = img.Wand.RotateImage(transparent, 90)
-	case imagick.ORIENTATION_RIGHT_BOTTOM:
-		err = img.Wand.TransverseImage()
-	case imagick.ORIENTATION_LEFT_BOTTOM:
-		err = img.Wand.RotateImage(transparent, 270)
-	}
+// emptyImageProcessorOptions are the options of requests without processing
+// parameters.
+var emptyImageProcessorOptions, _ = parseImageProcessorOptions(
+	func(string) string { return "" }, nil)
 
-	if err != nil {
-		return err
-	}
-
-	return img.Wand.SetImageOrientation(imagick.ORIENTATION_TOP_LEFT)
+// RequestsProcessing returns whether the options request any processing of
+// the image beyond defaults, the options of a request without processing
+// parameters.
+func (o *ImageProcessorOptions) RequestsProcessing(defaults *ImageProcessorOptions) bool {
+	return o.Key() != defaults.Key()
 }
 
-func (ip *imageProcessor) resize(img *Image, req *ImageProcessorOptions) error {
-	scaleMode := req.ScaleMode
-	if scaleMode == 0 {
-		scaleMode = ip.Config.DefaultScaleMode
+// resolveRelativeSize sets the requested dimensions of relative size requests
+// from the dimensions of the image being resized. The options are absolute
+// afterwards, so chained processors don't scale the image again.
+func (o *ImageProcessorOptions) resolveRelativeSize(dimensions ImageDimensions) {
+	if o.RelativeSize == (ImageScale{}) {
+		return
 	}
-
-	resize, err := ip.resizePrepare(img.GetDimensions(), req.Dimensions, scaleMode)
-	if err != nil {
-		return err
+	resolved := o.RelativeSize.Dimensions(dimensions)
+	if resolved.Width != 0 {
+		o.Dimensions.Width = resolved.Width
 	}
-
-	if resize.Scale != EmptyImageDimensions {
-		err = ip.resizeApply(img, resize.Scale)
-		if err != nil {
-			return err
-		}
+	if resolved.Height != 0 {
+		o.Dimensions.Height = resolved.Height
 	}
+	o.RelativeSize = ImageScale{}
+}
 
-	if resize.Crop != EmptyImageDimensions {
-		err = ip.cropApply(img, resize.Crop, req.Focalpoint)
-		if err != nil {
-			return err
+// resolveSourceRegion returns the region of an image of the given dimensions
+// that is processed: the requested crop, zoomed into around the focal point.
+// Like relative sizes, the crop and zoom are cleared, so chained processors
+// don't apply them again.
+func (o *ImageProcessorOptions) resolveSourceRegion(dimensions ImageDimensions) ImageRegion {
+	region := ImageRegion{Width: dimensions.Width, Height: dimensions.Height}
+	if o.Crop != (ImageCrop{}) {
+		if crop := o.Crop.Region(dimensions); crop.Width != 0 && crop.Height != 0 {
+			region = crop
 		}
 	}
+	if o.Zoom > 1 {
+		region = region.Zoom(o.Zoom, o.Focalpoint)
+	}
+	o.Crop = ImageCrop{}
+	o.Zoom = 0
+	return region
+}
 
-	return nil
+// Key returns a normalized representation of the options, suitable for
+// identifying the result of processing an image with them.
+func (o *ImageProcessorOptions) Key() string {
+	data, _ := json.Marshal(o)
+	return string(data)
 }
 
-func (ip *imageProcessor) resizePrepare(oldDimensions, reqDimensions ImageDimensions, scaleMode uint) (*ResizeDimensions, error) {
+// resizePrepare computes the dimensions an image of oldDimensions is scaled
+// and cropped to for reqDimensions in scaleMode, within maxDimensions.
+func resizePrepare(oldDimensions, reqDimensions ImageDimensions, scaleMode uint, maxDimensions ImageDimensions) (*ResizeDimensions, error) {
 	resize := &ResizeDimensions{
 		Scale: ImageDimensions{},
 		Crop:  ImageDimensions{},
@@ -176,7 +293,7 @@ func (ip *imageProcessor) resizePrepare(oldDimensions, reqDimensions ImageDimens
 		return resize, nil
 	}
 
-	reqDimensions = clampDimensionsToMaxima(oldDimensions, reqDimensions, ip.Config.MaxImageDimensions)
+	reqDimensions = clampDimensionsToMaxima(oldDimensions, reqDimensions, maxDimensions)
 	oldAspectRatio := oldDimensions.AspectRatio()
 
 	// Unspecified dimensions are automatically computed relative to the specified
@@ -247,67 +364,46 @@ func (ip *imageProcessor) resizePrepare(oldDimensions, reqDimensions ImageDimens
 	return resize, nil
 }
 
-func (ip *imageProcessor) resizeApply(img *Image, dimensions ImageDimensions) error {
-	if dimensions == EmptyImageDimensions {
-		return nil
+// maxBytesAttempts bounds the number of times an image is encoded to find the
+// quality fitting it in the requested size.
+const maxBytesAttempts = 7
+
+// searchQuality binary-searches the highest quality at most quality whose
+// encoding by encode fits in maxBytes, in at most maxBytesAttempts encodings.
+// If none fits, the quality of the smallest encoding is returned.
+func searchQuality(maxBytes uint64, quality uint, encode func(uint) ([]byte, error)) (uint, []byte, error) {
+	data, err := encode(quality)
+	if err != nil || uint64(len(data)) <= maxBytes {
+		return quality, data, err
 	}
 
-	err := img.Wand.ResizeImage(dimensions.Width, dimensions.Height, imagick.FILTER_LANCZOS, 1)
-	if err != nil {
-		ip.Logger.Errorf("Failed resizing image: %s", err)
-		return err
-	}
-
-	err = img.Wand.SetImageInterpolateMethod(imagick.INTERPOLATE_PIXEL_BICUBIC)
-	if err != nil {
-		ip.Logger.Errorf("Failed getting interpolation method: %s", err)
-		return err
-	}
-
-	err = img.Wand.StripImage()
-	if err != nil {
-		ip.Logger.Errorf("Failed stripping image metadata: %s", err)
-		return err
-	}
-
-	if img.Wand.GetImageFormat() == "JPEG" {
-		err = img.Wand.SetInterlaceScheme(imagick.INTERLACE_PLANE)
-		if err != nil {
-			ip.Logger.Errorf("Failed setting image interlace scheme: %s", err)
-			return err
-		}
-
-		err = img.Wand.SetImageCompression(imagick.COMPRESSION_JPEG)
+	best, bestData, fits := quality, data, false
+	low, high := uint(1), quality-1
+	for attempt := 1; attempt < maxBytesAttempts && low <= high; attempt++ {
+		middle := (low + high) / 2
+		data, err = encode(middle)
 		if err != nil {
-			ip.Logger.Errorf("Failed setting image compression type: %s", err)
-			return err
+			return 0, nil, err
 		}
-
-		err = img.Wand.SetImageCompressionQuality(uint(ip.Config.ImageCompressionQuality))
-		if err != nil {
-			ip.Logger.Errorf("Failed setting compression quality: %s", err)
-			return err
+		if uint64(len(data)) <= maxBytes {
+			best, bestData, fits = middle, data, true
+			low = middle + 1
+		} else {
+			if !fits && len(data) < len(bestData) {
+				best, bestData = middle, data
+			}
+			high = middle - 1
 		}
 	}
-
-	return nil
-}
-
-func (ip *imageProcessor) cropApply(img *Image, reqDimensions ImageDimensions, focalpoint Focalpoint) error {
-	oldDimensions := img.GetDimensions()
-	x := int(focalpoint.X * (float64(oldDimensions.Width) - float64(reqDimensions.Width)))
-	y := int(focalpoint.Y * (float64(oldDimensions.Height) - float64(reqDimensions.Height)))
-	w := reqDimensions.Width
-	h := reqDimensions.Height
-	return img.Wand.CropImage(w, h, x, y)
+	return best, bestData, nil
 }
 
-func (ip *imageProcessor) blur(image *Image, request *ImageProcessorOptions) error {
-	if request.BlurRadius == 0 {
-		return nil
+func formatSupportsAlpha(format string) bool {
+	switch format {
+	case "PNG", "WEBP", "AVIF", "GIF", "TIFF":
+		return true
 	}
-	blurRadius := float64(image.GetWidth()) * request.BlurRadius * ip.Config.MaxBlurRadiusPercentage
-	return image.Wand.GaussianBlurImage(blurRadius, blurRadius)
+	return false
 }
 
 func aspectHeight(aspectRatio float64, width uint) uint {
@@ -0,0 +1,222 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	ImageProcessorBackendGo ImageProcessorBackend = "go"
+)
+
+// goImageProcessor resizes and crops images using only the Go standard library
+// and golang.org/x/image. It supports a reduced set of operations: resizing,
+// cropping and format conversion between JPEG, PNG and GIF. Other options are
+// ignored. Images are decoded and encoded by the processor, so it works on
+// images without a wand and is available in binaries built without cgo.
+type goImageProcessor struct {
+	Config *ProcessorConfig
+	Logger *Logger
+}
+
+// NewGoImageProcessorWithConfig returns an ImageProcessor that doesn't use
+// ImageMagick for processing.
+func NewGoImageProcessorWithConfig(config *ProcessorConfig) ImageProcessor {
+	return &goImageProcessor{
+		Config: config,
+		Logger: NewLogger("image_processor.go.%s", config.Name),
+	}
+}
+
+// encodedImages returns whether the processors are all go backends, which
+// decode the images themselves.
+func encodedImages(configs []*ProcessorConfig) bool {
+	for _, config := range configs {
+		if config.Backend != ImageProcessorBackendGo {
+			return false
+		}
+	}
+	return len(configs) > 0
+}
+
+func (gp *goImageProcessor) ProcessImage(ctx context.Context, img *Image, req *ImageProcessorOptions) error {
+	if !gp.supports(req) {
+		gp.Logger.Warnf("Ignoring options unsupported by the go backend: %+v", req)
+	}
+
+	if req.Dimensions == EmptyImageDimensions && req.RelativeSize == (ImageScale{}) {
+		req.Dimensions.Width = uint(gp.Config.DefaultImageWidth)
+		req.Dimensions.Height = uint(gp.Config.DefaultImageHeight)
+	}
+
+	src, format, err := image.Decode(bytes.NewReader(img.getEncodedBytes()))
+	if err != nil {
+		gp.Logger.Errorf("Error decoding image: %s", err)
+		return err
+	}
+
+	bounds := src.Bounds()
+	dimensions := ImageDimensions{uint(bounds.Dx()), uint(bounds.Dy())}
+	region := req.resolveSourceRegion(dimensions)
+	if region != (ImageRegion{Width: dimensions.Width, Height: dimensions.Height}) {
+		dst := image.NewRGBA(image.Rect(0, 0, int(region.Width), int(region.Height)))
+		draw.Draw(dst, dst.Bounds(), src, bounds.Min.Add(image.Pt(int(region.X), int(region.Y))), draw.Src)
+		src = dst
+	}
+
+	src, err = gp.resize(src, req)
+	if err != nil {
+		gp.Logger.Errorf("Error resizing image: %s", err)
+		return err
+	}
+
+	// Gray images are encoded with a single channel.
+	if req.Grayscale {
+		gray := image.NewGray(src.Bounds())
+		draw.Draw(gray, gray.Bounds(), src, src.Bounds().Min, draw.Src)
+		src = gray
+	}
+
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	if req.OutputFormat != "" {
+		format = req.OutputFormat
+	}
+
+	var buffer bytes.Buffer
+	switch format {
+	case "jpeg", "JPEG":
+		quality := int(req.Quality)
+		if quality == 0 {
+			quality = int(gp.Config.ImageCompressionQuality)
+		}
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		if req.AutoQuality {
+			var autoQuality uint
+			autoQuality, err = searchAutoQuality(src, gp.Config.AutoQualityThreshold, func(quality uint) ([]byte, error) {
+				var buffer bytes.Buffer
+				err := jpeg.Encode(&buffer, src, &jpeg.Options{Quality: int(quality)})
+				return buffer.Bytes(), err
+			})
+			if err != nil {
+				break
+			}
+			quality = int(autoQuality)
+		}
+		if req.MaxBytes == 0 {
+			err = jpeg.Encode(&buffer, src, &jpeg.Options{Quality: quality})
+			break
+		}
+		var data []byte
+		_, data, err = searchQuality(req.MaxBytes, uint(quality), func(quality uint) ([]byte, error) {
+			var buffer bytes.Buffer
+			err := jpeg.Encode(&buffer, src, &jpeg.Options{Quality: int(quality)})
+			return buffer.Bytes(), err
+		})
+		buffer.Write(data)
+	case "gif", "GIF":
+		err = gif.Encode(&buffer, src, nil)
+	default:
+		// There is no pure Go WebP encoder, so anything else is returned as PNG.
+		err = png.Encode(&buffer, src)
+	}
+	if err != nil {
+		gp.Logger.Errorf("Error encoding image: %s", err)
+		return err
+	}
+
+	img.setEncodedBytes(buffer.Bytes())
+	return nil
+}
+
+func (gp *goImageProcessor) resize(src image.Image, req *ImageProcessorOptions) (image.Image, error) {
+	scaleMode := req.ScaleMode
+	if scaleMode == 0 {
+		scaleMode = gp.Config.DefaultScaleMode
+	}
+
+	bounds := src.Bounds()
+	dimensions := ImageDimensions{uint(bounds.Dx()), uint(bounds.Dy())}
+	req.resolveRelativeSize(dimensions)
+	resize, err := resizePrepare(dimensions, req.Dimensions, scaleMode, gp.Config.MaxImageDimensions)
+	if err != nil {
+		return nil, err
+	}
+
+	if resize.Scale != EmptyImageDimensions {
+		dst := image.NewRGBA(image.Rect(0, 0, int(resize.Scale.Width), int(resize.Scale.Height)))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+		src = dst
+		bounds = dst.Bounds()
+	}
+
+	if resize.Crop != EmptyImageDimensions {
+		x := int(req.Focalpoint.X * float64(bounds.Dx()-int(resize.Crop.Width)))
+		y := int(req.Focalpoint.Y * float64(bounds.Dy()-int(resize.Crop.Height)))
+		dst := image.NewRGBA(image.Rect(0, 0, int(resize.Crop.Width), int(resize.Crop.Height)))
+		draw.Draw(dst, dst.Bounds(), src, bounds.Min.Add(image.Pt(x, y)), draw.Src)
+		src = dst
+	}
+
+	return src, nil
+}
+
+// supports returns whether the go backend can handle all options of the
+// request.
+func (gp *goImageProcessor) supports(req *ImageProcessorOptions) bool {
+	return len(req.Operations) == 0 &&
+		!req.Trim &&
+		req.BlurRadius == 0 &&
+		req.Pixelate == 0 &&
+		req.CornerRadius == 0 &&
+		req.Mask == MaskNone &&
+		req.Colors == 0 &&
+		req.Adjustments == (ImageAdjustments{}) &&
+		req.Sepia == 0 &&
+		!req.Invert &&
+		req.Posterize == 0 &&
+		req.Threshold == 0 &&
+		req.Duotone == (ImageDuotone{}) &&
+		req.Tint == (ImageTint{}) &&
+		req.Vignette == (ImageVignette{}) &&
+		req.Gradient == (ImageGradient{}) &&
+		req.Fill == "" &&
+		req.Border == (ImageBorder{}) &&
+		!gp.Config.AutoOrient
+}
+
+func init() {
+	RegisterProcessor(ImageProcessorBackendGo, NewGoImageProcessorWithConfig)
+}
@@ -0,0 +1,682 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+// +build cgo
+
+package halfshell
+
+import (
+	"context"
+	"math"
+
+	"github.com/rafikk/imagick/imagick"
+)
+
+type imageProcessor struct {
+	Config *ProcessorConfig
+	Logger *Logger
+}
+
+// NewImageMagickImageProcessorWithConfig returns the default ImageProcessor,
+// which performs all image manipulation with ImageMagick.
+func NewImageMagickImageProcessorWithConfig(config *ProcessorConfig) ImageProcessor {
+	return newImageMagickImageProcessor(config)
+}
+
+func newImageMagickImageProcessor(config *ProcessorConfig) *imageProcessor {
+	return &imageProcessor{
+		Config: config,
+		Logger: NewLogger("image_processor.%s", config.Name),
+	}
+}
+
+func (ip *imageProcessor) ProcessImage(ctx context.Context, img *Image, req *ImageProcessorOptions) error {
+	err := img.ensureWand()
+	if err != nil {
+		ip.Logger.Errorf("Error decoding image: %s", err)
+		return err
+	}
+
+	// The wand is about to be modified, so the original encoded bytes no
+	// longer represent the image.
+	img.blob = nil
+
+	if req.Dimensions == EmptyImageDimensions && req.RelativeSize == (ImageScale{}) {
+		req.Dimensions.Width = uint(ip.Config.DefaultImageWidth)
+		req.Dimensions.Height = uint(ip.Config.DefaultImageHeight)
+	}
+
+	err = ip.runStages(ctx, img, req, []namedImageStage{
+		{"orienting", (*imageProcessor).orient},
+		{"cropping", (*imageProcessor).crop},
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(req.Operations) > 0 {
+		err = ip.applyOperations(ctx, img, req)
+		if err != nil {
+			return err
+		}
+		return ip.finish(ctx, img, req)
+	}
+
+	err = ip.runStages(ctx, img, req, []namedImageStage{
+		{"trimming", (*imageProcessor).trim},
+		{"resizing", (*imageProcessor).resize},
+		{"blurring", (*imageProcessor).blur},
+		{"pixelating", (*imageProcessor).pixelate},
+		{"adjusting", (*imageProcessor).adjust},
+		{"desaturating", (*imageProcessor).grayscale},
+		{"sepia toning", (*imageProcessor).sepia},
+		{"inverting", (*imageProcessor).invert},
+		{"posterizing", (*imageProcessor).posterize},
+		{"thresholding", (*imageProcessor).threshold},
+		{"duotoning", (*imageProcessor).duotone},
+		{"tinting", (*imageProcessor).tint},
+		{"vignetting", (*imageProcessor).vignette},
+		{"shading", (*imageProcessor).gradient},
+		{"bordering", (*imageProcessor).border},
+		{"masking", (*imageProcessor).mask},
+	})
+	if err != nil {
+		return err
+	}
+
+	return ip.finish(ctx, img, req)
+}
+
+// finish applies the output stages common to the flat request parameters and
+// operation pipelines. Metadata is scrubbed before fitting, so the encoded
+// size measured by fit is the size of the final image.
+func (ip *imageProcessor) finish(ctx context.Context, img *Image, req *ImageProcessorOptions) error {
+	return ip.runStages(ctx, img, req, []namedImageStage{
+		{"overlaying", (*imageProcessor).overlay},
+		{"converting", (*imageProcessor).convert},
+		{"compressing", (*imageProcessor).compress},
+		{"subsampling", (*imageProcessor).subsample},
+		{"quantizing", (*imageProcessor).quantize},
+		{"scrubbing", (*imageProcessor).scrub},
+		{"fitting", (*imageProcessor).fit},
+	})
+}
+
+type namedImageStage struct {
+	Name  string
+	Stage imageStage
+}
+
+// runStages applies stages to the image in order. ImageMagick operations can't
+// be interrupted, so the context is checked before each stage.
+func (ip *imageProcessor) runStages(ctx context.Context, img *Image, req *ImageProcessorOptions, stages []namedImageStage) error {
+	for _, stage := range stages {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		err = stage.Stage(ip, img, req)
+		if err != nil {
+			ip.Logger.Errorf("Error %s image: %s", stage.Name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// applyOperations runs the requested operation pipeline in order. Request-wide
+// settings such as the focal point and background color apply to every stage.
+func (ip *imageProcessor) applyOperations(ctx context.Context, img *Image, req *ImageProcessorOptions) error {
+	for _, operation := range req.Operations {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		options := operation.Options
+		options.Focalpoint = req.Focalpoint
+		options.Region = req.Region
+		options.Background = req.Background
+		options.Fill = req.Fill
+
+		err = imageOperationStages[operation.Name](ip, img, &options)
+		if err != nil {
+			ip.Logger.Errorf("Error applying operation %s: %s", operation.Name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (ip *imageProcessor) orient(img *Image, req *ImageProcessorOptions) error {
+	if !ip.Config.AutoOrient {
+		return nil
+	}
+
+	orientation := img.Wand.GetImageOrientation()
+
+	switch orientation {
+	case imagick.ORIENTATION_UNDEFINED:
+	case imagick.ORIENTATION_TOP_LEFT:
+		return nil
+	}
+
+	transparent := imagick.NewPixelWand()
+	defer transparent.Destroy()
+	transparent.SetColor("none")
+
+	var err error
+
+	switch orientation {
+	case imagick.ORIENTATION_TOP_RIGHT:
+		err = img.Wand.FlopImage()
+	case imagick.ORIENTATION_BOTTOM_RIGHT:
+		err = img.Wand.RotateImage(transparent, 180)
+	case imagick.ORIENTATION_BOTTOM_LEFT:
+		err = img.Wand.FlipImage()
+	case imagick.ORIENTATION_LEFT_TOP:
+		err = img.Wand.TransposeImage()
+	case imagick.ORIENTATION_RIGHT_TOP:
+		err = img.Wand.RotateImage(transparent, 90)
+	case imagick.ORIENTATION_RIGHT_BOTTOM:
+		err = img.Wand.TransverseImage()
+	case imagick.ORIENTATION_LEFT_BOTTOM:
+		err = img.Wand.RotateImage(transparent, 270)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return img.Wand.SetImageOrientation(imagick.ORIENTATION_TOP_LEFT)
+}
+
+// trim removes uniform-color borders from the image. The fuzz tolerance is a
+// percentage of the color range, so that near-white product photo backgrounds
+// are removed as well.
+func (ip *imageProcessor) trim(img *Image, req *ImageProcessorOptions) error {
+	if !req.Trim {
+		return nil
+	}
+
+	fuzz := math.Max(0, math.Min(100, req.TrimFuzz)) / 100 * imagick.QUANTUM_RANGE
+	err := img.Wand.TrimImage(fuzz)
+	if err != nil {
+		return err
+	}
+
+	return img.Wand.ResetImagePage("")
+}
+
+func (ip *imageProcessor) resize(img *Image, req *ImageProcessorOptions) error {
+	scaleMode := req.ScaleMode
+	if scaleMode == 0 && req.Fill != "" {
+		scaleMode = ScaleAspectFit
+	} else if scaleMode == 0 {
+		scaleMode = ip.Config.DefaultScaleMode
+	}
+
+	oldDimensions := img.GetDimensions()
+	req.resolveRelativeSize(oldDimensions)
+	resize, err := resizePrepare(oldDimensions, req.Dimensions, scaleMode, ip.Config.MaxImageDimensions)
+	if err != nil {
+		return err
+	}
+
+	if resize.Scale != EmptyImageDimensions {
+		err = ip.resizeApply(img, resize.Scale)
+		if err != nil {
+			return err
+		}
+
+		if resize.Scale.Width < oldDimensions.Width || resize.Scale.Height < oldDimensions.Height {
+			err = ip.sharpen(img)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if resize.Crop != EmptyImageDimensions {
+		err = ip.cropApply(img, resize.Crop, req.Focalpoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ip.pad(img, req)
+}
+
+// cropToAspectRatio crops the largest possible area with the requested aspect
+// ratio around the focal point.
+func (ip *imageProcessor) cropToAspectRatio(img *Image, req *ImageProcessorOptions) error {
+	if req.AspectRatio == 0 {
+		return nil
+	}
+
+	dimensions := img.GetDimensions()
+	crop := dimensions
+	if dimensions.AspectRatio() > req.AspectRatio {
+		crop.Width = aspectWidth(req.AspectRatio, dimensions.Height)
+	} else {
+		crop.Height = aspectHeight(req.AspectRatio, dimensions.Width)
+	}
+	if crop == dimensions {
+		return nil
+	}
+
+	return ip.cropApply(img, crop, req.Focalpoint)
+}
+
+func (ip *imageProcessor) resizeApply(img *Image, dimensions ImageDimensions) error {
+	if dimensions == EmptyImageDimensions {
+		return nil
+	}
+
+	err := img.Wand.ResizeImage(dimensions.Width, dimensions.Height, imagick.FILTER_LANCZOS, 1)
+	if err != nil {
+		ip.Logger.Errorf("Failed resizing image: %s", err)
+		return err
+	}
+
+	err = img.Wand.SetImageInterpolateMethod(imagick.INTERPOLATE_PIXEL_BICUBIC)
+	if err != nil {
+		ip.Logger.Errorf("Failed getting interpolation method: %s", err)
+		return err
+	}
+
+	// Scrubbed metadata is kept through resizing, and scrubbed once the
+	// image is finished.
+	if ip.Config.Metadata != MetadataScrub {
+		err = img.Wand.StripImage()
+		if err != nil {
+			ip.Logger.Errorf("Failed stripping image metadata: %s", err)
+			return err
+		}
+	}
+
+	if img.Wand.GetImageFormat() == "JPEG" {
+		err = img.Wand.SetInterlaceScheme(imagick.INTERLACE_PLANE)
+		if err != nil {
+			ip.Logger.Errorf("Failed setting image interlace scheme: %s", err)
+			return err
+		}
+
+		err = img.Wand.SetImageCompression(imagick.COMPRESSION_JPEG)
+		if err != nil {
+			ip.Logger.Errorf("Failed setting image compression type: %s", err)
+			return err
+		}
+
+		err = img.Wand.SetImageCompressionQuality(uint(ip.Config.ImageCompressionQuality))
+		if err != nil {
+			ip.Logger.Errorf("Failed setting compression quality: %s", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sharpen applies the processor's unsharp mask, which restores the detail
+// Lanczos filtering softens when downscaling.
+func (ip *imageProcessor) sharpen(img *Image) error {
+	sharpen := ip.Config.Sharpen
+	if !sharpen.Enabled {
+		return nil
+	}
+
+	err := img.Wand.UnsharpMaskImage(sharpen.Radius, sharpen.Sigma, sharpen.Amount, sharpen.Threshold)
+	if err != nil {
+		ip.Logger.Errorf("Failed sharpening image: %s", err)
+		return err
+	}
+	return nil
+}
+
+// crop crops the image to the requested rectangle and zooms into it, before
+// any other processing.
+func (ip *imageProcessor) crop(img *Image, req *ImageProcessorOptions) error {
+	dimensions := img.GetDimensions()
+	region := req.resolveSourceRegion(dimensions)
+	if region == (ImageRegion{Width: dimensions.Width, Height: dimensions.Height}) {
+		return nil
+	}
+	return img.Wand.CropImage(region.Width, region.Height, int(region.X), int(region.Y))
+}
+
+func (ip *imageProcessor) cropApply(img *Image, reqDimensions ImageDimensions, focalpoint Focalpoint) error {
+	oldDimensions := img.GetDimensions()
+	x := int(focalpoint.X * (float64(oldDimensions.Width) - float64(reqDimensions.Width)))
+	y := int(focalpoint.Y * (float64(oldDimensions.Height) - float64(reqDimensions.Height)))
+	w := reqDimensions.Width
+	h := reqDimensions.Height
+	return img.Wand.CropImage(w, h, x, y)
+}
+
+func (ip *imageProcessor) blur(image *Image, request *ImageProcessorOptions) error {
+	if request.BlurRadius == 0 {
+		return nil
+	}
+	blurRadius := float64(image.GetWidth()) * request.BlurRadius * ip.Config.MaxBlurRadiusPercentage
+	return ip.applyToRegion(image, request.Region, func(wand *imagick.MagickWand) error {
+		return wand.GaussianBlurImage(blurRadius, blurRadius)
+	})
+}
+
+// pixelate replaces the image (or the requested region) with blocks of
+// request.Pixelate pixels on each side.
+func (ip *imageProcessor) pixelate(image *Image, request *ImageProcessorOptions) error {
+	if request.Pixelate < 2 {
+		return nil
+	}
+	return ip.applyToRegion(image, request.Region, func(wand *imagick.MagickWand) error {
+		width, height := wand.GetImageWidth(), wand.GetImageHeight()
+		scaledWidth := (width + request.Pixelate - 1) / request.Pixelate
+		scaledHeight := (height + request.Pixelate - 1) / request.Pixelate
+		if err := wand.ScaleImage(scaledWidth, scaledHeight); err != nil {
+			return err
+		}
+		return wand.SampleImage(width, height)
+	})
+}
+
+// applyToRegion runs an operation on a region of the image only. If the region
+// is empty, the operation is applied to the whole image.
+func (ip *imageProcessor) applyToRegion(image *Image, region ImageRegion, operation func(*imagick.MagickWand) error) error {
+	if region == EmptyImageRegion {
+		return operation(image.Wand)
+	}
+
+	region = region.Clamp(image.GetDimensions())
+	if region.Width == 0 || region.Height == 0 {
+		return nil
+	}
+
+	wand := image.Wand.Clone()
+	defer wand.Destroy()
+
+	err := wand.CropImage(region.Width, region.Height, int(region.X), int(region.Y))
+	if err != nil {
+		return err
+	}
+	err = wand.ResetImagePage("")
+	if err != nil {
+		return err
+	}
+	err = operation(wand)
+	if err != nil {
+		return err
+	}
+
+	return image.Wand.CompositeImage(wand, imagick.COMPOSITE_OP_OVER, int(region.X), int(region.Y))
+}
+
+// mask applies an alpha mask with rounded corners or a circular shape to the
+// image. Formats without an alpha channel are converted to PNG.
+func (ip *imageProcessor) mask(image *Image, request *ImageProcessorOptions) error {
+	if request.CornerRadius == 0 && request.Mask != MaskCircle {
+		return nil
+	}
+
+	width, height := image.GetWidth(), image.GetHeight()
+
+	transparent := imagick.NewPixelWand()
+	defer transparent.Destroy()
+	transparent.SetColor("none")
+
+	opaque := imagick.NewPixelWand()
+	defer opaque.Destroy()
+	opaque.SetColor("white")
+
+	draw := imagick.NewDrawingWand()
+	defer draw.Destroy()
+	draw.SetFillColor(opaque)
+
+	if request.Mask == MaskCircle {
+		diameter := math.Min(float64(width), float64(height))
+		centerX, centerY := float64(width)/2, float64(height)/2
+		draw.Circle(centerX, centerY, centerX, centerY-diameter/2)
+	} else {
+		radius := float64(request.CornerRadius)
+		draw.RoundRectangle(0, 0, float64(width-1), float64(height-1), radius, radius)
+	}
+
+	mask := imagick.NewMagickWand()
+	defer mask.Destroy()
+
+	err := mask.NewImage(width, height, transparent)
+	if err != nil {
+		return err
+	}
+	err = mask.DrawImage(draw)
+	if err != nil {
+		return err
+	}
+
+	if !formatSupportsAlpha(image.Wand.GetImageFormat()) {
+		err = image.Wand.SetImageFormat("PNG")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = image.Wand.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_SET)
+	if err != nil {
+		return err
+	}
+
+	return image.Wand.CompositeImage(mask, imagick.COMPOSITE_OP_DST_IN, 0, 0)
+}
+
+// convert changes the format of the image to the requested output format.
+// Transparent images converted to a format without an alpha channel are
+// flattened onto the background color first.
+func (ip *imageProcessor) convert(image *Image, request *ImageProcessorOptions) error {
+	format := request.OutputFormat
+	if format == "" || format == image.Wand.GetImageFormat() {
+		return nil
+	}
+
+	if !formatSupportsAlpha(format) && image.Wand.GetImageAlphaChannel() {
+		background := request.Background
+		if background == "" {
+			background = ip.Config.BackgroundColor
+		}
+
+		color := imagick.NewPixelWand()
+		defer color.Destroy()
+		if !color.SetColor(background) {
+			color.SetColor("white")
+		}
+
+		err := image.Wand.SetImageBackgroundColor(color)
+		if err != nil {
+			return err
+		}
+
+		flattened := image.Wand.MergeImageLayers(imagick.IMAGE_LAYER_FLATTEN)
+		image.Wand.Destroy()
+		image.Wand = flattened
+	}
+
+	err := image.Wand.SetImageFormat(format)
+	if err != nil {
+		return err
+	}
+
+	if format == "JPEG" || format == "WEBP" || format == "AVIF" {
+		return image.Wand.SetImageCompressionQuality(uint(ip.Config.ImageCompressionQuality))
+	}
+
+	return nil
+}
+
+// compress applies the compression quality requested for JPEG, WebP and AVIF
+// output, overriding the processor's image_compression_quality.
+func (ip *imageProcessor) compress(image *Image, request *ImageProcessorOptions) error {
+	if request.AutoQuality {
+		return ip.compressAuto(image)
+	}
+	if request.Quality == 0 {
+		return nil
+	}
+
+	switch image.Wand.GetImageFormat() {
+	case "JPEG", "WEBP", "AVIF":
+		return image.Wand.SetImageCompressionQuality(request.Quality)
+	}
+
+	return nil
+}
+
+// subsample applies the chroma subsampling of the request, or else of the
+// processor, to JPEG output. ImageMagick's default is used if neither is set.
+func (ip *imageProcessor) subsample(image *Image, request *ImageProcessorOptions) error {
+	subsampling := request.Subsampling
+	if subsampling == "" {
+		subsampling = ip.Config.ChromaSubsampling
+	}
+	if subsampling == "" || image.Wand.GetImageFormat() != "JPEG" {
+		return nil
+	}
+	return image.Wand.SetOption("jpeg:sampling-factor", ChromaSubsamplings[subsampling])
+}
+
+// scrub removes the private EXIF fields of images, keeping the rest of the
+// EXIF data and the color profile, if the processor's metadata mode is
+// MetadataScrub. Unreadable EXIF data is removed entirely.
+func (ip *imageProcessor) scrub(image *Image, request *ImageProcessorOptions) error {
+	if ip.Config.Metadata != MetadataScrub {
+		return nil
+	}
+
+	exif := image.Wand.GetImageProfile("exif")
+	icc := image.Wand.GetImageProfile("icc")
+	err := image.Wand.StripImage()
+	if err != nil {
+		return err
+	}
+
+	if icc != "" {
+		err = image.Wand.SetImageProfile("icc", []byte(icc))
+		if err != nil {
+			return err
+		}
+	}
+	if exif != "" {
+		scrubbed, err := scrubExif([]byte(exif))
+		if err != nil {
+			ip.Logger.Warnf("Removing unreadable EXIF data: %v", err)
+			return nil
+		}
+		return image.Wand.SetImageProfile("exif", scrubbed)
+	}
+	return nil
+}
+
+// compressAuto applies the lowest quality whose JPEG or WebP encoding stays
+// within the processor's auto_quality_threshold of the unencoded image.
+func (ip *imageProcessor) compressAuto(image *Image) error {
+	switch image.Wand.GetImageFormat() {
+	case "JPEG", "WEBP":
+	default:
+		return nil
+	}
+
+	dimensions := image.GetDimensions()
+	reference, err := image.GetThumbnail(uint(math.Max(float64(dimensions.Width), float64(dimensions.Height))))
+	if err != nil {
+		return err
+	}
+	quality, err := searchAutoQuality(reference, ip.Config.AutoQualityThreshold, func(quality uint) ([]byte, error) {
+		if err := image.Wand.SetImageCompressionQuality(quality); err != nil {
+			return nil, err
+		}
+		return image.Wand.GetImageBlob(), nil
+	})
+	if err != nil {
+		return err
+	}
+	return image.Wand.SetImageCompressionQuality(quality)
+}
+
+// fit lowers the compression quality of JPEG and WebP output until the encoded
+// image fits in request.MaxBytes. If it doesn't fit at any quality tried, the
+// smallest encoding is kept.
+func (ip *imageProcessor) fit(image *Image, request *ImageProcessorOptions) error {
+	if request.MaxBytes == 0 {
+		return nil
+	}
+
+	switch image.Wand.GetImageFormat() {
+	case "JPEG", "WEBP":
+	default:
+		return nil
+	}
+
+	quality := image.Wand.GetImageCompressionQuality()
+	if quality == 0 {
+		quality = 92
+	}
+	quality, data, err := searchQuality(request.MaxBytes, quality, func(quality uint) ([]byte, error) {
+		if err := image.Wand.SetImageCompressionQuality(quality); err != nil {
+			return nil, err
+		}
+		return image.Wand.GetImageBlob(), nil
+	})
+	if err != nil {
+		return err
+	}
+	if uint64(len(data)) > request.MaxBytes {
+		ip.Logger.Warnf("Image doesn't fit in %d bytes, returning %d bytes at quality %d",
+			request.MaxBytes, len(data), quality)
+	}
+	return image.Wand.SetImageCompressionQuality(quality)
+}
+
+// quantize reduces PNG output to a limited color palette. The number of colors
+// is taken from the request, falling back to the processor's configured
+// png_palette_colors. A value of 0 leaves the image untouched.
+func (ip *imageProcessor) quantize(image *Image, request *ImageProcessorOptions) error {
+	if image.Wand.GetImageFormat() != "PNG" {
+		return nil
+	}
+
+	colors := request.Colors
+	if colors == 0 {
+		colors = uint(ip.Config.PNGPaletteColors)
+	}
+	if colors == 0 {
+		return nil
+	}
+	if colors > 256 {
+		colors = 256
+	}
+
+	colorspace := image.Wand.GetImageColorspace()
+	return image.Wand.QuantizeImage(colors, colorspace, 0, ip.Config.PNGPaletteDither, false)
+}
+
+func init() {
+	RegisterProcessor(ImageProcessorBackendImageMagick, NewImageMagickImageProcessorWithConfig)
+}
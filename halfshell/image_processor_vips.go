@@ -0,0 +1,212 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build vips && cgo
+// +build vips,cgo
+
+package halfshell
+
+import (
+	"context"
+	"sync"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+const (
+	ImageProcessorBackendVips ImageProcessorBackend = "vips"
+)
+
+var vipsStartup sync.Once
+
+// vipsImageProcessor resizes, crops and blurs images with libvips, which is
+// considerably faster and uses far less memory than ImageMagick for these
+// operations. Requests using other operations are handed to the ImageMagick
+// processor.
+type vipsImageProcessor struct {
+	*imageProcessor
+}
+
+// NewVipsImageProcessorWithConfig returns an ImageProcessor backed by libvips.
+// It is only available in binaries built with the "vips" build tag.
+func NewVipsImageProcessorWithConfig(config *ProcessorConfig) ImageProcessor {
+	vipsStartup.Do(func() { vips.Startup(nil) })
+	ip := newImageMagickImageProcessor(config)
+	ip.Logger = NewLogger("image_processor.vips.%s", config.Name)
+	return &vipsImageProcessor{ip}
+}
+
+func (vp *vipsImageProcessor) ProcessImage(ctx context.Context, img *Image, req *ImageProcessorOptions) error {
+	if !vp.supports(req) {
+		return vp.imageProcessor.ProcessImage(ctx, img, req)
+	}
+
+	if req.Dimensions == EmptyImageDimensions && req.RelativeSize == (ImageScale{}) {
+		req.Dimensions.Width = uint(vp.Config.DefaultImageWidth)
+		req.Dimensions.Height = uint(vp.Config.DefaultImageHeight)
+	}
+
+	ref, err := vips.NewImageFromBuffer(img.getEncodedBytes())
+	if err != nil {
+		vp.Logger.Errorf("Error loading image: %s", err)
+		return err
+	}
+	defer ref.Close()
+
+	if vp.Config.AutoOrient {
+		err = ref.AutoRotate()
+		if err != nil {
+			vp.Logger.Errorf("Error orienting image: %s", err)
+			return err
+		}
+	}
+
+	dimensions := ImageDimensions{uint(ref.Width()), uint(ref.Height())}
+	region := req.resolveSourceRegion(dimensions)
+	if region != (ImageRegion{Width: dimensions.Width, Height: dimensions.Height}) {
+		err = ref.ExtractArea(int(region.X), int(region.Y), int(region.Width), int(region.Height))
+		if err != nil {
+			vp.Logger.Errorf("Error cropping image: %s", err)
+			return err
+		}
+	}
+
+	err = vp.resize(ref, req)
+	if err != nil {
+		vp.Logger.Errorf("Error resizing image: %s", err)
+		return err
+	}
+
+	if req.BlurRadius != 0 {
+		blurRadius := float64(ref.Width()) * req.BlurRadius * vp.Config.MaxBlurRadiusPercentage
+		err = ref.GaussianBlur(blurRadius)
+		if err != nil {
+			vp.Logger.Errorf("Error blurring image: %s", err)
+			return err
+		}
+	}
+
+	var bytes []byte
+	if ref.Format() == vips.ImageTypeJPEG {
+		bytes, _, err = ref.ExportJpeg(&vips.JpegExportParams{
+			Quality:       int(vp.Config.ImageCompressionQuality),
+			Interlace:     true,
+			StripMetadata: vp.Config.Metadata != MetadataScrub,
+		})
+	} else {
+		bytes, _, err = ref.ExportNative()
+	}
+	if err != nil {
+		vp.Logger.Errorf("Error encoding image: %s", err)
+		return err
+	}
+
+	err = img.SetBytes(bytes)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	// Format conversion, quality and quantization are cheap on the resized
+	// image, so they are left to ImageMagick.
+	err = vp.finish(ctx, img, req)
+	img.blob = nil
+	return err
+}
+
+func (vp *vipsImageProcessor) resize(ref *vips.ImageRef, req *ImageProcessorOptions) error {
+	scaleMode := req.ScaleMode
+	if scaleMode == 0 {
+		scaleMode = vp.Config.DefaultScaleMode
+	}
+
+	dimensions := ImageDimensions{uint(ref.Width()), uint(ref.Height())}
+	req.resolveRelativeSize(dimensions)
+	resize, err := resizePrepare(dimensions, req.Dimensions, scaleMode, vp.Config.MaxImageDimensions)
+	if err != nil {
+		return err
+	}
+
+	if resize.Scale != EmptyImageDimensions {
+		err = ref.ResizeWithVScale(
+			float64(resize.Scale.Width)/float64(dimensions.Width),
+			float64(resize.Scale.Height)/float64(dimensions.Height),
+			vips.KernelLanczos3)
+		if err != nil {
+			return err
+		}
+
+		if resize.Scale.Width < dimensions.Width || resize.Scale.Height < dimensions.Height {
+			err = vp.sharpen(ref)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if resize.Crop != EmptyImageDimensions {
+		x := int(req.Focalpoint.X * float64(ref.Width()-int(resize.Crop.Width)))
+		y := int(req.Focalpoint.Y * float64(ref.Height()-int(resize.Crop.Height)))
+		return ref.ExtractArea(x, y, int(resize.Crop.Width), int(resize.Crop.Height))
+	}
+
+	return nil
+}
+
+// sharpen applies the processor's unsharp mask with libvips, which derives
+// the radius from the sigma. The threshold is converted to the L* units
+// libvips uses.
+func (vp *vipsImageProcessor) sharpen(ref *vips.ImageRef) error {
+	sharpen := vp.Config.Sharpen
+	if !sharpen.Enabled {
+		return nil
+	}
+	return ref.Sharpen(sharpen.Sigma, sharpen.Threshold*100, sharpen.Amount)
+}
+
+// supports returns whether libvips can handle all operations of the request.
+func (vp *vipsImageProcessor) supports(req *ImageProcessorOptions) bool {
+	return len(req.Operations) == 0 &&
+		!req.Trim &&
+		req.Pixelate == 0 &&
+		req.Region == EmptyImageRegion &&
+		req.CornerRadius == 0 &&
+		req.Mask == MaskNone &&
+		req.Adjustments == (ImageAdjustments{}) &&
+		!req.Grayscale &&
+		req.Sepia == 0 &&
+		!req.Invert &&
+		req.Posterize == 0 &&
+		req.Threshold == 0 &&
+		req.Duotone == (ImageDuotone{}) &&
+		req.Tint == (ImageTint{}) &&
+		req.Vignette == (ImageVignette{}) &&
+		req.Gradient == (ImageGradient{}) &&
+		req.Fill == "" &&
+		req.Border == (ImageBorder{})
+}
+
+func init() {
+	RegisterProcessor(ImageProcessorBackendVips, NewVipsImageProcessorWithConfig)
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+)
+
+// QualityAuto is the value of the quality parameter picking the quality of
+// each image by its perceptual distance from the unencoded image.
+const QualityAuto = "auto"
+
+// The range of qualities searched for automatic quality, and the number of
+// encodings tried.
+const (
+	autoQualityMin      = 30
+	autoQualityMax      = 95
+	autoQualityAttempts = 6
+)
+
+// searchAutoQuality binary-searches the lowest quality whose encoding by
+// encode is at most threshold away from reference, in structural
+// dissimilarity (DSSIM). Qualities between autoQualityMin and
+// autoQualityMax are tried, and autoQualityMax is returned if none is close
+// enough.
+func searchAutoQuality(reference image.Image, threshold float64, encode func(uint) ([]byte, error)) (uint, error) {
+	referenceLuma := lumaPlane(reference)
+
+	best := uint(autoQualityMax)
+	low, high := uint(autoQualityMin), uint(autoQualityMax-1)
+	for attempt := 0; attempt < autoQualityAttempts && low <= high; attempt++ {
+		middle := (low + high) / 2
+		data, err := encode(middle)
+		if err != nil {
+			return 0, err
+		}
+		encoded, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return 0, err
+		}
+		distance, err := dssim(referenceLuma, lumaPlane(encoded))
+		if err != nil {
+			return 0, err
+		}
+		if distance <= threshold {
+			best = middle
+			high = middle - 1
+		} else {
+			low = middle + 1
+		}
+	}
+	return best, nil
+}
+
+// plane is the luma channel of an image, with values from 0 to 255.
+type plane struct {
+	Width, Height int
+	Values        []float64
+}
+
+// lumaPlane returns the luma channel of img. The luma of JPEG images is read
+// as is rather than converted back from RGB.
+func lumaPlane(img image.Image) *plane {
+	bounds := img.Bounds()
+	p := &plane{Width: bounds.Dx(), Height: bounds.Dy()}
+	p.Values = make([]float64, p.Width*p.Height)
+
+	if ycbcr, ok := img.(*image.YCbCr); ok {
+		for y := 0; y < p.Height; y++ {
+			for x := 0; x < p.Width; x++ {
+				p.Values[y*p.Width+x] = float64(ycbcr.Y[ycbcr.YOffset(bounds.Min.X+x, bounds.Min.Y+y)])
+			}
+		}
+		return p
+	}
+
+	for y := 0; y < p.Height; y++ {
+		for x := 0; x < p.Width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			luma, _, _ := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			p.Values[y*p.Width+x] = float64(luma)
+		}
+	}
+	return p
+}
+
+// errPlaneSizeMismatch is returned when comparing images of different sizes.
+var errPlaneSizeMismatch = errors.New("Images have different dimensions")
+
+// dssim returns the structural dissimilarity of two luma planes, (1-SSIM)/2,
+// averaged over blocks of 8x8 pixels. It is 0 for identical images.
+func dssim(a, b *plane) (float64, error) {
+	if a.Width != b.Width || a.Height != b.Height {
+		return 0, errPlaneSizeMismatch
+	}
+
+	const (
+		block = 8
+		c1    = (0.01 * 255) * (0.01 * 255)
+		c2    = (0.03 * 255) * (0.03 * 255)
+	)
+
+	var total float64
+	var blocks int
+	for top := 0; top < a.Height; top += block {
+		for left := 0; left < a.Width; left += block {
+			var sumA, sumB, sumAA, sumBB, sumAB, n float64
+			for y := top; y < top+block && y < a.Height; y++ {
+				for x := left; x < left+block && x < a.Width; x++ {
+					valueA, valueB := a.Values[y*a.Width+x], b.Values[y*b.Width+x]
+					sumA += valueA
+					sumB += valueB
+					sumAA += valueA * valueA
+					sumBB += valueB * valueB
+					sumAB += valueA * valueB
+					n++
+				}
+			}
+			meanA, meanB := sumA/n, sumB/n
+			varianceA := sumAA/n - meanA*meanA
+			varianceB := sumBB/n - meanB*meanB
+			covariance := sumAB/n - meanA*meanB
+			total += ((2*meanA*meanB + c1) * (2*covariance + c2)) /
+				((meanA*meanA + meanB*meanB + c1) * (varianceA + varianceB + c2))
+			blocks++
+		}
+	}
+	if blocks == 0 {
+		return 0, nil
+	}
+	return (1 - total/float64(blocks)) / 2, nil
+}
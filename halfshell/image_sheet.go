@@ -0,0 +1,278 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSheetCell is the size of the cells of sheets without a cell
+// parameter.
+var DefaultSheetCell = ImageDimensions{160, 160}
+
+// MaxSheetCell is the largest cell size, and MaxSheetGutter the largest space
+// between cells, of sheets.
+var MaxSheetCell = ImageDimensions{1024, 1024}
+
+const MaxSheetGutter = 64
+
+// sheetFetchConcurrency bounds the number of tiles of a sheet retrieved at
+// once. Tiles are held from when they are retrieved until they are composed
+// into their cell, so it also bounds the number of originals in memory.
+const sheetFetchConcurrency = 8
+
+// An ImageSheet is a grid of images requested with the sheet output.
+type ImageSheet struct {
+	// Tiles are the source paths of the images. If there are none, they are
+	// listed in the manifest at the source path of the request, one per
+	// line.
+	Tiles []string
+
+	// Cell is the size of each image of the grid. Images are cropped to fill
+	// it.
+	Cell ImageDimensions
+
+	// Gutter is the space in pixels between cells.
+	Gutter uint
+
+	// Columns is the number of columns of the grid. The grid is about square
+	// if it is 0.
+	Columns uint
+}
+
+// parseImageSheet parses the sheet parameters returned by param.
+func parseImageSheet(param func(string) string) ImageSheet {
+	var tiles []string
+	for _, tile := range strings.Split(param("tiles"), ",") {
+		if tile = strings.TrimSpace(tile); tile != "" {
+			tiles = append(tiles, sheetTilePath(tile))
+		}
+	}
+	cell, _ := NewImageDimensionsFromString(param("cell"))
+	gutter, _ := strconv.ParseUint(param("gutter"), 10, 32)
+	columns, _ := strconv.ParseUint(param("columns"), 10, 32)
+	return ImageSheet{
+		Tiles:   tiles,
+		Cell:    cell,
+		Gutter:  uint(gutter),
+		Columns: uint(columns),
+	}
+}
+
+// sheetTilePath returns the source path of a tile listed in a request or a
+// manifest.
+func sheetTilePath(tile string) string {
+	if !strings.HasPrefix(tile, "/") {
+		return "/" + tile
+	}
+	return tile
+}
+
+// parseSheetManifest returns the tiles listed in a manifest, one per line.
+// Empty lines and lines starting with "#" are ignored.
+func parseSheetManifest(data []byte) []string {
+	var tiles []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			tiles = append(tiles, sheetTilePath(line))
+		}
+	}
+	return tiles
+}
+
+// processSheet retrieves the tiles of the sheet requested by r, crops them to
+// its cells and returns the encoded grid. Tiles that aren't found leave their
+// cell empty.
+func (s *Server) processSheet(ctx context.Context, r *Request) (*ProcessedImage, error) {
+	sheet := r.ProcessorOptions.Sheet
+	cell := sheet.Cell
+	if cell.Width == 0 || cell.Height == 0 {
+		cell = DefaultSheetCell
+	}
+	if cell.Width > MaxSheetCell.Width || cell.Height > MaxSheetCell.Height || sheet.Gutter > MaxSheetGutter {
+		s.Logger.Warnf("Rejecting sheet %s of %s cells with a %d pixel gutter", r.SourceOptions.Path, cell, sheet.Gutter)
+		return nil, NewHTTPError("Bad Request", http.StatusBadRequest)
+	}
+
+	tiles := sheet.Tiles
+	if len(tiles) == 0 {
+		sourceOptions := *r.SourceOptions
+		sourceOptions.Raw = true
+		manifest, err := r.Route.Source.GetImage(ctx, &sourceOptions)
+		if err != nil {
+			return nil, s.sourceError(ctx, r, err)
+		}
+		defer manifest.Destroy()
+		tiles = parseSheetManifest(manifest.getEncodedBytes())
+	}
+	maxTiles := int(r.Route.ProcessorConfig.MaxSheetTiles)
+	if len(tiles) == 0 || len(tiles) > maxTiles {
+		s.Logger.Warnf("Rejecting sheet %s of %d tiles", r.SourceOptions.Path, len(tiles))
+		return nil, NewHTTPError("Bad Request", http.StatusBadRequest)
+	}
+
+	columns := sheet.Columns
+	if columns == 0 {
+		columns = uint(math.Ceil(math.Sqrt(float64(len(tiles)))))
+	}
+	if columns > uint(len(tiles)) {
+		columns = uint(len(tiles))
+	}
+	rows := (uint(len(tiles)) + columns - 1) / columns
+
+	// The grid is bounded like the images the processor reads and writes.
+	size := ImageDimensions{
+		Width:  columns*cell.Width + (columns-1)*sheet.Gutter,
+		Height: rows*cell.Height + (rows-1)*sheet.Gutter,
+	}
+	maxDimensions := r.Route.ProcessorConfig.MaxImageDimensions
+	maxPixels := r.SourceOptions.Limits.MaxPixels
+	if (maxDimensions.Width > 0 && size.Width > maxDimensions.Width) ||
+		(maxDimensions.Height > 0 && size.Height > maxDimensions.Height) ||
+		(maxPixels > 0 && uint64(size.Width)*uint64(size.Height) > maxPixels) {
+		s.Logger.Warnf("Rejecting sheet %s of %s", r.SourceOptions.Path, size)
+		return nil, NewHTTPError("Bad Request", http.StatusBadRequest)
+	}
+
+	// Tiles are composed into the grid as they are retrieved, and destroyed
+	// right away, rather than all held until the grid is composed.
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	fetched := make(chan sheetTile)
+	signatures := make([]string, len(tiles))
+	var fetchErr error
+	go func() {
+		fetchErr = s.fetchSheetTiles(fetchCtx, r, tiles, signatures, fetched)
+		close(fetched)
+	}()
+
+	processedImage, err := s.composeSheet(ctx, r, fetched, tiles, cell, columns, rows)
+	cancel()
+	for tile := range fetched {
+		tile.destroy()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fetchErr != nil {
+		return nil, s.sourceError(ctx, r, fetchErr)
+	}
+
+	etag := NewETag(strings.Join(signatures, ""), r.Route.ProcessorHash, r.ProcessorOptions)
+	if isNotModified(r, etag, time.Time{}) {
+		return &ProcessedImage{ETag: etag}, ErrNotModified
+	}
+	processedImage.ETag = etag
+	return processedImage, nil
+}
+
+// A sheetTile is a tile of a sheet retrieved from the source, to be composed
+// into its cell.
+type sheetTile struct {
+	index   int
+	image   *Image
+	release func()
+}
+
+// destroy destroys the image of the tile, and lets the next tile be
+// retrieved.
+func (t sheetTile) destroy() {
+	t.image.Destroy()
+	t.release()
+}
+
+// fetchSheetTiles retrieves the images at the given source paths, sets their
+// signatures and sends them to fetched, up to sheetFetchConcurrency at once.
+// Each tile sent must be destroyed. Images that aren't found leave their
+// signature empty and aren't sent. Once a tile can't be retrieved, no more
+// are, and its error is returned.
+func (s *Server) fetchSheetTiles(ctx context.Context, r *Request, tiles []string, signatures []string, fetched chan<- sheetTile) error {
+	ctx, span := StartSpan(ctx, "source.fetch", SpanKindInternal)
+	defer span.Finish()
+	span.SetAttribute("halfshell.source.path", r.SourceOptions.Key())
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var fetchErr error
+	var failure sync.Once
+	semaphore := make(chan struct{}, sheetFetchConcurrency)
+	release := func() { <-semaphore }
+	var wait sync.WaitGroup
+fetching:
+	for index, tile := range tiles {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			break fetching
+		}
+		wait.Add(1)
+		go func(index int, tile string) {
+			defer wait.Done()
+			image, err := r.Route.Source.GetImage(ctx, &ImageSourceOptions{
+				Path:    tile,
+				Limits:  r.SourceOptions.Limits,
+				Bucket:  r.SourceOptions.Bucket,
+				Header:  r.SourceOptions.Header,
+				Encoded: r.SourceOptions.Encoded,
+			})
+			if err == nil {
+				err = runPostFetchHooks(r, image)
+				if err != nil {
+					image.Destroy()
+				}
+			}
+			if err == ErrImageNotFound {
+				s.Logger.Infof("Leaving missing tile %s of sheet %s empty", tile, r.SourceOptions.Path)
+			}
+			if err != nil {
+				if err != ErrImageNotFound {
+					failure.Do(func() { fetchErr = err })
+					cancel()
+				}
+				release()
+				return
+			}
+
+			signatures[index] = image.GetSignature()
+			select {
+			case fetched <- sheetTile{index: index, image: image, release: release}:
+			case <-ctx.Done():
+				image.Destroy()
+				release()
+			}
+		}(index, tile)
+	}
+	wait.Wait()
+
+	span.SetError(fetchErr)
+	return fetchErr
+}
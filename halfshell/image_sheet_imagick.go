@@ -0,0 +1,105 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+// +build cgo
+
+package halfshell
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/rafikk/imagick/imagick"
+)
+
+// composeSheet processes the tiles of a sheet fetched into cells of the given
+// size, destroying each once it is composed, and returns the encoded grid of
+// columns and rows they are composed into.
+func (s *Server) composeSheet(ctx context.Context, r *Request, fetched <-chan sheetTile, tiles []string, cell ImageDimensions, columns, rows uint) (*ProcessedImage, error) {
+	sheet := r.ProcessorOptions.Sheet
+	background := r.ProcessorOptions.Background
+	if background == "" {
+		background = r.Route.ProcessorConfig.BackgroundColor
+	}
+	color := imagick.NewPixelWand()
+	defer color.Destroy()
+	if !color.SetColor(background) {
+		color.SetColor("white")
+	}
+
+	grid := &Image{Wand: imagick.NewMagickWand()}
+	defer grid.Destroy()
+	err := grid.Wand.NewImage(columns*cell.Width+(columns-1)*sheet.Gutter,
+		rows*cell.Height+(rows-1)*sheet.Gutter, color)
+	if err != nil {
+		return nil, err
+	}
+
+	options := *emptyImageProcessorOptions
+	options.Dimensions = cell
+	options.ScaleMode = ScaleAspectCrop
+	for tile := range fetched {
+		err := s.composeSheetTile(ctx, r, grid, tile, options, tiles, cell, columns)
+		tile.destroy()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	format := r.ProcessorOptions.OutputFormat
+	if format == "" {
+		format = "JPEG"
+	}
+	if err := grid.Wand.SetImageFormat(format); err != nil {
+		return nil, err
+	}
+	quality := r.ProcessorOptions.Quality
+	if quality == 0 {
+		quality = uint(r.Route.ProcessorConfig.ImageCompressionQuality)
+	}
+	if quality > 0 {
+		grid.Wand.SetImageCompressionQuality(quality)
+	}
+
+	return NewProcessedImage(grid), nil
+}
+
+// composeSheetTile processes a tile with options and composes it into its
+// cell of grid.
+func (s *Server) composeSheetTile(ctx context.Context, r *Request, grid *Image, tile sheetTile, options ImageProcessorOptions, tiles []string, cell ImageDimensions, columns uint) error {
+	if err := ctx.Err(); err != nil {
+		return NewHTTPError("Gateway Timeout", http.StatusGatewayTimeout)
+	}
+	image := tile.image
+	if err := r.Route.Processor.ProcessImage(ctx, image, &options); err != nil {
+		s.Logger.Warnf("Error processing tile %s of sheet %s: %v", tiles[tile.index], r.SourceOptions.Path, err)
+		return NewHTTPError("Internal Server Error", http.StatusInternalServerError)
+	}
+	// The go backend leaves the tiles encoded.
+	if err := image.ensureWand(); err != nil {
+		return err
+	}
+	// Tiles smaller than their cell are centered in it.
+	gutter := r.ProcessorOptions.Sheet.Gutter
+	x := int(uint(tile.index)%columns*(cell.Width+gutter)) + (int(cell.Width)-int(image.GetWidth()))/2
+	y := int(uint(tile.index)/columns*(cell.Height+gutter)) + (int(cell.Height)-int(image.GetHeight()))/2
+	return grid.Wand.CompositeImage(image.Wand, imagick.COMPOSITE_OP_OVER, x, y)
+}
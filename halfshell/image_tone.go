@@ -0,0 +1,117 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// An ImageDuotone maps the shades of an image onto a gradient between two
+// colors, from Dark for its shadows to Light for its highlights.
+type ImageDuotone struct {
+	Dark  string
+	Light string
+}
+
+// An ImageTint blends an image with a color. Strength is the proportion of
+// the color, from 0 to 1.
+type ImageTint struct {
+	Color    string
+	Strength float64
+}
+
+// defaultTintStrength is the strength of tints that don't specify one.
+const defaultTintStrength = 0.5
+
+var colorPattern = regexp.MustCompile(`^#?[0-9a-fA-F]{3,8}$|^[a-zA-Z]+$`)
+
+// parseColor returns the ImageMagick color of s, a color name or a hex
+// color, with or without "#" as it must be escaped in URLs. It returns false
+// if s is neither.
+func parseColor(s string) (string, bool) {
+	if !colorPattern.MatchString(s) {
+		return "", false
+	}
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != len(s) || strings.Trim(s, "0123456789abcdefABCDEF") == "" {
+		switch len(hex) {
+		case 3, 4, 6, 8:
+			return "#" + hex, true
+		}
+		return "", false
+	}
+	return s, true
+}
+
+// parseImageDuotone parses a duotone of the form "dark,light".
+func parseImageDuotone(args []string) (ImageDuotone, error) {
+	if len(args) != 2 {
+		return ImageDuotone{}, fmt.Errorf("expected dark and light colors")
+	}
+	dark, ok := parseColor(args[0])
+	if !ok {
+		return ImageDuotone{}, fmt.Errorf("invalid color %s", args[0])
+	}
+	light, ok := parseColor(args[1])
+	if !ok {
+		return ImageDuotone{}, fmt.Errorf("invalid color %s", args[1])
+	}
+	return ImageDuotone{Dark: dark, Light: light}, nil
+}
+
+// parseImageTint parses a tint of the form "color[,strength]".
+func parseImageTint(args []string) (ImageTint, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return ImageTint{}, fmt.Errorf("expected a color and an optional strength")
+	}
+	color, ok := parseColor(args[0])
+	if !ok {
+		return ImageTint{}, fmt.Errorf("invalid color %s", args[0])
+	}
+	tint := ImageTint{Color: color, Strength: defaultTintStrength}
+	if len(args) == 2 {
+		strength, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || strength < 0 || strength > 1 {
+			return ImageTint{}, fmt.Errorf("invalid strength %s", args[1])
+		}
+		tint.Strength = strength
+	}
+	return tint, nil
+}
+
+func parseDuotoneOperation(args []string) (ImageProcessorOptions, error) {
+	duotone, err := parseImageDuotone(args)
+	if err != nil {
+		return ImageProcessorOptions{}, fmt.Errorf("expected duotone:dark:light, %v", err)
+	}
+	return ImageProcessorOptions{Duotone: duotone}, nil
+}
+
+func parseTintOperation(args []string) (ImageProcessorOptions, error) {
+	tint, err := parseImageTint(args)
+	if err != nil {
+		return ImageProcessorOptions{}, fmt.Errorf("expected tint:color[:strength], %v", err)
+	}
+	return ImageProcessorOptions{Tint: tint}, nil
+}
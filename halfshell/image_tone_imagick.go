@@ -0,0 +1,82 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build cgo
+// +build cgo
+
+package halfshell
+
+import (
+	"github.com/rafikk/imagick/imagick"
+)
+
+// duotone converts the image (or the requested region) to grayscale and maps
+// its shades onto the gradient of the requested colors.
+func (ip *imageProcessor) duotone(image *Image, request *ImageProcessorOptions) error {
+	if request.Duotone == (ImageDuotone{}) {
+		return nil
+	}
+
+	gradient := imagick.NewMagickWand()
+	defer gradient.Destroy()
+	err := gradient.SetSize(1, 256)
+	if err != nil {
+		return err
+	}
+	// The colors are validated by parseColor, so they can't name anything
+	// but a color.
+	err = gradient.ReadImage("gradient:" + request.Duotone.Dark + "-" + request.Duotone.Light)
+	if err != nil {
+		return err
+	}
+
+	return ip.applyToRegion(image, request.Region, func(wand *imagick.MagickWand) error {
+		if err := wand.TransformImageColorspace(imagick.COLORSPACE_GRAY); err != nil {
+			return err
+		}
+		if err := wand.TransformImageColorspace(imagick.COLORSPACE_SRGB); err != nil {
+			return err
+		}
+		return wand.ClutImage(gradient)
+	})
+}
+
+// tint blends the image (or the requested region) with the requested color.
+func (ip *imageProcessor) tint(image *Image, request *ImageProcessorOptions) error {
+	if request.Tint.Color == "" || request.Tint.Strength == 0 {
+		return nil
+	}
+
+	color := imagick.NewPixelWand()
+	defer color.Destroy()
+	color.SetColor(request.Tint.Color)
+
+	// ImageMagick takes the proportion of the color of each channel as a
+	// color.
+	strength := imagick.NewPixelWand()
+	defer strength.Destroy()
+	strength.SetRed(request.Tint.Strength)
+	strength.SetGreen(request.Tint.Strength)
+	strength.SetBlue(request.Tint.Strength)
+
+	return ip.applyToRegion(image, request.Region, func(wand *imagick.MagickWand) error {
+		return wand.ColorizeImage(color, strength)
+	})
+}
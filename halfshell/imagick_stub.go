@@ -0,0 +1,167 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build !cgo
+// +build !cgo
+
+package halfshell
+
+import (
+	"context"
+	"image"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// Binaries built without cgo don't link against ImageMagick. Images have no
+// wand and are kept encoded, only the go backend is available, and the
+// outputs requiring ImageMagick are answered with 501 Not Implemented.
+
+type magickWand struct{}
+
+// errImageMagickUnavailable answers requests requiring ImageMagick.
+var errImageMagickUnavailable = NewHTTPError("Not Implemented", http.StatusNotImplemented)
+
+// NewImageFromBufferWithLimits reads an image without decoding it, returning
+// ErrImageTooLarge if its header reports more pixels than allowed.
+func NewImageFromBufferWithLimits(buffer io.Reader, limits ImageLimits) (*Image, error) {
+	return NewEncodedImageFromBuffer(buffer, limits)
+}
+
+// checkImageLimits reads the header of the image. The frames aren't counted,
+// as only the first frame of animations is decoded.
+func checkImageLimits(bytes []byte, limits ImageLimits) error {
+	config, _, err := decodeImageConfig(bytes)
+	if err != nil {
+		return err
+	}
+
+	pixels := uint64(config.Width) * uint64(config.Height)
+	if limits.MaxPixels > 0 && pixels > limits.MaxPixels {
+		return ErrImageTooLarge
+	}
+
+	return nil
+}
+
+// SetBytes replaces the image with the given encoded image data.
+func (i *Image) SetBytes(bytes []byte) error {
+	_, _, err := decodeImageConfig(bytes)
+	if err != nil {
+		return err
+	}
+
+	i.setEncodedBytes(bytes)
+	return nil
+}
+
+func (i *Image) setEncodedBytes(bytes []byte) {
+	i.blob = bytes
+}
+
+func (i *Image) getEncodedBytes() []byte {
+	return i.blob
+}
+
+func (i *Image) GetMIMEType() string {
+	return i.encodedMIMEType()
+}
+
+func (i *Image) GetBytes() (bytes []byte, size int) {
+	return i.blob, len(i.blob)
+}
+
+func (i *Image) GetWidth() uint {
+	return i.encodedDimensions().Width
+}
+
+func (i *Image) GetHeight() uint {
+	return i.encodedDimensions().Height
+}
+
+func (i *Image) GetSignature() string {
+	return i.encodedSignature()
+}
+
+// GetThumbnail returns a decoded copy of the image scaled down to fit within
+// maxDimension pixels on each side.
+func (i *Image) GetThumbnail(maxDimension uint) (image.Image, error) {
+	return i.encodedThumbnail(maxDimension)
+}
+
+func (i *Image) Destroy() {
+	i.destroyed = true
+}
+
+// GetPalette requires ImageMagick.
+func (i *Image) GetPalette(size uint) (*ImagePalette, error) {
+	return nil, errImageMagickUnavailable
+}
+
+// NewImageInfo describes the image encoded in data from its header.
+func NewImageInfo(data []byte) (*ImageInfo, error) {
+	config, format, err := decodeImageConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageInfo{
+		Width:       uint(config.Width),
+		Height:      uint(config.Height),
+		Format:      format,
+		ContentType: "image/" + format,
+		Bytes:       len(data),
+		Frames:      1,
+	}, nil
+}
+
+// composeSheet requires ImageMagick.
+func (s *Server) composeSheet(ctx context.Context, r *Request, fetched <-chan sheetTile, tiles []string, cell ImageDimensions, columns, rows uint) (*ProcessedImage, error) {
+	s.Logger.Warnf("Rejecting sheet %s: ImageMagick isn't available", r.SourceOptions.Path)
+	return nil, errImageMagickUnavailable
+}
+
+// Initialize and Terminate only track the readiness of the server.
+func Initialize() {
+	atomic.StoreInt32(&imagickInitialized, 1)
+}
+
+func Terminate() {
+	atomic.StoreInt32(&imagickInitialized, 0)
+}
+
+func (h *Halfshell) applyResourceLimits() {}
+
+const (
+	imageMagickMemory = iota
+	imageMagickMap
+)
+
+func imageMagickResource(resource int) int64 {
+	return 0
+}
+
+func imageMagickVersion() string {
+	return ""
+}
+
+// defaultImageProcessorBackend is the backend of processors without one.
+const defaultImageProcessorBackend = ImageProcessorBackendGo
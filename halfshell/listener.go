@@ -0,0 +1,84 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+type listenerContextKey struct{}
+
+// listenerHandler serves the requests accepted by a listener, which are
+// restricted to its routes.
+type listenerHandler struct {
+	server   *Server
+	listener *ListenerConfig
+}
+
+func (h *listenerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), listenerContextKey{}, h.listener)
+	h.server.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// newListenerServer returns the HTTP server of an additional listener, with
+// the connection settings of base.
+func (s *Server) newListenerServer(base *http.Server, listener *ListenerConfig) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", listener.BindAddress, listener.Port),
+		Handler:           &listenerHandler{server: s, listener: listener},
+		ReadTimeout:       base.ReadTimeout,
+		ReadHeaderTimeout: base.ReadHeaderTimeout,
+		WriteTimeout:      base.WriteTimeout,
+		IdleTimeout:       base.IdleTimeout,
+		MaxHeaderBytes:    base.MaxHeaderBytes,
+		TLSConfig:         base.TLSConfig,
+		TLSNextProto:      base.TLSNextProto,
+	}
+}
+
+// listenerForRequest returns the listener that accepted r, or nil if r
+// wasn't accepted by a listener, e.g. when the server is used as a handler.
+func listenerForRequest(r *http.Request) *ListenerConfig {
+	listener, _ := r.Context().Value(listenerContextKey{}).(*ListenerConfig)
+	return listener
+}
+
+// servesRoute returns whether the listener serves the route named name. A nil
+// listener serves all routes.
+func (l *ListenerConfig) servesRoute(name string) bool {
+	if l == nil || len(l.Routes) == 0 {
+		return true
+	}
+	for _, route := range l.Routes {
+		if route == name {
+			return true
+		}
+	}
+	return false
+}
+
+// servesAdmin returns whether the listener serves the administration
+// endpoints. A nil listener serves them.
+func (l *ListenerConfig) servesAdmin() bool {
+	return l == nil || l.Admin
+}
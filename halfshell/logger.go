@@ -22,10 +22,139 @@ package halfshell
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path"
+	"strings"
+	"sync"
 )
 
+var (
+	logOutput      io.Writer = os.Stdout
+	logOutputMutex sync.RWMutex
+)
+
+// SetLogOutput sets the destination of the logs of all components, which is
+// the standard output by default. Programs using the package as a library may
+// discard them with ioutil.Discard.
+func SetLogOutput(w io.Writer) {
+	logOutputMutex.Lock()
+	defer logOutputMutex.Unlock()
+	logOutput = w
+}
+
+// sharedLogOutput writes to the output set with SetLogOutput, so the output
+// of loggers created beforehand changes too.
+type sharedLogOutput struct{}
+
+func (sharedLogOutput) Write(p []byte) (int, error) {
+	logOutputMutex.RLock()
+	defer logOutputMutex.RUnlock()
+	return logOutput.Write(p)
+}
+
+// LogLevel is the severity of a log message.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarning
+	LogLevelError
+	LogLevelOff
+)
+
+var logLevelNames = map[string]LogLevel{
+	"debug":   LogLevelDebug,
+	"info":    LogLevelInfo,
+	"warn":    LogLevelWarning,
+	"warning": LogLevelWarning,
+	"error":   LogLevelError,
+	"off":     LogLevelOff,
+}
+
+// ParseLogLevel returns the level named name, e.g. "warn".
+func ParseLogLevel(name string) (LogLevel, error) {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("Unknown log level %q", name)
+	}
+	return level, nil
+}
+
+var (
+	logLevel           = LogLevelDebug
+	componentLogLevels = make(map[string]LogLevel)
+	resolvedLogLevels  = make(map[string]LogLevel)
+	logLevelMutex      sync.RWMutex
+)
+
+// SetLogLevel sets the minimum level of the messages logged by components
+// without a level of their own. Everything is logged by default.
+func SetLogLevel(level LogLevel) {
+	logLevelMutex.Lock()
+	defer logLevelMutex.Unlock()
+	logLevel = level
+	resolvedLogLevels = make(map[string]LogLevel)
+}
+
+// SetComponentLogLevel sets the minimum level of the messages logged by the
+// components matching pattern. A pattern matches the component of the same
+// name and those below it, e.g. "source.s3" matches "source.s3.images", and
+// may contain wildcards, e.g. "image_processor.*". The most specific pattern
+// matching a component applies.
+func SetComponentLogLevel(pattern string, level LogLevel) {
+	logLevelMutex.Lock()
+	defer logLevelMutex.Unlock()
+	componentLogLevels[pattern] = level
+	resolvedLogLevels = make(map[string]LogLevel)
+}
+
+// setLogLevels replaces the global and component log levels, e.g. with those
+// of a reloaded configuration.
+func setLogLevels(level LogLevel, componentLevels map[string]LogLevel) {
+	logLevelMutex.Lock()
+	defer logLevelMutex.Unlock()
+	logLevel = level
+	componentLogLevels = make(map[string]LogLevel)
+	for pattern, componentLevel := range componentLevels {
+		componentLogLevels[pattern] = componentLevel
+	}
+	resolvedLogLevels = make(map[string]LogLevel)
+}
+
+// logLevelForComponent returns the minimum level logged by the component
+// name. Levels are resolved once per component, as loggers are shared by
+// requests.
+func logLevelForComponent(name string) LogLevel {
+	logLevelMutex.RLock()
+	level, ok := resolvedLogLevels[name]
+	logLevelMutex.RUnlock()
+	if ok {
+		return level
+	}
+
+	logLevelMutex.Lock()
+	defer logLevelMutex.Unlock()
+	level, longestPattern := logLevel, -1
+	for pattern, patternLevel := range componentLogLevels {
+		if len(pattern) > longestPattern && componentMatches(pattern, name) {
+			level, longestPattern = patternLevel, len(pattern)
+		}
+	}
+	resolvedLogLevels[name] = level
+	return level
+}
+
+func componentMatches(pattern, name string) bool {
+	if matched, _ := path.Match(pattern, name); matched {
+		return true
+	}
+	matched, _ := path.Match(pattern+".*", name)
+	return matched
+}
+
 type Logger struct {
 	*log.Logger
 	Name string
@@ -33,12 +162,17 @@ type Logger struct {
 
 func NewLogger(nameFormat string, v ...interface{}) *Logger {
 	return &Logger{
-		log.New(os.Stdout, "", log.Ldate|log.Lmicroseconds),
+		log.New(sharedLogOutput{}, "", log.Ldate|log.Lmicroseconds),
 		fmt.Sprintf(nameFormat, v...),
 	}
 }
 
+// Logf logs a message with the given level name, such as "WARNING", if the
+// level is enabled for the logger's component.
 func (l *Logger) Logf(level, format string, v ...interface{}) {
+	if parsedLevel, err := ParseLogLevel(level); err == nil && parsedLevel < logLevelForComponent(l.Name) {
+		return
+	}
 	l.Printf("[%s] [%s] %s", level, l.Name, fmt.Sprintf(format, v...))
 }
 
@@ -0,0 +1,94 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"container/list"
+)
+
+// lruIndex tracks entries by recency of use and evicts the least recently
+// used ones once their total size exceeds maxSize. It is not safe for
+// concurrent use.
+type lruIndex struct {
+	maxSize uint64
+	size    uint64
+	entries map[string]*list.Element
+	order   *list.List
+	onEvict func(key string, value interface{})
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+	size  uint64
+}
+
+func newLRUIndex(maxSize uint64, onEvict func(key string, value interface{})) *lruIndex {
+	return &lruIndex{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		onEvict: onEvict,
+	}
+}
+
+// Get returns the value of key and marks it as the most recently used.
+func (l *lruIndex) Get(key string) (interface{}, bool) {
+	element, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(element)
+	return element.Value.(*lruEntry).value, true
+}
+
+// Add adds or replaces the value of key, evicting entries as needed.
+func (l *lruIndex) Add(key string, value interface{}, size uint64) {
+	if element, ok := l.entries[key]; ok {
+		l.remove(element)
+	}
+
+	l.entries[key] = l.order.PushFront(&lruEntry{key: key, value: value, size: size})
+	l.size += size
+
+	for l.size > l.maxSize {
+		entry := l.remove(l.order.Back())
+		if l.onEvict != nil {
+			l.onEvict(entry.key, entry.value)
+		}
+	}
+}
+
+// Remove removes key, returning whether it was present.
+func (l *lruIndex) Remove(key string) bool {
+	element, ok := l.entries[key]
+	if ok {
+		l.remove(element)
+	}
+	return ok
+}
+
+func (l *lruIndex) remove(element *list.Element) *lruEntry {
+	entry := l.order.Remove(element).(*lruEntry)
+	delete(l.entries, entry.key)
+	l.size -= entry.size
+	return entry
+}
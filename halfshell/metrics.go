@@ -0,0 +1,317 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricBuckets are the upper bounds in seconds of the histogram buckets.
+var metricBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects counters, histograms and gauges, and exposes them in the
+// Prometheus text format.
+type Metrics struct {
+	mu         sync.Mutex
+	help       map[string]string
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+	gauges     map[string]func() float64
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// DefaultMetrics collects the metrics of the routes and the server.
+var DefaultMetrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		help:       make(map[string]string),
+		counters:   make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+		gauges:     make(map[string]func() float64),
+	}
+}
+
+// Inc increments the counter name with the given labels, which alternate
+// label names and values.
+func (m *Metrics) Inc(name, help string, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.help[name] = help
+	if m.counters[name] == nil {
+		m.counters[name] = make(map[string]float64)
+	}
+	m.counters[name][formatLabels(labels)]++
+}
+
+// Observe records a duration in the histogram name with the given labels.
+func (m *Metrics) Observe(name, help string, duration time.Duration, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.help[name] = help
+	if m.histograms[name] == nil {
+		m.histograms[name] = make(map[string]*histogram)
+	}
+	key := formatLabels(labels)
+	h := m.histograms[name][key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(metricBuckets))}
+		m.histograms[name][key] = h
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range metricBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// SetGauge registers a gauge whose value is returned by value when the
+// metrics are written.
+func (m *Metrics) SetGauge(name, help string, value func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.help[name] = help
+	m.gauges[name] = value
+}
+
+// CounterValues returns the values of the counter name whose labels include
+// the given ones, summed by the value of their label by.
+func (m *Metrics) CounterValues(name, by string, labels ...string) map[string]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	values := make(map[string]float64)
+	for key, value := range m.counters[name] {
+		if keyLabels, ok := matchLabels(key, labels); ok {
+			values[keyLabels[by]] += value
+		}
+	}
+	return values
+}
+
+// HistogramTotals returns the number and sum of the observations of the
+// histogram name whose labels include the given ones.
+func (m *Metrics) HistogramTotals(name string, labels ...string) (count uint64, sum float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, h := range m.histograms[name] {
+		if _, ok := matchLabels(key, labels); ok {
+			count += h.count
+			sum += h.sum
+		}
+	}
+	return count, sum
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	var names []string
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeMetricHeader(&b, name, m.help[name], "counter")
+		var labelSets []string
+		for labels := range m.counters[name] {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+		for _, labels := range labelSets {
+			fmt.Fprintf(&b, "%s%s %s\n", name, wrapLabels(labels), formatFloat(m.counters[name][labels]))
+		}
+	}
+
+	names = names[:0]
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeMetricHeader(&b, name, m.help[name], "histogram")
+		var labelSets []string
+		for labels := range m.histograms[name] {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+		for _, labels := range labelSets {
+			h := m.histograms[name][labels]
+			for i, bound := range metricBuckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", name, wrapLabels(joinLabels(labels, `le="`+formatFloat(bound)+`"`)), h.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, wrapLabels(joinLabels(labels, `le="+Inf"`)), h.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", name, wrapLabels(labels), formatFloat(h.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, wrapLabels(labels), h.count)
+		}
+	}
+
+	names = names[:0]
+	for name := range m.gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeMetricHeader(&b, name, m.help[name], "gauge")
+		fmt.Fprintf(&b, "%s %s\n", name, formatFloat(m.gauges[name]()))
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics to Prometheus.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+func writeMetricHeader(b *strings.Builder, name, help, metricType string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats alternating label names and values, e.g.
+// `route="blog",status="200"`.
+func formatLabels(labels []string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelValueEscaper.Replace(labels[i+1])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// parseLabels parses labels formatted by formatLabels.
+func parseLabels(s string) map[string]string {
+	labels := make(map[string]string)
+	for s != "" {
+		equals := strings.Index(s, `="`)
+		if equals < 0 {
+			break
+		}
+		name := s[:equals]
+		var value strings.Builder
+		i := equals + 2
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				if s[i] == 'n' {
+					value.WriteByte('\n')
+					continue
+				}
+			}
+			value.WriteByte(s[i])
+		}
+		labels[name] = value.String()
+		s = strings.TrimPrefix(s[minInt(i+1, len(s)):], ",")
+	}
+	return labels
+}
+
+// matchLabels parses the labels formatted by formatLabels and returns
+// whether they include the alternating label names and values of match.
+func matchLabels(s string, match []string) (map[string]string, bool) {
+	labels := parseLabels(s)
+	for i := 0; i+1 < len(match); i += 2 {
+		if labels[match[i]] != match[i+1] {
+			return labels, false
+		}
+	}
+	return labels, true
+}
+
+func joinLabels(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// prometheusStatter records the statistics of a route in a Metrics.
+type prometheusStatter struct {
+	Name    string
+	Metrics *Metrics
+}
+
+// NewPrometheusStatter returns a Statter recording the statistics of the
+// route name in metrics.
+func NewPrometheusStatter(name string, metrics *Metrics) Statter {
+	return &prometheusStatter{Name: name, Metrics: metrics}
+}
+
+func (s *prometheusStatter) RegisterRequest(w *ResponseWriter, r *Request) {
+	s.Metrics.Inc("halfshell_requests_total", "Requests handled, by route and status.",
+		"route", s.Name, "status", strconv.Itoa(w.Status))
+	s.Metrics.Observe("halfshell_request_duration_seconds", "Time spent handling requests, by route.",
+		time.Since(r.Timestamp), "route", s.Name)
+}
+
+// Count increments the counter of stat. Cache hits and misses are counted
+// together, so the hit ratio can be computed.
+func (s *prometheusStatter) Count(stat string) {
+	if result := strings.TrimPrefix(stat, "cache."); result != stat {
+		s.Metrics.Inc("halfshell_cache_requests_total", "Cache lookups, by route and result.",
+			"route", s.Name, "result", result)
+		return
+	}
+	s.Metrics.Inc("halfshell_events_total", "Source retries, placeholders and other events, by route.",
+		"route", s.Name, "event", stat)
+}
+
+func (s *prometheusStatter) Timing(stat string, duration time.Duration) {
+	name := "halfshell_" + strings.Replace(stat, ".", "_", -1) + "_duration_seconds"
+	s.Metrics.Observe(name, "Time spent "+stat+", by route.", duration, "route", s.Name)
+}
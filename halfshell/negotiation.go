@@ -0,0 +1,133 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultAutoFormats are the formats routes with auto_format negotiate, in
+// order of preference.
+var DefaultAutoFormats = []string{"avif", "webp"}
+
+// negotiateFormat returns the first of the route's automatic formats the
+// client of r accepts, or "" if it accepts none of them.
+func (p *Route) negotiateFormat(r *http.Request) string {
+	accept := strings.Join(r.Header["Accept"], ",")
+	for _, name := range p.AutoFormats {
+		if acceptsMediaType(accept, "image/"+name) {
+			return OutputFormats[name]
+		}
+	}
+	return ""
+}
+
+// requestsOutputFormat returns whether options request a specific output
+// format, which isn't negotiated then.
+func requestsOutputFormat(options *ImageProcessorOptions) bool {
+	if options.OutputFormat != "" {
+		return true
+	}
+	for _, operation := range options.Operations {
+		if operation.Options.OutputFormat != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsMediaType returns whether an Accept header lists mediaType with a
+// non-zero quality. Wildcards aren't taken into account, as clients
+// advertise the image formats they decode explicitly, and "*/*" doesn't
+// imply they decode every format.
+func acceptsMediaType(accept, mediaType string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), mediaType) {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			nameValue := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(nameValue) == 2 && strings.EqualFold(nameValue[0], "q") {
+				quality, _ = strconv.ParseFloat(nameValue[1], 64)
+			}
+		}
+		return quality > 0
+	}
+	return false
+}
+
+// maxClientHintsDPR bounds the device pixel ratio images are scaled by, so
+// clients can't request arbitrarily large images with it.
+const maxClientHintsDPR = 4
+
+// ClientHintsHeaders are the client hints routes with client_hints request
+// and take into account.
+var ClientHintsHeaders = []string{"Sec-CH-DPR", "Sec-CH-Width", "Sec-CH-Viewport-Width"}
+
+// applyClientHints scales the dimensions of options by the device pixel
+// ratio of the client of r. If no dimensions are requested, the width is the
+// layout width of the image, or the width of the viewport, hinted by the
+// client. The dimensions are then fitted to the route's limits. Requests for
+// relative sizes are left as is.
+func (p *Route) applyClientHints(r *http.Request, options *ImageProcessorOptions) {
+	// Relative sizes already follow the original rather than the layout.
+	if options.RelativeSize != (ImageScale{}) {
+		return
+	}
+
+	dpr, err := strconv.ParseFloat(r.Header.Get("Sec-CH-DPR"), 64)
+	if err != nil || dpr <= 0 {
+		dpr = 1
+	}
+	dpr = math.Min(dpr, maxClientHintsDPR)
+
+	width := float64(options.Dimensions.Width) * dpr
+	height := float64(options.Dimensions.Height) * dpr
+	if options.Dimensions == EmptyImageDimensions {
+		// The width hint is in physical pixels already, unlike the viewport's.
+		if hintWidth, err := strconv.ParseUint(r.Header.Get("Sec-CH-Width"), 10, 32); err == nil && hintWidth > 0 {
+			width = float64(hintWidth)
+		} else if viewportWidth, err := strconv.ParseUint(r.Header.Get("Sec-CH-Viewport-Width"), 10, 32); err == nil {
+			width = float64(viewportWidth) * dpr
+		}
+	}
+
+	dimensions := ImageDimensions{uint(math.Floor(width + 0.5)), uint(math.Floor(height + 0.5))}
+	options.Dimensions = p.ParameterLimits.FitDimensions(dimensions)
+}
+
+// Vary returns the value of the Vary header of the route's responses, which
+// lists the request headers other than the URL the response depends on.
+func (p *Route) Vary() string {
+	var headers []string
+	if p.AutoFormat {
+		headers = append(headers, "Accept")
+	}
+	if p.ClientHints {
+		headers = append(headers, ClientHintsHeaders...)
+	}
+	return strings.Join(headers, ", ")
+}
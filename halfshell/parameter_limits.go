@@ -0,0 +1,161 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParameterLimits restricts the processing parameters of a route's requests,
+// which bounds the number of derivatives of each image. Requested widths and
+// heights must be among Widths and Heights, if there are any, and at most
+// MaxWidth and MaxHeight, if they are set; likewise for the other
+// parameters. Parameters that aren't requested are always allowed.
+type ParameterLimits struct {
+	Widths     []uint64
+	Heights    []uint64
+	MaxWidth   uint64
+	MaxHeight  uint64
+	MaxBlur    float64
+	Qualities  []uint64
+	MinQuality uint64
+	MaxQuality uint64
+
+	// Formats are the names of the output formats that may be requested,
+	// e.g. "jpeg" or "webp".
+	Formats []string
+}
+
+// Check returns an error if options, or any of their operations, exceed the
+// limits.
+func (l *ParameterLimits) Check(options *ImageProcessorOptions) error {
+	if l == nil {
+		return nil
+	}
+	if err := l.check(options); err != nil {
+		return err
+	}
+	for _, operation := range options.Operations {
+		if err := l.check(&operation.Options); err != nil {
+			return fmt.Errorf("Invalid operation %s: %v", operation.Name, err)
+		}
+	}
+	return nil
+}
+
+func (l *ParameterLimits) check(options *ImageProcessorOptions) error {
+	// The dimensions of relative sizes depend on the original, so they can't
+	// be checked against the limits.
+	if options.RelativeSize != (ImageScale{}) &&
+		(len(l.Widths) > 0 || len(l.Heights) > 0 || l.MaxWidth > 0 || l.MaxHeight > 0) {
+		return fmt.Errorf("Relative sizes are not allowed")
+	}
+	if err := checkParameterLimit("Width", uint64(options.Dimensions.Width), l.Widths, 0, l.MaxWidth); err != nil {
+		return err
+	}
+	if err := checkParameterLimit("Height", uint64(options.Dimensions.Height), l.Heights, 0, l.MaxHeight); err != nil {
+		return err
+	}
+	if err := checkParameterLimit("Sheet cell width", uint64(options.Sheet.Cell.Width), nil, 0, l.MaxWidth); err != nil {
+		return err
+	}
+	if err := checkParameterLimit("Sheet cell height", uint64(options.Sheet.Cell.Height), nil, 0, l.MaxHeight); err != nil {
+		return err
+	}
+	if err := checkParameterLimit("Quality", uint64(options.Quality), l.Qualities, l.MinQuality, l.MaxQuality); err != nil {
+		return err
+	}
+	if l.MaxBlur > 0 && options.BlurRadius > l.MaxBlur {
+		return fmt.Errorf("Blur %g exceeds the maximum of %g", options.BlurRadius, l.MaxBlur)
+	}
+	if options.OutputFormat != "" && len(l.Formats) > 0 {
+		for _, format := range l.Formats {
+			if OutputFormats[strings.ToLower(format)] == options.OutputFormat {
+				return nil
+			}
+		}
+		return fmt.Errorf("Format %s is not allowed", strings.ToLower(options.OutputFormat))
+	}
+	return nil
+}
+
+// FitDimensions returns the allowed dimensions closest to dimensions, which
+// aren't requested as such but derived from the client's hints: each is
+// rounded up to the next allowed value, or down to the largest one, and
+// capped at the maximum.
+func (l *ParameterLimits) FitDimensions(dimensions ImageDimensions) ImageDimensions {
+	if l == nil {
+		return dimensions
+	}
+	return ImageDimensions{
+		Width:  uint(fitParameterLimit(uint64(dimensions.Width), l.Widths, l.MaxWidth)),
+		Height: uint(fitParameterLimit(uint64(dimensions.Height), l.Heights, l.MaxHeight)),
+	}
+}
+
+func fitParameterLimit(value uint64, allowed []uint64, max uint64) uint64 {
+	if value == 0 {
+		return 0
+	}
+	if len(allowed) > 0 {
+		var fitted, largest uint64
+		for _, allowedValue := range allowed {
+			if allowedValue >= value && (fitted == 0 || allowedValue < fitted) {
+				fitted = allowedValue
+			}
+			if allowedValue > largest {
+				largest = allowedValue
+			}
+		}
+		if fitted == 0 {
+			fitted = largest
+		}
+		value = fitted
+	}
+	if max > 0 && value > max {
+		value = max
+	}
+	return value
+}
+
+// checkParameterLimit checks a requested value against the allowed values
+// and range of a parameter. A value of 0 isn't requested, and is allowed.
+func checkParameterLimit(name string, value uint64, allowed []uint64, min, max uint64) error {
+	if value == 0 {
+		return nil
+	}
+	if len(allowed) > 0 {
+		for _, allowedValue := range allowed {
+			if value == allowedValue {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s %d is not one of the allowed values %v", name, value, allowed)
+	}
+	if value < min {
+		return fmt.Errorf("%s %d is below the minimum of %d", name, value, min)
+	}
+	if max > 0 && value > max {
+		return fmt.Errorf("%s %d exceeds the maximum of %d", name, value, max)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+)
+
+// PassthroughRequestHandler serves the original image of a request as is,
+// without decoding it, for routes fronting a bucket of originals. Range and
+// conditional requests are supported.
+func (s *Server) PassthroughRequestHandler(w *ResponseWriter, r *Request) {
+	ctx := r.Context()
+	if s.ProcessingTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ProcessingTimeout)
+		defer cancel()
+	}
+
+	sourceOptions := *r.SourceOptions
+	sourceOptions.Raw = true
+	sourceCtx, span := StartSpan(ctx, "source.fetch", SpanKindInternal)
+	span.SetAttribute("halfshell.source.path", sourceOptions.Key())
+	image, err := r.Route.Source.GetImage(sourceCtx, &sourceOptions)
+	span.SetError(err)
+	span.Finish()
+	if err != nil {
+		w.WriteHTTPError(s.sourceError(ctx, r, err))
+		return
+	}
+	defer image.Destroy()
+
+	data := image.getEncodedBytes()
+	contentType, ok := passthroughContentType(data)
+	if !ok {
+		s.Logger.Warnf("Refusing to return original %s of type %s", r.SourceOptions.Path, contentType)
+		w.WriteError("Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	s.Logger.Infof("Returning original image %s", r.SourceOptions.Path)
+
+	hash := sha1.Sum(data)
+	w.ContentType = contentType
+	w.SetHeader("Content-Type", w.ContentType)
+	w.SetHeader("X-Content-Type-Options", "nosniff")
+	w.SetHeader("ETag", `"`+hex.EncodeToString(hash[:])+`"`)
+	s.setCacheHeaders(w, r)
+	http.ServeContent(w, r.Request, "", image.LastModified, bytes.NewReader(data))
+}
+
+// passthroughImageTypes are the media types of the originals passed through.
+// Only raster images are, as other documents, such as HTML or SVG, could run
+// scripts when served from the server's origin.
+var passthroughImageTypes = map[string]bool{
+	"image/jpeg":   true,
+	"image/png":    true,
+	"image/gif":    true,
+	"image/webp":   true,
+	"image/bmp":    true,
+	"image/x-icon": true,
+	"image/avif":   true,
+}
+
+// passthroughContentType returns the media type of an original image sniffed
+// from its data, whatever the extension of its path, and whether it may be
+// passed through.
+func passthroughContentType(data []byte) (string, bool) {
+	contentType := http.DetectContentType(data)
+	if contentType == "application/octet-stream" && isAVIF(data) {
+		contentType = "image/avif"
+	}
+	return contentType, passthroughImageTypes[contentType]
+}
+
+// isAVIF returns whether data starts with the file type box of an AVIF
+// image, which content sniffing doesn't recognize.
+func isAVIF(data []byte) bool {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	brand := string(data[8:12])
+	return brand == "avif" || brand == "avis"
+}
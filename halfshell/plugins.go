@@ -0,0 +1,67 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"path/filepath"
+	"plugin"
+)
+
+// LoadPlugin loads the Go plugin at path. Plugins register their sources,
+// processor backends, caches and hooks from their init functions, with
+// RegisterSource, RegisterProcessor, RegisterCache and RegisterHook, so that
+// the configuration can refer to them by name. A plugin is only loaded once,
+// and must be built with the same versions of Go and of this package as the
+// server.
+func LoadPlugin(path string) error {
+	_, err := plugin.Open(path)
+	if err != nil {
+		return fmt.Errorf("Unable to load plugin %s: %v", path, err)
+	}
+	return nil
+}
+
+// loadConfigPlugins loads the plugins listed in the plugins setting of the
+// configuration file at configPath. Relative paths are relative to the
+// directory of the configuration file.
+func loadConfigPlugins(configPath string, value interface{}) error {
+	var paths []interface{}
+	switch value := value.(type) {
+	case string:
+		paths = []interface{}{value}
+	case []interface{}:
+		paths = value
+	}
+	for _, path := range paths {
+		path, ok := path.(string)
+		if !ok {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(configPath), path)
+		}
+		if err := LoadPlugin(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
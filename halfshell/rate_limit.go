@@ -0,0 +1,181 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A RateLimiter limits the rate of requests of each client with a token
+// bucket per client IP. Buckets hold up to Burst tokens and are refilled
+// with Rate tokens per second.
+type RateLimiter struct {
+	Rate  float64
+	Burst float64
+
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiterSweepInterval is the interval at which the buckets that are full
+// again are forgotten.
+const rateLimiterSweepInterval = time.Minute
+
+// NewRateLimiter returns a rate limiter allowing rate requests per second,
+// and bursts of up to burst requests. It returns nil, which allows every
+// request, if rate is 0.
+func NewRateLimiter(rate float64, burst uint64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst == 0 {
+		burst = uint64(math.Max(1, math.Ceil(rate)))
+	}
+	return &RateLimiter{
+		Rate:      rate,
+		Burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of client. If the bucket is empty, it
+// returns false and the time until a token is available.
+func (l *RateLimiter) Allow(client string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= rateLimiterSweepInterval {
+		l.sweep(now)
+	}
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.Burst, updated: now}
+		l.buckets[client] = bucket
+	}
+	bucket.refill(now, l.Rate, l.Burst)
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.Rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep forgets the buckets that are full, which behave as new ones would.
+func (l *RateLimiter) sweep(now time.Time) {
+	for client, bucket := range l.buckets {
+		bucket.refill(now, l.Rate, l.Burst)
+		if bucket.tokens >= l.Burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+}
+
+// ParseTrustedProxies parses a list of IP addresses and CIDR ranges of
+// trusted proxies.
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR range %q", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ClientIP returns the IP address of the client of r. Requests from trusted
+// proxies are attributed to the last address of their X-Forwarded-For
+// header that isn't a trusted proxy's, as the addresses before it may be
+// forged by the client.
+func ClientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(ip, trustedProxies) {
+		return ip
+	}
+
+	forwardedFor := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		forwardedIP := strings.TrimSpace(forwardedFor[i])
+		if net.ParseIP(forwardedIP) == nil {
+			break
+		}
+		ip = forwardedIP
+		if !isTrustedProxy(ip, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+func isTrustedProxy(ip string, trustedProxies []*net.IPNet) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(parsedIP) {
+			return true
+		}
+	}
+	return false
+}
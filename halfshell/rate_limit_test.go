@@ -0,0 +1,169 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	trustedProxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		ip           string
+	}{
+		{"untrusted peer", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer with forged header", "203.0.113.5:1234", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"trusted proxy without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"trusted proxy without port", "10.0.0.1", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.1:1234", []string{"198.51.100.7, 192.168.1.1, 10.0.0.2"}, "198.51.100.7"},
+		{"forged addresses before the client", "10.0.0.1:1234", []string{"1.1.1.1, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"several headers", "10.0.0.1:1234", []string{"1.1.1.1, 198.51.100.7", "10.0.0.2"}, "198.51.100.7"},
+		{"only trusted proxies", "10.0.0.1:1234", []string{"10.0.0.2, 10.0.0.3"}, "10.0.0.2"},
+		{"unparsable last entry", "10.0.0.1:1234", []string{"198.51.100.7, unknown"}, "10.0.0.1"},
+		{"unparsable entry before the client", "10.0.0.1:1234", []string{"unknown, 198.51.100.7"}, "198.51.100.7"},
+		{"unparsable entry after a trusted proxy", "10.0.0.1:1234", []string{"198.51.100.7, _hidden, 10.0.0.2"}, "10.0.0.2"},
+		{"entry with a port", "10.0.0.1:1234", []string{"198.51.100.7:5678"}, "10.0.0.1"},
+		{"empty header", "10.0.0.1:1234", []string{""}, "10.0.0.1"},
+		{"untrusted IPv6 peer", "[2001:db9::1]:443", []string{"198.51.100.7"}, "2001:db9::1"},
+		{"trusted IPv6 peer", "[2001:db8::1]:443", []string{"2001:db9::5"}, "2001:db9::5"},
+		{"IPv6 client behind IPv4 proxy", "10.0.0.1:1234", []string{"2001:db9::5, 10.0.0.2"}, "2001:db9::5"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, value := range test.forwardedFor {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if ip := ClientIP(r, trustedProxies); ip != test.ip {
+			t.Errorf("%s: client IP %s, want %s", test.name, ip, test.ip)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		proxies []string
+		valid   bool
+	}{
+		{[]string{"10.0.0.1", "10.0.0.0/8", "::1", "2001:db8::/32"}, true},
+		{[]string{"10.0.0"}, false},
+		{[]string{"10.0.0.0/33"}, false},
+		{[]string{"proxy.example.com"}, false},
+	}
+	for _, test := range tests {
+		_, err := ParseTrustedProxies(test.proxies)
+		if (err == nil) != test.valid {
+			t.Errorf("%v: error %v, want valid %v", test.proxies, err, test.valid)
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	if NewRateLimiter(0, 10) != nil {
+		t.Error("rate limiter without rate")
+	}
+	var unlimited *RateLimiter
+	if allowed, _ := unlimited.Allow("client"); !allowed {
+		t.Error("request denied without rate limiter")
+	}
+	if burst := NewRateLimiter(2.5, 0).Burst; burst != 3 {
+		t.Errorf("default burst %v, want 3", burst)
+	}
+
+	limiter := NewRateLimiter(2, 3)
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.Allow("a"); !allowed {
+			t.Fatalf("request %d of burst denied", i+1)
+		}
+	}
+	allowed, wait := limiter.Allow("a")
+	if allowed {
+		t.Fatal("request past burst allowed")
+	}
+	if wait <= 0 || wait > 500*time.Millisecond {
+		t.Errorf("wait %v, want up to 500ms", wait)
+	}
+	if allowed, _ := limiter.Allow("b"); !allowed {
+		t.Error("request of other client denied")
+	}
+
+	// A second refills two tokens, but no more than the burst.
+	limiter.buckets["a"].updated = limiter.buckets["a"].updated.Add(-time.Second)
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.Allow("a"); !allowed {
+			t.Fatalf("request %d after refill denied", i+1)
+		}
+	}
+	if allowed, _ := limiter.Allow("a"); allowed {
+		t.Error("request past refill allowed")
+	}
+	limiter.buckets["a"].updated = limiter.buckets["a"].updated.Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.Allow("a"); !allowed {
+			t.Fatalf("request %d after full refill denied", i+1)
+		}
+	}
+	if allowed, _ := limiter.Allow("a"); allowed {
+		t.Error("request past burst after full refill allowed")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	limiter := NewRateLimiter(1, 2)
+	limiter.Allow("full")
+	limiter.Allow("draining")
+	limiter.Allow("draining")
+
+	// The full bucket has been refilled by the time of the sweep, the
+	// draining one only partly.
+	now := time.Now()
+	limiter.buckets["full"].updated = now.Add(-10 * time.Second)
+	limiter.buckets["draining"].updated = now.Add(-time.Second)
+	limiter.lastSweep = now.Add(-rateLimiterSweepInterval)
+
+	limiter.Allow("other")
+	if _, ok := limiter.buckets["full"]; ok {
+		t.Error("full bucket kept")
+	}
+	if _, ok := limiter.buckets["draining"]; !ok {
+		t.Error("draining bucket forgotten")
+	}
+	if !limiter.lastSweep.After(now.Add(-time.Second)) {
+		t.Error("sweep time not updated")
+	}
+
+	// Buckets are swept at most once per interval.
+	limiter.buckets["other"].updated = now.Add(-10 * time.Second)
+	limiter.Allow("draining")
+	if _, ok := limiter.buckets["other"]; !ok {
+		t.Error("bucket forgotten before the sweep interval")
+	}
+}
@@ -21,9 +21,17 @@
 package halfshell
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // A Route handles the business logic of a Halfshell request. It contains a
@@ -31,29 +39,187 @@ import (
 // is chosen after which the image is retrieved from the source and
 // processed by the processor.
 type Route struct {
-	Name           string
-	Pattern        *regexp.Regexp
-	ImagePathIndex int
-	Processor      ImageProcessor
-	Formats        map[string]FormatConfig
-	Source         ImageSource
-	CacheControl   string
-	Statter        Statter
+	Name            string
+	Pattern         *regexp.Regexp
+	ImagePathIndex  int
+	Processor       ImageProcessor
+	ProcessorConfig *ProcessorConfig
+	Formats         map[string]FormatConfig
+	Source          ImageSource
+	SourceConfig    *SourceConfig
+	Cache           Cache
+	CacheControl    string
+	Expires         time.Duration
+	SurrogateKeys   string
+	SurrogateHeader string
+	SigningKeys     []string
+	RequireExpires  bool
+	AllowUploads    bool
+	Defaults        map[string]string
+	ParameterNames  map[string]string
+	Statter         Statter
+	RateLimiter     *RateLimiter
+	ParameterLimits *ParameterLimits
+	AutoFormat      bool
+	AutoFormats     []string
+	ClientHints     bool
+	Passthrough     bool
+	Script          *RequestScript
+
+	// EncodedImages is set if the route's processors decode the images
+	// themselves, so sources don't decode them with ImageMagick.
+	EncodedImages bool
+
+	// ProcessorHash identifies the settings of the route's processors. It is
+	// part of the cache keys and ETags of the route's images, so images
+	// processed before a reload changing them aren't served afterwards.
+	ProcessorHash string
+
+	// RequestPool bounds the number of requests handled by the route at
+	// once.
+	RequestPool *WorkerPool
+
+	// Placeholder is the path of the image returned with PlaceholderStatus
+	// when the requested image isn't found. No placeholder is returned if it
+	// is empty.
+	Placeholder       string
+	PlaceholderSource ImageSource
+	PlaceholderStatus int
 }
 
 // NewRouteWithConfig returns a pointer to a new Route instance created using
-// the provided configuration settings.
+// the provided configuration settings. It exits if the route's sources or
+// processors can't be created.
 func NewRouteWithConfig(config *RouteConfig, statterConfig *StatterConfig) *Route {
-	return &Route{
-		Name:           config.Name,
-		Pattern:        config.Pattern,
-		ImagePathIndex: config.ImagePathIndex,
-		CacheControl:   config.CacheControl,
-		Processor:      NewImageProcessorWithConfig(config.ProcessorConfig),
-		Formats:        config.ProcessorConfig.Formats,
-		Source:         NewImageSourceWithConfig(config.SourceConfig),
-		Statter:        NewStatterWithConfig(config, statterConfig),
+	route, err := NewRoute(config, statterConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid route %s: %v\n", config.Name, err)
+		os.Exit(1)
 	}
+	return route
+}
+
+// NewRoute is like NewRouteWithConfig, but returns an error if the route's
+// sources or processors can't be created.
+func NewRoute(config *RouteConfig, statterConfig *StatterConfig) (*Route, error) {
+	processors := make([]ImageProcessor, 0, len(config.ProcessorConfigs))
+	for _, processorConfig := range config.ProcessorConfigs {
+		processor, err := NewImageProcessor(processorConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid processor %s: %v", processorConfig.Name, err)
+		}
+		processors = append(processors, processor)
+	}
+
+	statter := NewStatterWithConfig(config, statterConfig)
+
+	sources := make([]ImageSource, 0, len(config.SourceConfigs))
+	for _, sourceConfig := range config.SourceConfigs {
+		source, err := NewImageSource(sourceConfig, statter)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid source %s: %v", sourceConfig.Name, err)
+		}
+		sources = append(sources, source)
+	}
+
+	cacheControl := config.CacheControl
+	if cacheControl == "" {
+		cacheControl = "no-transform,public,max-age=86400,s-maxage=2592000"
+	}
+	if config.StaleWhileRevalidate > 0 {
+		cacheControl += fmt.Sprintf(",stale-while-revalidate=%d", config.StaleWhileRevalidate)
+	}
+
+	route := &Route{
+		Name:            config.Name,
+		Pattern:         config.Pattern,
+		ImagePathIndex:  config.ImagePathIndex,
+		CacheControl:    cacheControl,
+		Expires:         time.Duration(config.Expires) * time.Second,
+		SurrogateKeys:   config.SurrogateKeys,
+		SurrogateHeader: config.SurrogateKeyHeader,
+		SigningKeys:     config.SigningKeys,
+		RequireExpires:  config.RequireExpires,
+		AllowUploads:    config.AllowUploads,
+		Defaults:        config.Defaults,
+		ParameterNames:  config.ParameterNames,
+		Processor:       NewChainedImageProcessor(processors...),
+		ProcessorConfig: config.ProcessorConfig,
+		Formats:         config.ProcessorConfig.Formats,
+		Source:          NewFallbackImageSource(sources...),
+		SourceConfig:    config.SourceConfig,
+		Statter:         statter,
+		RateLimiter:     NewRateLimiter(config.RateLimit, config.RateLimitBurst),
+		RequestPool:     NewWorkerPool(config.MaxConcurrentRequests, config.RequestQueueSize),
+		ParameterLimits: config.ParameterLimits,
+		AutoFormat:      config.AutoFormat,
+		AutoFormats:     config.AutoFormats,
+		ClientHints:     config.ClientHints,
+		Passthrough:     config.Passthrough,
+		EncodedImages:   encodedImages(config.ProcessorConfigs),
+		ProcessorHash:   processorHash(config.ProcessorConfigs),
+
+		Placeholder:       config.Placeholder,
+		PlaceholderStatus: int(config.PlaceholderStatus),
+	}
+
+	route.PlaceholderSource = route.Source
+	if config.PlaceholderSourceConfig != nil {
+		placeholderSource, err := NewImageSource(config.PlaceholderSourceConfig, statter)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid source %s: %v", config.PlaceholderSourceConfig.Name, err)
+		}
+		route.PlaceholderSource = placeholderSource
+	}
+
+	if config.Script != "" {
+		script, err := NewRequestScript(config.Script, config.Name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid script %s: %v", config.Script, err)
+		}
+		route.Script = script
+	}
+	return route, nil
+}
+
+// processorHash returns the hash of the settings of configs that affect the
+// images they process. The cache settings don't.
+func processorHash(configs []*ProcessorConfig) string {
+	settings := make([]ProcessorConfig, len(configs))
+	for i, config := range configs {
+		settings[i] = *config
+		settings[i].Cache = CacheConfig{}
+	}
+	data, _ := json.Marshal(settings)
+	hash := sha1.Sum(data)
+	return hex.EncodeToString(hash[:8])
+}
+
+// CacheKey returns the key identifying the image derived from source with
+// options by the route's processors. Keys of the same source image share the
+// prefix "<route>:<path>?", or "<route>:<bucket>/<path>?" if the bucket is
+// templated.
+func (p *Route) CacheKey(source *ImageSourceOptions, options *ImageProcessorOptions) string {
+	return p.Name + ":" + source.Key() + "?" + options.Key() + "#" + p.ProcessorHash
+}
+
+// SurrogateKeysForRequest returns the surrogate keys of a response, by
+// replacing the placeholders {route}, {source}, {bucket} and {path} in the
+// route's surrogate keys template.
+func (p *Route) SurrogateKeysForRequest(source *ImageSourceOptions) string {
+	bucket := source.Bucket
+	if bucket == "" {
+		bucket = p.SourceConfig.S3Bucket
+	}
+
+	// Keys are separated by spaces, so the path is escaped.
+	replacer := strings.NewReplacer(
+		"{route}", p.Name,
+		"{source}", p.SourceConfig.Name,
+		"{bucket}", bucket,
+		"{path}", strings.TrimPrefix((&url.URL{Path: source.Path}).EscapedPath(), "/"),
+	)
+	return replacer.Replace(p.SurrogateKeys)
 }
 
 // ShouldHandleRequest accepts an HTTP request and returns a bool indicating
@@ -63,33 +229,273 @@ func (p *Route) ShouldHandleRequest(r *http.Request) bool {
 }
 
 // SourceAndProcessorOptionsForRequest parses the source and processor options
-// from the request.
+// from the request. An error is returned if the request contains invalid
+// processing options.
 func (p *Route) SourceAndProcessorOptionsForRequest(r *http.Request) (
-	*ImageSourceOptions, *ImageProcessorOptions) {
+	*ImageSourceOptions, *ImageProcessorOptions, error) {
 
 	matches := p.Pattern.FindAllStringSubmatch(r.URL.Path, -1)[0]
 	path := matches[p.ImagePathIndex]
+	params := &requestParameters{route: p, query: r.URL.Query(), matches: matches}
+
+	var rewrite *RequestRewrite
+	if p.Script != nil {
+		var err error
+		if rewrite, err = p.Script.Rewrite(r, path, p.groups(matches)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if rewrite != nil {
+		params.overrides = rewrite.Params
+	}
+
+	options, err := parseImageProcessorOptions(params.Get, p.Formats)
+	if err == nil {
+		err = p.ParameterLimits.Check(options)
+	}
+	// The scaled dimensions and the negotiated format aren't requested as
+	// such, so they aren't rejected for exceeding the limits.
+	if p.ClientHints && err == nil {
+		p.applyClientHints(r, options)
+	}
+	if p.AutoFormat && !requestsOutputFormat(options) {
+		options.OutputFormat = p.negotiateFormat(r)
+	}
+
+	source := &ImageSourceOptions{Path: path, Limits: p.ProcessorConfig.ImageLimits(), Header: r.Header, Encoded: p.EncodedImages}
+	if p.SourceConfig.VideoFrames {
+		if frameTime, _ := strconv.ParseFloat(params.Get("t"), 64); frameTime > 0 {
+			source.FrameTime = frameTime
+		}
+	}
+	if p.SourceConfig.Type == ImageSourceTypeS3 {
+		if templatePattern.MatchString(p.SourceConfig.S3Bucket) {
+			source.Bucket = p.expandTemplate(p.SourceConfig.S3Bucket, matches)
+		}
+		if p.SourceConfig.S3Key != "" {
+			source.Path = p.expandTemplate(p.SourceConfig.S3Key, matches)
+		}
+	}
+	if rewrite != nil && rewrite.Path != "" {
+		source.Path = rewrite.Path
+	}
+
+	return source, options, err
+}
+
+// DefaultOptionsForRequest returns the processor options of r if it had no
+// processing parameters: the route's defaults, and the output format
+// negotiated with its client if the route has auto_format.
+func (p *Route) DefaultOptionsForRequest(r *http.Request) *ImageProcessorOptions {
+	options, _ := parseImageProcessorOptions(func(name string) string {
+		return p.Defaults[name]
+	}, p.Formats)
+	if p.AutoFormat && !requestsOutputFormat(options) {
+		options.OutputFormat = p.negotiateFormat(r)
+	}
+	return options
+}
+
+// groups returns the named groups of the route pattern matched by a request.
+func (p *Route) groups(matches []string) map[string]string {
+	groups := map[string]string{}
+	for index, name := range p.Pattern.SubexpNames() {
+		if name != "" {
+			groups[name] = matches[index]
+		}
+	}
+	return groups
+}
+
+var templatePattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// expandTemplate replaces the {name} placeholders of template with the named
+// groups of the route pattern matched by the request. Placeholders that don't
+// name a group are left as is.
+func (p *Route) expandTemplate(template string, matches []string) string {
+	return templatePattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		if index := p.Pattern.SubexpIndex(placeholder[1 : len(placeholder)-1]); index > 0 {
+			return matches[index]
+		}
+		return placeholder
+	})
+}
+
+// ParseImageProcessorOptions parses the processing options in values, such as
+// the query string of a request, for a processor configured by config. An
+// error is returned if values contain invalid processing options.
+func ParseImageProcessorOptions(values url.Values, config *ProcessorConfig) (*ImageProcessorOptions, error) {
+	return parseImageProcessorOptions(values.Get, config.Formats)
+}
+
+// parseImageProcessorOptions parses the processing options returned by param.
+func parseImageProcessorOptions(param func(string) string, formats map[string]FormatConfig) (
+	*ImageProcessorOptions, error) {
 
 	var width, height uint64
+	var relativeSize ImageScale
 	var blurRadius float64
-	if formatName := r.FormValue("format"); formatName == "" {
-		width, _ = strconv.ParseUint(r.FormValue("w"), 10, 32)
-		height, _ = strconv.ParseUint(r.FormValue("h"), 10, 32)
-		blurRadius, _ = strconv.ParseFloat(r.FormValue("blur"), 64)
+	if formatName := param("format"); formatName == "" {
+		width, relativeSize.Width = parseDimension(param("w"))
+		height, relativeSize.Height = parseDimension(param("h"))
+		scale := parseRelativeSize(param("scale"))
+		if scale > 0 && width == 0 && height == 0 && relativeSize == (ImageScale{}) {
+			relativeSize = ImageScale{Width: scale}
+		}
+		blurRadius, _ = strconv.ParseFloat(param("blur"), 64)
 	} else {
-		width = p.Formats[formatName].Width
-		height = p.Formats[formatName].Height
-		blurRadius = p.Formats[formatName].Blur
+		width = formats[formatName].Width
+		height = formats[formatName].Height
+		blurRadius = formats[formatName].Blur
 	}
 
-	focalpoint := r.FormValue("focalpoint")
-	scaleModeName := r.FormValue("scale_mode")
+	focalpoint := param("focalpoint")
+	scaleModeName := param("scale_mode")
 	scaleMode, _ := ScaleModes[scaleModeName]
+	paletteColors, _ := strconv.ParseUint(param("palette_colors"), 10, 32)
+	colors, _ := strconv.ParseUint(param("colors"), 10, 32)
+	pixelate, _ := strconv.ParseUint(param("pixelate"), 10, 32)
+
+	cornerRadius, _ := strconv.ParseUint(param("radius"), 10, 32)
+
+	outputFormat, _ := OutputFormats[strings.ToLower(param("fmt"))]
+
+	quality, _ := strconv.ParseUint(param("quality"), 10, 32)
+	if quality > 100 {
+		quality = 100
+	}
+	autoQuality := param("quality") == QualityAuto
+	maxBytes, _ := strconv.ParseUint(param("max_bytes"), 10, 64)
+	subsampling := parseChromaSubsampling(param("subsampling"))
+
+	trimValue := param("trim")
+	trimFuzz, _ := strconv.ParseFloat(trimValue, 64)
+
+	// Invalid duotones, tints, vignettes and borders are ignored, like other
+	// invalid parameters.
+	duotone, _ := parseImageDuotone(strings.Split(param("duotone"), ","))
+	tint, _ := parseImageTint(strings.Split(param("tint"), ","))
+	vignette, _ := parseImageVignette(strings.Split(param("vignette"), ","))
+	border, _ := parseImageBorder(strings.Split(param("border"), ","))
+
+	operations, err := ParseImageOperations(param("ops"))
+	if err == nil && len(operations) > 0 {
+		err = checkFlatOperationParameters(param)
+	}
 
-	return &ImageSourceOptions{Path: path}, &ImageProcessorOptions{
-		Dimensions: ImageDimensions{uint(width), uint(height)},
-		BlurRadius: blurRadius,
-		ScaleMode:  uint(scaleMode),
-		Focalpoint: NewFocalpointFromString(focalpoint),
+	return &ImageProcessorOptions{
+		Dimensions:    ImageDimensions{uint(width), uint(height)},
+		RelativeSize:  relativeSize,
+		BlurRadius:    blurRadius,
+		ScaleMode:     uint(scaleMode),
+		Focalpoint:    NewFocalpointFromString(focalpoint),
+		PaletteColors: uint(paletteColors),
+		Colors:        uint(colors),
+		Output:        param("output"),
+		Pixelate:      uint(pixelate),
+		Region:        NewImageRegionFromString(param("region")),
+		Crop:          NewImageCropFromString(param("crop")),
+		Zoom:          parseZoom(param("zoom")),
+		Trim:          trimValue != "" && trimValue != "false",
+		TrimFuzz:      trimFuzz,
+		CornerRadius:  uint(cornerRadius),
+		Mask:          param("mask"),
+		OutputFormat:  outputFormat,
+		Background:    param("bg"),
+		Fill:          parseFill(param("fill")),
+		Operations:    operations,
+		Quality:       uint(quality),
+		AutoQuality:   autoQuality,
+		MaxBytes:      maxBytes,
+		Subsampling:   subsampling,
+		Overlay:       parseImageOverlay(param),
+		Sheet:         parseImageSheet(param),
+		Adjustments:   parseImageAdjustments(param),
+		Grayscale:     param("grayscale") != "" && param("grayscale") != "false",
+		Sepia:         parseSepiaThreshold(param("sepia")),
+		Invert:        param("invert") != "" && param("invert") != "false",
+		Posterize:     parsePosterizeLevels(param("posterize")),
+		Threshold:     parseThreshold(param("threshold")),
+		Duotone:       duotone,
+		Tint:          tint,
+		Vignette:      vignette,
+		Gradient:      parseImageGradient(param),
+		Border:        border,
+	}, err
+}
+
+// maxRelativeSize is the largest relative size of requests, which keeps them
+// from upscaling images.
+const maxRelativeSize = 1
+
+// maxZoom is the largest zoom factor of requests.
+const maxZoom = 10
+
+// parseZoom parses a zoom factor, from 1 to maxZoom. It returns 0 if s isn't
+// one.
+func parseZoom(s string) float64 {
+	zoom, err := strconv.ParseFloat(s, 64)
+	if err != nil || zoom < 1 || zoom > maxZoom {
+		return 0
+	}
+	return zoom
+}
+
+// parseDimension parses a requested width or height, in pixels or, suffixed
+// with "p", as a percentage of the original's, returned as a fraction.
+// Invalid dimensions are ignored.
+func parseDimension(s string) (uint64, float64) {
+	if strings.HasSuffix(s, "p") {
+		percentage, err := strconv.ParseFloat(strings.TrimSuffix(s, "p"), 64)
+		if err != nil || percentage <= 0 || percentage > 100*maxRelativeSize {
+			return 0, 0
+		}
+		return 0, percentage / 100
+	}
+	value, _ := strconv.ParseUint(s, 10, 32)
+	return value, 0
+}
+
+// parseRelativeSize parses a relative size as a fraction of the original's
+// dimensions. It returns 0 if s isn't one.
+func parseRelativeSize(s string) float64 {
+	scale, err := strconv.ParseFloat(s, 64)
+	if err != nil || scale <= 0 || scale > maxRelativeSize {
+		return 0
+	}
+	return scale
+}
+
+// requestParameters resolves the processing parameters of a request. Only
+// the path and query string are read, which are what signatures cover, so
+// the fields of an uploaded form can't alter a signed request.
+type requestParameters struct {
+	route     *Route
+	query     url.Values
+	matches   []string
+	overrides map[string]string
+}
+
+// Get returns the value of a parameter. Parameters set by the route's script
+// take precedence over all others. Named groups of the route pattern take
+// precedence over the query string, which takes precedence over the route's
+// defaults. If the route maps the parameter to another name, that name is
+// looked up in the path and query string instead.
+func (rp *requestParameters) Get(name string) string {
+	if value, ok := rp.overrides[name]; ok {
+		return value
+	}
+
+	requestName := name
+	if mappedName, ok := rp.route.ParameterNames[name]; ok {
+		requestName = mappedName
+	}
+
+	if index := rp.route.Pattern.SubexpIndex(requestName); index > 0 && rp.matches[index] != "" {
+		return rp.matches[index]
+	}
+	if value := rp.query.Get(requestName); value != "" {
+		return value
 	}
+	return rp.route.Defaults[name]
 }
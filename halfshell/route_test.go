@@ -0,0 +1,76 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func newTestRoute(signingKeys ...string) *Route {
+	return &Route{
+		Name:            "test",
+		Pattern:         regexp.MustCompile(`^/images(?P<image_path>/.*)$`),
+		ImagePathIndex:  1,
+		ProcessorConfig: &ProcessorConfig{},
+		SourceConfig:    &SourceConfig{},
+		SigningKeys:     signingKeys,
+		AllowUploads:    true,
+	}
+}
+
+func TestUploadFormFieldsDontAlterSignedParameters(t *testing.T) {
+	route := newTestRoute("secret")
+	query := url.Values{"w": {"100"}}
+	query.Set(SignatureParameter, ComputeSignature("secret", "/images/a.jpg", query))
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("w", "9999")
+	form.WriteField("blur", "50")
+	form.Close()
+	r := httptest.NewRequest("POST", "/images/a.jpg?"+query.Encode(), &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+
+	if !route.VerifySignature(r) {
+		t.Fatal("signed request rejected")
+	}
+	_, options, err := route.SourceAndProcessorOptionsForRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.Dimensions.Width != 100 || options.BlurRadius != 0 {
+		t.Errorf("form fields applied: width %d, blur %v", options.Dimensions.Width, options.BlurRadius)
+	}
+	if r.MultipartForm != nil || r.PostForm != nil {
+		t.Error("body parsed while reading the request parameters")
+	}
+
+	// The same parameters in the query string invalidate the signature.
+	tampered := httptest.NewRequest("POST", "/images/a.jpg?"+query.Encode()+"&w=9999", nil)
+	if route.VerifySignature(tampered) {
+		t.Error("tampered request accepted")
+	}
+}
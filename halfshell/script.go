@@ -0,0 +1,203 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// requestScriptTimeout bounds the time a request script may run for each
+// request.
+const requestScriptTimeout = 100 * time.Millisecond
+
+// A RequestScript is a Lua script rewriting the requests of a route, for URL
+// schemes a route pattern can't express. The script defines a function
+//
+//	function rewrite(request) ... end
+//
+// called with a table of the request's method, url_path, path (the source
+// path), query, headers and groups (the named groups of the route pattern).
+// It may return a table with a path replacing the source path and params
+// replacing processing parameters, or nil to leave the request unchanged.
+// Raising an error rejects the request.
+type RequestScript struct {
+	Path   string
+	Logger *Logger
+	proto  *lua.FunctionProto
+	states sync.Pool
+}
+
+// A RequestRewrite is the result of a request script.
+type RequestRewrite struct {
+	Path   string
+	Params map[string]string
+}
+
+// NewRequestScript compiles the script at path for the route routeName.
+func NewRequestScript(path string, routeName string) (*RequestScript, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	chunk, err := parse.Parse(file, path)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, err
+	}
+
+	script := &RequestScript{
+		Path:   path,
+		Logger: NewLogger("script.%s", routeName),
+		proto:  proto,
+	}
+	// Loading the script in a first state reports a missing rewrite function
+	// when the route is created rather than on its first request.
+	state, err := script.newState()
+	if err != nil {
+		return nil, err
+	}
+	script.states.Put(state)
+	return script, nil
+}
+
+// newState returns a Lua state with the script loaded. States only have the
+// base, string, table and math libraries, without access to files.
+func (s *RequestScript) newState() (*lua.LState, error) {
+	state := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.StringLibName, lua.OpenString},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		state.Push(state.NewFunction(lib.open))
+		state.Push(lua.LString(lib.name))
+		state.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		state.SetGlobal(name, lua.LNil)
+	}
+
+	state.Push(state.NewFunctionFromProto(s.proto))
+	if err := state.PCall(0, lua.MultRet, nil); err != nil {
+		state.Close()
+		return nil, err
+	}
+	if _, ok := state.GetGlobal("rewrite").(*lua.LFunction); !ok {
+		state.Close()
+		return nil, fmt.Errorf("Script %s doesn't define a rewrite function", s.Path)
+	}
+	return state, nil
+}
+
+// Rewrite runs the script for the request r, whose source path is path and
+// whose route pattern groups are groups. It returns nil if the script leaves
+// the request unchanged.
+func (s *RequestScript) Rewrite(r *http.Request, path string, groups map[string]string) (*RequestRewrite, error) {
+	state, _ := s.states.Get().(*lua.LState)
+	if state == nil {
+		var err error
+		if state, err = s.newState(); err != nil {
+			s.Logger.Errorf("Unable to load script: %v", err)
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestScriptTimeout)
+	defer cancel()
+	state.SetContext(ctx)
+
+	err := state.CallByParam(lua.P{
+		Fn:      state.GetGlobal("rewrite"),
+		NRet:    1,
+		Protect: true,
+	}, s.requestTable(state, r, path, groups))
+	if err != nil {
+		// A state interrupted while running may be left inconsistent, so
+		// it isn't reused.
+		state.Close()
+		s.Logger.Warnf("Script rejected request %s: %v", r.URL, err)
+		return nil, fmt.Errorf("Request rejected by script")
+	}
+
+	result := state.Get(-1)
+	state.Pop(1)
+	state.RemoveContext()
+	s.states.Put(state)
+
+	table, ok := result.(*lua.LTable)
+	if !ok {
+		return nil, nil
+	}
+	rewrite := &RequestRewrite{Params: map[string]string{}}
+	if path, ok := table.RawGetString("path").(lua.LString); ok {
+		rewrite.Path = string(path)
+	}
+	if params, ok := table.RawGetString("params").(*lua.LTable); ok {
+		params.ForEach(func(name lua.LValue, value lua.LValue) {
+			rewrite.Params[name.String()] = value.String()
+		})
+	}
+	return rewrite, nil
+}
+
+// requestTable returns the table describing a request passed to the script.
+func (s *RequestScript) requestTable(state *lua.LState, r *http.Request, path string, groups map[string]string) *lua.LTable {
+	query := state.NewTable()
+	for name, values := range r.URL.Query() {
+		if len(values) > 0 {
+			query.RawSetString(name, lua.LString(values[0]))
+		}
+	}
+	headers := state.NewTable()
+	for name := range r.Header {
+		headers.RawSetString(name, lua.LString(r.Header.Get(name)))
+	}
+	groupsTable := state.NewTable()
+	for name, value := range groups {
+		groupsTable.RawSetString(name, lua.LString(value))
+	}
+
+	request := state.NewTable()
+	request.RawSetString("method", lua.LString(r.Method))
+	request.RawSetString("url_path", lua.LString(r.URL.Path))
+	request.RawSetString("path", lua.LString(path))
+	request.RawSetString("query", query)
+	request.RawSetString("headers", headers)
+	request.RawSetString("groups", groupsTable)
+	return request
+}
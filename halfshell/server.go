@@ -21,37 +21,216 @@
 package halfshell
 
 import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Server struct {
 	*http.Server
-	Routes []*Route
-	Logger *Logger
+	Routes     []*Route
+	Logger     *Logger
+	WorkerPool *WorkerPool
+	Tracer     *Tracer
+	AccessLog  *AccessLog
+
+	// RequestPool bounds the number of image requests handled at once.
+	// Requests wait for it for up to RequestQueueTimeout, or as long as
+	// their client does if it is 0.
+	RequestPool         *WorkerPool
+	RequestQueueTimeout time.Duration
+
+	// ProcessingTimeout bounds the time spent retrieving and processing an
+	// image. No deadline is set if it is 0.
+	ProcessingTimeout time.Duration
+
+	// AdminToken is the bearer token required by the administration
+	// endpoints. They are disabled if it is empty.
+	AdminToken string
+
+	// WarmUpWebhookSecret is the key the webhook calls of warm-up jobs are
+	// signed with. They aren't signed if it is empty.
+	WarmUpWebhookSecret string
+
+	// MaxUploadSize is the maximum size in bytes of the body of POST
+	// requests.
+	MaxUploadSize int64
+
+	// LivenessPath and ReadinessPath are the paths of the liveness and
+	// readiness probes.
+	LivenessPath  string
+	ReadinessPath string
+
+	// TrustedProxies are the networks of the proxies whose X-Forwarded-For
+	// headers identify the clients that are rate limited.
+	TrustedProxies []*net.IPNet
+
+	// Listeners are the servers of the listeners other than the main one,
+	// which accept connections for a subset of the routes.
+	Listeners []*http.Server
+
+	// Started is the time the server was created at.
+	Started time.Time
+
+	// Reload reloads the configuration of the server. The admin reload
+	// endpoint is disabled if it is nil.
+	Reload func() error
+
+	flights flightGroup
+
+	// warmUps are the cache warm-up jobs started through the admin endpoint.
+	warmUps warmUpJobs
+
+	// routesMutex guards Routes, which are replaced when the configuration
+	// is reloaded.
+	routesMutex sync.RWMutex
+
+	// stats tracks the requests being reported to the statters.
+	stats sync.WaitGroup
 }
 
 func NewServerWithConfigAndRoutes(config *ServerConfig, routes []*Route) *Server {
 	httpServer := &http.Server{
-		Addr:           fmt.Sprintf(":%d", config.Port),
-		ReadTimeout:    time.Duration(config.ReadTimeout) * time.Second,
-		WriteTimeout:   time.Duration(config.WriteTimeout) * time.Second,
-		MaxHeaderBytes: 1 << 20,
+		Addr:              fmt.Sprintf("%s:%d", config.BindAddress, config.Port),
+		ReadTimeout:       time.Duration(config.ReadTimeout) * time.Second,
+		ReadHeaderTimeout: time.Duration(config.ReadHeaderTimeout) * time.Second,
+		WriteTimeout:      time.Duration(config.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(config.IdleTimeout) * time.Second,
+		MaxHeaderBytes:    int(config.MaxHeaderBytes),
+	}
+	httpServer.SetKeepAlivesEnabled(!config.DisableKeepAlives)
+	server := &Server{
+		Server:     httpServer,
+		Routes:     routes,
+		Logger:     NewLogger("server"),
+		WorkerPool: NewWorkerPool(config.ProcessingWorkers, config.ProcessingQueueSize),
+		Tracer:     NewTracerWithConfig(config),
+		AccessLog:  NewAccessLogWithConfig(config),
+
+		Started:             time.Now(),
+		RequestPool:         NewWorkerPool(config.MaxConcurrentRequests, config.RequestQueueSize),
+		RequestQueueTimeout: time.Duration(config.RequestQueueTimeout) * time.Second,
+
+		ProcessingTimeout:   time.Duration(config.ProcessingTimeout) * time.Second,
+		AdminToken:          config.AdminToken,
+		WarmUpWebhookSecret: config.WarmUpWebhookSecret,
+		MaxUploadSize:       int64(config.MaxUploadSize),
+		LivenessPath:        config.LivenessPath,
+		ReadinessPath:       config.ReadinessPath,
+	}
+	httpServer.Handler = &listenerHandler{server: server, listener: config.Listeners[0]}
+
+	trustedProxies, err := ParseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid trusted proxies: %v\n", err)
+		os.Exit(1)
+	}
+	server.TrustedProxies = trustedProxies
+
+	tlsConfig, err := NewTLSConfig(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid TLS configuration: %v\n", err)
+		os.Exit(1)
+	}
+	if tlsConfig != nil {
+		if config.DisableHTTP2 {
+			// A non-nil map keeps the server from setting up HTTP/2.
+			httpServer.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+			tlsConfig.NextProtos = []string{"http/1.1"}
+		} else {
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+	httpServer.TLSConfig = tlsConfig
+
+	for _, listener := range config.Listeners[1:] {
+		server.Listeners = append(server.Listeners, server.newListenerServer(httpServer, listener))
 	}
-	server := &Server{httpServer, routes, NewLogger("server")}
-	httpServer.Handler = server
 	return server
 }
 
+// SetRoutes replaces the routes of the server. Requests being handled keep
+// the routes they were matched with.
+func (s *Server) SetRoutes(routes []*Route) {
+	s.routesMutex.Lock()
+	defer s.routesMutex.Unlock()
+	s.Routes = routes
+}
+
+// routes returns the current routes of the server.
+func (s *Server) routes() []*Route {
+	s.routesMutex.RLock()
+	defer s.routesMutex.RUnlock()
+	return s.Routes
+}
+
+// Drain stops the server gracefully: it stops accepting connections, waits
+// for the requests in progress to be answered until ctx is done, and flushes
+// their statistics and traces.
+func (s *Server) Drain(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(s.Listeners))
+	for i, listener := range s.Listeners {
+		wg.Add(1)
+		go func(i int, listener *http.Server) {
+			defer wg.Done()
+			errs[i] = listener.Shutdown(ctx)
+		}(i, listener)
+	}
+	err := s.Shutdown(ctx)
+	wg.Wait()
+	for _, listenerErr := range errs {
+		if err == nil {
+			err = listenerErr
+		}
+	}
+	// Requests still in progress after a timeout may yet report statistics,
+	// so they are only awaited once every request has been answered.
+	if err == nil {
+		s.stats.Wait()
+	}
+	s.Tracer.Flush()
+	return err
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The body of uploads is limited before it is read.
+	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, s.MaxUploadSize)
+	}
+
+	ctx, span := s.Tracer.StartRequestSpan(r)
+	r = r.WithContext(ctx)
+
 	hw := s.NewResponseWriter(w)
+	hw.OmitBody = r.Method == "HEAD"
 	hr := s.NewRequest(r)
 	defer s.LogRequest(hw, hr)
+	defer func() {
+		span.SetAttribute("http.status_code", strconv.Itoa(hw.Status))
+		span.Finish()
+	}()
 	switch {
 	case "/healthcheck" == hr.URL.Path || "/health" == hr.URL.Path:
 		hw.Write([]byte("OK"))
+	case s.LivenessPath == hr.URL.Path:
+		s.LivenessHandler(hw, hr)
+	case s.ReadinessPath == hr.URL.Path:
+		s.ReadinessHandler(hw, hr)
+	case strings.HasPrefix(hr.URL.Path, "/admin/") && listenerForRequest(r).servesAdmin():
+		s.AdminRequestHandler(hw, hr)
 	default:
 		s.ImageRequestHandler(hw, hr)
 	}
@@ -64,44 +243,485 @@ func (s *Server) ImageRequestHandler(w *ResponseWriter, r *Request) {
 		return
 	}
 
-	defer func() { go r.Route.Statter.RegisterRequest(w, r) }()
+	s.stats.Add(1)
+	defer func() {
+		go func() {
+			defer s.stats.Done()
+			r.Route.Statter.RegisterRequest(w, r)
+		}()
+	}()
+
+	if vary := r.Route.Vary(); vary != "" {
+		w.SetHeader("Vary", vary)
+	}
+	if r.Route.ClientHints {
+		w.SetHeader("Accept-CH", strings.Join(ClientHintsHeaders, ", "))
+	}
+
+	if allowed, wait := r.Route.RateLimiter.Allow(ClientIP(r.Request, s.TrustedProxies)); !allowed {
+		s.count(r, "rate_limited")
+		w.SetHeader("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		w.WriteError("Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+
+	if !r.Route.VerifySignature(r.Request) {
+		w.WriteError("Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.OptionsError != nil {
+		w.WriteError(r.OptionsError.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.admitRequest(r); err != nil {
+		w.WriteHTTPError(err)
+		return
+	}
+	defer s.releaseRequest(r)
+
+	if err := runPreFetchHooks(w, r); err != nil {
+		w.WriteHTTPError(err)
+		return
+	}
+
+	if r.Method == "POST" {
+		s.UploadRequestHandler(w, r)
+		return
+	}
+
+	if r.ProcessorOptions.Output == OutputInfo {
+		s.InfoRequestHandler(w, r)
+		return
+	}
+
+	if r.Route.Passthrough && !r.ProcessorOptions.RequestsProcessing(r.Route.DefaultOptionsForRequest(r.Request)) {
+		s.PassthroughRequestHandler(w, r)
+		return
+	}
 
 	s.Logger.Infof("Handling request for image %s with dimensions %v",
 		r.SourceOptions.Path, r.ProcessorOptions.Dimensions)
 
-	image, err := r.Route.Source.GetImage(r.SourceOptions)
+	// HEAD requests are answered like GET requests, from the cache if the
+	// derivative is in it, with the body omitted by the writer.
+	key := r.Route.CacheKey(r.SourceOptions, r.ProcessorOptions)
+	processedImage, err := s.cachedProcessImage(key, r)
+	if err == ErrNotModified {
+		s.setCacheHeaders(w, r)
+		w.WriteNotModified(processedImage)
+		return
+	}
+	if err == nil {
+		err = runPostProcessHooks(w, r, processedImage)
+	}
 	if err != nil {
-		w.WriteError("Not Found", http.StatusNotFound)
+		w.WriteHTTPError(err)
 		return
 	}
-	defer image.Destroy()
 
-	err = r.Route.Processor.ProcessImage(image, r.ProcessorOptions)
-	if err != nil {
-		s.Logger.Warnf("Error processing image data %s to dimensions: %v", r.ProcessorOptions.Dimensions)
-		w.WriteError("Internal Server Error", http.StatusNotFound)
+	if processedImage.Placeholder {
+		s.Logger.Infof("Returning placeholder for missing image %s", r.SourceOptions.Path)
+		w.SetHeader("Cache-Control", "no-cache")
+		w.WritePlaceholderImage(processedImage, r.Route.PlaceholderStatus)
 		return
 	}
 
+	if processedImage.BlurHash != "" {
+		w.SetHeader("X-BlurHash", processedImage.BlurHash)
+	}
+
 	s.Logger.Infof("Returning resized image %s to dimensions %v",
 		r.SourceOptions.Path, r.ProcessorOptions.Dimensions)
 
-	cacheControl := r.Route.CacheControl
-	if r.Route.CacheControl == "" {
-		cacheControl = "no-transform,public,max-age=86400,s-maxage=2592000"
+	s.setCacheHeaders(w, r)
+	_, span := StartSpan(r.Context(), "respond", SpanKindInternal)
+	w.WriteProcessedImage(processedImage)
+	span.Finish()
+}
+
+// setCacheHeaders sets the caching headers configured for the route.
+func (s *Server) setCacheHeaders(w *ResponseWriter, r *Request) {
+	w.SetHeader("Cache-Control", r.Route.CacheControl)
+	if r.Route.Expires > 0 {
+		expires := time.Now().Add(r.Route.Expires)
+		w.SetHeader("Expires", expires.UTC().Format(http.TimeFormat))
+	}
+	if r.Route.SurrogateKeys != "" {
+		w.SetHeader(r.Route.SurrogateHeader, r.Route.SurrogateKeysForRequest(r.SourceOptions))
 	}
-	w.SetHeader("Cache-Control", cacheControl)
-	w.WriteImage(image)
 }
 
-func (s *Server) LogRequest(w *ResponseWriter, r *Request) {
-	logFormat := "%s - - [%s] \"%s %s %s\" %d %d\n"
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
+// cachedProcessImage returns the processed image for key from the route's
+// cache, processing and caching it on a miss. Concurrent requests for the same
+// derivative are processed only once. ErrNotModified is returned along with
+// the image if the request's conditional headers match it.
+//
+// Images past the cache's maximum age are served stale while they are
+// processed again in the background, for up to its stale-while-revalidate
+// window, and served stale if processing them again fails, for up to its
+// stale-if-error window.
+func (s *Server) cachedProcessImage(key string, r *Request) (*ProcessedImage, error) {
+	cache := r.Route.Cache
+	cacheConfig := &r.Route.ProcessorConfig.Cache
+	var staleImage *ProcessedImage
+	if cache != nil {
+		if processedImage, ok := cache.Get(key); ok {
+			staleness := cacheConfig.Staleness(processedImage, time.Now())
+			switch {
+			case staleness <= 0:
+				s.count(r, "cache.hit")
+				return cachedImageForRequest(r, processedImage)
+			case staleness <= time.Duration(cacheConfig.StaleWhileRevalidate)*time.Second:
+				s.count(r, "cache.stale")
+				s.revalidate(key, r)
+				return cachedImageForRequest(r, processedImage)
+			case staleness <= time.Duration(cacheConfig.StaleIfError)*time.Second:
+				staleImage = processedImage
+			}
+		}
+		s.count(r, "cache.miss")
+	}
+
+	// Whether the result is ErrNotModified depends on the conditional
+	// headers, so only requests with the same headers share it.
+	flightKey := key
+	for _, name := range []string{"If-None-Match", "If-Modified-Since"} {
+		if value := r.Header.Get(name); value != "" {
+			flightKey += "\n" + name + ": " + value
+		}
+	}
+
+	result, err, shared := s.flights.Do(flightKey, func() (interface{}, error) {
+		return s.processAndCache(key, r)
+	})
+	if shared {
+		s.Logger.Infof("Shared result of concurrent request for image %s", r.SourceOptions.Path)
+	}
+	if err != nil && err != ErrNotModified && staleImage != nil {
+		s.count(r, "cache.stale_if_error")
+		s.Logger.Warnf("Serving stale image %s: %v", r.SourceOptions.Path, err)
+		return cachedImageForRequest(r, staleImage)
+	}
+	processedImage, _ := result.(*ProcessedImage)
+	return processedImage, err
+}
+
+// processAndCache processes the image of r and stores it in the route's cache
+// under key. Placeholders aren't cached, so the image is served once it
+// exists.
+func (s *Server) processAndCache(key string, r *Request) (*ProcessedImage, error) {
+	processedImage, err := s.ProcessImage(r)
+	if err == nil && r.Route.Cache != nil && !processedImage.Placeholder {
+		processedImage.CachedAt = time.Now()
+		r.Route.Cache.Set(key, processedImage)
+	}
+	return processedImage, err
+}
+
+// revalidate processes the image of r again in the background, replacing its
+// stale copy in the cache under key. The refresh uses copies of the options
+// of r, without its conditional headers, so it doesn't depend on the request
+// being answered first.
+func (s *Server) revalidate(key string, r *Request) {
+	ctx := ContextWithSpan(context.Background(), SpanFromContext(r.Context()))
+	httpRequest := r.Request.WithContext(ctx)
+	httpRequest.Header = r.Header.Clone()
+	httpRequest.Header.Del("If-None-Match")
+	httpRequest.Header.Del("If-Modified-Since")
+	sourceOptions := *r.SourceOptions
+	processorOptions := *r.ProcessorOptions
+	refresh := &Request{
+		Request:          httpRequest,
+		Timestamp:        time.Now(),
+		Route:            r.Route,
+		SourceOptions:    &sourceOptions,
+		ProcessorOptions: &processorOptions,
+	}
+
+	go func() {
+		_, err, shared := s.flights.Do(key, func() (interface{}, error) {
+			return s.processAndCache(key, refresh)
+		})
+		if err != nil && !shared {
+			s.count(refresh, "cache.revalidate_error")
+			s.Logger.Warnf("Error revalidating image %s: %v", refresh.SourceOptions.Path, err)
+		}
+	}()
+}
+
+// cachedImageForRequest returns a cached image, along with ErrNotModified if
+// the conditional headers of r match it.
+func cachedImageForRequest(r *Request, processedImage *ProcessedImage) (*ProcessedImage, error) {
+	if isNotModified(r, processedImage.ETag, processedImage.LastModified) {
+		return processedImage, ErrNotModified
+	}
+	return processedImage, nil
+}
+
+func (s *Server) count(r *Request, stat string) {
+	if r.Route.Statter != nil {
+		r.Route.Statter.Count(stat)
+	}
+}
+
+func (s *Server) timing(r *Request, stat string, duration time.Duration) {
+	if r.Route.Statter != nil {
+		r.Route.Statter.Timing(stat, duration)
+	}
+}
+
+// ProcessImage retrieves the image of a request from its route's source,
+// processes it, and returns the encoded result. If the request's
+// If-None-Match header matches the ETag of the result, ErrNotModified is
+// returned before the image is processed. The same goes for the
+// If-Modified-Since header and the modification time of the original. If the
+// image isn't found, the route's placeholder is processed instead.
+func (s *Server) ProcessImage(r *Request) (*ProcessedImage, error) {
+	// The result may be shared with concurrent requests, so the work isn't
+	// tied to the context of the request that started it. It is still traced
+	// as part of that request.
+	ctx := ContextWithSpan(context.Background(), SpanFromContext(r.Context()))
+	if s.ProcessingTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ProcessingTimeout)
+		defer cancel()
+	}
+
+	// The worker is held for as long as the image is in memory, which bounds
+	// the memory used by ImageMagick.
+	err := s.acquireWorker(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	defer s.WorkerPool.Release()
+
+	if r.ProcessorOptions.Output == OutputSheet {
+		return s.processSheet(ctx, r)
+	}
+
+	sourceCtx, span := StartSpan(ctx, "source.fetch", SpanKindInternal)
+	span.SetAttribute("halfshell.source.path", r.SourceOptions.Key())
+	image, err := r.Route.Source.GetImage(sourceCtx, r.SourceOptions)
+	placeholder := err == ErrImageNotFound && r.Route.Placeholder != ""
+	if placeholder {
+		s.count(r, "placeholder")
+		span.SetAttribute("halfshell.placeholder", r.Route.Placeholder)
+		image, err = r.Route.PlaceholderSource.GetImage(sourceCtx, &ImageSourceOptions{
+			Path:    r.Route.Placeholder,
+			Limits:  r.SourceOptions.Limits,
+			Header:  r.SourceOptions.Header,
+			Encoded: r.SourceOptions.Encoded,
+		})
+	}
+	span.SetError(err)
+	span.Finish()
+	if err == nil && ctx.Err() == context.DeadlineExceeded {
+		image.Destroy()
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, s.sourceError(ctx, r, err)
+	}
+	defer image.Destroy()
+
+	err = runPostFetchHooks(r, image)
+	if err != nil {
+		return nil, err
+	}
+
+	overlay, err := s.fetchOverlay(ctx, r)
+	if err != nil {
+		return nil, s.sourceError(ctx, r, err)
+	}
+	signature := image.GetSignature()
+	if overlay != nil {
+		defer overlay.Destroy()
+		r.ProcessorOptions.OverlayImage = overlay
+		defer func() { r.ProcessorOptions.OverlayImage = nil }()
+		signature += overlay.GetSignature()
+	}
+
+	// The ETag is derived from the original image, so it is known before the
+	// image is processed.
+	etag := NewETag(signature, r.Route.ProcessorHash, r.ProcessorOptions)
+	if !placeholder && isNotModified(r, etag, image.LastModified) {
+		return &ProcessedImage{ETag: etag, LastModified: image.LastModified}, ErrNotModified
+	}
+
+	processedImage, err := s.processImage(ctx, image, r)
+	if err != nil {
+		return nil, err
+	}
+	if placeholder {
+		processedImage.Placeholder = true
+		return processedImage, nil
+	}
+	processedImage.ETag = etag
+	processedImage.LastModified = image.LastModified
+	return processedImage, nil
+}
+
+// admitRequest waits until the route and the server are handling few enough
+// requests to handle r. Requests are shed with a 503 Service Unavailable
+// error once the queues are full or the wait times out.
+func (s *Server) admitRequest(r *Request) error {
+	ctx := r.Context()
+	if s.RequestQueueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.RequestQueueTimeout)
+		defer cancel()
+	}
+
+	// The route's limit is waited for first, so the requests of a busy route
+	// don't keep the server from handling other routes.
+	err := r.Route.RequestPool.Acquire(ctx)
+	if err == nil {
+		err = s.RequestPool.Acquire(ctx)
+		if err != nil {
+			r.Route.RequestPool.Release()
+		}
+	}
 	if err != nil {
-		host = r.RemoteAddr
+		s.count(r, "load_shed")
+		s.Logger.Warnf("Shedding request for image %s: %v", r.SourceOptions.Path, err)
+		return NewHTTPError("Service Unavailable", http.StatusServiceUnavailable)
+	}
+	return nil
+}
+
+// releaseRequest releases the request slots acquired by admitRequest.
+func (s *Server) releaseRequest(r *Request) {
+	s.RequestPool.Release()
+	r.Route.RequestPool.Release()
+}
+
+// sourceError returns the error answering a request whose image couldn't be
+// retrieved from the source, within ctx, because of err.
+func (s *Server) sourceError(ctx context.Context, r *Request, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		s.Logger.Warnf("Timed out retrieving image %s", r.SourceOptions.Path)
+		return NewHTTPError("Gateway Timeout", http.StatusGatewayTimeout)
+	}
+	if err == ErrImageTooLarge {
+		s.Logger.Warnf("Rejecting image %s: %v", r.SourceOptions.Path, err)
+		return NewHTTPError("Unprocessable Entity", http.StatusUnprocessableEntity)
+	}
+	if err == ErrOriginalTooLarge {
+		s.Logger.Warnf("Rejecting image %s: %v", r.SourceOptions.Path, err)
+		return NewHTTPError("Request Entity Too Large", http.StatusRequestEntityTooLarge)
+	}
+	if isTimeout(err) {
+		s.Logger.Warnf("Timed out retrieving image %s from source: %v", r.SourceOptions.Path, err)
+		return NewHTTPError("Bad Gateway", http.StatusBadGateway)
+	}
+	// Failing origins aren't reported as missing images, which clients and
+	// CDNs would take as final.
+	var statusErr *SourceStatusError
+	if errors.As(err, &statusErr) {
+		s.Logger.Warnf("Error retrieving image %s from source: %v", r.SourceOptions.Path, err)
+		return NewHTTPError("Bad Gateway", http.StatusBadGateway)
+	}
+	return NewHTTPError("Not Found", http.StatusNotFound)
+}
+
+// acquireWorker acquires a worker of the pool for r.
+func (s *Server) acquireWorker(ctx context.Context, r *Request) error {
+	err := s.WorkerPool.Acquire(ctx)
+	if err == context.DeadlineExceeded {
+		s.Logger.Warnf("Timed out waiting for a worker for image %s", r.SourceOptions.Path)
+		return NewHTTPError("Gateway Timeout", http.StatusGatewayTimeout)
+	}
+	if err != nil {
+		s.Logger.Warnf("Rejecting request for image %s: %v", r.SourceOptions.Path, err)
+		return NewHTTPError("Service Unavailable", http.StatusServiceUnavailable)
+	}
+	return nil
+}
+
+// processImage processes an image with the route's processor and encodes the
+// result.
+func (s *Server) processImage(ctx context.Context, image *Image, r *Request) (*ProcessedImage, error) {
+	ctx, span := StartSpan(ctx, "process", SpanKindInternal)
+	defer span.Finish()
+
+	err := runPreProcessHooks(r, image)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	err = r.Route.Processor.ProcessImage(ctx, image, r.ProcessorOptions)
+	span.SetError(err)
+	if err == context.DeadlineExceeded {
+		s.Logger.Warnf("Timed out processing image %s", r.SourceOptions.Path)
+		return nil, NewHTTPError("Gateway Timeout", http.StatusGatewayTimeout)
+	}
+	if err != nil {
+		s.Logger.Warnf("Error processing image data %s to dimensions: %v", r.SourceOptions.Path, r.ProcessorOptions.Dimensions)
+		return nil, NewHTTPError("Internal Server Error", http.StatusInternalServerError)
+	}
+	s.timing(r, "processing", time.Since(start))
+
+	return s.encodeImage(image, r)
+}
+
+// isTimeout returns whether err is a source's connect or read timeout.
+func isTimeout(err error) bool {
+	if err == ErrSourceTimeout {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// encodeImage encodes a processed image into the output requested.
+func (s *Server) encodeImage(image *Image, r *Request) (*ProcessedImage, error) {
+	if r.ProcessorOptions.Output == OutputBlurHash {
+		blurHash, err := image.GetBlurHash()
+		if err != nil {
+			s.Logger.Warnf("Error computing BlurHash for image %s: %v", r.SourceOptions.Path, err)
+			return nil, err
+		}
+		return &ProcessedImage{
+			Bytes:       []byte(blurHash),
+			ContentType: "text/plain; charset=utf-8",
+		}, nil
+	}
+
+	if r.ProcessorOptions.Output == OutputPalette {
+		palette, err := image.GetPalette(r.ProcessorOptions.PaletteColors)
+		if err != nil {
+			s.Logger.Warnf("Error extracting palette for image %s: %v", r.SourceOptions.Path, err)
+			return nil, err
+		}
+		data, err := json.Marshal(palette)
+		if err != nil {
+			return nil, err
+		}
+		return &ProcessedImage{Bytes: data, ContentType: "application/json"}, nil
+	}
+
+	processedImage := NewProcessedImage(image)
+
+	if r.Route.ProcessorConfig.BlurHashHeader {
+		blurHash, err := image.GetBlurHash()
+		if err != nil {
+			s.Logger.Warnf("Error computing BlurHash for image %s: %v", r.SourceOptions.Path, err)
+		} else {
+			processedImage.BlurHash = blurHash
+		}
+	}
+
+	return processedImage, nil
+}
+
+// LogRequest writes the request to the access log, if there is one.
+func (s *Server) LogRequest(w *ResponseWriter, r *Request) {
+	if s.AccessLog != nil {
+		s.AccessLog.Log(w, r)
 	}
-	fmt.Printf(logFormat, host, r.Timestamp.Format("02/Jan/2006:15:04:05 -0700"),
-		r.Method, r.URL.RequestURI(), r.Proto, w.Status, w.Size)
 }
 
 type Request struct {
@@ -110,19 +730,26 @@ type Request struct {
 	Route            *Route
 	SourceOptions    *ImageSourceOptions
 	ProcessorOptions *ImageProcessorOptions
+	OptionsError     error
 }
 
 func (s *Server) NewRequest(r *http.Request) *Request {
-	request := &Request{r, time.Now(), nil, nil, nil}
-	for _, route := range s.Routes {
-		if route.ShouldHandleRequest(r) {
+	_, span := StartSpan(r.Context(), "route.match", SpanKindInternal)
+	defer span.Finish()
+
+	request := &Request{Request: r, Timestamp: time.Now()}
+	listener := listenerForRequest(r)
+	for _, route := range s.routes() {
+		if listener.servesRoute(route.Name) && route.ShouldHandleRequest(r) {
 			request.Route = route
 		}
 	}
 
 	if request.Route != nil {
-		request.SourceOptions, request.ProcessorOptions =
+		span.SetAttribute("halfshell.route", request.Route.Name)
+		request.SourceOptions, request.ProcessorOptions, request.OptionsError =
 			request.Route.SourceAndProcessorOptionsForRequest(r)
+		span.SetError(request.OptionsError)
 	}
 
 	return request
@@ -131,9 +758,14 @@ func (s *Server) NewRequest(r *http.Request) *Request {
 // ResponseWriter is a wrapper around http.ResponseWriter that provides
 // access to the response status and size after they have been set.
 type ResponseWriter struct {
-	w      http.ResponseWriter
-	Status int
-	Size   int
+	w           http.ResponseWriter
+	Status      int
+	Size        int
+	ContentType string
+
+	// OmitBody makes the writer discard the body of the response, which
+	// answers HEAD requests with the headers of the GET response.
+	OmitBody bool
 }
 
 // NewResponseWriter creates a new ResponseWriter by wrapping http.ResponseWriter.
@@ -141,6 +773,12 @@ func (s *Server) NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
 	return &ResponseWriter{w: w}
 }
 
+// Header returns the headers of the response, like http.ResponseWriter's
+// Header method.
+func (hw *ResponseWriter) Header() http.Header {
+	return hw.w.Header()
+}
+
 // WriteHeader forwards to http.ResponseWriter's WriteHeader method.
 func (hw *ResponseWriter) WriteHeader(status int) {
 	hw.Status = status
@@ -154,6 +792,9 @@ func (hw *ResponseWriter) SetHeader(name, value string) {
 
 // Writes data the output stream.
 func (hw *ResponseWriter) Write(data []byte) (int, error) {
+	if hw.OmitBody {
+		return len(data), nil
+	}
 	hw.Size += len(data)
 	return hw.w.Write(data)
 }
@@ -165,6 +806,71 @@ func (hw *ResponseWriter) WriteError(message string, status int) {
 	hw.Write([]byte(message))
 }
 
+// WriteText writes a plain text response.
+func (hw *ResponseWriter) WriteText(text string) {
+	hw.SetHeader("Content-Type", "text/plain; charset=utf-8")
+	hw.WriteHeader(http.StatusOK)
+	hw.Write([]byte(text))
+}
+
+// WriteJSON writes v as a JSON response.
+func (hw *ResponseWriter) WriteJSON(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		hw.WriteError("Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	hw.SetHeader("Content-Type", "application/json")
+	hw.WriteHeader(http.StatusOK)
+	hw.Write(data)
+}
+
+// WriteHTTPError writes an error response for err, using its status code if
+// it is an HTTPError.
+func (hw *ResponseWriter) WriteHTTPError(err error) {
+	if httpError, ok := err.(*HTTPError); ok {
+		hw.WriteError(httpError.Message, httpError.Status)
+	} else {
+		hw.WriteError("Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// WriteProcessedImage writes a processed image to the output stream and sets
+// the appropriate headers.
+func (hw *ResponseWriter) WriteProcessedImage(image *ProcessedImage) {
+	hw.setValidators(image)
+	hw.writeImageBytes(image, http.StatusOK)
+}
+
+// WritePlaceholderImage writes a placeholder image with the given status.
+func (hw *ResponseWriter) WritePlaceholderImage(image *ProcessedImage, status int) {
+	hw.writeImageBytes(image, status)
+}
+
+func (hw *ResponseWriter) writeImageBytes(image *ProcessedImage, status int) {
+	hw.ContentType = image.ContentType
+	hw.SetHeader("Content-Type", image.ContentType)
+	hw.SetHeader("Content-Length", fmt.Sprintf("%d", len(image.Bytes)))
+	hw.WriteHeader(status)
+	hw.Write(image.Bytes)
+}
+
+// WriteNotModified writes a 304 Not Modified response for image.
+func (hw *ResponseWriter) WriteNotModified(image *ProcessedImage) {
+	hw.setValidators(image)
+	hw.WriteHeader(http.StatusNotModified)
+}
+
+// setValidators sets the headers used to revalidate image.
+func (hw *ResponseWriter) setValidators(image *ProcessedImage) {
+	if image.ETag != "" {
+		hw.SetHeader("ETag", image.ETag)
+	}
+	if !image.LastModified.IsZero() {
+		hw.SetHeader("Last-Modified", image.LastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
 // WriteImage writes an image to the output stream and sets the appropriate headers.
 func (hw *ResponseWriter) WriteImage(image *Image) {
 	bytes, size := image.GetBytes()
@@ -174,3 +880,97 @@ func (hw *ResponseWriter) WriteImage(image *Image) {
 	hw.WriteHeader(http.StatusOK)
 	hw.Write(bytes)
 }
+
+// ProcessedImage is the encoded result of processing a request. Unlike an
+// Image, it can be shared between requests.
+type ProcessedImage struct {
+	Bytes       []byte
+	ContentType string
+	Signature   string
+	ETag        string
+	BlurHash    string
+
+	LastModified time.Time
+
+	// CachedAt is the time the image was stored in the cache, which its
+	// staleness is measured from.
+	CachedAt time.Time
+
+	// Placeholder is set if the image is the route's placeholder for a
+	// missing original.
+	Placeholder bool
+}
+
+// NewProcessedImage encodes an image into a ProcessedImage.
+func NewProcessedImage(image *Image) *ProcessedImage {
+	bytes, _ := image.GetBytes()
+	return &ProcessedImage{
+		Bytes:       bytes,
+		ContentType: image.GetMIMEType(),
+		Signature:   image.GetSignature(),
+	}
+}
+
+// ErrNotModified is returned when the image requested matches the request's
+// If-None-Match header.
+var ErrNotModified = errors.New("Not modified")
+
+// NewETag returns a strong ETag for the image derived from the original with
+// the given signature using options, by processors with the settings
+// identified by processorHash.
+func NewETag(signature, processorHash string, options *ImageProcessorOptions) string {
+	hash := sha1.Sum([]byte(signature + "?" + options.Key() + "#" + processorHash))
+	return `"` + hex.EncodeToString(hash[:]) + `"`
+}
+
+// isNotModified returns whether the conditional headers of r match an image
+// with the given ETag and modification time. As in RFC 7232,
+// If-Modified-Since is ignored if If-None-Match is present.
+func isNotModified(r *Request, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag)
+	}
+
+	if lastModified.IsZero() {
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// HTTP dates have a resolution of one second.
+	return !lastModified.Truncate(time.Second).After(ifModifiedSince)
+}
+
+// etagMatches returns whether an If-None-Match header value matches etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		// If-None-Match uses the weak comparison.
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPError is an error with an associated HTTP status code.
+type HTTPError struct {
+	Message string
+	Status  int
+}
+
+// NewHTTPError returns a new HTTPError.
+func NewHTTPError(message string, status int) *HTTPError {
+	return &HTTPError{Message: message, Status: status}
+}
+
+func (e *HTTPError) Error() string {
+	return e.Message
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SignatureParameter is the name of the request parameter holding the
+// signature of signed requests.
+const SignatureParameter = "s"
+
+// ExpiresParameter is the name of the request parameter holding the Unix
+// time after which a signed request is no longer valid.
+const ExpiresParameter = "expires"
+
+// ComputeSignature returns the signature of a request for path with the
+// parameters query, computed with key. The signature parameter itself, if
+// present in query, is ignored.
+func ComputeSignature(key, path string, query url.Values) string {
+	params := url.Values{}
+	for name, values := range query {
+		if name != SignatureParameter {
+			params[name] = values
+		}
+	}
+
+	// Encode sorts the parameters by name, so the order of the parameters
+	// in the request doesn't matter.
+	message := path
+	if len(params) > 0 {
+		message += "?" + params.Encode()
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature returns whether the request carries a valid signature for
+// the route. Any of the route's signing keys is accepted, so keys can be
+// rotated by adding the new key, updating the clients, and then removing the
+// old key. Signed requests with an expiry time are no longer valid once it
+// has passed. Requests to routes without signing keys are always valid.
+func (p *Route) VerifySignature(r *http.Request) bool {
+	if len(p.SigningKeys) == 0 {
+		return true
+	}
+
+	query := r.URL.Query()
+	signature, err := hex.DecodeString(query.Get(SignatureParameter))
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+
+	if expires := query.Get(ExpiresParameter); expires != "" {
+		expiryTime, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || time.Now().Unix() > expiryTime {
+			return false
+		}
+	} else if p.RequireExpires {
+		return false
+	}
+
+	for _, key := range p.SigningKeys {
+		expected, _ := hex.DecodeString(ComputeSignature(key, r.URL.Path, query))
+		if hmac.Equal(signature, expected) {
+			return true
+		}
+	}
+	return false
+}
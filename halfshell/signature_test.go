@@ -0,0 +1,97 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestComputeSignature(t *testing.T) {
+	base := ComputeSignature("secret", "/images/a.jpg", url.Values{"w": {"100"}, "h": {"50"}})
+
+	tests := []struct {
+		name  string
+		key   string
+		path  string
+		query string
+		same  bool
+	}{
+		{"same parameters", "secret", "/images/a.jpg", "w=100&h=50", true},
+		{"reordered parameters", "secret", "/images/a.jpg", "h=50&w=100", true},
+		{"signature ignored", "secret", "/images/a.jpg", "w=100&h=50&s=abc", true},
+		{"other key", "other", "/images/a.jpg", "w=100&h=50", false},
+		{"other path", "secret", "/images/b.jpg", "w=100&h=50", false},
+		{"other value", "secret", "/images/a.jpg", "w=101&h=50", false},
+		{"extra parameter", "secret", "/images/a.jpg", "w=100&h=50&blur=1", false},
+		{"missing parameter", "secret", "/images/a.jpg", "w=100", false},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		signature := ComputeSignature(test.key, test.path, query)
+		if (signature == base) != test.same {
+			t.Errorf("%s: signature %s, base signature %s", test.name, signature, base)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	sign := func(key, query string) string {
+		values, _ := url.ParseQuery(query)
+		values.Set(SignatureParameter, ComputeSignature(key, "/images/a.jpg", values))
+		return values.Encode()
+	}
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name           string
+		keys           []string
+		requireExpires bool
+		query          string
+		valid          bool
+	}{
+		{"unsigned route", nil, false, "w=100", true},
+		{"signed", []string{"new"}, false, sign("new", "w=100"), true},
+		{"old key during rotation", []string{"new", "old"}, false, sign("old", "w=100"), true},
+		{"removed key", []string{"new"}, false, sign("old", "w=100"), false},
+		{"missing signature", []string{"new"}, false, "w=100", false},
+		{"malformed signature", []string{"new"}, false, "w=100&s=zz", false},
+		{"tampered parameter", []string{"new"}, false, sign("new", "w=100") + "&h=9999", false},
+		{"tampered value", []string{"new"}, false, "w=9999&s=" + url.QueryEscape(ComputeSignature("new", "/images/a.jpg", url.Values{"w": {"100"}})), false},
+		{"unexpired", []string{"new"}, false, sign("new", "w=100&expires="+future), true},
+		{"expired", []string{"new"}, false, sign("new", "w=100&expires="+past), false},
+		{"invalid expiry", []string{"new"}, false, sign("new", "w=100&expires=soon"), false},
+		{"required expiry", []string{"new"}, true, sign("new", "w=100&expires="+future), true},
+		{"missing required expiry", []string{"new"}, true, sign("new", "w=100"), false},
+	}
+	for _, test := range tests {
+		route := newTestRoute(test.keys...)
+		route.RequireExpires = test.requireExpires
+		r := httptest.NewRequest("GET", "/images/a.jpg?"+test.query, nil)
+		if valid := route.VerifySignature(r); valid != test.valid {
+			t.Errorf("%s: valid %v, want %v", test.name, valid, test.valid)
+		}
+	}
+}
@@ -21,34 +21,132 @@
 package halfshell
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strconv"
 )
 
 type ImageSourceType string
-type ImageSourceFactoryFunction func(*SourceConfig) ImageSource
+type ImageSourceFactoryFunction func(*SourceConfig) (ImageSource, error)
 
 var (
 	imageSourceTypeToFactoryFunctionMap = make(map[ImageSourceType]ImageSourceFactoryFunction)
 )
 
+// ErrImageNotFound is returned by sources that don't have the requested image.
+var ErrImageNotFound = errors.New("Image not found")
+
 type ImageSource interface {
-	GetImage(*ImageSourceOptions) (*Image, error)
+	GetImage(context.Context, *ImageSourceOptions) (*Image, error)
+}
+
+// ImageSourceHealthChecker is implemented by sources that can check whether
+// their origin is reachable, for the readiness endpoint.
+type ImageSourceHealthChecker interface {
+	CheckHealth(context.Context) error
+}
+
+// CheckSourceHealth checks whether the origin of source is reachable. Sources
+// that can't check it are assumed to be healthy.
+func CheckSourceHealth(ctx context.Context, source ImageSource) error {
+	if checker, ok := source.(ImageSourceHealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
 }
 
 type ImageSourceOptions struct {
-	Path string
+	Path   string
+	Limits ImageLimits
+
+	// Bucket overrides the bucket of S3 sources whose bucket is templated
+	// from the route pattern.
+	Bucket string
+
+	// Header holds the headers of the incoming request, which sources may
+	// forward to the origin.
+	Header http.Header
+
+	// Raw asks for the encoded bytes of the image only, which aren't
+	// decoded, for images served as is. Limits don't apply then.
+	Raw bool
+
+	// Encoded asks for an image which is only decoded by the processor, for
+	// processors which don't use ImageMagick. Limits still apply.
+	Encoded bool
+
+	// FrameTime is the time in seconds of the frame returned by sources of
+	// videos.
+	FrameTime float64
+}
+
+// Key returns the key identifying the original image requested, including
+// the frame requested from videos.
+func (o *ImageSourceOptions) Key() string {
+	key := o.Path
+	if o.Bucket != "" {
+		key = o.Bucket + "/" + o.Path
+	}
+	if o.FrameTime != 0 {
+		key += "#t=" + strconv.FormatFloat(o.FrameTime, 'f', -1, 64)
+	}
+	return key
+}
+
+// newSourceImage reads the image requested from a source in buffer.
+func newSourceImage(buffer io.Reader, request *ImageSourceOptions) (*Image, error) {
+	if request.Raw {
+		return NewRawImageFromBuffer(buffer)
+	}
+	if request.Encoded {
+		return NewEncodedImageFromBuffer(buffer, request.Limits)
+	}
+	return NewImageFromBufferWithLimits(buffer, request.Limits)
 }
 
 func RegisterSource(sourceType ImageSourceType, factory ImageSourceFactoryFunction) {
 	imageSourceTypeToFactoryFunctionMap[sourceType] = factory
 }
 
-func NewImageSourceWithConfig(config *SourceConfig) ImageSource {
+// NewImageSource returns the source configured by config, with retries, a
+// cache of missing images and a cache of originals if they are configured.
+// Retries and cached misses are counted through statter, which may be nil.
+func NewImageSource(config *SourceConfig, statter Statter) (ImageSource, error) {
 	factory := imageSourceTypeToFactoryFunctionMap[config.Type]
 	if factory == nil {
-		fmt.Fprintf(os.Stderr, "Unknown image source type: %s\n", config.Type)
+		return nil, fmt.Errorf("Unknown image source type: %s", config.Type)
+	}
+
+	source, err := factory(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Retries > 0 {
+		source = NewRetryingImageSource(source, config, statter)
+	}
+	if config.NotFoundTTL > 0 {
+		source = NewNotFoundCachingImageSource(source, config, statter)
+	}
+	if config.CacheMaxSize > 0 {
+		source = NewCachedImageSource(source, config)
+	}
+	if config.VideoFrames {
+		source = NewVideoFrameImageSource(source, config)
+	}
+	return source, nil
+}
+
+// NewImageSourceWithConfig is like NewImageSource, but exits if the source
+// can't be created.
+func NewImageSourceWithConfig(config *SourceConfig, statter Statter) ImageSource {
+	source, err := NewImageSource(config, statter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid source %s: %v\n", config.Name, err)
 		os.Exit(1)
 	}
-	return factory(config)
+	return source
 }
@@ -0,0 +1,138 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+// cachedImageSource keeps the originals retrieved from a source in memory,
+// so that several derivatives of the same image only fetch it once. Concurrent
+// requests for an original that isn't cached share a single fetch.
+type cachedImageSource struct {
+	Source ImageSource
+	Config *SourceConfig
+	Logger *Logger
+
+	mu      sync.Mutex
+	index   *lruIndex
+	flights flightGroup
+}
+
+type cachedOriginal struct {
+	data         []byte
+	lastModified time.Time
+	expires      time.Time
+}
+
+// NewCachedImageSource wraps source with a cache of originals configured by
+// config.
+func NewCachedImageSource(source ImageSource, config *SourceConfig) ImageSource {
+	return &cachedImageSource{
+		Source: source,
+		Config: config,
+		Logger: NewLogger("source.cache.%s", config.Name),
+		index:  newLRUIndex(config.CacheMaxSize<<20, nil),
+	}
+}
+
+func (s *cachedImageSource) GetImage(ctx context.Context, request *ImageSourceOptions) (*Image, error) {
+	key := request.Key()
+	original, ok := s.get(key)
+	if ok {
+		s.Logger.Infof("Retrieved cached original: %s", key)
+		return original.newImage(request)
+	}
+
+	var image *Image
+	result, err, shared := s.flights.Do(key, func() (interface{}, error) {
+		var err error
+		image, err = s.Source.GetImage(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		original := &cachedOriginal{
+			data:         image.getEncodedBytes(),
+			lastModified: image.LastModified,
+		}
+		s.set(key, original)
+		return original, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !shared {
+		return image, nil
+	}
+
+	// The image read by the fetching request is its own, so the ones sharing
+	// the fetch read theirs from the data.
+	return result.(*cachedOriginal).newImage(request)
+}
+
+func (s *cachedImageSource) CheckHealth(ctx context.Context) error {
+	return CheckSourceHealth(ctx, s.Source)
+}
+
+func (o *cachedOriginal) newImage(request *ImageSourceOptions) (*Image, error) {
+	image, err := newSourceImage(bytes.NewReader(o.data), request)
+	if err != nil {
+		return nil, err
+	}
+	image.LastModified = o.lastModified
+	return image, nil
+}
+
+func (s *cachedImageSource) get(path string) (*cachedOriginal, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.index.Get(path)
+	if !ok {
+		return nil, false
+	}
+
+	original := value.(*cachedOriginal)
+	if !original.expires.IsZero() && time.Now().After(original.expires) {
+		s.index.Remove(path)
+		return nil, false
+	}
+	return original, true
+}
+
+func (s *cachedImageSource) set(path string, original *cachedOriginal) {
+	size := uint64(len(original.data))
+	if size > s.index.maxSize {
+		return
+	}
+
+	if s.Config.CacheTTL > 0 {
+		original.expires = time.Now().Add(time.Duration(s.Config.CacheTTL) * time.Second)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.index.Add(path, original, size)
+}
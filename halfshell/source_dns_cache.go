@@ -0,0 +1,128 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxDNSCacheEntries bounds the number of host names a DNS cache holds, as
+// sources with embedded URLs may resolve any number of them.
+const maxDNSCacheEntries = 1024
+
+// dnsCache caches the addresses host names resolve to for a fixed duration,
+// sparing the resolver a lookup for every connection to a busy origin.
+// Failed lookups aren't cached. A nil dnsCache resolves every time.
+type dnsCache struct {
+	ttl      time.Duration
+	resolver *net.Resolver
+
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	ipAddrs []net.IPAddr
+	expires time.Time
+}
+
+// newDNSCache returns the DNS cache of config's remote sources, or nil if
+// its DNS cache TTL is zero.
+func newDNSCache(config *SourceConfig) *dnsCache {
+	if config.DNSCacheTTL == 0 {
+		return nil
+	}
+	return &dnsCache{
+		ttl:      time.Duration(config.DNSCacheTTL) * time.Second,
+		resolver: net.DefaultResolver,
+		entries:  make(map[string]dnsCacheEntry),
+	}
+}
+
+// LookupIPAddr returns the addresses of host, from the cache if they were
+// resolved less than the TTL ago.
+func (c *dnsCache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if c == nil {
+		return net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.ipAddrs, nil
+	}
+
+	ipAddrs, err := c.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxDNSCacheEntries {
+		for name, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, name)
+			}
+		}
+		if len(c.entries) >= maxDNSCacheEntries {
+			c.entries = make(map[string]dnsCacheEntry)
+		}
+	}
+	c.entries[host] = dnsCacheEntry{ipAddrs: ipAddrs, expires: now.Add(c.ttl)}
+	return ipAddrs, nil
+}
+
+// dialContext returns a dial function connecting with dialer to the
+// addresses of the host, resolved with the cache, trying each in turn.
+func (c *dnsCache) dialContext(dialer *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
+	if c == nil {
+		return dialer.DialContext
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+
+		ipAddrs, err := c.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ipAddr := range ipAddrs {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ipAddr.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
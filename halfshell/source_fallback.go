@@ -0,0 +1,61 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"context"
+)
+
+// fallbackImageSource retrieves images from the first of its sources that
+// has them, e.g. a new bucket, then a legacy bucket, then an origin server.
+type fallbackImageSource []ImageSource
+
+// NewFallbackImageSource returns an ImageSource that tries each of the given
+// sources in order, moving on to the next only if an image isn't found. A
+// single source is returned as is.
+func NewFallbackImageSource(sources ...ImageSource) ImageSource {
+	if len(sources) == 1 {
+		return sources[0]
+	}
+	return fallbackImageSource(sources)
+}
+
+func (f fallbackImageSource) GetImage(ctx context.Context, request *ImageSourceOptions) (*Image, error) {
+	var err error
+	for _, source := range f {
+		var image *Image
+		image, err = source.GetImage(ctx, request)
+		if err != ErrImageNotFound {
+			return image, err
+		}
+	}
+	return nil, err
+}
+
+// CheckHealth checks every source of the chain, as any of them may be needed.
+func (f fallbackImageSource) CheckHealth(ctx context.Context) error {
+	for _, source := range f {
+		if err := CheckSourceHealth(ctx, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
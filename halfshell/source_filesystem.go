@@ -21,6 +21,8 @@
 package halfshell
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -35,7 +37,7 @@ type FileSystemImageSource struct {
 	Logger *Logger
 }
 
-func NewFileSystemImageSourceWithConfig(config *SourceConfig) ImageSource {
+func NewFileSystemImageSourceWithConfig(config *SourceConfig) (ImageSource, error) {
 	source := &FileSystemImageSource{
 		Config: config,
 		Logger: NewLogger("source.fs.%s", config.Name),
@@ -49,35 +51,66 @@ func NewFileSystemImageSourceWithConfig(config *SourceConfig) ImageSource {
 	}
 
 	if err != nil {
-		source.Logger.Fatal(err)
+		return nil, err
 	}
+	defer baseDirectory.Close()
 
 	fileInfo, err := baseDirectory.Stat()
 	if err != nil || !fileInfo.IsDir() {
-		source.Logger.Fatal("Directory ", source.Config.Directory, " not a directory", err)
+		return nil, fmt.Errorf("Directory %s not a directory", source.Config.Directory)
 	}
 
-	return source
+	return source, nil
 }
 
-func (s *FileSystemImageSource) GetImage(request *ImageSourceOptions) (*Image, error) {
+func (s *FileSystemImageSource) GetImage(ctx context.Context, request *ImageSourceOptions) (*Image, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
 	fileName := s.fileNameForRequest(request)
 
 	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil, ErrImageNotFound
+	}
 	if err != nil {
 		s.Logger.Warnf("Failed to open file: %v", err)
 		return nil, err
 	}
 
-	image, err := NewImageFromFile(file)
+	defer file.Close()
+	if s.Config.MaxOriginalSize > 0 {
+		if fileInfo, err := file.Stat(); err == nil && uint64(fileInfo.Size()) > s.Config.MaxOriginalSize {
+			return nil, ErrOriginalTooLarge
+		}
+	}
+
+	image, err := newSourceImage(file, request)
 	if err != nil {
 		s.Logger.Warnf("Failed to read image: %v", err)
 		return nil, err
 	}
+	if fileInfo, err := file.Stat(); err == nil {
+		image.LastModified = fileInfo.ModTime()
+	}
 
 	return image, nil
 }
 
+// CheckHealth checks that the source's directory is readable.
+func (s *FileSystemImageSource) CheckHealth(ctx context.Context) error {
+	fileInfo, err := os.Stat(s.Config.Directory)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.IsDir() {
+		return fmt.Errorf("Directory %s not a directory", s.Config.Directory)
+	}
+	return nil
+}
+
 func (s *FileSystemImageSource) fileNameForRequest(request *ImageSourceOptions) string {
 	// Remove the leading / from the file name and replace the
 	// directory separator (/) with something safe for file names (_)
@@ -21,8 +21,8 @@
 package halfshell
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
@@ -32,40 +32,144 @@ const (
 	ImageSourceTypeHttp ImageSourceType = "http"
 )
 
+// HttpImageSource retrieves images from a web origin. The origin is either
+// the configured host, the configured base URL, or, with embedded URLs, the
+// full URL making up the path of the request.
 type HttpImageSource struct {
-	Config *SourceConfig
-	Logger *Logger
+	Config  *SourceConfig
+	Logger  *Logger
+	Client  *http.Client
+	BaseURL *url.URL
 }
 
-func NewHttpImageSourceWithConfig(config *SourceConfig) ImageSource {
-	return &HttpImageSource{
+func NewHttpImageSourceWithConfig(config *SourceConfig) (ImageSource, error) {
+	source := &HttpImageSource{
 		Config: config,
 		Logger: NewLogger("source.http.%s", config.Name),
+		Client: newSourceHTTPClient(config),
 	}
+
+	// Embedded URLs may point anywhere, so credentials would be sent to
+	// whichever host a request names.
+	authenticated := config.BasicAuthUsername != "" || config.BearerToken != "" || config.TLSClientCertFile != ""
+	if authenticated && config.EmbeddedURLs {
+		return nil, fmt.Errorf("Authentication can't be used with embedded URLs")
+	}
+	tlsConfig, err := newSourceTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		source.Client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+	}
+
+	if config.BaseURL != "" {
+		baseURL, err := url.Parse(config.BaseURL)
+		if err != nil || baseURL.Host == "" {
+			return nil, fmt.Errorf("Invalid base URL %s", config.BaseURL)
+		}
+		source.BaseURL = baseURL
+	}
+
+	return source, nil
 }
 
-func (s *HttpImageSource) GetImage(request *ImageSourceOptions) (*Image, error) {
-	httpRequest := s.getHttpRequest(request)
-	httpResponse, err := http.DefaultClient.Do(httpRequest)
-	defer httpResponse.Body.Close()
+func (s *HttpImageSource) GetImage(ctx context.Context, request *ImageSourceOptions) (*Image, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	httpRequest, err := s.getHttpRequest(request)
+	if err != nil {
+		s.Logger.Warnf("Invalid image URL: %v", err)
+		return nil, err
+	}
+	httpRequest = httpRequest.WithContext(ctx)
+	s.setHeaders(httpRequest, request)
+	InjectTraceparent(ctx, httpRequest.Header)
+	httpResponse, err := s.Client.Do(httpRequest)
 	if err != nil {
 		s.Logger.Warnf("Error downlading image: %v", err)
 		return nil, err
 	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode == http.StatusNotFound || httpResponse.StatusCode == http.StatusGone {
+		return nil, ErrImageNotFound
+	}
 	if httpResponse.StatusCode != 200 {
-		return nil, fmt.Errorf("Error downlading image (url=%v)", httpRequest.URL)
+		return nil, &SourceStatusError{URL: httpRequest.URL.String(), Status: httpResponse.StatusCode}
 	}
-	image, err := NewImageFromBuffer(httpResponse.Body)
+	image, err := newImageFromSourceResponse(httpResponse, s.Config, cancel, request)
 	if err != nil {
-		responseBody, _ := ioutil.ReadAll(httpResponse.Body)
-		s.Logger.Warnf("Unable to create image from response body: %v (url=%v)", string(responseBody), httpRequest.URL)
+		s.Logger.Warnf("Unable to create image from response body: %v (url=%v)", err, httpRequest.URL)
 		return nil, err
 	}
+	image.LastModified, _ = http.ParseTime(httpResponse.Header.Get("Last-Modified"))
 	s.Logger.Infof("Successfully retrieved image from http: %v", httpRequest.URL)
 	return image, nil
 }
 
-func (s *HttpImageSource) getHttpRequest(request *ImageSourceOptions) *http.Request {
+// CheckHealth checks that the origin answers HTTP requests, whatever their
+// status. Sources with embedded URLs have no single origin to check.
+func (s *HttpImageSource) CheckHealth(ctx context.Context) error {
+	if s.Config.EmbeddedURLs {
+		return nil
+	}
+
+	requestURL := &url.URL{Scheme: "http", Host: s.Config.Host, Path: "/"}
+	if s.BaseURL != nil {
+		requestURL = s.BaseURL
+	}
+	httpRequest, err := http.NewRequest("HEAD", requestURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	httpResponse, err := s.Client.Do(httpRequest.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	httpResponse.Body.Close()
+	return nil
+}
+
+// setHeaders adds the configured headers, the forwarded headers of the
+// incoming request and the credentials to a request to the origin.
+func (s *HttpImageSource) setHeaders(httpRequest *http.Request, request *ImageSourceOptions) {
+	for _, name := range s.Config.ForwardHeaders {
+		if values, ok := request.Header[http.CanonicalHeaderKey(name)]; ok {
+			httpRequest.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	for name, value := range s.Config.Headers {
+		httpRequest.Header.Set(name, value)
+	}
+	if host := httpRequest.Header.Get("Host"); host != "" {
+		httpRequest.Host = host
+		httpRequest.Header.Del("Host")
+	}
+	if s.Config.BasicAuthUsername != "" {
+		httpRequest.SetBasicAuth(s.Config.BasicAuthUsername, s.Config.BasicAuthPassword)
+	} else if s.Config.BearerToken != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+s.Config.BearerToken)
+	}
+}
+
+func (s *HttpImageSource) getHttpRequest(request *ImageSourceOptions) (*http.Request, error) {
+	if s.Config.EmbeddedURLs {
+		requestURL, err := embeddedURL(request.Path)
+		if err != nil {
+			return nil, err
+		}
+		return http.NewRequest("GET", requestURL.String(), nil)
+	}
+
+	if s.BaseURL != nil {
+		requestURL := *s.BaseURL
+		requestURL.Path = strings.TrimSuffix(requestURL.Path, "/") + "/" +
+			strings.TrimPrefix(s.Config.Directory+request.Path, "/")
+		requestURL.RawPath = ""
+		return http.NewRequest("GET", requestURL.String(), nil)
+	}
+
 	path := s.Config.Directory + request.Path
 	imageURLPathComponents := strings.Split(path, "/")
 
@@ -82,7 +186,28 @@ func (s *HttpImageSource) getHttpRequest(request *ImageSourceOptions) *http.Requ
 	httpRequest, _ := http.NewRequest("GET", requestURL.RequestURI(), nil)
 	httpRequest.URL = requestURL
 
-	return httpRequest
+	return httpRequest, nil
+}
+
+// embeddedURL parses the URL embedded in the path of a request, such as
+// "/https://example.com/image.jpg". Proxies may merge the slashes following
+// the scheme, so a single one is accepted too.
+func embeddedURL(path string) (*url.URL, error) {
+	rawURL := strings.TrimPrefix(path, "/")
+	for _, scheme := range []string{"http:/", "https:/"} {
+		if strings.HasPrefix(rawURL, scheme) && !strings.HasPrefix(rawURL, scheme+"/") {
+			rawURL = scheme + "/" + strings.TrimPrefix(rawURL, scheme)
+		}
+	}
+
+	embeddedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (embeddedURL.Scheme != "http" && embeddedURL.Scheme != "https") || embeddedURL.Host == "" {
+		return nil, fmt.Errorf("Not an HTTP URL: %s", rawURL)
+	}
+	return embeddedURL, nil
 }
 
 func init() {
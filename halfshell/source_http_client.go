@@ -0,0 +1,425 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSourceTimeout is returned when a source doesn't send the image in time.
+var ErrSourceTimeout = errors.New("Timed out reading image from source")
+
+// ErrOriginalTooLarge is returned when an original image exceeds the size
+// limit of its source.
+var ErrOriginalTooLarge = errors.New("Image exceeds the maximum original size")
+
+// hostGuard restricts the hosts a source connects to, to protect against
+// server-side request forgery. The host configured for the source and its
+// proxies are always allowed. Requests sent through a proxy are checked
+// before being sent, as the guard only sees the connection to the proxy.
+type hostGuard struct {
+	dial                 func(context.Context, string, string) (net.Conn, error)
+	dnsCache             *dnsCache
+	configuredHost       string
+	proxyHosts           []string
+	hostNames            []string
+	networks             []*net.IPNet
+	allowPrivateNetworks bool
+}
+
+func newHostGuard(config *SourceConfig) *hostGuard {
+	configuredHost := config.Host
+	if baseURL, err := url.Parse(config.BaseURL); err == nil && config.BaseURL != "" {
+		configuredHost = baseURL.Host
+	}
+	if host, _, err := net.SplitHostPort(configuredHost); err == nil {
+		configuredHost = host
+	}
+
+	dnsCache := newDNSCache(config)
+	guard := &hostGuard{
+		dial:                 dnsCache.dialContext(newSourceDialer(config)),
+		dnsCache:             dnsCache,
+		configuredHost:       strings.ToLower(configuredHost),
+		allowPrivateNetworks: config.AllowPrivateNetworks,
+		proxyHosts:           sourceProxyHosts(config),
+	}
+	for _, host := range config.AllowedHosts {
+		if _, network, err := net.ParseCIDR(host); err == nil {
+			guard.networks = append(guard.networks, network)
+		} else if ip := net.ParseIP(host); ip != nil {
+			guard.networks = append(guard.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else {
+			guard.hostNames = append(guard.hostNames, strings.ToLower(host))
+		}
+	}
+	return guard
+}
+
+// dialContext resolves the address, checks that the host and the resolved
+// IPs are allowed, and connects to the checked IP, so the check can't be
+// bypassed by the name resolving differently the second time.
+func (g *hostGuard) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	host = strings.ToLower(host)
+	if g.configuredHost != "" && host == g.configuredHost {
+		return g.dial(ctx, network, address)
+	}
+	for _, proxyHost := range g.proxyHosts {
+		if host == proxyHost {
+			return g.dial(ctx, network, address)
+		}
+	}
+
+	ip, err := g.allowedIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return g.dial(ctx, network, net.JoinHostPort(ip.String(), port))
+}
+
+// allowedIP resolves host and returns the first of its IPs connecting to is
+// allowed.
+func (g *hostGuard) allowedIP(ctx context.Context, host string) (net.IP, error) {
+	ipAddrs, err := g.dnsCache.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	hostAllowed := g.hostNameAllowed(host)
+	for _, ipAddr := range ipAddrs {
+		if g.ipAllowed(ipAddr.IP, hostAllowed) {
+			return ipAddr.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("Connecting to host %s is not allowed", host)
+}
+
+// proxy wraps the proxy function of a transport, checking that the hosts of
+// requests sent through a proxy are allowed.
+func (g *hostGuard) proxy(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(r *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(r)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+		host := strings.ToLower(r.URL.Hostname())
+		if g.configuredHost == "" || host != g.configuredHost {
+			if _, err := g.allowedIP(r.Context(), host); err != nil {
+				return nil, err
+			}
+		}
+		return proxyURL, nil
+	}
+}
+
+func (g *hostGuard) hostNameAllowed(host string) bool {
+	for _, hostName := range g.hostNames {
+		if host == hostName || (strings.HasPrefix(hostName, ".") && strings.HasSuffix(host, hostName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed returns whether connecting to ip is allowed. IPs in an allowed
+// network always are. Otherwise the host name must be allowed, unless no
+// hosts are configured, and the IP must not be private.
+func (g *hostGuard) ipAllowed(ip net.IP, hostAllowed bool) bool {
+	for _, network := range g.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	if !hostAllowed && (len(g.hostNames) > 0 || len(g.networks) > 0) {
+		return false
+	}
+
+	private := ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+	return g.allowPrivateNetworks || !private
+}
+
+// newSourceDialer returns the dialer of remote sources, which applies
+// config's connect timeout.
+func newSourceDialer(config *SourceConfig) *net.Dialer {
+	timeout := 30 * time.Second
+	if config.ConnectTimeout > 0 {
+		timeout = time.Duration(config.ConnectTimeout) * time.Second
+	}
+	return &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+}
+
+// sourceProxy returns the proxy function of config's remote sources: the
+// configured proxy, or the one set by the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables.
+func sourceProxy(config *SourceConfig) func(*http.Request) (*url.URL, error) {
+	if config.Proxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	proxyURL, err := parseProxyURL(config.Proxy)
+	if err != nil {
+		return func(*http.Request) (*url.URL, error) { return nil, err }
+	}
+	return http.ProxyURL(proxyURL)
+}
+
+// sourceProxyHosts returns the host names of the proxies config's remote
+// sources may use.
+func sourceProxyHosts(config *SourceConfig) []string {
+	rawURLs := []string{config.Proxy}
+	if config.Proxy == "" {
+		for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+			rawURLs = append(rawURLs, os.Getenv(name))
+		}
+	}
+
+	var hosts []string
+	for _, rawURL := range rawURLs {
+		if proxyURL, err := parseProxyURL(rawURL); err == nil && rawURL != "" {
+			hosts = append(hosts, strings.ToLower(proxyURL.Hostname()))
+		}
+	}
+	return hosts
+}
+
+// parseProxyURL parses the URL of a proxy, which defaults to the http scheme
+// like in the proxy environment variables.
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy URL %s", rawURL)
+	}
+	return proxyURL, nil
+}
+
+// newSourceTransport returns the transport of remote sources, which applies
+// config's proxy, connect and read timeouts, connection pooling settings and
+// DNS cache.
+func newSourceTransport(config *SourceConfig) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = sourceProxy(config)
+	transport.DialContext = newDNSCache(config).dialContext(newSourceDialer(config))
+	transport.ResponseHeaderTimeout = time.Duration(config.ReadTimeout) * time.Second
+	if config.MaxIdleConnections > 0 {
+		transport.MaxIdleConnsPerHost = int(config.MaxIdleConnections)
+	}
+	if config.MaxIdleConnectionsTotal > 0 {
+		transport.MaxIdleConns = int(config.MaxIdleConnectionsTotal)
+	}
+	if transport.MaxIdleConns < transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = transport.MaxIdleConnsPerHost
+	}
+	transport.MaxConnsPerHost = int(config.MaxConnectionsPerHost)
+	if config.IdleConnectionTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(config.IdleConnectionTimeout) * time.Second
+	}
+	return transport
+}
+
+// newSourceHTTPClient returns the HTTP client used by HTTP sources, which
+// only connects to the hosts allowed by config, and applies its timeout,
+// connection pooling and redirect settings.
+func newSourceHTTPClient(config *SourceConfig) *http.Client {
+	transport := newSourceTransport(config)
+	guard := newHostGuard(config)
+	transport.DialContext = guard.dialContext
+	transport.Proxy = guard.proxy(transport.Proxy)
+
+	return &http.Client{
+		Transport:     transport,
+		Timeout:       time.Duration(config.Timeout) * time.Second,
+		CheckRedirect: redirectPolicy(config),
+	}
+}
+
+// newSourceTLSConfig returns the TLS configuration of requests to the origin
+// of config, with its client certificate and certificate authorities, or nil
+// if it has neither.
+func newSourceTLSConfig(config *SourceConfig) (*tls.Config, error) {
+	if config.TLSClientCertFile == "" && config.TLSClientKeyFile == "" && config.TLSCAFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.TLSClientCertFile != "" || config.TLSClientKeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.TLSClientCertFile, config.TLSClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if config.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(config.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read certificate authorities: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", config.TLSCAFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// RedirectPolicies are the redirect policies of HTTP sources.
+var RedirectPolicies = map[string]bool{
+	"follow":    true,
+	"same_host": true,
+	"none":      true,
+}
+
+// redirectPolicy returns the function checking redirects for config's
+// redirect policy: "follow" (the default) follows up to MaxRedirects redirects,
+// "same_host" only those to the host of the original request, and "none"
+// returns the redirect response itself. Redirects from https to http are
+// refused unless AllowInsecureRedirects is set.
+func redirectPolicy(config *SourceConfig) func(*http.Request, []*http.Request) error {
+	maxRedirects := int(config.MaxRedirects)
+	if maxRedirects == 0 {
+		maxRedirects = 10
+	}
+
+	return func(r *http.Request, via []*http.Request) error {
+		switch config.RedirectPolicy {
+		case "none":
+			return http.ErrUseLastResponse
+		case "same_host":
+			if r.URL.Host != via[0].URL.Host {
+				return fmt.Errorf("Redirect to another host: %s", r.URL.Host)
+			}
+		}
+		if !config.AllowInsecureRedirects && r.URL.Scheme == "http" && via[len(via)-1].URL.Scheme == "https" {
+			return fmt.Errorf("Redirect from https to http: %s", r.URL)
+		}
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("Stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	}
+}
+
+// newImageFromSourceResponse reads the image in the body of a source's
+// response. The body must be sent within config's read timeout of the
+// previous read, which cancel aborts the request with, and must not exceed
+// config's maximum original size.
+func newImageFromSourceResponse(httpResponse *http.Response, config *SourceConfig,
+	cancel context.CancelFunc, request *ImageSourceOptions) (*Image, error) {
+
+	maxSize := int64(config.MaxOriginalSize)
+	if maxSize > 0 && httpResponse.ContentLength > maxSize {
+		return nil, ErrOriginalTooLarge
+	}
+
+	var body io.Reader = httpResponse.Body
+	if maxSize > 0 {
+		body = &maxSizeReader{Reader: body, remaining: maxSize}
+	}
+	if config.ReadTimeout > 0 {
+		reader := newIdleTimeoutReader(body, time.Duration(config.ReadTimeout)*time.Second, cancel)
+		defer reader.Stop()
+		body = reader
+	}
+
+	return newSourceImage(body, request)
+}
+
+// maxSizeReader reads up to remaining bytes, returning ErrOriginalTooLarge if
+// there are more.
+type maxSizeReader struct {
+	io.Reader
+	remaining int64
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, ErrOriginalTooLarge
+	}
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.Reader.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, ErrOriginalTooLarge
+	}
+	return n, err
+}
+
+// idleTimeoutReader calls cancel if no data is read for timeout, after which
+// it returns ErrSourceTimeout.
+type idleTimeoutReader struct {
+	io.Reader
+	timeout  time.Duration
+	timer    *time.Timer
+	mutex    sync.Mutex
+	timedOut bool
+}
+
+func newIdleTimeoutReader(reader io.Reader, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutReader {
+	r := &idleTimeoutReader{Reader: reader, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.mutex.Lock()
+		r.timedOut = true
+		r.mutex.Unlock()
+		cancel()
+	})
+	return r
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.timedOut {
+		return n, ErrSourceTimeout
+	}
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// Stop stops the timer.
+func (r *idleTimeoutReader) Stop() {
+	r.timer.Stop()
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHostGuardHostNameAllowed(t *testing.T) {
+	guard := newHostGuard(&SourceConfig{AllowedHosts: []string{"images.example.com", ".cdn.example.com", "10.0.0.0/8"}})
+
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"images.example.com", true},
+		{"a.cdn.example.com", true},
+		{"a.b.cdn.example.com", true},
+		{"cdn.example.com", false},
+		{"evilcdn.example.com", false},
+		{"images.example.com.evil.com", false},
+		{"other.example.com", false},
+		{"example.com", false},
+		{"10.0.0.1", false},
+	}
+	for _, test := range tests {
+		if allowed := guard.hostNameAllowed(test.host); allowed != test.allowed {
+			t.Errorf("%s: allowed %v, want %v", test.host, allowed, test.allowed)
+		}
+	}
+}
+
+func TestHostGuardIPAllowed(t *testing.T) {
+	tests := []struct {
+		name         string
+		allowedHosts []string
+		private      bool
+		ip           string
+		hostAllowed  bool
+		allowed      bool
+	}{
+		{"public", nil, false, "93.184.216.34", false, true},
+		{"private", nil, false, "10.1.2.3", false, false},
+		{"private 172.16/12", nil, false, "172.20.0.1", false, false},
+		{"private 192.168/16", nil, false, "192.168.1.1", false, false},
+		{"loopback", nil, false, "127.0.0.1", false, false},
+		{"link-local", nil, false, "169.254.169.254", false, false},
+		{"unspecified", nil, false, "0.0.0.0", false, false},
+		{"IPv6 loopback", nil, false, "::1", false, false},
+		{"IPv6 unique local", nil, false, "fd00::1", false, false},
+		{"IPv6 link-local", nil, false, "fe80::1", false, false},
+		{"IPv4-mapped loopback", nil, false, "::ffff:127.0.0.1", false, false},
+		{"private networks allowed", nil, true, "10.1.2.3", false, true},
+		{"allowed network", []string{"10.0.0.0/8"}, false, "10.1.2.3", false, true},
+		{"outside allowed network", []string{"10.0.0.0/8"}, false, "93.184.216.34", false, false},
+		{"allowed IP", []string{"192.168.1.1"}, false, "192.168.1.1", false, true},
+		{"other IP", []string{"192.168.1.1"}, false, "192.168.1.2", false, false},
+		{"allowed host", []string{"images.example.com"}, false, "93.184.216.34", true, true},
+		{"allowed host, private IP", []string{"images.example.com"}, false, "10.1.2.3", true, false},
+		{"allowed host, private networks allowed", []string{"images.example.com"}, true, "10.1.2.3", true, true},
+		{"other host", []string{"images.example.com"}, false, "93.184.216.34", false, false},
+	}
+	for _, test := range tests {
+		guard := newHostGuard(&SourceConfig{AllowedHosts: test.allowedHosts, AllowPrivateNetworks: test.private})
+		if allowed := guard.ipAllowed(net.ParseIP(test.ip), test.hostAllowed); allowed != test.allowed {
+			t.Errorf("%s: %s allowed %v, want %v", test.name, test.ip, allowed, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultNotFoundCacheSize is the number of missing images remembered unless
+// configured otherwise.
+const defaultNotFoundCacheSize = 10000
+
+// notFoundCachingImageSource remembers the images a source doesn't have for a
+// short time, so repeated requests for a missing image don't each reach the
+// origin.
+type notFoundCachingImageSource struct {
+	Source  ImageSource
+	Config  *SourceConfig
+	Logger  *Logger
+	Statter Statter
+
+	mu    sync.Mutex
+	index *lruIndex
+}
+
+// NewNotFoundCachingImageSource wraps source to answer requests for images it
+// didn't find with ErrImageNotFound for config's NotFoundTTL. Cached misses
+// are counted through statter, which may be nil.
+func NewNotFoundCachingImageSource(source ImageSource, config *SourceConfig, statter Statter) ImageSource {
+	size := config.NotFoundCacheSize
+	if size == 0 {
+		size = defaultNotFoundCacheSize
+	}
+	return &notFoundCachingImageSource{
+		Source:  source,
+		Config:  config,
+		Logger:  NewLogger("source.not_found.%s", config.Name),
+		Statter: statter,
+		index:   newLRUIndex(size, nil),
+	}
+}
+
+func (s *notFoundCachingImageSource) GetImage(ctx context.Context, request *ImageSourceOptions) (*Image, error) {
+	key := request.Key()
+	if s.notFound(key) {
+		s.Logger.Infof("Image remembered as not found: %s", key)
+		if s.Statter != nil {
+			s.Statter.Count("source.not_found_cached")
+		}
+		return nil, ErrImageNotFound
+	}
+
+	image, err := s.Source.GetImage(ctx, request)
+	if err == ErrImageNotFound {
+		expires := time.Now().Add(time.Duration(s.Config.NotFoundTTL) * time.Second)
+		s.mu.Lock()
+		s.index.Add(key, expires, 1)
+		s.mu.Unlock()
+	}
+	return image, err
+}
+
+func (s *notFoundCachingImageSource) CheckHealth(ctx context.Context) error {
+	return CheckSourceHealth(ctx, s.Source)
+}
+
+// notFound returns whether the image for key was recently not found.
+func (s *notFoundCachingImageSource) notFound(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.index.Get(key)
+	if !ok {
+		return false
+	}
+	if time.Now().After(value.(time.Time)) {
+		s.index.Remove(key)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+)
+
+// defaultRetryStatuses are the response statuses retried unless configured
+// otherwise: throttling and transient server errors.
+var defaultRetryStatuses = []uint64{429, 500, 502, 503, 504}
+
+// SourceStatusError is returned by remote sources for responses with an
+// unexpected status.
+type SourceStatusError struct {
+	URL    string
+	Status int
+}
+
+func (e *SourceStatusError) Error() string {
+	return fmt.Sprintf("Error downlading image (url=%v, status=%d)", e.URL, e.Status)
+}
+
+// retryingImageSource retries the failed fetches of a source with an
+// exponential backoff.
+type retryingImageSource struct {
+	Source  ImageSource
+	Config  *SourceConfig
+	Logger  *Logger
+	Statter Statter
+}
+
+// NewRetryingImageSource wraps source to retry fetches that fail with a
+// network error or a retryable status, as configured by config. Retries are
+// counted through statter, which may be nil.
+func NewRetryingImageSource(source ImageSource, config *SourceConfig, statter Statter) ImageSource {
+	return &retryingImageSource{
+		Source:  source,
+		Config:  config,
+		Logger:  NewLogger("source.retry.%s", config.Name),
+		Statter: statter,
+	}
+}
+
+func (s *retryingImageSource) GetImage(ctx context.Context, request *ImageSourceOptions) (*Image, error) {
+	backoff := time.Duration(s.Config.RetryBackoff) * time.Millisecond
+	for attempt := uint64(0); ; attempt++ {
+		image, err := s.Source.GetImage(ctx, request)
+		if err == nil || !s.retryable(err) {
+			return image, err
+		}
+		if attempt == s.Config.Retries {
+			s.count("source.retries_exhausted")
+			return nil, err
+		}
+
+		// The wait is randomized between half and all of the backoff, so
+		// throttled requests don't retry in lockstep.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		s.Logger.Warnf("Retrying image %s in %v: %v", request.Path, wait, err)
+		s.count("source.retry")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// retryable returns whether a fetch failing with err may succeed when tried
+// again.
+func (s *retryingImageSource) retryable(err error) bool {
+	if err == ErrSourceTimeout {
+		return true
+	}
+
+	switch err := err.(type) {
+	case *SourceStatusError:
+		for _, status := range s.Config.RetryStatuses {
+			if uint64(err.Status) == status {
+				return true
+			}
+		}
+		return false
+	case *url.Error:
+		if errors.Is(err.Err, context.Canceled) || errors.Is(err.Err, context.DeadlineExceeded) {
+			return false
+		}
+		// Only connection failures and timeouts are retried. The refusals of
+		// the host guard and the redirect policy aren't network errors, and
+		// would fail again.
+		var netErr net.Error
+		return errors.As(err.Err, &netErr) || errors.Is(err.Err, io.EOF) || errors.Is(err.Err, io.ErrUnexpectedEOF)
+	default:
+		return false
+	}
+}
+
+// CheckHealth checks the wrapped source.
+func (s *retryingImageSource) CheckHealth(ctx context.Context) error {
+	return CheckSourceHealth(ctx, s.Source)
+}
+
+func (s *retryingImageSource) count(stat string) {
+	if s.Statter != nil {
+		s.Statter.Count(stat)
+	}
+}
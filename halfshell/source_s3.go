@@ -21,14 +21,12 @@
 package halfshell
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
-	"strings"
+	"regexp"
 	"time"
-
-	"github.com/oysterbooks/s3"
 )
 
 const (
@@ -36,61 +34,172 @@ const (
 )
 
 type S3ImageSource struct {
-	Config *SourceConfig
-	Logger *Logger
+	Config      *SourceConfig
+	Logger      *Logger
+	Credentials *AWSCredentialsChain
+	Client      *http.Client
+
+	// CustomerKeyHeaders are the headers of requests for objects encrypted
+	// with a customer-provided key, if one is configured.
+	CustomerKeyHeaders http.Header
 }
 
-func NewS3ImageSourceWithConfig(config *SourceConfig) ImageSource {
-	return &S3ImageSource{
-		Config: config,
-		Logger: NewLogger("source.s3.%s", config.Name),
+func NewS3ImageSourceWithConfig(config *SourceConfig) (ImageSource, error) {
+	source := &S3ImageSource{
+		Config:      config,
+		Logger:      NewLogger("source.s3.%s", config.Name),
+		Credentials: NewAWSCredentialsChain(config.S3AccessKey, config.S3SecretKey),
+		Client:      newS3HTTPClient(newSourceTransport(config), config.S3InsecureSkipVerify),
+	}
+
+	if config.S3SSECustomerKey != "" {
+		headers, err := newS3CustomerKeyHeaders(config.S3SSECustomerKey)
+		if err != nil {
+			return nil, err
+		}
+		source.CustomerKeyHeaders = headers
 	}
+
+	return source, nil
 }
 
-func (s *S3ImageSource) GetImage(request *ImageSourceOptions) (*Image, error) {
-	httpRequest := s.signedHTTPRequestForRequest(request)
-	httpResponse, err := http.DefaultClient.Do(httpRequest)
-	defer httpResponse.Body.Close()
+func (s *S3ImageSource) GetImage(ctx context.Context, request *ImageSourceOptions) (*Image, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	bucket, key, err := s.objectForRequest(request)
 	if err != nil {
-		s.Logger.Warnf("Error downlading image: %v", err)
+		s.Logger.Warnf("Rejecting request: %v", err)
 		return nil, err
 	}
+	httpRequest, err := s.signedHTTPRequest(ctx, bucket, key)
+	if err != nil {
+		s.Logger.Warnf("Error signing request: %v", err)
+		return nil, err
+	}
+	httpResponse, err := s.Client.Do(httpRequest)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = urlWithoutQuery(httpRequest.URL)
+		}
+		s.Logger.Warnf("Error downlading image: %v (bucket=%s, key=%s)", err, bucket, key)
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	// S3 answers requests for missing objects with 403 Forbidden unless the
+	// credentials may list the bucket.
+	if httpResponse.StatusCode == http.StatusNotFound || httpResponse.StatusCode == http.StatusForbidden {
+		return nil, ErrImageNotFound
+	}
 	if httpResponse.StatusCode != 200 {
-		return nil, fmt.Errorf("Error downlading image (url=%v)", httpRequest.URL)
+		return nil, &SourceStatusError{URL: urlWithoutQuery(httpRequest.URL), Status: httpResponse.StatusCode}
 	}
-	image, err := NewImageFromBuffer(httpResponse.Body)
+	image, err := newImageFromSourceResponse(httpResponse, s.Config, cancel, request)
 	if err != nil {
-		responseBody, _ := ioutil.ReadAll(httpResponse.Body)
-		s.Logger.Warnf("Unable to create image from response body: %v (url=%v)", string(responseBody), httpRequest.URL)
+		s.Logger.Warnf("Unable to create image from response body: %v (bucket=%s, key=%s)", err, bucket, key)
 		return nil, err
 	}
-	s.Logger.Infof("Successfully retrieved image from S3: %v", httpRequest.URL)
+	image.LastModified, _ = http.ParseTime(httpResponse.Header.Get("Last-Modified"))
+	s.Logger.Infof("Successfully retrieved image from S3 (bucket=%s, key=%s)", bucket, key)
 	return image, nil
 }
 
-func (s *S3ImageSource) signedHTTPRequestForRequest(request *ImageSourceOptions) *http.Request {
-	path := s.Config.Directory + request.Path
-	imageURLPathComponents := strings.Split(path, "/")
+// urlWithoutQuery returns u without its query string, which carries the
+// credentials and signature of presigned requests.
+func urlWithoutQuery(u *url.URL) string {
+	stripped := *u
+	stripped.RawQuery = ""
+	return stripped.String()
+}
 
-	for index, component := range imageURLPathComponents {
-		component = url.QueryEscape(component)
-		imageURLPathComponents[index] = component
+// objectForRequest returns the bucket and key of the object requested.
+func (s *S3ImageSource) objectForRequest(request *ImageSourceOptions) (bucket, key string, err error) {
+	bucket = s.Config.S3Bucket
+	if request.Bucket != "" && templatePattern.MatchString(s.Config.S3Bucket) {
+		if !s.bucketAllowed(request.Bucket) {
+			return "", "", fmt.Errorf("Bucket not allowed: %q", request.Bucket)
+		}
+		bucket = request.Bucket
 	}
-	requestURL := &url.URL{
-		Opaque: strings.Join(imageURLPathComponents, "/"),
-		Scheme: "http",
-		Host:   fmt.Sprintf("%s.s3.amazonaws.com", s.Config.S3Bucket),
+	return bucket, s.Config.Directory + request.Path, nil
+}
+
+func (s *S3ImageSource) signedHTTPRequest(ctx context.Context, bucket, key string) (*http.Request, error) {
+	credentials, err := s.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	httpRequest, _ := http.NewRequest("GET", requestURL.RequestURI(), nil)
-	httpRequest.URL = requestURL
-	httpRequest.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
-	s3.Sign(httpRequest, s3.Keys{
-		AccessKey: s.Config.S3AccessKey,
-		SecretKey: s.Config.S3SecretKey,
-	})
+	location := s3Location{
+		Bucket:    bucket,
+		Region:    s.Config.S3Region,
+		Endpoint:  s.Config.S3Endpoint,
+		PathStyle: s.Config.S3PathStyle,
+	}
+	httpRequest, err := newS3Request("GET", location, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range s.CustomerKeyHeaders {
+		httpRequest.Header[name] = values
+	}
+	if s.Config.S3RequesterPays {
+		httpRequest.Header.Set("X-Amz-Request-Payer", "requester")
+	}
+	if s.Config.S3Presigned {
+		expires := time.Duration(s.Config.S3PresignExpires) * time.Second
+		presignAWSRequest(httpRequest, credentials, s.Config.S3Region, "s3", time.Now(), expires)
+	} else {
+		signAWSRequest(httpRequest, credentials, s.Config.S3Region, "s3", time.Now())
+	}
+
+	return httpRequest.WithContext(ctx), nil
+}
+
+// CheckHealth checks that S3 answers requests for the source's bucket,
+// whatever their status, as the credentials may not allow listing it.
+// Templated buckets aren't known in advance, so they aren't checked.
+func (s *S3ImageSource) CheckHealth(ctx context.Context) error {
+	if templatePattern.MatchString(s.Config.S3Bucket) {
+		return nil
+	}
+	location := s3Location{
+		Bucket:    s.Config.S3Bucket,
+		Region:    s.Config.S3Region,
+		Endpoint:  s.Config.S3Endpoint,
+		PathStyle: s.Config.S3PathStyle,
+	}
+	httpRequest, err := newS3Request("HEAD", location, "", nil)
+	if err != nil {
+		return err
+	}
+	httpResponse, err := s.Client.Do(httpRequest.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	httpResponse.Body.Close()
+	return nil
+}
+
+// s3BucketNamePattern matches valid bucket names, which keeps templated
+// buckets from altering the request's host name.
+var s3BucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
 
-	return httpRequest
+// bucketAllowed returns whether a templated bucket is a valid bucket name and
+// one of the allowed buckets, if any are configured.
+func (s *S3ImageSource) bucketAllowed(bucket string) bool {
+	if !s3BucketNamePattern.MatchString(bucket) {
+		return false
+	}
+	if len(s.Config.S3AllowedBuckets) == 0 {
+		return true
+	}
+	for _, allowedBucket := range s.Config.S3AllowedBuckets {
+		if bucket == allowedBucket {
+			return true
+		}
+	}
+	return false
 }
 
 func init() {
@@ -0,0 +1,149 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ErrNoVideoFrame is returned when a video has no frame at the requested
+// time, e.g. past its end.
+var ErrNoVideoFrame = errors.New("No video frame at the requested time")
+
+// videoFrameImageSource extracts frames of the videos of a source with
+// ffmpeg, so they are processed like images.
+type videoFrameImageSource struct {
+	Source ImageSource
+	Config *SourceConfig
+	Logger *Logger
+}
+
+// NewVideoFrameImageSource wraps source to return the frame at the requested
+// time of the videos it returns, the first frame by default. Images are
+// returned as is.
+func NewVideoFrameImageSource(source ImageSource, config *SourceConfig) ImageSource {
+	return &videoFrameImageSource{
+		Source: source,
+		Config: config,
+		Logger: NewLogger("source.video.%s", config.Name),
+	}
+}
+
+func (s *videoFrameImageSource) GetImage(ctx context.Context, request *ImageSourceOptions) (*Image, error) {
+	// Originals requested as is, such as for passthrough, are never
+	// converted.
+	if request.Raw {
+		return s.Source.GetImage(ctx, request)
+	}
+
+	// The video is retrieved whole, and cached once for all its frames.
+	videoRequest := *request
+	videoRequest.Raw = true
+	videoRequest.FrameTime = 0
+	original, err := s.Source.GetImage(ctx, &videoRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer original.Destroy()
+
+	data := original.getEncodedBytes()
+	if !isVideo(data, request.Path) {
+		image, err := newSourceImage(bytes.NewReader(data), request)
+		if err == nil {
+			image.LastModified = original.LastModified
+		}
+		return image, err
+	}
+
+	frame, err := s.extractFrame(ctx, data, request.FrameTime)
+	if err != nil {
+		s.Logger.Warnf("Unable to extract frame at %gs of video %s: %v", request.FrameTime, request.Path, err)
+		return nil, err
+	}
+	image, err := newSourceImage(bytes.NewReader(frame), request)
+	if err != nil {
+		return nil, err
+	}
+	image.LastModified = original.LastModified
+	return image, nil
+}
+
+func (s *videoFrameImageSource) CheckHealth(ctx context.Context) error {
+	return CheckSourceHealth(ctx, s.Source)
+}
+
+// extractFrame returns the frame of the video at time seconds, encoded as
+// PNG. ffmpeg reads the video from a temporary file, as it can't seek in
+// most containers read from a pipe.
+func (s *videoFrameImageSource) extractFrame(ctx context.Context, video []byte, time float64) ([]byte, error) {
+	file, err := ioutil.TempFile("", "halfshell-video-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(video)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	command := exec.CommandContext(ctx, s.Config.FFmpegPath,
+		"-nostdin", "-v", "error",
+		"-ss", strconv.FormatFloat(time, 'f', -1, 64),
+		"-i", file.Name(),
+		"-frames:v", "1",
+		"-f", "image2", "-c:v", "png", "pipe:1")
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	if err := command.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, ErrNoVideoFrame
+	}
+	return stdout.Bytes(), nil
+}
+
+// isVideo returns whether the original at imagePath is a video, from its
+// extension or else its data.
+func isVideo(data []byte, imagePath string) bool {
+	if strings.HasPrefix(mime.TypeByExtension(path.Ext(imagePath)), "video/") {
+		return true
+	}
+	return strings.HasPrefix(http.DetectContentType(data), "video/")
+}
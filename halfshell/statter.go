@@ -25,11 +25,36 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
 type Statter interface {
 	RegisterRequest(*ResponseWriter, *Request)
+	Count(stat string)
+	Timing(stat string, duration time.Duration)
+}
+
+// multiStatter reports to each of its statters.
+type multiStatter []Statter
+
+func (m multiStatter) RegisterRequest(w *ResponseWriter, r *Request) {
+	for _, statter := range m {
+		statter.RegisterRequest(w, r)
+	}
+}
+
+func (m multiStatter) Count(stat string) {
+	for _, statter := range m {
+		statter.Count(stat)
+	}
+}
+
+func (m multiStatter) Timing(stat string, duration time.Duration) {
+	for _, statter := range m {
+		statter.Timing(stat, duration)
+	}
 }
 
 type statsdStatter struct {
@@ -39,9 +64,25 @@ type statsdStatter struct {
 	Hostname string
 	Logger   *Logger
 	Enabled  bool
+
+	// Tags are the DogStatsD tags of every metric. If it is nil, metrics are
+	// sent in the plain StatsD format, with their dimensions in their names.
+	Tags []string
 }
 
+// NewStatterWithConfig returns the statter of a route, which reports to
+// DefaultMetrics and, if it is enabled, to StatsD.
 func NewStatterWithConfig(routeConfig *RouteConfig, statterConfig *StatterConfig) Statter {
+	statters := multiStatter{NewPrometheusStatter(routeConfig.Name, DefaultMetrics)}
+	if statterConfig.Enabled {
+		if statsd := newStatsdStatter(routeConfig, statterConfig); statsd != nil {
+			statters = append(statters, statsd)
+		}
+	}
+	return statters
+}
+
+func newStatsdStatter(routeConfig *RouteConfig, statterConfig *StatterConfig) *statsdStatter {
 	logger := NewLogger("stats.%s", routeConfig.Name)
 	hostname, _ := os.Hostname()
 
@@ -58,7 +99,7 @@ func NewStatterWithConfig(routeConfig *RouteConfig, statterConfig *StatterConfig
 		return nil
 	}
 
-	return &statsdStatter{
+	statter := &statsdStatter{
 		conn:     conn,
 		addr:     addr,
 		Name:     routeConfig.Name,
@@ -66,6 +107,23 @@ func NewStatterWithConfig(routeConfig *RouteConfig, statterConfig *StatterConfig
 		Logger:   logger,
 		Enabled:  statterConfig.Enabled,
 	}
+
+	if statterConfig.Format == StatterFormatDogStatsD {
+		statter.Tags = []string{dogStatsDTag("route", routeConfig.Name), dogStatsDTag("host", hostname)}
+		if routeConfig.ProcessorConfig != nil {
+			statter.Tags = append(statter.Tags, dogStatsDTag("processor", routeConfig.ProcessorConfig.Name))
+		}
+		names := make([]string, 0, len(statterConfig.Tags))
+		for name := range statterConfig.Tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			statter.Tags = append(statter.Tags, dogStatsDTag(name, statterConfig.Tags[name]))
+		}
+	}
+
+	return statter
 }
 
 func (s *statsdStatter) RegisterRequest(w *ResponseWriter, r *Request) {
@@ -75,6 +133,19 @@ func (s *statsdStatter) RegisterRequest(w *ResponseWriter, r *Request) {
 
 	now := time.Now()
 
+	if s.Tags != nil {
+		tags := []string{
+			dogStatsDTag("status", fmt.Sprintf("%d", w.Status)),
+			dogStatsDTag("status_class", fmt.Sprintf("%dxx", w.Status/100)),
+		}
+		if format := strings.TrimPrefix(w.ContentType, "image/"); format != w.ContentType {
+			tags = append(tags, dogStatsDTag("format", format))
+		}
+		s.count("requests", tags...)
+		s.time("request_duration", (now.UnixNano()-r.Timestamp.UnixNano())/1000000, tags...)
+		return
+	}
+
 	status := "success"
 	if w.Status != http.StatusOK {
 		status = "failure"
@@ -91,20 +162,48 @@ func (s *statsdStatter) RegisterRequest(w *ResponseWriter, r *Request) {
 	}
 }
 
-func (s *statsdStatter) count(stat string) {
-	stat = fmt.Sprintf("%s.halfshell.%s.%s", s.Hostname, s.Name, stat)
+// Count increments the counter stat.
+func (s *statsdStatter) Count(stat string) {
+	if !s.Enabled {
+		return
+	}
+	s.count(stat)
+}
+
+// Timing registers the duration of stat.
+func (s *statsdStatter) Timing(stat string, duration time.Duration) {
+	if !s.Enabled {
+		return
+	}
+	s.time(stat, int64(duration/time.Millisecond))
+}
+
+func (s *statsdStatter) count(stat string, tags ...string) {
+	stat = s.metricName(stat)
 	s.Logger.Infof("Incrementing counter: %s", stat)
-	s.send(stat, "1|c")
+	s.send(stat, "1|c", tags)
 }
 
-func (s *statsdStatter) time(stat string, time int64) {
-	stat = fmt.Sprintf("%s.halfshell.%s.%s", s.Hostname, s.Name, stat)
+func (s *statsdStatter) time(stat string, time int64, tags ...string) {
+	stat = s.metricName(stat)
 	s.Logger.Infof("Registering time: %s (%d)", stat, time)
-	s.send(stat, fmt.Sprintf("%d|ms", time))
+	s.send(stat, fmt.Sprintf("%d|ms", time), tags)
+}
+
+// metricName returns the full name of stat. DogStatsD metrics carry the host
+// and route as tags rather than in their names.
+func (s *statsdStatter) metricName(stat string) string {
+	if s.Tags != nil {
+		return "halfshell." + stat
+	}
+	return fmt.Sprintf("%s.halfshell.%s.%s", s.Hostname, s.Name, stat)
 }
 
-func (s *statsdStatter) send(stat string, value string) {
+func (s *statsdStatter) send(stat string, value string, tags []string) {
 	data := fmt.Sprintf("%s:%s", stat, value)
+	if s.Tags != nil {
+		data += "|#" + strings.Join(append(s.Tags[:len(s.Tags):len(s.Tags)], tags...), ",")
+	}
 	n, err := s.conn.Write([]byte(data))
 	if err != nil {
 		s.Logger.Errorf("Error sending data to statsd: %v", err)
@@ -112,3 +211,11 @@ func (s *statsdStatter) send(stat string, value string) {
 		s.Logger.Errorf("No bytes were written")
 	}
 }
+
+// dogStatsDTagEscaper replaces the characters delimiting the fields of
+// DogStatsD datagrams.
+var dogStatsDTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+func dogStatsDTag(name, value string) string {
+	return dogStatsDTagEscaper.Replace(name) + ":" + dogStatsDTagEscaper.Replace(value)
+}
@@ -28,14 +28,28 @@ const StartupTemplateString = `
 Running on process {{.Pid}}
 
 Server settings:
+  Bind Address: {{.Config.ServerConfig.BindAddress}}
   Port: {{.Config.ServerConfig.Port}}
+  TLS Certificate: {{.Config.ServerConfig.TLSCertFile}}
   Read Timeout: {{.Config.ServerConfig.ReadTimeout}}
   Write Timeout: {{.Config.ServerConfig.WriteTimeout}}
+  Read Header Timeout: {{.Config.ServerConfig.ReadHeaderTimeout}}
+  Idle Timeout: {{.Config.ServerConfig.IdleTimeout}}
+  Processing Workers: {{.Config.ServerConfig.ProcessingWorkers}}
+  Processing Queue Size: {{.Config.ServerConfig.ProcessingQueueSize}}
+  Max Concurrent Requests: {{.Config.ServerConfig.MaxConcurrentRequests}}
+  Request Queue Size: {{.Config.ServerConfig.RequestQueueSize}}
+  Processing Timeout: {{.Config.ServerConfig.ProcessingTimeout}}
+  Shutdown Timeout: {{.Config.ServerConfig.ShutdownTimeout}}
+  Metrics Port: {{.Config.ServerConfig.MetricsPort}}
+  Debug Address: {{.Config.ServerConfig.DebugAddress}}
+  Tracing Endpoint: {{.Config.ServerConfig.TracingEndpoint}}
 
 StatsD settings:
   Host: {{.Config.StatterConfig.Host}}
   Port: {{.Config.StatterConfig.Port}}
   Enabled: {{.Config.StatterConfig.Enabled}}
+  Format: {{.Config.StatterConfig.Format}}
 
 Routes:
 {{ range $index, $route := .Routes }}  {{ $route.Name }}:
@@ -0,0 +1,140 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloadCheckInterval is the minimum time between checks of the
+// certificate files for changes.
+const tlsReloadCheckInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig returns the TLS configuration of the server, or nil if no
+// certificate is configured.
+func NewTLSConfig(config *ServerConfig) (*tls.Config, error) {
+	if config.TLSCertFile == "" && config.TLSKeyFile == "" {
+		return nil, nil
+	}
+	if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+		return nil, fmt.Errorf("Both tls_cert_file and tls_key_file must be set")
+	}
+
+	minVersion, ok := tlsVersions[config.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("Unknown TLS version %q", config.TLSMinVersion)
+	}
+
+	certificate := &certificateReloader{
+		CertFile: config.TLSCertFile,
+		KeyFile:  config.TLSKeyFile,
+		Reload:   config.TLSReload,
+		Logger:   NewLogger("tls"),
+	}
+	if err := certificate.load(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: certificate.GetCertificate,
+	}, nil
+}
+
+// certificateReloader serves a certificate, and reloads it once its files
+// change if Reload is set, so rotated certificates are picked up without a
+// restart.
+type certificateReloader struct {
+	CertFile string
+	KeyFile  string
+	Reload   bool
+	Logger   *Logger
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+	checked     time.Time
+}
+
+func (c *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Reload && time.Since(c.checked) >= tlsReloadCheckInterval {
+		c.checked = time.Now()
+		if modTime, err := c.filesModTime(); err == nil && !modTime.Equal(c.modTime) {
+			if err := c.loadLocked(); err != nil {
+				c.Logger.Errorf("Unable to reload certificate, keeping the previous one: %v", err)
+			} else {
+				c.Logger.Infof("Reloaded certificate %s", c.CertFile)
+			}
+		}
+	}
+	return c.certificate, nil
+}
+
+func (c *certificateReloader) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.loadLocked()
+}
+
+func (c *certificateReloader) loadLocked() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return err
+	}
+	c.certificate = &certificate
+	c.modTime = modTime
+	c.checked = time.Now()
+	return nil
+}
+
+// filesModTime returns the latest modification time of the certificate and
+// key files.
+func (c *certificateReloader) filesModTime() (time.Time, error) {
+	var modTime time.Time
+	for _, file := range []string{c.CertFile, c.KeyFile} {
+		fileInfo, err := os.Stat(file)
+		if err != nil {
+			return modTime, err
+		}
+		if fileInfo.ModTime().After(modTime) {
+			modTime = fileInfo.ModTime()
+		}
+	}
+	return modTime, nil
+}
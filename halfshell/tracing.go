@@ -0,0 +1,387 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tracerBatchSize is the number of spans exported at once.
+	tracerBatchSize = 512
+
+	// tracerFlushInterval bounds the time spans wait to be exported.
+	tracerFlushInterval = 5 * time.Second
+)
+
+// Span kinds, as defined by OpenTelemetry.
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+// Tracer records the spans of requests and exports them to an OpenTelemetry
+// collector with OTLP over HTTP. A nil Tracer records nothing, but its
+// methods may still be called.
+type Tracer struct {
+	Endpoint    string
+	ServiceName string
+	SampleRate  float64
+	Logger      *Logger
+
+	client  *http.Client
+	spans   chan *Span
+	flushes chan chan struct{}
+}
+
+// Span is a timed operation of a trace.
+type Span struct {
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte
+	Name         string
+	Kind         int
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]string
+	Err          error
+	Sampled      bool
+
+	tracer *Tracer
+	mu     sync.Mutex
+}
+
+type spanContextKey struct{}
+
+// NewTracerWithConfig returns a tracer exporting to the configured OTLP
+// endpoint, or nil if no endpoint is configured.
+func NewTracerWithConfig(config *ServerConfig) *Tracer {
+	if config.TracingEndpoint == "" {
+		return nil
+	}
+
+	tracer := &Tracer{
+		Endpoint:    config.TracingEndpoint,
+		ServiceName: config.TracingServiceName,
+		SampleRate:  config.TracingSampleRate,
+		Logger:      NewLogger("tracer"),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spans:       make(chan *Span, 4*tracerBatchSize),
+		flushes:     make(chan chan struct{}),
+	}
+	go tracer.export()
+	return tracer
+}
+
+// StartRequestSpan starts the server span of an incoming request, continuing
+// the trace of its traceparent header if it has one.
+func (t *Tracer) StartRequestSpan(r *http.Request) (context.Context, *Span) {
+	if t == nil {
+		return r.Context(), nil
+	}
+
+	span := &Span{Name: r.Method, Kind: SpanKindServer, tracer: t}
+	if parent, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+		span.Sampled = parent.Sampled
+	} else {
+		rand.Read(span.TraceID[:])
+		span.Sampled = sampleTrace(span.TraceID, t.SampleRate)
+	}
+	span.start()
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.target", r.URL.RequestURI())
+	return context.WithValue(r.Context(), spanContextKey{}, span), span
+}
+
+// StartSpan starts a span that is a child of the span of ctx, if it has one,
+// and returns a context carrying it. The span is nil otherwise.
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		TraceID:      parent.TraceID,
+		ParentSpanID: parent.SpanID,
+		Name:         name,
+		Kind:         kind,
+		Sampled:      parent.Sampled,
+		tracer:       parent.tracer,
+	}
+	span.start()
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// SpanFromContext returns the span carried by ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// ContextWithSpan returns a copy of ctx carrying span, e.g. to continue the
+// trace of a request in work that isn't tied to the request's context.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// InjectTraceparent sets the traceparent header of an outgoing request to
+// the span of ctx, so the receiver continues the trace.
+func InjectTraceparent(ctx context.Context, header http.Header) {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	flags := "00"
+	if span.Sampled {
+		flags = "01"
+	}
+	header.Set("Traceparent", "00-"+hex.EncodeToString(span.TraceID[:])+"-"+
+		hex.EncodeToString(span.SpanID[:])+"-"+flags)
+}
+
+func (s *Span) start() {
+	rand.Read(s.SpanID[:])
+	s.Start = time.Now()
+	s.Attributes = make(map[string]string)
+}
+
+// SetAttribute sets an attribute of the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed with err, if it isn't nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Err = err
+}
+
+// Finish ends the span and queues it for export if it is sampled.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	if !s.Sampled {
+		return
+	}
+	select {
+	case s.tracer.spans <- s:
+	default:
+		s.tracer.Logger.Warnf("Dropping span %s: export queue is full", s.Name)
+	}
+}
+
+// Flush exports the spans finished so far, e.g. before the process exits.
+func (t *Tracer) Flush() {
+	if t == nil {
+		return
+	}
+	done := make(chan struct{})
+	t.flushes <- done
+	<-done
+}
+
+// export sends the finished spans to the collector in batches.
+func (t *Tracer) export() {
+	ticker := time.NewTicker(tracerFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, tracerBatchSize)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := t.send(batch)
+		if err != nil {
+			t.Logger.Warnf("Error exporting %d spans: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) == tracerBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-t.flushes:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+				if len(batch) == tracerBatchSize {
+					send()
+				}
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+// send exports spans with the JSON encoding of OTLP over HTTP.
+func (t *Tracer) send(spans []*Span) error {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		span.mu.Lock()
+		otlp := otlpSpan{
+			TraceID:           hex.EncodeToString(span.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.SpanID[:]),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if span.ParentSpanID != [8]byte{} {
+			otlp.ParentSpanID = hex.EncodeToString(span.ParentSpanID[:])
+		}
+		for key, value := range span.Attributes {
+			attribute := otlpAttribute{Key: key}
+			attribute.Value.StringValue = value
+			otlp.Attributes = append(otlp.Attributes, attribute)
+		}
+		if span.Err != nil {
+			otlp.Status.Code = 2
+			otlp.Status.Message = span.Err.Error()
+		}
+		span.mu.Unlock()
+		otlpSpans = append(otlpSpans, otlp)
+	}
+
+	serviceName := otlpAttribute{Key: "service.name"}
+	serviceName.Value.StringValue = t.ServiceName
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": []otlpAttribute{serviceName}},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "halfshell"},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	httpResponse, err := t.client.Post(t.Endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode/100 != 2 {
+		return fmt.Errorf("Collector responded with status %d", httpResponse.StatusCode)
+	}
+	return nil
+}
+
+type traceparent struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// parseTraceparent parses a W3C Trace Context traceparent header, such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceparent(header string) (traceparent, bool) {
+	var parent traceparent
+	fields := strings.Split(strings.TrimSpace(header), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" ||
+		len(fields[1]) != 32 || len(fields[2]) != 16 || len(fields[3]) != 2 {
+		return parent, false
+	}
+
+	_, err1 := hex.Decode(parent.TraceID[:], []byte(fields[1]))
+	_, err2 := hex.Decode(parent.SpanID[:], []byte(fields[2]))
+	flags, err3 := strconv.ParseUint(fields[3], 16, 8)
+	if err1 != nil || err2 != nil || err3 != nil ||
+		parent.TraceID == [16]byte{} || parent.SpanID == [8]byte{} {
+		return parent, false
+	}
+	parent.Sampled = flags&1 == 1
+	return parent, true
+}
+
+// sampleTrace decides whether a new trace is sampled, from its random ID, so
+// the decision is the same for every span of the trace.
+func sampleTrace(traceID [16]byte, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	var n uint64
+	for _, b := range traceID[8:] {
+		n = n<<8 | uint64(b)
+	}
+	return float64(n>>11)/(1<<53) < rate
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// UploadRequestHandler processes the image in the body of a POST request with
+// the request's parameters, bypassing the route's sources and caches. The
+// image is either the whole body or the "image" field of a multipart form.
+func (s *Server) UploadRequestHandler(w *ResponseWriter, r *Request) {
+	if !r.Route.AllowUploads {
+		w.SetHeader("Allow", "GET, HEAD")
+		w.WriteError("Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			w.WriteHTTPError(uploadError(err))
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	s.Logger.Infof("Handling upload with dimensions %v", r.ProcessorOptions.Dimensions)
+
+	processedImage, err := s.ProcessUploadedImage(r, body)
+	if err == nil {
+		err = runPostProcessHooks(w, r, processedImage)
+	}
+	if err != nil {
+		w.WriteHTTPError(err)
+		return
+	}
+
+	if processedImage.BlurHash != "" {
+		w.SetHeader("X-BlurHash", processedImage.BlurHash)
+	}
+	w.SetHeader("Cache-Control", "no-store")
+	w.WriteProcessedImage(processedImage)
+}
+
+// ProcessUploadedImage reads an uploaded image from body, processes it and
+// returns the encoded result.
+func (s *Server) ProcessUploadedImage(r *Request, body io.Reader) (*ProcessedImage, error) {
+	// Unlike source images, uploads aren't shared, so the work stops when
+	// the request is canceled.
+	ctx := r.Context()
+	if s.ProcessingTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ProcessingTimeout)
+		defer cancel()
+	}
+
+	err := s.acquireWorker(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	defer s.WorkerPool.Release()
+
+	image, err := newSourceImage(body, r.SourceOptions)
+	if err != nil {
+		s.Logger.Warnf("Rejecting upload: %v", err)
+		return nil, uploadError(err)
+	}
+	defer image.Destroy()
+
+	return s.processImage(ctx, image, r)
+}
+
+// uploadError returns the HTTPError answering an upload that couldn't be
+// read.
+func uploadError(err error) error {
+	var maxBytesError *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesError):
+		return NewHTTPError("Request Entity Too Large", http.StatusRequestEntityTooLarge)
+	case err == ErrImageTooLarge:
+		return NewHTTPError("Unprocessable Entity", http.StatusUnprocessableEntity)
+	default:
+		return NewHTTPError("Bad Request", http.StatusBadRequest)
+	}
+}
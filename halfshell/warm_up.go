@@ -0,0 +1,428 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultWarmUpParallelism is the number of images of a warm-up job
+	// processed at once unless requested otherwise, and maxWarmUpParallelism
+	// the most that may be requested.
+	defaultWarmUpParallelism = 4
+	maxWarmUpParallelism     = 32
+
+	// maxWarmUpJobs is the number of warm-up jobs whose progress is kept.
+	// The oldest finished jobs are forgotten first.
+	maxWarmUpJobs = 100
+
+	// maxWarmUpErrors is the number of errors reported per job.
+	maxWarmUpErrors = 100
+
+	// maxWarmUpRequestSize is the maximum size in bytes of the list of images
+	// of a job.
+	maxWarmUpRequestSize = 16 << 20
+
+	// maxRunningWarmUps is the number of warm-up jobs run at once. Further
+	// jobs are queued until one finishes, up to maxUnfinishedWarmUps queued
+	// and running jobs.
+	maxRunningWarmUps    = 2
+	maxUnfinishedWarmUps = 20
+
+	// warmUpWebhookAttempts is the number of times the webhook of a job is
+	// called before giving up, waiting warmUpWebhookBackoff before the first
+	// retry and doubling the wait with each retry.
+	warmUpWebhookAttempts = 3
+	warmUpWebhookBackoff  = time.Second
+)
+
+// The states of warm-up jobs.
+const (
+	WarmUpQueued   = "queued"
+	WarmUpRunning  = "running"
+	WarmUpFinished = "finished"
+)
+
+// warmUpWebhookClient calls the webhooks of warm-up jobs.
+var warmUpWebhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// WarmUpImage is an image to generate into the cache: the path of a request,
+// which may include processing parameters, and optionally the name of one of
+// the route's formats.
+type WarmUpImage struct {
+	Path   string `json:"path"`
+	Format string `json:"format,omitempty"`
+}
+
+// warmUpRequest is the body of requests starting a warm-up job.
+type warmUpRequest struct {
+	Images      []WarmUpImage `json:"images"`
+	Parallelism int           `json:"parallelism"`
+	Webhook     string        `json:"webhook"`
+}
+
+// warmUpJob tracks the progress of generating a list of images into the
+// caches of their routes. Webhook is the URL the job's progress is posted to
+// once it's finished.
+type warmUpJob struct {
+	mu sync.Mutex
+
+	ID       string     `json:"id"`
+	State    string     `json:"state"`
+	Webhook  string     `json:"webhook,omitempty"`
+	Total    int        `json:"total"`
+	Done     int        `json:"done"`
+	Failed   int        `json:"failed"`
+	Errors   []string   `json:"errors,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// status returns a copy of the job's progress.
+func (j *warmUpJob) status() *warmUpJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return &warmUpJob{
+		ID:       j.ID,
+		State:    j.State,
+		Webhook:  j.Webhook,
+		Total:    j.Total,
+		Done:     j.Done,
+		Failed:   j.Failed,
+		Errors:   append([]string(nil), j.Errors...),
+		Started:  j.Started,
+		Finished: j.Finished,
+	}
+}
+
+func (j *warmUpJob) finished() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Finished != nil
+}
+
+func (j *warmUpJob) setState(state string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.State = state
+	if state == WarmUpFinished {
+		finished := time.Now()
+		j.Finished = &finished
+	}
+}
+
+// warmUpJobs holds the warm-up jobs of a server, and queues them so only
+// maxRunningWarmUps run at once.
+type warmUpJobs struct {
+	mu      sync.Mutex
+	jobs    map[string]*warmUpJob
+	running chan struct{}
+}
+
+// acquire waits until the number of running jobs allows another one.
+func (j *warmUpJobs) acquire() {
+	j.mu.Lock()
+	if j.running == nil {
+		j.running = make(chan struct{}, maxRunningWarmUps)
+	}
+	running := j.running
+	j.mu.Unlock()
+	running <- struct{}{}
+}
+
+func (j *warmUpJobs) release() {
+	<-j.running
+}
+
+// add adds a job, unless maxUnfinishedWarmUps jobs are already queued or
+// running.
+func (j *warmUpJobs) add(job *warmUpJob) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.jobs == nil {
+		j.jobs = make(map[string]*warmUpJob)
+	}
+	unfinished := 0
+	for _, other := range j.jobs {
+		if !other.finished() {
+			unfinished++
+		}
+	}
+	if unfinished >= maxUnfinishedWarmUps {
+		return false
+	}
+	if len(j.jobs) >= maxWarmUpJobs {
+		var oldest *warmUpJob
+		for _, other := range j.jobs {
+			if other.finished() && (oldest == nil || other.Started.Before(oldest.Started)) {
+				oldest = other
+			}
+		}
+		if oldest != nil {
+			delete(j.jobs, oldest.ID)
+		}
+	}
+	j.jobs[job.ID] = job
+	return true
+}
+
+func (j *warmUpJobs) get(id string) (*warmUpJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	return job, ok
+}
+
+// statuses returns the progress of all jobs, the most recent first.
+func (j *warmUpJobs) statuses() []*warmUpJob {
+	j.mu.Lock()
+	statuses := make([]*warmUpJob, 0, len(j.jobs))
+	for _, job := range j.jobs {
+		statuses = append(statuses, job.status())
+	}
+	j.mu.Unlock()
+
+	sort.Slice(statuses, func(a, b int) bool {
+		return statuses[a].Started.After(statuses[b].Started)
+	})
+	return statuses
+}
+
+// WarmUpHandler queues the generation of the images listed in the body of
+// POST requests into the caches of their routes, and answers with the job's
+// progress. GET requests return the progress of the job whose id parameter
+// they carry, or of all recent jobs.
+func (s *Server) WarmUpHandler(w *ResponseWriter, r *Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		id := r.FormValue("id")
+		if id == "" {
+			w.WriteJSON(s.warmUps.statuses())
+			return
+		}
+		job, ok := s.warmUps.get(id)
+		if !ok {
+			w.WriteError("Not Found", http.StatusNotFound)
+			return
+		}
+		w.WriteJSON(job.status())
+	case "POST":
+		var request warmUpRequest
+		err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxWarmUpRequestSize)).Decode(&request)
+		if err != nil {
+			w.WriteError(fmt.Sprintf("Invalid warm-up request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(request.Images) == 0 {
+			w.WriteError("No images to warm up", http.StatusBadRequest)
+			return
+		}
+		if request.Webhook != "" {
+			webhookURL, err := url.Parse(request.Webhook)
+			if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+				w.WriteError(fmt.Sprintf("Invalid webhook URL %q", request.Webhook), http.StatusBadRequest)
+				return
+			}
+		}
+		parallelism := request.Parallelism
+		if parallelism <= 0 {
+			parallelism = defaultWarmUpParallelism
+		}
+		if parallelism > maxWarmUpParallelism {
+			parallelism = maxWarmUpParallelism
+		}
+
+		job := s.startWarmUp(request.Images, parallelism, request.Webhook)
+		if job == nil {
+			s.Logger.Warnf("Rejecting warm-up of %d images: too many jobs are queued", len(request.Images))
+			w.WriteError("Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteJSON(job.status())
+	default:
+		w.SetHeader("Allow", "GET, HEAD, POST")
+		w.WriteError("Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startWarmUp queues a job generating images into the caches of their routes
+// in the background, up to parallelism at once, and returns the job, or nil if
+// the queue is full. Its progress is posted to webhook once it's finished,
+// unless webhook is empty.
+func (s *Server) startWarmUp(images []WarmUpImage, parallelism int, webhook string) *warmUpJob {
+	id := make([]byte, 8)
+	rand.Read(id)
+	job := &warmUpJob{
+		ID:      hex.EncodeToString(id),
+		State:   WarmUpQueued,
+		Webhook: webhook,
+		Total:   len(images),
+		Started: time.Now(),
+	}
+	if !s.warmUps.add(job) {
+		return nil
+	}
+
+	// The webhook is called once the job has left the queue, so retrying it
+	// doesn't hold up the next job.
+	go func() {
+		s.warmUps.acquire()
+		s.runWarmUp(job, images, parallelism)
+		s.warmUps.release()
+
+		if webhook != "" {
+			err := s.callWarmUpWebhook(job.status())
+			if err != nil {
+				s.Logger.Warnf("Error calling webhook of job %s: %v", job.ID, err)
+			}
+		}
+	}()
+	return job
+}
+
+// runWarmUp generates the images of job, up to parallelism at once.
+func (s *Server) runWarmUp(job *warmUpJob, images []WarmUpImage, parallelism int) {
+	job.setState(WarmUpRunning)
+	s.Logger.Infof("Warming up %d images (job=%s)", len(images), job.ID)
+
+	queue := make(chan WarmUpImage)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for image := range queue {
+				err := s.warmUpImage(image)
+				job.mu.Lock()
+				job.Done++
+				if err != nil {
+					job.Failed++
+					if len(job.Errors) < maxWarmUpErrors {
+						job.Errors = append(job.Errors, image.Path+": "+err.Error())
+					}
+				}
+				job.mu.Unlock()
+			}
+		}()
+	}
+
+	for _, image := range images {
+		queue <- image
+	}
+	close(queue)
+	wg.Wait()
+
+	job.setState(WarmUpFinished)
+	status := job.status()
+	s.Logger.Infof("Warmed up %d images, %d failed (job=%s)", status.Done-status.Failed, status.Failed, job.ID)
+}
+
+// callWarmUpWebhook posts the progress of a finished job to its webhook as
+// JSON, retrying failed calls. If a webhook secret is configured, the body is
+// signed with it, in the hex-encoded HMAC-SHA256 of the X-Halfshell-Signature
+// header.
+func (s *Server) callWarmUpWebhook(status *warmUpJob) error {
+	body, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	backoff := warmUpWebhookBackoff
+	for attempt := 1; ; attempt++ {
+		httpRequest, err := http.NewRequest("POST", status.Webhook, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		httpRequest.Header.Set("Content-Type", "application/json")
+		if s.WarmUpWebhookSecret != "" {
+			signature := hmacSHA256([]byte(s.WarmUpWebhookSecret), string(body))
+			httpRequest.Header.Set("X-Halfshell-Signature", hex.EncodeToString(signature))
+		}
+
+		httpResponse, err := warmUpWebhookClient.Do(httpRequest)
+		if err == nil {
+			httpResponse.Body.Close()
+			if httpResponse.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("Webhook answered with status %d", httpResponse.StatusCode)
+		}
+		if attempt == warmUpWebhookAttempts {
+			return err
+		}
+		s.Logger.Warnf("Retrying webhook of job %s in %v: %v", status.ID, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// warmUpImage generates an image into the cache of its route, unless it's
+// already cached.
+func (s *Server) warmUpImage(image WarmUpImage) error {
+	requestURL, err := url.Parse(image.Path)
+	if err != nil || !strings.HasPrefix(requestURL.Path, "/") {
+		return fmt.Errorf("Invalid path %q", image.Path)
+	}
+	if image.Format != "" {
+		query := requestURL.Query()
+		query.Set("format", image.Format)
+		requestURL.RawQuery = query.Encode()
+	}
+	httpRequest, err := http.NewRequest("GET", requestURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	r := s.NewRequest(httpRequest)
+	if r.Route == nil {
+		return errors.New("No route available to handle request")
+	}
+	if r.OptionsError != nil {
+		return r.OptionsError
+	}
+	if r.Route.Cache == nil {
+		return fmt.Errorf("Route %s has no cache", r.Route.Name)
+	}
+
+	key := r.Route.CacheKey(r.SourceOptions, r.ProcessorOptions)
+	processedImage, err := s.cachedProcessImage(key, r)
+	if err != nil {
+		return err
+	}
+	if processedImage.Placeholder {
+		return ErrImageNotFound
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrWorkerPoolFull is returned when a job can't be queued because the pool's
+// queue is full.
+var ErrWorkerPoolFull = errors.New("Worker pool queue is full")
+
+// WorkerPool bounds the number of jobs running concurrently. Jobs beyond the
+// number of workers wait in a queue of bounded size; once the queue is full,
+// new jobs are rejected. A nil WorkerPool places no bounds.
+type WorkerPool struct {
+	workers chan struct{}
+	slots   chan struct{}
+}
+
+// NewWorkerPool returns a pool running up to workers jobs at once with up to
+// queueSize jobs waiting. If workers is 0, nil is returned.
+func NewWorkerPool(workers, queueSize uint64) *WorkerPool {
+	if workers == 0 {
+		return nil
+	}
+	return &WorkerPool{
+		workers: make(chan struct{}, workers),
+		slots:   make(chan struct{}, workers+queueSize),
+	}
+}
+
+// Acquire blocks until a worker is available or ctx is done. It returns
+// ErrWorkerPoolFull without blocking if the queue is full. Every successful
+// Acquire must be followed by a call to Release.
+func (p *WorkerPool) Acquire(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return ErrWorkerPoolFull
+	}
+
+	select {
+	case p.workers <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		<-p.slots
+		return ctx.Err()
+	}
+}
+
+// Release returns a worker to the pool.
+func (p *WorkerPool) Release() {
+	if p == nil {
+		return
+	}
+	<-p.workers
+	<-p.slots
+}
+
+// Active returns the number of running jobs.
+func (p *WorkerPool) Active() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.workers)
+}
+
+// Queued returns the number of jobs waiting for a worker.
+func (p *WorkerPool) Queued() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.slots) - len(p.workers)
+}
+
+// Saturated returns whether the pool can't accept any more jobs.
+func (p *WorkerPool) Saturated() bool {
+	if p == nil {
+		return false
+	}
+	return len(p.slots) == cap(p.slots)
+}
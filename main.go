@@ -21,18 +21,120 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/oysterbooks/halfshell/halfshell"
+	"io"
 	"os"
+	"runtime"
 )
 
 func main() {
-	if len(os.Args) < 2 || os.Args[1] == "" {
-		fmt.Fprintf(os.Stderr, "usage: %s [config]\n", os.Args[0])
+	if len(os.Args) > 1 && os.Args[1] == "process" {
+		process(os.Args[2:])
+		return
+	}
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	configPath := flags.String("config", "", "configuration file, which may also be given as an argument")
+	bind := flags.String("bind", "", "address to listen on, overriding the configuration")
+	port := flags.Uint64("port", 0, "port to listen on, overriding the configuration")
+	logLevel := flags.String("log-level", "", "minimum level of the logs (debug, info, warn, error or off), overriding the configuration")
+	validate := flags.Bool("validate", false, "check the configuration and exit")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [--bind address] [--port port] [--log-level level] [--validate] config\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s process [-o destination] [-workers n] config [jobs]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+	if *configPath == "" && flags.NArg() == 1 {
+		*configPath = flags.Arg(0)
+	}
+	if *configPath == "" || flags.NArg() > 1 {
+		flags.Usage()
 		os.Exit(1)
 	}
 
-	config := halfshell.NewConfigFromFile(os.Args[1])
+	var level halfshell.LogLevel
+	if *logLevel != "" {
+		var err error
+		level, err = halfshell.ParseLogLevel(*logLevel)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --log-level: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// The flags override the settings of the configuration file, including
+	// when it is reloaded.
+	overrides := func(config *halfshell.Config) {
+		if *bind != "" {
+			config.ServerConfig.BindAddress = *bind
+		}
+		if *port != 0 {
+			config.ServerConfig.Port = *port
+		}
+		if *logLevel != "" {
+			config.LogConfig.Level = level
+			config.LogConfig.ComponentLevels = make(map[string]halfshell.LogLevel)
+		}
+	}
+
+	if *validate {
+		_, err := halfshell.LoadConfigFromFile(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Configuration %s is valid\n", *configPath)
+		return
+	}
+
+	config := halfshell.NewConfigFromFile(*configPath)
+	overrides(config)
 	halfshell := halfshell.NewWithConfig(config)
+	halfshell.ConfigPath = *configPath
+	halfshell.Overrides = overrides
 	halfshell.Run()
 }
+
+// process runs the batch processing of the jobs listed in a file, or read
+// from the standard input.
+func process(args []string) {
+	flags := flag.NewFlagSet("process", flag.ExitOnError)
+	destination := flags.String("o", ".", "output directory or s3://bucket/prefix location")
+	workers := flags.Int("workers", runtime.NumCPU(), "number of images processed at once")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s process [-o destination] [-workers n] config [jobs]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 || *workers < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	var jobs io.Reader = os.Stdin
+	if flags.NArg() == 2 {
+		file, err := os.Open(flags.Arg(1))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to open jobs file: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		jobs = file
+	}
+
+	output, err := halfshell.NewBatchOutput(*destination)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid destination %s: %v\n", *destination, err)
+		os.Exit(1)
+	}
+
+	config := halfshell.NewConfigFromFile(flags.Arg(0))
+	failures := halfshell.NewWithConfig(config).RunBatch(jobs, output, *workers)
+	if failures > 0 {
+		fmt.Fprintf(os.Stderr, "%d jobs failed\n", failures)
+		os.Exit(1)
+	}
+}